@@ -32,6 +32,8 @@ type AnalyticsClient struct {
 	userID string
 	log    zerolog.Logger
 	client http.Client
+
+	messageEvents bool
 }
 
 var Analytics AnalyticsClient
@@ -73,6 +75,16 @@ func (sc *AnalyticsClient) IsEnabled() bool {
 	return len(sc.key) > 0
 }
 
+// TrackMessage tracks a successfully bridged message if message events are enabled in the config.
+func (sc *AnalyticsClient) TrackMessage(userID id.UserID, direction, messageType string) {
+	if sc.messageEvents {
+		sc.Track(userID, "Message bridged", map[string]interface{}{
+			"direction":    direction,
+			"message_type": messageType,
+		})
+	}
+}
+
 func (sc *AnalyticsClient) Track(userID id.UserID, event string, properties ...map[string]interface{}) {
 	if !sc.IsEnabled() {
 		return
@@ -125,6 +125,7 @@ func (user *User) HandleBackfillRequestsLoop(backfillTypes []database.BackfillTy
 			if err != nil {
 				log.Err(err).Msg("Failed to save portal after updating expiration time")
 			}
+			portal.UpdateDisappearingTimerState(ctx)
 		}
 
 		user.backfillInChunks(ctx, req, conv, portal)
@@ -44,7 +44,7 @@ func init() {
 		WANotConnected:     "You're not connected to WhatsApp",
 		WAConnecting:       "Reconnecting to WhatsApp...",
 		WAKeepaliveTimeout: "The WhatsApp web servers are not responding. The bridge will try to reconnect.",
-		WAPhoneOffline:     "Your phone hasn't been seen in over 12 days. The bridge is currently connected, but will get disconnected if you don't open the app soon.",
+		WAPhoneOffline:     "Your phone hasn't been seen in a long time. The bridge is currently connected, but will get disconnected if you don't open the app soon.",
 		WAConnectionFailed: "Connecting to the WhatsApp web servers failed.",
 		WADisconnected:     "Disconnected from WhatsApp. Trying to reconnect.",
 	})
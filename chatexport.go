@@ -0,0 +1,545 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// ImportedMessageKey is added to the content of messages imported from a WhatsApp chat export.
+const ImportedMessageKey = "fi.mau.whatsapp.imported_from_export"
+
+var (
+	// Android: "31/12/2023, 22:15 - Name: text", iOS: "[31/12/2023, 22:15:03] Name: text"
+	androidExportLineRegex = regexp.MustCompile(`^\x{200e}?(\d{1,2}[/.]\d{1,2}[/.]\d{2,4}),? (\d{1,2}[:.]\d{2}(?:[:.]\d{2})?(?:[\s\x{202f}]?[AaPp]\.?\s?[Mm]\.?)?) - (.*)$`)
+	iosExportLineRegex     = regexp.MustCompile(`^\x{200e}?\[(\d{1,2}[/.]\d{1,2}[/.]\d{2,4}),? (\d{1,2}[:.]\d{2}(?:[:.]\d{2})?(?:[\s\x{202f}]?[AaPp]\.?\s?[Mm]\.?)?)\] (.*)$`)
+	androidAttachmentRegex = regexp.MustCompile(`^\x{200e}?(.+?) \(file attached\)$`)
+	iosAttachmentRegex     = regexp.MustCompile(`^\x{200e}?<attached: (.+)>$`)
+	exportDateSplitRegex   = regexp.MustCompile(`[/.]`)
+	exportTimeSplitRegex   = regexp.MustCompile(`[:.]`)
+)
+
+var ErrNoExportText = errors.New("zip file doesn't contain a chat export text file")
+
+type ExportedMessage struct {
+	Timestamp  time.Time
+	Sender     string
+	Text       string
+	Attachment string
+}
+
+type ChatExport struct {
+	Messages []*ExportedMessage
+	files    map[string]*zip.File
+}
+
+type rawExportLine struct {
+	date, clock, rest string
+}
+
+// ParseChatExport parses a zip file created with the "Export chat" feature of WhatsApp.
+func ParseChatExport(zipReader *zip.Reader, loc *time.Location) (*ChatExport, error) {
+	export := &ChatExport{files: make(map[string]*zip.File)}
+	var textFile *zip.File
+	for _, file := range zipReader.File {
+		name := path.Base(file.Name)
+		export.files[name] = file
+		if strings.HasSuffix(name, ".txt") && (textFile == nil || name == "_chat.txt" || strings.HasPrefix(name, "WhatsApp Chat")) {
+			textFile = file
+		}
+	}
+	if textFile == nil {
+		return nil, ErrNoExportText
+	}
+	reader, err := textFile.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", textFile.Name, err)
+	}
+	defer reader.Close()
+	var lines []*rawExportLine
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(scanner.Text(), "\ufeff")
+		match := androidExportLineRegex.FindStringSubmatch(line)
+		if match == nil {
+			match = iosExportLineRegex.FindStringSubmatch(line)
+		}
+		if match != nil {
+			lines = append(lines, &rawExportLine{date: match[1], clock: match[2], rest: match[3]})
+		} else if len(lines) > 0 {
+			lines[len(lines)-1].rest += "\n" + line
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", textFile.Name, err)
+	}
+	dayFirst := exportDatesAreDayFirst(lines)
+	for _, line := range lines {
+		ts, err := parseExportTimestamp(line.date, line.clock, dayFirst, loc)
+		if err != nil {
+			return nil, err
+		}
+		sender, text, found := strings.Cut(line.rest, ": ")
+		if !found {
+			// System messages like "Messages and calls are end-to-end encrypted" don't have a sender
+			continue
+		}
+		msg := &ExportedMessage{Timestamp: ts, Sender: strings.TrimPrefix(sender, "\u200e"), Text: text}
+		if match := androidAttachmentRegex.FindStringSubmatch(text); match != nil {
+			msg.Attachment = match[1]
+		} else if match = iosAttachmentRegex.FindStringSubmatch(text); match != nil {
+			msg.Attachment = match[1]
+		}
+		if msg.Attachment != "" {
+			if _, ok := export.files[msg.Attachment]; !ok {
+				msg.Attachment = ""
+			} else {
+				msg.Text = ""
+			}
+		}
+		export.Messages = append(export.Messages, msg)
+	}
+	return export, nil
+}
+
+// exportDatesAreDayFirst guesses whether the dates in the export are in day/month or month/day order.
+// Exports don't specify the format, so this relies on finding a date where one of the numbers is over 12.
+func exportDatesAreDayFirst(lines []*rawExportLine) bool {
+	for _, line := range lines {
+		parts := exportDateSplitRegex.Split(line.date, 3)
+		first, _ := strconv.Atoi(parts[0])
+		second, _ := strconv.Atoi(parts[1])
+		if first > 12 {
+			return true
+		} else if second > 12 {
+			return false
+		}
+	}
+	return true
+}
+
+func parseExportTimestamp(date, clock string, dayFirst bool, loc *time.Location) (time.Time, error) {
+	dateParts := exportDateSplitRegex.Split(date, 3)
+	day, _ := strconv.Atoi(dateParts[0])
+	month, _ := strconv.Atoi(dateParts[1])
+	year, _ := strconv.Atoi(dateParts[2])
+	if !dayFirst {
+		day, month = month, day
+	}
+	if year < 100 {
+		year += 2000
+	}
+	clock = strings.ToLower(clock)
+	isPM := strings.Contains(clock, "p")
+	isAM := strings.Contains(clock, "a")
+	clock = strings.TrimRightFunc(clock, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	timeParts := exportTimeSplitRegex.Split(clock, 3)
+	hour, _ := strconv.Atoi(timeParts[0])
+	minute, _ := strconv.Atoi(timeParts[1])
+	var second int
+	if len(timeParts) > 2 {
+		second, _ = strconv.Atoi(timeParts[2])
+	}
+	if isPM && hour < 12 {
+		hour += 12
+	} else if isAM && hour == 12 {
+		hour = 0
+	}
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 {
+		return time.Time{}, fmt.Errorf("invalid timestamp %s %s", date, clock)
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, loc), nil
+}
+
+// getExportSenderMap maps the names that may appear in a chat export to the JIDs of the chat's participants.
+// Only participants of the chat are considered, and names shared by multiple participants are left out,
+// so that messages are never attributed to the wrong person.
+func (portal *Portal) getExportSenderMap(ctx context.Context, user *User) map[string]types.JID {
+	var participants []types.JID
+	if portal.IsPrivateChat() {
+		participants = []types.JID{portal.Key.JID}
+	} else if portal.IsGroupChat() {
+		groupInfo, err := user.Client.GetGroupInfo(portal.Key.JID)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to get group info for mapping chat export senders")
+		} else {
+			for _, participant := range groupInfo.Participants {
+				participants = append(participants, participant.JID)
+			}
+		}
+	}
+	senders := make(map[string]types.JID)
+	ambiguous := make(map[string]bool)
+	addName := func(name string, jid types.JID) {
+		if name == "" || ambiguous[name] {
+			return
+		} else if existing, ok := senders[name]; ok && existing != jid {
+			delete(senders, name)
+			ambiguous[name] = true
+		} else {
+			senders[name] = jid
+		}
+	}
+	ownJID := user.JID.ToNonAD()
+	for _, jid := range participants {
+		if jid.ToNonAD() == ownJID {
+			continue
+		}
+		contact, err := user.Client.Store.Contacts.GetContact(jid)
+		if err != nil {
+			continue
+		}
+		for _, name := range []string{contact.FullName, contact.FirstName, contact.PushName, contact.BusinessName} {
+			addName(name, jid)
+		}
+	}
+	addName(user.Client.Store.PushName, ownJID)
+	return senders
+}
+
+func (portal *Portal) getExportSenderJID(user *User, senders map[string]types.JID, name string) (types.JID, bool) {
+	if jid, ok := senders[name]; ok {
+		return jid, true
+	}
+	// Senders who aren't in the address book are shown as phone numbers
+	if strings.HasPrefix(name, "+") {
+		number := strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, name)
+		if len(number) > 0 {
+			return types.NewJID(number, types.DefaultUserServer), true
+		}
+	}
+	// Private chat exports only have two senders, so anyone who isn't the user must be the other participant
+	if portal.IsPrivateChat() && name != user.Client.Store.PushName {
+		return portal.Key.JID, true
+	}
+	return types.EmptyJID, false
+}
+
+// exportMessageID generates a stable fake message ID for a message in a chat export, so that importing the same
+// export again (or an overlapping one) skips messages that have already been imported. Identical messages sent
+// in the same minute are told apart by the number of times the same message has been seen before.
+func exportMessageID(msg *ExportedMessage, occurrence int) types.MessageID {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s\x00%s\x00%d", msg.Timestamp.Unix(), msg.Sender, msg.Text, msg.Attachment, occurrence)))
+	return "FAKE::EXPORT-" + strings.ToUpper(hex.EncodeToString(hash[:12]))
+}
+
+const chatExportBatchSize = 100
+
+type exportedMessageInfo struct {
+	*ExportedMessage
+	info *types.MessageInfo
+}
+
+// filterImportedExportMessages assigns message IDs to the messages in the export and
+// drops the ones which have already been imported earlier.
+func (portal *Portal) filterImportedExportMessages(ctx context.Context, export *ChatExport) ([]*exportedMessageInfo, error) {
+	occurrences := make(map[types.MessageID]int)
+	messages := make([]*exportedMessageInfo, 0, len(export.Messages))
+	for _, msg := range export.Messages {
+		baseID := exportMessageID(msg, 0)
+		msgID := exportMessageID(msg, occurrences[baseID])
+		occurrences[baseID]++
+		existing, err := portal.bridge.DB.Message.GetByJID(ctx, portal.Key, msgID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if message was already imported: %w", err)
+		} else if existing != nil {
+			continue
+		}
+		messages = append(messages, &exportedMessageInfo{
+			ExportedMessage: msg,
+			info: &types.MessageInfo{
+				MessageSource: types.MessageSource{
+					Chat:    portal.Key.JID,
+					IsGroup: portal.IsGroupChat(),
+				},
+				ID:        msgID,
+				Timestamp: msg.Timestamp,
+			},
+		})
+	}
+	return messages, nil
+}
+
+func (portal *Portal) convertExportedMessage(ctx context.Context, user *User, senders map[string]types.JID, export *ChatExport, msg *exportedMessageInfo) (*appservice.IntentAPI, *event.MessageEventContent) {
+	log := zerolog.Ctx(ctx)
+	var intent *appservice.IntentAPI
+	senderPrefix := ""
+	if jid, ok := portal.getExportSenderJID(user, senders, msg.Sender); ok {
+		msg.info.Sender = jid
+		msg.info.IsFromMe = jid == user.JID.ToNonAD()
+		intent = portal.bridge.GetPuppetByJID(jid).IntentFor(portal)
+		if !intent.IsCustomPuppet {
+			err := intent.EnsureJoined(ctx, portal.MXID)
+			if err != nil {
+				log.Warn().Err(err).Stringer("sender_jid", jid).Msg("Failed to ensure chat export sender is joined")
+				intent = nil
+			}
+		}
+	}
+	if intent == nil {
+		intent = portal.MainIntent()
+		senderPrefix = msg.Sender + ": "
+	}
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: senderPrefix + msg.Text}
+	if msg.Attachment != "" {
+		var err error
+		content, err = portal.convertExportAttachment(ctx, intent, export.files[msg.Attachment], senderPrefix)
+		if err != nil {
+			log.Err(err).Str("file_name", msg.Attachment).Msg("Failed to import attachment from chat export")
+			content = &event.MessageEventContent{MsgType: event.MsgNotice, Body: senderPrefix + "Failed to import attachment " + msg.Attachment}
+		}
+	}
+	return intent, content
+}
+
+// ImportChatExport sends the messages in a chat export to the portal room as historical messages.
+// Messages are batch sent to the beginning of the room if the homeserver supports it, and every imported message
+// is stored in the database, so that importing the same export again doesn't create duplicates.
+func (portal *Portal) ImportChatExport(ctx context.Context, user *User, export *ChatExport) (imported int, err error) {
+	// Importing uses the same lock as backfilling to avoid mixing up the order of historical messages
+	portal.backfillLock.Lock()
+	defer portal.backfillLock.Unlock()
+	messages, err := portal.filterImportedExportMessages(ctx, export)
+	if err != nil {
+		return 0, err
+	}
+	senders := portal.getExportSenderMap(ctx, user)
+	extra := map[string]any{ImportedMessageKey: true}
+	if !portal.bridge.SpecVersions.Supports(mautrix.BeeperFeatureBatchSending) {
+		for _, msg := range messages {
+			intent, content := portal.convertExportedMessage(ctx, user, senders, export, msg)
+			resp, err := portal.sendMessage(ctx, intent, event.EventMessage, content, extra, msg.Timestamp.UnixMilli())
+			if err != nil {
+				return imported, fmt.Errorf("failed to send message from %s: %w", msg.Timestamp, err)
+			}
+			portal.markHandled(ctx, nil, msg.info, resp.EventID, intent.UserID, true, false, database.MsgFake, 0, database.MsgNoError)
+			imported++
+		}
+		return imported, nil
+	}
+	// Backwards batches are inserted at the start of the room, so the newest batch has to be sent first
+	for end := len(messages); end > 0; end -= chatExportBatchSize {
+		batch := messages[max(0, end-chatExportBatchSize):end]
+		req := mautrix.ReqBeeperBatchSend{Forward: false}
+		infos := make([]*wrappedInfo, 0, len(batch))
+		for _, msg := range batch {
+			intent, content := portal.convertExportedMessage(ctx, user, senders, export, msg)
+			evt, err := portal.wrapBatchEvent(ctx, msg.info, intent, event.EventMessage, content, extra, "")
+			if err != nil {
+				return imported, fmt.Errorf("failed to prepare message from %s: %w", msg.Timestamp, err)
+			}
+			req.Events = append(req.Events, evt)
+			infos = append(infos, &wrappedInfo{MessageInfo: msg.info, Type: database.MsgFake, SenderMXID: evt.Sender})
+		}
+		resp, err := portal.MainIntent().BeeperBatchSend(ctx, portal.MXID, &req)
+		if err != nil {
+			return imported, fmt.Errorf("failed to send batch of messages: %w", err)
+		}
+		err = portal.bridge.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+			return portal.finishBatch(ctx, resp.EventIDs, infos)
+		})
+		if err != nil {
+			return imported, fmt.Errorf("failed to save imported messages to database: %w", err)
+		}
+		imported += len(batch)
+	}
+	return imported, nil
+}
+
+func (portal *Portal) convertExportAttachment(ctx context.Context, intent *appservice.IntentAPI, file *zip.File, senderPrefix string) (*event.MessageEventContent, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(reader)
+	_ = reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	fileName := path.Base(file.Name)
+	mimeType := mime.TypeByExtension(path.Ext(fileName))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	content := &event.MessageEventContent{
+		Body: fileName,
+		Info: &event.FileInfo{MimeType: mimeType},
+	}
+	if senderPrefix != "" {
+		content.Body = senderPrefix + fileName
+		content.FileName = fileName
+	}
+	switch strings.Split(mimeType, "/")[0] {
+	case "image":
+		content.MsgType = event.MsgImage
+	case "video":
+		content.MsgType = event.MsgVideo
+	case "audio":
+		content.MsgType = event.MsgAudio
+	default:
+		content.MsgType = event.MsgFile
+	}
+	err = portal.uploadMedia(ctx, intent, data, content)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+func (portal *Portal) getExportSenderName(ctx context.Context, userID id.UserID) string {
+	if jid, ok := portal.bridge.ParsePuppetMXID(userID); ok {
+		puppet := portal.bridge.GetPuppetByJID(jid)
+		if puppet != nil && puppet.Displayname != "" {
+			return puppet.Displayname
+		}
+		return "+" + jid.User
+	}
+	member, err := portal.bridge.StateStore.GetMember(ctx, portal.MXID, userID)
+	if err == nil && member != nil && member.Displayname != "" {
+		return member.Displayname
+	}
+	return userID.String()
+}
+
+var exportFileNameSanitizer = strings.NewReplacer("/", "_", "\\", "_", "\n", " ")
+
+// ExportChat writes the messages in the portal room into a zip file in the same format that WhatsApp uses
+// for the "Export chat" feature, i.e. a _chat.txt file with the messages plus all media files.
+func (portal *Portal) ExportChat(ctx context.Context, writer io.Writer, loc *time.Location) (exported int, err error) {
+	log := zerolog.Ctx(ctx)
+	intent := portal.MainIntent()
+	zipWriter := zip.NewWriter(writer)
+	var chat strings.Builder
+	var from string
+	for {
+		var resp *mautrix.RespMessages
+		resp, err = intent.Messages(ctx, portal.MXID, from, "", mautrix.DirectionForward, nil, 100)
+		if err != nil {
+			return exported, fmt.Errorf("failed to fetch messages: %w", err)
+		}
+		for _, evt := range resp.Chunk {
+			_ = evt.Content.ParseRaw(evt.Type)
+			if evt.Type == event.EventEncrypted && portal.bridge.Crypto != nil {
+				decrypted, decryptErr := portal.bridge.Crypto.Decrypt(ctx, evt)
+				if decryptErr != nil {
+					log.Warn().Err(decryptErr).Stringer("event_id", evt.ID).Msg("Failed to decrypt event for chat export")
+					continue
+				}
+				evt = decrypted
+			}
+			if evt.Type != event.EventMessage {
+				continue
+			}
+			content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+			if !ok || content.MsgType == "" || content.RelatesTo.GetReplaceID() != "" {
+				continue
+			}
+			text := content.Body
+			if content.URL != "" || content.File != nil {
+				fileName, attachErr := portal.exportAttachment(ctx, zipWriter, content, exported)
+				if attachErr != nil {
+					log.Warn().Err(attachErr).Stringer("event_id", evt.ID).Msg("Failed to export attachment")
+					text = "<Media omitted>"
+				} else {
+					text = fileName + " (file attached)"
+					if content.FileName != "" && content.Body != content.FileName {
+						text += "\n" + content.Body
+					}
+				}
+			}
+			ts := time.UnixMilli(evt.Timestamp).In(loc)
+			_, _ = fmt.Fprintf(&chat, "%s - %s: %s\n", ts.Format("02/01/2006, 15:04"), portal.getExportSenderName(ctx, evt.Sender), text)
+			exported++
+		}
+		if resp.End == "" || len(resp.Chunk) == 0 {
+			break
+		}
+		from = resp.End
+	}
+	chatFile, err := zipWriter.Create("_chat.txt")
+	if err != nil {
+		return exported, err
+	}
+	_, err = io.WriteString(chatFile, chat.String())
+	if err != nil {
+		return exported, err
+	}
+	return exported, zipWriter.Close()
+}
+
+func (portal *Portal) exportAttachment(ctx context.Context, zipWriter *zip.Writer, content *event.MessageEventContent, index int) (string, error) {
+	rawMXC := content.URL
+	if content.File != nil {
+		rawMXC = content.File.URL
+	}
+	mxc, err := rawMXC.Parse()
+	if err != nil {
+		return "", err
+	}
+	data, err := portal.MainIntent().DownloadBytes(ctx, mxc)
+	if err != nil {
+		return "", err
+	}
+	if content.File != nil {
+		err = content.File.DecryptInPlace(data)
+		if err != nil {
+			return "", err
+		}
+	}
+	name := content.FileName
+	if name == "" {
+		name = content.Body
+	}
+	fileName := fmt.Sprintf("%05d-%s", index, exportFileNameSanitizer.Replace(path.Base(name)))
+	file, err := zipWriter.Create(fileName)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	return fileName, err
+}
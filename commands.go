@@ -32,9 +32,11 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/skip2/go-qrcode"
 	"github.com/tidwall/gjson"
+	"google.golang.org/protobuf/proto"
 
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/appstate"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/types"
 
 	"maunium.net/go/mautrix"
@@ -42,6 +44,9 @@ import (
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/config"
+	"maunium.net/go/mautrix-whatsapp/database"
 )
 
 type WrappedCommandEvent struct {
@@ -75,7 +80,30 @@ func (br *WABridge) RegisterCommands() {
 		cmdOpen,
 		cmdPM,
 		cmdSync,
+		cmdResyncMembers,
 		cmdDisappearingTimer,
+		cmdBroadcast,
+		cmdInvites,
+		cmdMatrixLeave,
+		cmdLeaveGroup,
+		cmdSetAvatar,
+		cmdSetName,
+		cmdSetStatus,
+		cmdStatus,
+		cmdPrivacy,
+		cmdReadReceipts,
+		cmdTyping,
+		cmdVoiceMode,
+		cmdReadOnly,
+		cmdPresence,
+		cmdLanguage,
+		cmdDebugMessage,
+		cmdRequestAgain,
+		cmdStickers,
+		cmdSchedule,
+		cmdIgnore,
+		cmdUnignore,
+		cmdStats,
 	)
 }
 
@@ -104,7 +132,8 @@ var cmdSetRelay = &commands.FullHandler{
 	Name: "set-relay",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionPortalManagement,
-		Description: "Relay messages in this room through your WhatsApp account.",
+		Description: "Relay messages in this room through your WhatsApp account, or as a room moderator, through another logged-in member of the chat who accepts with `--accept`.",
+		Args:        "[_Matrix user ID_ | --accept]",
 	},
 	RequiresPortal: true,
 	RequiresLogin:  true,
@@ -113,16 +142,78 @@ var cmdSetRelay = &commands.FullHandler{
 func fnSetRelay(ce *WrappedCommandEvent) {
 	if !ce.Bridge.Config.Bridge.Relay.Enabled {
 		ce.Reply("Relay mode is not enabled on this instance of the bridge")
+		return
 	} else if ce.Bridge.Config.Bridge.Relay.AdminOnly && !ce.User.Admin {
 		ce.Reply("Only bridge admins are allowed to enable relay mode on this instance of the bridge")
-	} else {
-		ce.Portal.RelayUserID = ce.User.MXID
-		err := ce.Portal.Update(ce.Ctx)
-		if err != nil {
-			ce.ZLog.Err(err).Msg("Failed to save portal after setting relay user")
+		return
+	}
+	target := ce.User
+	if len(ce.Args) > 0 && ce.Args[0] == "--accept" {
+		requester, ok := ce.Portal.relayRequests.LoadAndDelete(ce.User.MXID)
+		if !ok {
+			ce.Reply("Nobody has asked you to act as the relay in this room")
+			return
+		}
+		ce.ZLog.Debug().Any("requester", requester).Msg("Accepting relay request")
+	} else if len(ce.Args) > 0 {
+		target = ce.Bridge.GetUserByMXIDIfExists(id.UserID(ce.Args[0]))
+		if target == nil || !target.IsLoggedIn() {
+			ce.Reply("%s is not logged into the bridge", ce.Args[0])
+			return
+		}
+	}
+	if target != ce.User {
+		if !ce.User.Admin && !isRoomModerator(ce) {
+			ce.Reply("Only room moderators and bridge admins can choose another user as the relay")
+			return
+		} else if !target.isGroupMember(ce.Portal) {
+			ce.Reply("%s isn't a member of this WhatsApp chat", target.MXID)
+			return
+		} else if !ce.User.Admin {
+			// Relaying sends messages through the target's personal account, so they have to agree to it first
+			ce.Portal.relayRequests.Store(target.MXID, ce.User.MXID)
+			ce.Reply("Asked %s to act as the relay. They need to run `set-relay --accept` in this room to confirm.", target.MXID)
+			return
 		}
+	}
+	ce.Portal.RelayUserID = target.MXID
+	ce.Portal.relayUser = nil
+	err := ce.Portal.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save portal after setting relay user")
+	}
+	if target == ce.User {
 		ce.Reply("Messages from non-logged-in users in this room will now be bridged through your WhatsApp account")
+	} else {
+		ce.Reply("Messages from non-logged-in users in this room will now be bridged through the WhatsApp account of %s", target.MXID)
+	}
+}
+
+// isRoomModerator checks if the sender of the command has at least the power level required to change room state.
+func isRoomModerator(ce *WrappedCommandEvent) bool {
+	levels, err := ce.Portal.MainIntent().PowerLevels(ce.Ctx, ce.Portal.MXID)
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to get power levels to check moderator status")
+		return false
+	}
+	return levels.GetUserLevel(ce.User.MXID) >= levels.StateDefault()
+}
+
+// isGroupMember checks if the user's WhatsApp account is a participant of the portal's chat.
+func (user *User) isGroupMember(portal *Portal) bool {
+	if portal.IsPrivateChat() {
+		return portal.Key.Receiver == user.JID.ToNonAD()
+	}
+	info, err := user.Client.GetGroupInfo(portal.Key.JID)
+	if err != nil {
+		return false
+	}
+	for _, participant := range info.Participants {
+		if participant.JID.User == user.JID.User {
+			return true
+		}
 	}
+	return false
 }
 
 var cmdUnsetRelay = &commands.FullHandler{
@@ -142,6 +233,7 @@ func fnUnsetRelay(ce *WrappedCommandEvent) {
 		ce.Reply("Only bridge admins are allowed to enable relay mode on this instance of the bridge")
 	} else {
 		ce.Portal.RelayUserID = ""
+		ce.Portal.relayUser = nil
 		err := ce.Portal.Update(ce.Ctx)
 		if err != nil {
 			ce.ZLog.Err(err).Msg("Failed to save portal after clearing relay user")
@@ -155,29 +247,67 @@ var cmdInviteLink = &commands.FullHandler{
 	Name: "invite-link",
 	Help: commands.HelpMeta{
 		Section:     HelpSectionInvites,
-		Description: "Get an invite link to the current group chat, optionally regenerating the link and revoking the old link.",
-		Args:        "[--reset]",
+		Description: "Get an invite link to the current group chat, optionally revoking the old link and generating a new one.",
+		Args:        "[--revoke]",
 	},
 	RequiresPortal: true,
 	RequiresLogin:  true,
 }
 
 func fnInviteLink(ce *WrappedCommandEvent) {
-	reset := len(ce.Args) > 0 && strings.ToLower(ce.Args[0]) == "--reset"
+	var reset bool
+	if len(ce.Args) > 0 {
+		switch strings.ToLower(ce.Args[0]) {
+		case "--revoke", "--reset":
+			reset = true
+		default:
+			ce.Reply("**Usage:** `invite-link [--revoke]`")
+			return
+		}
+	}
 	if ce.Portal.IsPrivateChat() {
 		ce.Reply("Can't get invite link to private chat")
+		return
 	} else if ce.Portal.IsBroadcastList() {
 		ce.Reply("Can't get invite link to broadcast list")
-	} else if link, err := ce.User.Client.GetGroupInviteLink(ce.Portal.Key.JID, reset); err != nil {
+		return
+	}
+	if reset {
+		if ce.rejectReadOnly(ce.Portal) {
+			return
+		}
+		info, err := ce.User.Client.GetGroupInfo(ce.Portal.Key.JID)
+		if err != nil {
+			ce.Reply("Failed to get group info: %v", err)
+			return
+		}
+		isAdmin := false
+		for _, participant := range info.Participants {
+			if participant.JID.User == ce.User.JID.User {
+				isAdmin = participant.IsAdmin || participant.IsSuperAdmin
+				break
+			}
+		}
+		if !isAdmin {
+			ce.Reply("You must be an admin of the group to revoke the invite link")
+			return
+		}
+	}
+	link, err := ce.User.Client.GetGroupInviteLink(ce.Portal.Key.JID, reset)
+	if err != nil {
 		ce.Reply("Failed to get invite link: %v", err)
+	} else if reset {
+		ce.ZLog.Info().Msg("Revoked group invite link")
+		ce.Reply("Revoked the old invite link. The new invite link is %s", link)
 	} else {
 		ce.Reply(link)
 	}
 }
 
 var cmdResolveLink = &commands.FullHandler{
-	Func: wrapCommand(fnResolveLink),
-	Name: "resolve-link",
+	Func:    wrapCommand(fnResolveLink),
+	Name:    "resolve-link",
+	Aliases: []string{"resolve"},
 	Help: commands.HelpMeta{
 		Section:     HelpSectionInvites,
 		Description: "Resolve a WhatsApp group invite or business message link.",
@@ -197,7 +327,7 @@ func fnResolveLink(ce *WrappedCommandEvent) {
 			ce.Reply("Failed to get group info: %v", err)
 			return
 		}
-		ce.Reply("That invite link points at %s (`%s`)", group.Name, group.JID)
+		replyResolvedGroup(ce, group)
 	} else if strings.HasPrefix(ce.Args[0], whatsmeow.BusinessMessageLinkPrefix) || strings.HasPrefix(ce.Args[0], whatsmeow.BusinessMessageLinkDirectPrefix) {
 		target, err := ce.User.Client.ResolveBusinessMessageLink(ce.Args[0])
 		if err != nil {
@@ -229,6 +359,51 @@ func fnResolveLink(ce *WrappedCommandEvent) {
 	}
 }
 
+// replyResolvedGroup shows the details of a group resolved from an invite link,
+// so that the user can check what the group is before joining it.
+func replyResolvedGroup(ce *WrappedCommandEvent, group *types.GroupInfo) {
+	lines := []string{fmt.Sprintf("That invite link points at %s (`%s`)", group.Name, group.JID)}
+	if group.IsParent {
+		lines = append(lines, "* Type: community")
+	}
+	lines = append(lines, fmt.Sprintf("* Members: %d", len(group.Participants)))
+	if !group.GroupCreated.IsZero() {
+		lines = append(lines, fmt.Sprintf("* Created: %s", group.GroupCreated.Format("2006-01-02")))
+	}
+	if group.Topic != "" {
+		topicLines := strings.Split(group.Topic, "\n")
+		for i, line := range topicLines {
+			topicLines[i] = "> " + html.EscapeString(line)
+		}
+		lines = append(lines, "", "Description:", "", strings.Join(topicLines, "\n"))
+	}
+	ce.Reply(strings.Join(lines, "\n"))
+
+	avatar, err := ce.User.Client.GetProfilePictureInfo(group.JID, &whatsmeow.GetProfilePictureParams{
+		Preview:     true,
+		IsCommunity: group.IsParent,
+	})
+	if err != nil || avatar == nil {
+		// Group pictures are often not visible to non-members, so this is expected to fail sometimes
+		ce.ZLog.Debug().Err(err).Msg("Didn't get picture of resolved group")
+		return
+	}
+	mxc, err := reuploadAvatar(ce.Ctx, ce.Bot, avatar.URL)
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to reupload picture of resolved group")
+		return
+	}
+	_, err = ce.Bot.SendMessageEvent(ce.Ctx, ce.RoomID, event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    "group-picture.jpg",
+		URL:     mxc.CUString(),
+		Info:    &event.FileInfo{MimeType: "image/jpeg"},
+	})
+	if err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to send picture of resolved group")
+	}
+}
+
 var cmdJoin = &commands.FullHandler{
 	Func: wrapCommand(fnJoin),
 	Name: "join",
@@ -244,6 +419,8 @@ func fnJoin(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 {
 		ce.Reply("**Usage:** `join <invite link>`")
 		return
+	} else if ce.rejectReadOnly(nil) {
+		return
 	}
 
 	if strings.HasPrefix(ce.Args[0], whatsmeow.InviteLinkPrefix) {
@@ -317,6 +494,8 @@ var cmdAccept = &commands.FullHandler{
 func fnAccept(ce *WrappedCommandEvent) {
 	if len(ce.ReplyTo) == 0 {
 		ce.Reply("You must reply to a group invite message when using this command.")
+	} else if ce.rejectReadOnly(nil) {
+		return
 	} else if evt, err := ce.Portal.MainIntent().GetEvent(ce.Ctx, ce.RoomID, ce.ReplyTo); err != nil {
 		ce.ZLog.Err(err).Stringer("reply_to_mxid", ce.ReplyTo).Msg("Failed to get reply target event to handle !wa accept command")
 		ce.Reply("Failed to get reply event")
@@ -330,24 +509,136 @@ func fnAccept(ce *WrappedCommandEvent) {
 	} else if err = ce.User.Client.JoinGroupWithInvite(meta.JID, meta.Inviter, meta.Code, meta.Expiration); err != nil {
 		ce.Reply("Failed to accept group invite: %v", err)
 	} else {
+		deletePendingInvite(ce, meta.JID)
 		ce.Reply("Successfully accepted the invite, the portal should be created momentarily")
 	}
 }
 
+func deletePendingInvite(ce *WrappedCommandEvent, groupJID types.JID) {
+	invite := ce.Bridge.DB.GroupInvite.New()
+	invite.UserMXID = ce.User.MXID
+	invite.GroupJID = groupJID
+	err := invite.Delete(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Stringer("group_jid", groupJID).Msg("Failed to delete pending group invite")
+	}
+}
+
+var cmdInvites = &commands.FullHandler{
+	Func: wrapCommand(fnInvites),
+	Name: "invites",
+	Help: commands.HelpMeta{
+		Section: HelpSectionInvites,
+		Description: "List pending group invites, or accept or reject one of them. " +
+			"Rejecting only forgets the invite on the bridge, WhatsApp doesn't notify the inviter.",
+		Args: "[`accept`|`reject` <_number or group JID_>]",
+	},
+	RequiresLogin: true,
+}
+
+func fnInvites(ce *WrappedCommandEvent) {
+	if err := ce.Bridge.DB.GroupInvite.DeleteExpired(ce.Ctx); err != nil {
+		ce.ZLog.Warn().Err(err).Msg("Failed to delete expired group invites")
+	}
+	invites, err := ce.Bridge.DB.GroupInvite.GetAll(ce.Ctx, ce.User.MXID)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to get pending group invites")
+		ce.Reply("Failed to get pending group invites")
+		return
+	}
+	if len(ce.Args) == 0 {
+		if len(invites) == 0 {
+			ce.Reply("You don't have any pending group invites")
+			return
+		}
+		lines := make([]string, len(invites))
+		for i, invite := range invites {
+			lines[i] = fmt.Sprintf(
+				"%d. %s (`%s`) from +%s, expires at %s",
+				i+1, invite.GroupName, invite.GroupJID.User, invite.Inviter.User, invite.Expiration.Format(time.RFC1123),
+			)
+		}
+		ce.Reply("### Pending group invites\n\n%s\n\nUse `invites accept <number>` or `invites reject <number>` to respond.", strings.Join(lines, "\n"))
+		return
+	} else if len(ce.Args) < 2 {
+		ce.Reply("**Usage:** `invites [accept|reject <number or group JID>]`")
+		return
+	}
+	var target *database.GroupInvite
+	if index, err := strconv.Atoi(ce.Args[1]); err == nil {
+		if index > 0 && index <= len(invites) {
+			target = invites[index-1]
+		}
+	} else {
+		for _, invite := range invites {
+			if invite.GroupJID.User == ce.Args[1] || invite.GroupJID.String() == ce.Args[1] {
+				target = invite
+				break
+			}
+		}
+	}
+	if target == nil {
+		ce.Reply("No pending invite found for %q", ce.Args[1])
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "accept":
+		if ce.rejectReadOnly(nil) {
+			return
+		}
+		err = ce.User.Client.JoinGroupWithInvite(target.GroupJID, target.Inviter, target.Code, target.Expiration.Unix())
+		if err != nil {
+			ce.Reply("Failed to accept group invite: %v", err)
+			return
+		}
+		deletePendingInvite(ce, target.GroupJID)
+		ce.Reply("Successfully accepted the invite to %s, the portal should be created momentarily", target.GroupName)
+	case "reject":
+		// WhatsApp doesn't have a way to decline invites, so this only forgets about it locally
+		deletePendingInvite(ce, target.GroupJID)
+		ce.Reply("Removed the invite to %s from your pending invites. The inviter isn't notified.", target.GroupName)
+	default:
+		ce.Reply("**Usage:** `invites [accept|reject <number or group JID>]`")
+	}
+}
+
 var cmdCreate = &commands.FullHandler{
 	Func: wrapCommand(fnCreate),
 	Name: "create",
 	Help: commands.HelpMeta{
-		Section:     HelpSectionCreatingPortals,
-		Description: "Create a WhatsApp group chat for the current Matrix room.",
+		Section: HelpSectionCreatingPortals,
+		Description: "Create a WhatsApp group chat for the current Matrix room. " +
+			"If the room is in a bridged community space, the group is created inside the community.",
 	},
 	RequiresLogin: true,
 }
 
+// findParentCommunity finds a bridged WhatsApp community that the given room has been added to.
+func findParentCommunity(ce *WrappedCommandEvent) (*Portal, error) {
+	state, err := ce.Bot.State(ce.Ctx, ce.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	for stateKey, evt := range state[event.StateSpaceParent] {
+		_ = evt.Content.ParseRaw(evt.Type)
+		if content, ok := evt.Content.Parsed.(*event.SpaceParentEventContent); !ok || len(content.Via) == 0 {
+			// Parent events without via are considered removed
+			continue
+		}
+		portal := ce.Bridge.GetPortalByMXID(id.RoomID(stateKey))
+		if portal != nil && portal.IsParent {
+			return portal, nil
+		}
+	}
+	return nil, nil
+}
+
 func fnCreate(ce *WrappedCommandEvent) {
 	if ce.Portal != nil {
 		ce.Reply("This is already a portal room")
 		return
+	} else if ce.rejectReadOnly(nil) {
+		return
 	}
 
 	members, err := ce.Bot.JoinedMembers(ce.Ctx, ce.RoomID)
@@ -400,7 +691,15 @@ func fnCreate(ce *WrappedCommandEvent) {
 			participants = append(participants, jid)
 		}
 	}
-	// TODO check m.space.parent to create rooms directly in communities
+	var parentCommunity *Portal
+	if createEvent.Type != event.RoomTypeSpace {
+		parentCommunity, err = findParentCommunity(ce)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to get room state to find parent community")
+			ce.Reply("Failed to check if the room is in a community")
+			return
+		}
+	}
 
 	messageID := ce.User.Client.GenerateMessageID()
 	ce.ZLog.Info().
@@ -408,15 +707,20 @@ func fnCreate(ce *WrappedCommandEvent) {
 		Any("participants", participants).
 		Str("create_key", messageID).
 		Msg("Creating WhatsApp group for Matrix room")
-	ce.User.createKeyDedup = messageID
-	resp, err := ce.User.Client.CreateGroup(whatsmeow.ReqCreateGroup{
+	req := whatsmeow.ReqCreateGroup{
 		CreateKey:    messageID,
 		Name:         roomNameEvent.Name,
 		Participants: participants,
 		GroupParent: types.GroupParent{
 			IsParent: createEvent.Type == event.RoomTypeSpace,
 		},
-	})
+	}
+	if parentCommunity != nil {
+		ce.ZLog.Debug().Stringer("parent_group_jid", parentCommunity.Key.JID).Msg("Creating group inside community")
+		req.GroupLinkedParent.LinkedParentJID = parentCommunity.Key.JID
+	}
+	ce.User.createKeyDedup = messageID
+	resp, err := ce.User.Client.CreateGroup(req)
 	if err != nil {
 		ce.Reply("Failed to create group: %v", err)
 		return
@@ -435,6 +739,7 @@ func fnCreate(ce *WrappedCommandEvent) {
 	portal.updateLogger()
 	portal.Name = roomNameEvent.Name
 	portal.IsParent = resp.IsParent
+	portal.ParentGroup = resp.LinkedParentJID
 	portal.Encrypted = encryptionEvent.Algorithm == id.AlgorithmMegolmV1
 	if !portal.Encrypted && ce.Bridge.Config.Bridge.Encryption.Default {
 		_, err = portal.MainIntent().SendStateEvent(ce.Ctx, portal.MXID, event.StateEncryption, "", portal.GetEncryptionEventContent())
@@ -455,6 +760,11 @@ func fnCreate(ce *WrappedCommandEvent) {
 	}
 	portal.UpdateBridgeInfo(ce.Ctx)
 	ce.User.createKeyDedup = ""
+	if !portal.ParentGroup.IsEmpty() {
+		portal.updateCommunitySpace(ce.Ctx, ce.User, true, true)
+		ce.Reply("Successfully created WhatsApp group %s in community %s", portal.Key.JID, portal.ParentGroup)
+		return
+	}
 
 	ce.Reply("Successfully created WhatsApp group %s", portal.Key.JID)
 }
@@ -605,6 +915,7 @@ func fnLogout(ce *WrappedCommandEvent) {
 	ce.User.removeFromJIDMap(status.BridgeState{StateEvent: status.StateLoggedOut})
 	ce.User.DeleteConnection()
 	ce.User.DeleteSession(ce.Ctx)
+	ce.Bridge.Webhooks.Send(ce.User, WebhookLogout, map[string]interface{}{"remote": false})
 	ce.Reply("Logged out successfully.")
 }
 
@@ -637,7 +948,7 @@ func fnTogglePresence(ce *WrappedCommandEvent) {
 		ce.Reply("Disabled presence bridging")
 	}
 	if ce.User.IsLoggedIn() {
-		err := ce.User.Client.SendPresence(newPresence)
+		err := ce.User.sendPresence(newPresence)
 		if err != nil {
 			ce.ZLog.Err(err).Msg("Failed to send presence to WhatsApp")
 		}
@@ -850,32 +1161,68 @@ func matchesQuery(str string, query string) bool {
 	return strings.Contains(strings.ToLower(str), query)
 }
 
-func formatContacts(bridge *WABridge, input map[types.JID]types.ContactInfo, query string) (result []string) {
-	hasQuery := len(query) > 0
+type listFilter struct {
+	query         string
+	unbridgedOnly bool
+}
+
+// getExistingPortalRoom returns the room ID of the portal for the given chat, or an empty string if it's not bridged.
+func getExistingPortalRoom(user *User, jid types.JID) id.RoomID {
+	portal := user.bridge.GetExistingPortalByJID(database.NewPortalKey(jid, user.JID))
+	if portal == nil {
+		return ""
+	}
+	return portal.MXID
+}
+
+func formatPortalAction(roomID id.RoomID, command string) string {
+	if roomID != "" {
+		return fmt.Sprintf("[open](https://matrix.to/#/%s)", roomID)
+	}
+	return fmt.Sprintf("bridge with `%s`", command)
+}
+
+func formatContacts(user *User, input map[types.JID]types.ContactInfo, filter listFilter) (result []string) {
+	hasQuery := len(filter.query) > 0
 	for jid, contact := range input {
 		if len(contact.FullName) == 0 {
 			continue
 		}
-		puppet := bridge.GetPuppetByJID(jid)
 		pushName := contact.PushName
 		if len(pushName) == 0 {
 			pushName = contact.FullName
 		}
-
-		if !hasQuery || matchesQuery(pushName, query) || matchesQuery(contact.FullName, query) || matchesQuery(jid.User, query) {
-			result = append(result, fmt.Sprintf("* %s / [%s](https://matrix.to/#/%s) - `+%s`", contact.FullName, pushName, puppet.MXID, jid.User))
+		if hasQuery && !matchesQuery(pushName, filter.query) && !matchesQuery(contact.FullName, filter.query) && !matchesQuery(jid.User, filter.query) {
+			continue
+		}
+		roomID := getExistingPortalRoom(user, jid)
+		if filter.unbridgedOnly && roomID != "" {
+			continue
 		}
+		puppet := user.bridge.GetPuppetByJID(jid)
+		result = append(result, fmt.Sprintf(
+			"* %s / [%s](https://matrix.to/#/%s) - `+%s` - %s",
+			contact.FullName, pushName, puppet.MXID, jid.User, formatPortalAction(roomID, "pm +"+jid.User),
+		))
 	}
 	sort.Sort(sort.StringSlice(result))
 	return
 }
 
-func formatGroups(input []*types.GroupInfo, query string) (result []string) {
-	hasQuery := len(query) > 0
+func formatGroups(user *User, input []*types.GroupInfo, filter listFilter) (result []string) {
+	hasQuery := len(filter.query) > 0
 	for _, group := range input {
-		if !hasQuery || matchesQuery(group.GroupName.Name, query) || matchesQuery(group.JID.User, query) {
-			result = append(result, fmt.Sprintf("* %s - `%s`", group.GroupName.Name, group.JID.User))
+		if hasQuery && !matchesQuery(group.GroupName.Name, filter.query) && !matchesQuery(group.JID.User, filter.query) {
+			continue
+		}
+		roomID := getExistingPortalRoom(user, group.JID)
+		if filter.unbridgedOnly && roomID != "" {
+			continue
 		}
+		result = append(result, fmt.Sprintf(
+			"* %s - `%s` - %s",
+			group.GroupName.Name, group.JID.User, formatPortalAction(roomID, "open "+group.JID.User),
+		))
 	}
 	sort.Sort(sort.StringSlice(result))
 	return
@@ -887,35 +1234,54 @@ var cmdList = &commands.FullHandler{
 	Help: commands.HelpMeta{
 		Section:     HelpSectionMiscellaneous,
 		Description: "Get a list of all contacts and groups.",
-		Args:        "<`contacts`|`groups`> [_page_] [_items per page_]",
+		Args:        "<`contacts`|`groups`> [`--unbridged`] [`--name` _query_] [_page_] [_items per page_]",
 	},
 	RequiresLogin: true,
 }
 
+const listUsage = "**Usage:** `list <contacts|groups> [--unbridged] [--name <query>] [page] [items per page]`"
+
 func fnList(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 {
-		ce.Reply("**Usage:** `list <contacts|groups> [page] [items per page]`")
+		ce.Reply(listUsage)
 		return
 	}
 	mode := strings.ToLower(ce.Args[0])
 	if mode[0] != 'g' && mode[0] != 'c' {
-		ce.Reply("**Usage:** `list <contacts|groups> [page] [items per page]`")
+		ce.Reply(listUsage)
 		return
 	}
+	var filter listFilter
+	args := make([]string, 0, 2)
+	for i := 1; i < len(ce.Args); i++ {
+		switch strings.ToLower(ce.Args[i]) {
+		case "--unbridged":
+			filter.unbridgedOnly = true
+		case "--name":
+			if i+1 >= len(ce.Args) {
+				ce.Reply(listUsage)
+				return
+			}
+			i++
+			filter.query = strings.ToLower(ce.Args[i])
+		default:
+			args = append(args, ce.Args[i])
+		}
+	}
 	var err error
 	page := 1
 	maxPerPage := 100
-	if len(ce.Args) > 1 {
-		page, err = strconv.Atoi(ce.Args[1])
+	if len(args) > 0 {
+		page, err = strconv.Atoi(args[0])
 		if err != nil || page <= 0 {
-			ce.Reply("\"%s\" isn't a valid page number", ce.Args[1])
+			ce.Reply("\"%s\" isn't a valid page number", args[0])
 			return
 		}
 	}
-	if len(ce.Args) > 2 {
-		maxPerPage, err = strconv.Atoi(ce.Args[2])
+	if len(args) > 1 {
+		maxPerPage, err = strconv.Atoi(args[1])
 		if err != nil || maxPerPage <= 0 {
-			ce.Reply("\"%s\" isn't a valid number of items per page", ce.Args[2])
+			ce.Reply("\"%s\" isn't a valid number of items per page", args[1])
 			return
 		} else if maxPerPage > 400 {
 			ce.Reply("Warning: a high number of items per page may fail to send a reply")
@@ -932,14 +1298,14 @@ func fnList(ce *WrappedCommandEvent) {
 			ce.Reply("Failed to get contacts: %s", err)
 			return
 		}
-		result = formatContacts(ce.User.bridge, contactList, "")
+		result = formatContacts(ce.User, contactList, filter)
 	} else {
 		groupList, err := ce.User.Client.GetJoinedGroups()
 		if err != nil {
 			ce.Reply("Failed to get groups: %s", err)
 			return
 		}
-		result = formatGroups(groupList, "")
+		result = formatGroups(ce.User, groupList, filter)
 	}
 
 	if len(result) == 0 {
@@ -992,8 +1358,8 @@ func fnSearch(ce *WrappedCommandEvent) {
 	}
 
 	query := strings.ToLower(strings.TrimSpace(strings.Join(ce.Args, " ")))
-	formattedContacts := strings.Join(formatContacts(ce.User.bridge, contactList, query), "\n")
-	formattedGroups := strings.Join(formatGroups(groupList, query), "\n")
+	formattedContacts := strings.Join(formatContacts(ce.User, contactList, listFilter{query: query}), "\n")
+	formattedGroups := strings.Join(formatGroups(ce.User, groupList, listFilter{query: query}), "\n")
 
 	result := make([]string, 0, 2)
 	if len(formattedContacts) > 0 {
@@ -1088,6 +1454,8 @@ func fnPM(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 {
 		ce.Reply("**Usage:** `pm <international phone number>`")
 		return
+	} else if ce.rejectReadOnly(nil) {
+		return
 	}
 
 	user := ce.User
@@ -1204,6 +1572,34 @@ func fnSync(ce *WrappedCommandEvent) {
 	}
 }
 
+var cmdResyncMembers = &commands.FullHandler{
+	Func: wrapCommand(fnResyncMembers),
+	Name: "resync-members",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Fetch the participant list of the current group from WhatsApp and fix the Matrix room members and power levels to match it.",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnResyncMembers(ce *WrappedCommandEvent) {
+	if !ce.Portal.IsGroupChat() {
+		ce.Reply("Only group chats have members that can be resynced")
+		return
+	} else if ce.rejectReadOnly(ce.Portal) {
+		return
+	}
+	info, err := ce.User.Client.GetGroupInfo(ce.Portal.Key.JID)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to get group info to resync members")
+		ce.Reply("Failed to get group info: %v", err)
+		return
+	}
+	ce.Portal.SyncParticipants(ce.Ctx, ce.User, info)
+	ce.Reply("Resynced %d members of the group", len(info.Participants))
+}
+
 var cmdDisappearingTimer = &commands.FullHandler{
 	Func:    wrapCommand(fnDisappearingTimer),
 	Name:    "disappearing-timer",
@@ -1221,6 +1617,8 @@ func fnDisappearingTimer(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 {
 		ce.Reply("**Usage:** `disappearing-timer <off/1d/7d/90d>`")
 		return
+	} else if ce.rejectReadOnly(ce.Portal) {
+		return
 	}
 	duration, ok := whatsmeow.ParseDisappearingTimerString(ce.Args[0])
 	if !ok {
@@ -1239,5 +1637,811 @@ func fnDisappearingTimer(ce *WrappedCommandEvent) {
 	if err != nil {
 		ce.ZLog.Err(err).Msg("Failed to save portal after setting disappearing timer")
 	}
+	ce.Portal.UpdateDisappearingTimerState(ce.Ctx)
+	ce.React("✅")
+}
+
+var cmdBroadcast = &commands.FullHandler{
+	Func: wrapCommand(fnBroadcast),
+	Name: "broadcast",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Send a text message to all recipients of a broadcast list.",
+		Args:        "<_broadcast list ID_> <_message_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnBroadcast(ce *WrappedCommandEvent) {
+	if len(ce.Args) < 2 {
+		ce.Reply("**Usage:** `broadcast <broadcast list ID> <message>`")
+		return
+	}
+	listID := ce.Args[0]
+	if !strings.ContainsRune(listID, '@') {
+		listID += "@" + types.BroadcastServer
+	}
+	jid, err := types.ParseJID(listID)
+	if err != nil || jid.Server != types.BroadcastServer || jid == types.StatusBroadcastJID {
+		ce.Reply("That doesn't look like a broadcast list ID")
+		return
+	}
+	portal := ce.User.GetPortalByJID(jid)
+	if ce.rejectReadOnly(portal) {
+		return
+	}
+	recipients, err := portal.getBroadcastRecipients(ce.Ctx, ce.User)
+	if errors.Is(err, errBroadcastNoRecipients) {
+		ce.Reply("No known recipients for that broadcast list. Make sure broadcast list portals are enabled and the list has been synced.")
+		return
+	} else if err != nil {
+		ce.Reply("Failed to get broadcast list recipients: %v", err)
+		return
+	}
+	text := strings.Join(ce.Args[1:], " ")
+	_, err = portal.sendBroadcastListMessage(ce.Ctx, ce.User, recipients, &waProto.Message{Conversation: proto.String(text)}, whatsmeow.SendRequestExtra{})
+	if err != nil {
+		ce.Reply("Failed to send broadcast message: %v", err)
+		return
+	}
+	ce.Reply("Sent message to %d recipients of the broadcast list", len(recipients))
+}
+
+var cmdMatrixLeave = &commands.FullHandler{
+	Func: wrapCommand(fnMatrixLeave),
+	Name: "matrix-leave",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Set whether leaving this Matrix room should also leave the WhatsApp group.",
+		Args:        "<`on`|`off`|`default`>",
+	},
+	RequiresPortal: true,
+}
+
+func fnMatrixLeave(ce *WrappedCommandEvent) {
+	if !ce.Portal.IsGroupChat() {
+		ce.Reply("This is only supported in group portals")
+		return
+	} else if len(ce.Args) == 0 {
+		current := "default"
+		if ce.Portal.BridgeMatrixLeave != nil {
+			current = strconv.FormatBool(*ce.Portal.BridgeMatrixLeave)
+		}
+		ce.Reply("**Usage:** `matrix-leave <on|off|default>` (currently %s)", current)
+		return
+	}
+	val, ok := parseBoolOverride(ce.Args[0])
+	if !ok {
+		ce.Reply("**Usage:** `matrix-leave <on|off|default>`")
+		return
+	}
+	ce.Portal.BridgeMatrixLeave = val
+	err := ce.Portal.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save portal after changing matrix leave setting")
+		ce.Reply("Failed to save setting")
+		return
+	}
 	ce.React("✅")
 }
+
+// parseBoolOverride parses an on/off/default command argument into an optional boolean, where nil means default.
+func parseBoolOverride(arg string) (val *bool, ok bool) {
+	switch strings.ToLower(arg) {
+	case "on", "true", "yes":
+		return proto.Bool(true), true
+	case "off", "false", "no":
+		return proto.Bool(false), true
+	case "default":
+		return nil, true
+	default:
+		return nil, false
+	}
+}
+
+func formatBoolOverride(val *bool) string {
+	if val == nil {
+		return "default"
+	} else if *val {
+		return "on"
+	}
+	return "off"
+}
+
+var cmdLeaveGroup = &commands.FullHandler{
+	Func: wrapCommand(fnLeaveGroup),
+	Name: "leave-group",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Leave a WhatsApp group. Defaults to the group of the current portal.",
+		Args:        "[_group JID_]",
+	},
+	RequiresLogin: true,
+}
+
+func fnLeaveGroup(ce *WrappedCommandEvent) {
+	var jid types.JID
+	if len(ce.Args) > 0 {
+		if strings.ContainsRune(ce.Args[0], '@') {
+			jid, _ = types.ParseJID(ce.Args[0])
+		} else {
+			jid = types.NewJID(ce.Args[0], types.GroupServer)
+		}
+	} else if ce.Portal != nil {
+		jid = ce.Portal.Key.JID
+	}
+	if jid.Server != types.GroupServer {
+		ce.Reply("**Usage:** `leave-group [group JID]`")
+		return
+	} else if ce.rejectReadOnly(nil) {
+		return
+	}
+	err := ce.User.Client.LeaveGroup(jid)
+	if err != nil {
+		ce.Reply("Failed to leave group: %v", err)
+		return
+	}
+	ce.Reply("Successfully left the WhatsApp group")
+}
+
+var cmdSetAvatar = &commands.FullHandler{
+	Func: wrapCommand(fnSetAvatar),
+	Name: "set-avatar",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Set your WhatsApp profile picture. Defaults to your current Matrix avatar, but you can also reply to an image or pass an mxc URI.",
+		Args:        "[_mxc URI_|`remove`]",
+	},
+	RequiresLogin: true,
+}
+
+func fnSetAvatar(ce *WrappedCommandEvent) {
+	if ce.rejectReadOnly(nil) {
+		return
+	}
+	var avatarURL id.ContentURI
+	var err error
+	if len(ce.Args) > 0 {
+		if ce.Args[0] == "remove" {
+			// An empty URI removes the avatar
+			err = ce.User.SetWhatsAppAvatar(ce.Ctx, id.ContentURI{})
+			if err != nil {
+				ce.Reply("Failed to remove profile picture: %v", err)
+			} else {
+				ce.React("✅")
+			}
+			return
+		}
+		avatarURL, err = id.ParseContentURI(ce.Args[0])
+		if err != nil {
+			ce.Reply("That doesn't look like a valid mxc URI")
+			return
+		}
+	} else if len(ce.ReplyTo) > 0 {
+		evt, err := ce.Bot.GetEvent(ce.Ctx, ce.RoomID, ce.ReplyTo)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to get reply target event to set avatar")
+			ce.Reply("Failed to get reply event")
+			return
+		}
+		rawContent, err := tryDecryptEvent(ce, evt)
+		if err != nil {
+			ce.Reply("Failed to decrypt reply event")
+			return
+		}
+		var content event.MessageEventContent
+		if err = json.Unmarshal(rawContent, &content); err != nil || content.MsgType != event.MsgImage {
+			ce.Reply("You must reply to an image to use it as your profile picture")
+			return
+		} else if content.File != nil {
+			ce.Reply("Encrypted images can't be used as the profile picture")
+			return
+		}
+		avatarURL, err = content.URL.Parse()
+		if err != nil {
+			ce.Reply("The image doesn't have a valid URL")
+			return
+		}
+	} else {
+		avatarURL, err = ce.Bot.GetAvatarURL(ce.Ctx, ce.User.MXID)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to get Matrix avatar of user")
+			ce.Reply("Failed to get your Matrix avatar")
+			return
+		} else if avatarURL.IsEmpty() {
+			ce.Reply("You don't have a Matrix avatar. Use `set-avatar remove` to remove your WhatsApp profile picture.")
+			return
+		}
+	}
+	err = ce.User.SetWhatsAppAvatar(ce.Ctx, avatarURL)
+	if err != nil {
+		ce.Reply("Failed to set profile picture: %v", err)
+		return
+	}
+	ce.React("✅")
+}
+
+var cmdSetName = &commands.FullHandler{
+	Func: wrapCommand(fnSetName),
+	Name: "set-name",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Set your WhatsApp push name, which is shown to people who don't have you in their contacts.",
+		Args:        "<_name_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnSetName(ce *WrappedCommandEvent) {
+	name := strings.TrimSpace(strings.Join(ce.Args, " "))
+	if len(name) == 0 {
+		ce.Reply("**Usage:** `set-name <name>`")
+		return
+	} else if ce.rejectReadOnly(nil) {
+		return
+	}
+	err := ce.User.SetWhatsAppPushName(ce.Ctx, name)
+	if err != nil {
+		ce.Reply("Failed to set push name: %v", err)
+		return
+	}
+	ce.React("✅")
+}
+
+var cmdSetStatus = &commands.FullHandler{
+	Func: wrapCommand(fnSetStatus),
+	Name: "set-status",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Set the about text of your WhatsApp profile.",
+		Args:        "<_text_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnSetStatus(ce *WrappedCommandEvent) {
+	text := strings.TrimSpace(strings.Join(ce.Args, " "))
+	if len(text) == 0 {
+		ce.Reply("**Usage:** `set-status <text>`")
+		return
+	} else if ce.rejectReadOnly(nil) {
+		return
+	}
+	err := ce.User.Client.SetStatusMessage(text)
+	if err != nil {
+		ce.Reply("Failed to set about text: %v", err)
+		return
+	}
+	ce.React("✅")
+}
+
+var cmdStatus = &commands.FullHandler{
+	Func: wrapCommand(fnStatus),
+	Name: "status",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Show the current about text of your WhatsApp profile.",
+	},
+	RequiresLogin: true,
+}
+
+func fnStatus(ce *WrappedCommandEvent) {
+	ownJID := ce.User.JID.ToNonAD()
+	infos, err := ce.User.Client.GetUserInfo([]types.JID{ownJID})
+	if err != nil {
+		ce.Reply("Failed to get profile info: %v", err)
+		return
+	}
+	info, ok := infos[ownJID]
+	if !ok || len(info.Status) == 0 {
+		ce.Reply("Your about text is empty.")
+		return
+	}
+	ce.Reply("Your about text is: %s", info.Status)
+}
+
+var privacySettingNames = map[string]types.PrivacySettingType{
+	"last-seen":     types.PrivacySettingTypeLastSeen,
+	"profile-photo": types.PrivacySettingTypeProfile,
+	"about":         types.PrivacySettingTypeStatus,
+	"read-receipts": types.PrivacySettingTypeReadReceipts,
+	"groups-add":    types.PrivacySettingTypeGroupAdd,
+	"online":        types.PrivacySettingTypeOnline,
+}
+
+var privacySettingValues = map[string]types.PrivacySetting{
+	"all":             types.PrivacySettingAll,
+	"contacts":        types.PrivacySettingContacts,
+	"contacts-except": types.PrivacySettingContactBlacklist,
+	"match-last-seen": types.PrivacySettingMatchLastSeen,
+	"none":            types.PrivacySettingNone,
+}
+
+const privacyUsage = "**Usage:** `privacy [get]` or `privacy set <setting> <value>`\n\n" +
+	"Settings: `last-seen`, `profile-photo`, `about`, `read-receipts`, `groups-add`, `online`\n\n" +
+	"Values: `all`, `contacts`, `contacts-except`, `match-last-seen`, `none`"
+
+var cmdPrivacy = &commands.FullHandler{
+	Func: wrapCommand(fnPrivacy),
+	Name: "privacy",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "View or change your WhatsApp privacy settings.",
+		Args:        "[get | set <_setting_> <_value_>]",
+	},
+	RequiresLogin: true,
+}
+
+func formatPrivacySettingValue(value types.PrivacySetting) string {
+	for name, val := range privacySettingValues {
+		if val == value {
+			return name
+		}
+	}
+	if value == types.PrivacySettingUndefined {
+		return "unknown"
+	}
+	return string(value)
+}
+
+func fnPrivacy(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 || strings.ToLower(ce.Args[0]) == "get" {
+		settings := ce.User.Client.GetPrivacySettings()
+		ce.Reply("Current privacy settings:\n\n"+
+			"* Last seen: %s\n"+
+			"* Profile photo: %s\n"+
+			"* About: %s\n"+
+			"* Read receipts: %s\n"+
+			"* Adding to groups: %s\n"+
+			"* Online: %s",
+			formatPrivacySettingValue(settings.LastSeen),
+			formatPrivacySettingValue(settings.Profile),
+			formatPrivacySettingValue(settings.Status),
+			formatPrivacySettingValue(settings.ReadReceipts),
+			formatPrivacySettingValue(settings.GroupAdd),
+			formatPrivacySettingValue(settings.Online))
+		return
+	} else if strings.ToLower(ce.Args[0]) != "set" || len(ce.Args) != 3 {
+		ce.Reply(privacyUsage)
+		return
+	} else if ce.rejectReadOnly(nil) {
+		return
+	}
+	setting, ok := privacySettingNames[strings.ToLower(ce.Args[1])]
+	if !ok {
+		ce.Reply("Unknown privacy setting `%s`.\n\n%s", ce.Args[1], privacyUsage)
+		return
+	}
+	value, ok := privacySettingValues[strings.ToLower(ce.Args[2])]
+	if !ok {
+		ce.Reply("Unknown privacy value `%s`.\n\n%s", ce.Args[2], privacyUsage)
+		return
+	}
+	_, err := ce.User.Client.SetPrivacySetting(setting, value)
+	if err != nil {
+		ce.Reply("Failed to change privacy setting: %v", err)
+		return
+	}
+	ce.React("✅")
+}
+
+var cmdReadReceipts = &commands.FullHandler{
+	Func: wrapCommand(fnReadReceipts),
+	Name: "read-receipts",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Set whether your Matrix read receipts are sent to WhatsApp. Delivery receipts are always sent.",
+		Args:        "<`on`|`off`|`default`>",
+	},
+	RequiresLogin: true,
+}
+
+func fnReadReceipts(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `read-receipts <on|off|default>` (currently %s)", formatBoolOverride(ce.User.SendReadReceipts))
+		return
+	}
+	val, ok := parseBoolOverride(ce.Args[0])
+	if !ok {
+		ce.Reply("**Usage:** `read-receipts <on|off|default>`")
+		return
+	}
+	ce.User.SendReadReceipts = val
+	err := ce.User.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save user after changing read receipt setting")
+		ce.Reply("Failed to save setting")
+		return
+	}
+	if !ce.User.shouldSendReadReceipts() {
+		ce.Reply("Read receipts will no longer be sent to WhatsApp. Chats will stay unread on your other devices.")
+	} else if ce.User.Client.GetPrivacySettings().ReadReceipts == types.PrivacySettingNone {
+		ce.Reply("Read receipts will be sent to WhatsApp, but as they're disabled in your WhatsApp privacy settings, " +
+			"they will only mark chats as read on your other devices.")
+	} else {
+		ce.Reply("Read receipts will be sent to WhatsApp.")
+	}
+}
+
+const typingUsage = "**Usage:** `typing <send|receive> <on|off|default>` or `typing portal <on|off|default>`"
+
+var cmdTyping = &commands.FullHandler{
+	Func: wrapCommand(fnTyping),
+	Name: "typing",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Set whether typing notifications are bridged for your account, or in both directions in the current portal.",
+		Args:        "<`send`|`receive`|`portal`> <`on`|`off`|`default`>",
+	},
+	RequiresLogin: true,
+}
+
+func fnTyping(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("%s\n\nCurrently sending: %s, receiving: %s", typingUsage,
+			formatBoolOverride(ce.User.SendTyping), formatBoolOverride(ce.User.ReceiveTyping))
+		return
+	}
+	target := strings.ToLower(ce.Args[0])
+	if target == "portal" && ce.Portal == nil {
+		ce.Reply("This is not a portal room")
+		return
+	} else if len(ce.Args) < 2 {
+		if target == "portal" {
+			ce.Reply("%s\n\nCurrently in this portal: %s", typingUsage, formatBoolOverride(ce.Portal.TypingNotifications))
+		} else {
+			ce.Reply(typingUsage)
+		}
+		return
+	}
+	val, ok := parseBoolOverride(ce.Args[1])
+	if !ok {
+		ce.Reply(typingUsage)
+		return
+	}
+	var err error
+	switch target {
+	case "send":
+		ce.User.SendTyping = val
+		err = ce.User.Update(ce.Ctx)
+	case "receive":
+		ce.User.ReceiveTyping = val
+		err = ce.User.Update(ce.Ctx)
+	case "portal":
+		ce.Portal.TypingNotifications = val
+		err = ce.Portal.Update(ce.Ctx)
+	default:
+		ce.Reply(typingUsage)
+		return
+	}
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save typing notification setting")
+		ce.Reply("Failed to save setting")
+		return
+	}
+	ce.React("✅")
+}
+
+const voiceModeUsage = "**Usage:** `voice-mode <msc3245|always|never|default>`"
+
+var cmdVoiceMode = &commands.FullHandler{
+	Func: wrapCommand(fnVoiceMode),
+	Name: "voice-mode",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Set which audio messages are sent to WhatsApp as voice messages in the current portal.",
+		Args:        "<`msc3245`|`always`|`never`|`default`>",
+	},
+	RequiresPortal: true,
+}
+
+func fnVoiceMode(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		current := ce.Portal.OutgoingVoiceMode
+		if current == "" {
+			current = fmt.Sprintf("default (%s)", ce.Bridge.Config.Bridge.OutgoingVoiceMode)
+		}
+		ce.Reply("%s\n\nCurrently in this portal: %s", voiceModeUsage, current)
+		return
+	}
+	switch mode := config.VoiceMessageMode(strings.ToLower(ce.Args[0])); mode {
+	case config.VoiceMessageModeMSC3245, config.VoiceMessageModeAlways, config.VoiceMessageModeNever:
+		ce.Portal.OutgoingVoiceMode = string(mode)
+	case "default":
+		ce.Portal.OutgoingVoiceMode = ""
+	default:
+		ce.Reply(voiceModeUsage)
+		return
+	}
+	err := ce.Portal.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save voice message setting")
+		ce.Reply("Failed to save setting")
+		return
+	}
+	ce.React("✅")
+}
+
+const readOnlyUsage = "**Usage:** `read-only <on|off>` or `read-only portal <on|off>`"
+
+var cmdReadOnly = &commands.FullHandler{
+	Func: wrapCommand(fnReadOnly),
+	Name: "read-only",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Stop sending anything to WhatsApp from your account, or from anyone in the current portal. Only bridge admins can turn read-only mode off.",
+		Args:        "[`portal`] <`on`|`off`>",
+	},
+	RequiresLogin: true,
+}
+
+func fnReadOnly(ce *WrappedCommandEvent) {
+	args := ce.Args
+	isPortal := len(args) > 0 && strings.ToLower(args[0]) == "portal"
+	if isPortal {
+		args = args[1:]
+		if ce.Portal == nil {
+			ce.Reply("This is not a portal room")
+			return
+		}
+	}
+	if len(args) == 0 {
+		if isPortal {
+			ce.Reply("%s\n\nThis portal is currently %s", readOnlyUsage, formatReadOnly(ce.Portal.ReadOnly))
+		} else {
+			ce.Reply("%s\n\nYour account is currently %s", readOnlyUsage, formatReadOnly(ce.User.ReadOnly))
+		}
+		return
+	}
+	var readOnly bool
+	switch strings.ToLower(args[0]) {
+	case "on", "true", "yes":
+		readOnly = true
+	case "off", "false", "no":
+		readOnly = false
+	default:
+		ce.Reply(readOnlyUsage)
+		return
+	}
+	if !readOnly && !ce.User.Admin {
+		ce.Reply("Only bridge admins can turn off read-only mode")
+		return
+	} else if isPortal && !ce.User.Admin && !isRoomModerator(ce) {
+		ce.Reply("Only room moderators and bridge admins can change the read-only mode of a portal")
+		return
+	}
+	var err error
+	if isPortal {
+		ce.Portal.ReadOnly = readOnly
+		err = ce.Portal.Update(ce.Ctx)
+	} else {
+		ce.User.ReadOnly = readOnly
+		err = ce.User.Update(ce.Ctx)
+	}
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save read-only setting")
+		ce.Reply("Failed to save setting")
+		return
+	}
+	ce.ZLog.Info().Bool("portal", isPortal).Bool("read_only", readOnly).Msg("Changed read-only mode")
+	ce.React("✅")
+}
+
+// rejectReadOnly replies with an error and returns true if the user's login or the given portal is
+// in read-only mode, which means commands that change something on WhatsApp must not be used.
+func (ce *WrappedCommandEvent) rejectReadOnly(portal *Portal) bool {
+	if ce.User.ReadOnly {
+		ce.Reply("Your account is in read-only mode, so this command can't be used. Use `read-only off` to disable it.")
+		return true
+	} else if portal != nil && portal.ReadOnly {
+		ce.Reply("This portal is in read-only mode, so this command can't be used here.")
+		return true
+	}
+	return false
+}
+
+func formatReadOnly(readOnly bool) string {
+	if readOnly {
+		return "read-only"
+	}
+	return "not read-only"
+}
+
+const presenceUsage = "**Usage:** `presence <receive|offline-after-send> <on|off|default>`\n\n" +
+	"Use `toggle-presence` to change whether your own presence is sent to WhatsApp."
+
+var cmdPresence = &commands.FullHandler{
+	Func: wrapCommand(fnPresence),
+	Name: "presence",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Set whether contacts' presence is bridged and whether you're marked as unavailable after sending messages.",
+		Args:        "<`receive`|`offline-after-send`> <`on`|`off`|`default`>",
+	},
+	RequiresLogin: true,
+}
+
+func fnPresence(ce *WrappedCommandEvent) {
+	if len(ce.Args) < 2 {
+		ce.Reply("%s\n\nCurrently receiving: %s, offline after send: %s", presenceUsage,
+			formatBoolOverride(ce.User.ReceivePresence), formatBoolOverride(ce.User.OfflineAfterSend))
+		return
+	}
+	val, ok := parseBoolOverride(ce.Args[1])
+	if !ok {
+		ce.Reply(presenceUsage)
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "receive":
+		ce.User.ReceivePresence = val
+	case "offline-after-send":
+		ce.User.OfflineAfterSend = val
+	default:
+		ce.Reply(presenceUsage)
+		return
+	}
+	err := ce.User.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save user after changing presence settings")
+		ce.Reply("Failed to save setting")
+		return
+	}
+	if ce.User.shouldReceivePresence() {
+		go ce.User.subscribePresence(ce.User.zlog.WithContext(context.TODO()))
+	}
+	ce.React("✅")
+}
+
+var cmdLanguage = &commands.FullHandler{
+	Func: wrapCommand(fnLanguage),
+	Name: "language",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Set the language of notices and placeholders generated by the bridge.",
+		Args:        "<_language code_|`default`>",
+	},
+}
+
+func fnLanguage(ce *WrappedCommandEvent) {
+	supported := strings.Join(SupportedLanguages(), ", ")
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `language <code|default>` (currently `%s`, supported: %s)", ce.User.language(), supported)
+		return
+	}
+	lang := strings.ToLower(ce.Args[0])
+	if lang == "default" {
+		lang = ""
+	} else if !isSupportedLanguage(lang) {
+		ce.Reply("Unsupported language `%s`. Supported languages: %s", lang, supported)
+		return
+	}
+	ce.User.Language = lang
+	err := ce.User.Update(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save user after changing language")
+		ce.Reply("Failed to save setting")
+		return
+	}
+	ce.React("✅")
+}
+
+var cmdDebugMessage = &commands.FullHandler{
+	Func: wrapCommand(fnDebugMessage),
+	Name: "debug-message",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Show the stored WhatsApp mapping of a bridged message. Either reply to the message or pass its event ID.",
+		Args:        "[_event ID_]",
+	},
+	RequiresPortal: true,
+}
+
+func fnDebugMessage(ce *WrappedCommandEvent) {
+	var eventID id.EventID
+	if len(ce.Args) > 0 {
+		eventID = id.EventID(ce.Args[0])
+	} else if len(ce.ReplyTo) > 0 {
+		eventID = ce.ReplyTo
+	} else {
+		ce.Reply("**Usage:** `debug-message <event ID>` or reply to a message with `debug-message`")
+		return
+	}
+	msg, err := ce.Bridge.DB.Message.GetByMXID(ce.Ctx, eventID)
+	if err != nil {
+		ce.ZLog.Err(err).Stringer("target_event_id", eventID).Msg("Failed to get message from database")
+		ce.Reply("Failed to get message from database")
+		return
+	} else if msg == nil {
+		reaction, err := ce.Bridge.DB.Reaction.GetByMXID(ce.Ctx, eventID)
+		if err != nil {
+			ce.ZLog.Err(err).Stringer("target_event_id", eventID).Msg("Failed to get reaction from database")
+			ce.Reply("Failed to get reaction from database")
+		} else if reaction == nil || reaction.Chat != ce.Portal.Key {
+			ce.Reply("Event `%s` isn't a known bridged message in this room", eventID)
+		} else {
+			ce.Reply("**Reaction** `%s`\n\n"+
+				"* WhatsApp message ID: `%s`\n"+
+				"* Chat: `%s` (receiver `%s`)\n"+
+				"* Sender: `%s`\n"+
+				"* Target message ID: `%s`",
+				reaction.MXID, reaction.JID, reaction.Chat.JID, reaction.Chat.Receiver, reaction.Sender, reaction.TargetJID)
+		}
+		return
+	} else if msg.Chat != ce.Portal.Key {
+		ce.Reply("Event `%s` isn't a known bridged message in this room", eventID)
+		return
+	}
+	var timestamp string
+	if !msg.Timestamp.IsZero() {
+		timestamp = msg.Timestamp.UTC().Format(time.RFC3339)
+	} else {
+		timestamp = "unknown"
+	}
+	lines := []string{
+		fmt.Sprintf("**Message** `%s`\n", msg.MXID),
+		fmt.Sprintf("* WhatsApp message ID: `%s`", msg.JID),
+		fmt.Sprintf("* Chat: `%s` (receiver `%s`)", msg.Chat.JID, msg.Chat.Receiver),
+		fmt.Sprintf("* Sender: `%s` (device %d), Matrix user `%s`", msg.Sender, msg.Sender.Device, msg.SenderMXID),
+		fmt.Sprintf("* Timestamp: %s", timestamp),
+		fmt.Sprintf("* Type: `%s`, gallery part: %d", msg.Type, msg.GalleryPart),
+		fmt.Sprintf("* Sent: %t, error: `%s`", msg.Sent, msg.Error),
+		fmt.Sprintf("* Fake JID: %t, fake MXID: %t", msg.IsFakeJID(), msg.IsFakeMXID()),
+	}
+	if !msg.BroadcastListJID.IsEmpty() {
+		lines = append(lines, fmt.Sprintf("* Broadcast list: `%s`", msg.BroadcastListJID))
+	}
+	if ce.Portal.isRecentlyHandled(msg.JID, msg.Error) {
+		lines = append(lines, "* In recently handled message buffer")
+	}
+	ce.Reply(strings.Join(lines, "\n"))
+}
+
+var cmdRequestAgain = &commands.FullHandler{
+	Func:    wrapCommand(fnRequestAgain),
+	Name:    "request-again",
+	Aliases: []string{"retry-decrypt"},
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Ask your phone to resend a message that couldn't be decrypted and report if it doesn't arrive. Reply to the placeholder or pass its event ID.",
+		Args:        "[_event ID_]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnRequestAgain(ce *WrappedCommandEvent) {
+	var eventID id.EventID
+	if len(ce.Args) > 0 {
+		eventID = id.EventID(ce.Args[0])
+	} else if len(ce.ReplyTo) > 0 {
+		eventID = ce.ReplyTo
+	} else {
+		ce.Reply("**Usage:** `request-again <event ID>` or reply to an undecryptable message with `request-again`")
+		return
+	}
+	msg, err := ce.Bridge.DB.Message.GetByMXID(ce.Ctx, eventID)
+	if err != nil {
+		ce.ZLog.Err(err).Stringer("target_event_id", eventID).Msg("Failed to get message from database")
+		ce.Reply("Failed to get message from database")
+		return
+	} else if msg == nil || msg.Chat != ce.Portal.Key {
+		ce.Reply("Event `%s` isn't a known bridged message in this room", eventID)
+		return
+	} else if msg.Error != database.MsgErrDecryptionFailed {
+		ce.Reply("That message was decrypted successfully, there's nothing to request")
+		return
+	} else if ce.rejectReadOnly(ce.Portal) {
+		return
+	}
+	// This doesn't send a retry receipt to the sender: whatsmeow already sends those automatically when decryption
+	// fails, and sending one manually isn't possible, as it needs the original encrypted message node, which isn't
+	// stored. Asking the user's own phone to resend the message is the only way left to get it again.
+	err = ce.Portal.RequestUnavailableMessage(ce.Ctx, ce.User, msg, true)
+	if err != nil {
+		ce.ZLog.Err(err).Str("message_id", msg.JID).Msg("Failed to request unavailable message")
+		ce.Reply("Failed to request message from your phone: %v", err)
+		return
+	}
+	ce.Reply("Requested the message from your phone. It will replace the placeholder once your phone sends it.")
+}
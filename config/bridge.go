@@ -43,6 +43,63 @@ const (
 	MediaRequestMethodLocalTime                    = "local_time"
 )
 
+type CaptionMode string
+
+const (
+	// CaptionModeSplit sends media captions as a separate event after the media.
+	CaptionModeSplit CaptionMode = "split"
+	// CaptionModeMerged puts the caption in the media event itself (MSC2530 and MSC3552).
+	CaptionModeMerged CaptionMode = "merged"
+)
+
+type ContactsArrayMode string
+
+const (
+	// ContactsArrayModeSplit sends a summary notice followed by one vCard file per contact.
+	ContactsArrayModeSplit ContactsArrayMode = "split"
+	// ContactsArrayModeCombined sends a single vCard file containing all contacts, with the list of contacts as the caption.
+	ContactsArrayModeCombined ContactsArrayMode = "combined"
+)
+
+type AboutChangeNoticeMode string
+
+const (
+	// AboutChangeNoticeOff doesn't notify about contacts changing their about text.
+	AboutChangeNoticeOff AboutChangeNoticeMode = "off"
+	// AboutChangeNoticePortal sends the notice to the private chat portal with the contact.
+	AboutChangeNoticePortal AboutChangeNoticeMode = "portal"
+	// AboutChangeNoticeManagementRoom sends the notice to the user's management room.
+	AboutChangeNoticeManagementRoom AboutChangeNoticeMode = "management_room"
+)
+
+type VoiceMessageMode string
+
+const (
+	// VoiceMessageModeMSC3245 sends audio as voice messages only if it has the MSC3245 voice marker.
+	VoiceMessageModeMSC3245 VoiceMessageMode = "msc3245"
+	// VoiceMessageModeAlways sends all Opus audio as voice messages.
+	VoiceMessageModeAlways VoiceMessageMode = "always"
+	// VoiceMessageModeNever sends all audio as normal audio attachments.
+	VoiceMessageModeNever VoiceMessageMode = "never"
+)
+
+type NoticeMode string
+
+const (
+	// NoticeModeBridge bridges m.notice messages like normal text messages.
+	NoticeModeBridge NoticeMode = "bridge"
+	// NoticeModePrefix bridges m.notice messages with NoticePrefix prepended to mark them as bot messages.
+	NoticeModePrefix NoticeMode = "prefix"
+	// NoticeModeDrop doesn't bridge m.notice messages at all.
+	NoticeModeDrop NoticeMode = "drop"
+)
+
+type WebhookTarget struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"`
+}
+
 type BridgeConfig struct {
 	UsernameTemplate    string `yaml:"username_template"`
 	DisplaynameTemplate string `yaml:"displayname_template"`
@@ -55,6 +112,53 @@ type BridgeConfig struct {
 	PortalMessageBuffer   int  `yaml:"portal_message_buffer"`
 	CallStartNotices      bool `yaml:"call_start_notices"`
 	IdentityChangeNotices bool `yaml:"identity_change_notices"`
+	AvatarChangeNotices   bool `yaml:"avatar_change_notices"`
+	DisappearingRetention bool `yaml:"disappearing_retention"`
+	DisappearingTopic     bool `yaml:"disappearing_topic"`
+	RedactRevokedMessages bool `yaml:"redact_revoked_messages"`
+	DeleteRedactedMedia   bool `yaml:"delete_redacted_media"`
+	UnknownMessageDump    bool `yaml:"unknown_message_dump"`
+
+	UndecryptableRerequest struct {
+		Window      int `yaml:"window"`
+		MaxMessages int `yaml:"max_messages"`
+	} `yaml:"undecryptable_rerequest"`
+
+	NoticeLoopProtection struct {
+		MaxNotices int `yaml:"max_notices"`
+		Window     int `yaml:"window"`
+	} `yaml:"notice_loop_protection"`
+
+	SelfChatCommands struct {
+		Enabled bool   `yaml:"enabled"`
+		Prefix  string `yaml:"prefix"`
+	} `yaml:"self_chat_commands"`
+
+	NoticeTemplates map[string]string `yaml:"notice_templates"`
+	Language        string            `yaml:"language"`
+
+	ReactionMapping struct {
+		ToWhatsApp map[string]string `yaml:"to_whatsapp"`
+		ToMatrix   map[string]string `yaml:"to_matrix"`
+		Fallback   string            `yaml:"fallback"`
+	} `yaml:"reaction_mapping"`
+
+	Webhooks struct {
+		Targets    []WebhookTarget `yaml:"targets"`
+		MaxRetries int             `yaml:"max_retries"`
+	} `yaml:"webhooks"`
+
+	ContactPortals struct {
+		Create bool `yaml:"create"`
+		Delay  int  `yaml:"delay"`
+	} `yaml:"contact_portals"`
+
+	MessagePruning struct {
+		MaxAgeDays       int  `yaml:"max_age_days"`
+		OnlyDisappearing bool `yaml:"only_disappearing"`
+		BatchSize        int  `yaml:"batch_size"`
+		BatchDelay       int  `yaml:"batch_delay"`
+	} `yaml:"message_pruning"`
 
 	HistorySync struct {
 		Backfill bool `yaml:"backfill"`
@@ -65,9 +169,15 @@ type BridgeConfig struct {
 			SizeLimit    uint32 `yaml:"size_mb_limit"`
 			StorageQuota uint32 `yaml:"storage_quota_mb"`
 		}
-		MaxInitialConversations int `yaml:"max_initial_conversations"`
-		MessageCount            int `yaml:"message_count"`
-		UnreadHoursThreshold    int `yaml:"unread_hours_threshold"`
+		MaxInitialConversations int  `yaml:"max_initial_conversations"`
+		MessageCount            int  `yaml:"message_count"`
+		UnreadHoursThreshold    int  `yaml:"unread_hours_threshold"`
+		Silent                  bool `yaml:"silent"`
+		MembershipHistory       bool `yaml:"membership_history"`
+		RecentStickers          bool `yaml:"recent_stickers"`
+
+		PortalCreateDelay            int `yaml:"portal_create_delay"`
+		PortalCreateProgressInterval int `yaml:"portal_create_progress_interval"`
 
 		Immediate struct {
 			WorkerCount int `yaml:"worker_count"`
@@ -83,39 +193,100 @@ type BridgeConfig struct {
 
 		Deferred []DeferredConfig `yaml:"deferred"`
 	} `yaml:"history_sync"`
-	UserAvatarSync    bool `yaml:"user_avatar_sync"`
-	BridgeMatrixLeave bool `yaml:"bridge_matrix_leave"`
+	UserAvatarSync           bool `yaml:"user_avatar_sync"`
+	BridgeMatrixLeave        bool `yaml:"bridge_matrix_leave"`
+	BridgeMatrixLeaveConfirm bool `yaml:"bridge_matrix_leave_confirm"`
+
+	MatrixProfileSync struct {
+		Avatar      bool `yaml:"avatar"`
+		Displayname bool `yaml:"displayname"`
+	} `yaml:"matrix_profile_sync"`
 
 	SyncDirectChatList     bool `yaml:"sync_direct_chat_list"`
 	SyncManualMarkedUnread bool `yaml:"sync_manual_marked_unread"`
 	DefaultBridgePresence  bool `yaml:"default_bridge_presence"`
+	SendReadReceipts       bool `yaml:"send_read_receipts"`
 	SendPresenceOnTyping   bool `yaml:"send_presence_on_typing"`
 
+	TypingNotifications struct {
+		Send    bool `yaml:"send"`
+		Receive bool `yaml:"receive"`
+	} `yaml:"typing_notifications"`
+
+	Presence struct {
+		Receive          bool `yaml:"receive"`
+		OfflineAfterSend bool `yaml:"offline_after_send"`
+	} `yaml:"presence"`
+
 	ForceActiveDeliveryReceipts bool `yaml:"force_active_delivery_receipts"`
 
 	DoublePuppetConfig bridgeconfig.DoublePuppetConfig `yaml:",inline"`
 
-	PrivateChatPortalMeta string `yaml:"private_chat_portal_meta"`
-	ParallelMemberSync    bool   `yaml:"parallel_member_sync"`
-	BridgeNotices         bool   `yaml:"bridge_notices"`
-	ResendBridgeInfo      bool   `yaml:"resend_bridge_info"`
-	MuteBridging          bool   `yaml:"mute_bridging"`
-	ArchiveTag            string `yaml:"archive_tag"`
-	PinnedTag             string `yaml:"pinned_tag"`
-	TagOnlyOnCreate       bool   `yaml:"tag_only_on_create"`
-	MarkReadOnlyOnCreate  bool   `yaml:"mark_read_only_on_create"`
-	EnableStatusBroadcast bool   `yaml:"enable_status_broadcast"`
-	MuteStatusBroadcast   bool   `yaml:"mute_status_broadcast"`
-	StatusBroadcastTag    string `yaml:"status_broadcast_tag"`
-	WhatsappThumbnail     bool   `yaml:"whatsapp_thumbnail"`
-	AllowUserInvite       bool   `yaml:"allow_user_invite"`
-	FederateRooms         bool   `yaml:"federate_rooms"`
-	URLPreviews           bool   `yaml:"url_previews"`
-	CaptionInMessage      bool   `yaml:"caption_in_message"`
-	BeeperGalleries       bool   `yaml:"beeper_galleries"`
-	ExtEvPolls            bool   `yaml:"extev_polls"`
-	CrossRoomReplies      bool   `yaml:"cross_room_replies"`
-	DisableReplyFallbacks bool   `yaml:"disable_reply_fallbacks"`
+	PrivateChatPortalMeta string      `yaml:"private_chat_portal_meta"`
+	NoteToSelfName        string      `yaml:"note_to_self_name"`
+	ParallelMemberSync    bool        `yaml:"parallel_member_sync"`
+	LazyMemberThreshold   int         `yaml:"lazy_member_threshold"`
+	MaxGhostsPerPortal    int         `yaml:"max_ghosts_per_portal"`
+	BridgeNotices         NoticeMode  `yaml:"bridge_notices"`
+	NoticePrefix          string      `yaml:"notice_prefix"`
+	ResendBridgeInfo      bool        `yaml:"resend_bridge_info"`
+	MuteBridging          bool        `yaml:"mute_bridging"`
+	ArchiveTag            string      `yaml:"archive_tag"`
+	PinnedTag             string      `yaml:"pinned_tag"`
+	TagOnlyOnCreate       bool        `yaml:"tag_only_on_create"`
+	MarkReadOnlyOnCreate  bool        `yaml:"mark_read_only_on_create"`
+	EnableStatusBroadcast bool        `yaml:"enable_status_broadcast"`
+	MuteStatusBroadcast   bool        `yaml:"mute_status_broadcast"`
+	StatusBroadcastTag    string      `yaml:"status_broadcast_tag"`
+	BroadcastListPortals  bool        `yaml:"broadcast_list_portals"`
+	WhatsappThumbnail     bool        `yaml:"whatsapp_thumbnail"`
+	DocumentThumbnails    bool        `yaml:"document_thumbnails"`
+	AllowUserInvite       bool        `yaml:"allow_user_invite"`
+	FederateRooms         bool        `yaml:"federate_rooms"`
+	URLPreviews           bool        `yaml:"url_previews"`
+	CaptionMode           CaptionMode `yaml:"caption_mode"`
+	BeeperGalleries       bool        `yaml:"beeper_galleries"`
+	ExtEvPolls            bool        `yaml:"extev_polls"`
+	AnonymousPollVotes    bool        `yaml:"anonymous_poll_votes"`
+	CrossRoomReplies      bool        `yaml:"cross_room_replies"`
+	DisableReplyFallbacks bool        `yaml:"disable_reply_fallbacks"`
+
+	ContactsArrayMode  ContactsArrayMode     `yaml:"contacts_array_mode"`
+	AboutChangeNotices AboutChangeNoticeMode `yaml:"about_change_notices"`
+
+	OutgoingVoiceMode VoiceMessageMode `yaml:"outgoing_voice_mode"`
+
+	VideoTranscode struct {
+		Enabled       bool     `yaml:"enabled"`
+		MaxSize       int      `yaml:"max_size"`
+		AllowedCodecs []string `yaml:"allowed_codecs"`
+	} `yaml:"video_transcode"`
+
+	OutgoingVideoTranscode struct {
+		Enabled       bool     `yaml:"enabled"`
+		AllowedCodecs []string `yaml:"allowed_codecs"`
+		MaxResolution int      `yaml:"max_resolution"`
+		Bitrate       int      `yaml:"bitrate"`
+		MinBitrate    int      `yaml:"min_bitrate"`
+		AudioBitrate  int      `yaml:"audio_bitrate"`
+	} `yaml:"outgoing_video_transcode"`
+
+	VoiceLoudnorm struct {
+		Outgoing bool `yaml:"outgoing"`
+		Incoming bool `yaml:"incoming"`
+		Target   int  `yaml:"target"`
+	} `yaml:"voice_loudnorm"`
+
+	MediaSizeLimits struct {
+		Image    int `yaml:"image"`
+		Video    int `yaml:"video"`
+		Audio    int `yaml:"audio"`
+		Document int `yaml:"document"`
+
+		DownscaleImages   bool `yaml:"downscale_images"`
+		MinImageQuality   int  `yaml:"min_image_quality"`
+		MinImageDimension int  `yaml:"min_image_dimension"`
+	} `yaml:"media_size_limits"`
 
 	MessageHandlingTimeout struct {
 		ErrorAfterStr string `yaml:"error_after"`
@@ -130,6 +301,35 @@ type BridgeConfig struct {
 	DisableBridgeAlerts   bool `yaml:"disable_bridge_alerts"`
 	CrashOnStreamReplaced bool `yaml:"crash_on_stream_replaced"`
 
+	Reconnect struct {
+		InitialDelay        int     `yaml:"initial_delay"`
+		MaxDelay            int     `yaml:"max_delay"`
+		Jitter              float64 `yaml:"jitter"`
+		HealthCheckInterval int     `yaml:"health_check_interval"`
+		KeepaliveTimeout    int     `yaml:"keepalive_timeout"`
+		IdleTimeout         int     `yaml:"idle_timeout"`
+	} `yaml:"reconnect"`
+
+	PhoneOffline struct {
+		WarningAfter    int  `yaml:"warning_after"`
+		PingAfter       int  `yaml:"ping_after"`
+		WarningInterval int  `yaml:"warning_interval"`
+		SendWarnings    bool `yaml:"send_warnings"`
+	} `yaml:"phone_offline"`
+
+	IgnoredJIDs []string `yaml:"ignored_jids"`
+
+	OfflineQueue struct {
+		Enabled     bool `yaml:"enabled"`
+		MaxMessages int  `yaml:"max_messages"`
+		Expiry      int  `yaml:"expiry"`
+	} `yaml:"offline_queue"`
+
+	ConnectionAlerts struct {
+		Cooldown           int `yaml:"cooldown"`
+		TransientThreshold int `yaml:"transient_threshold"`
+	} `yaml:"connection_alerts"`
+
 	CommandPrefix string `yaml:"command_prefix"`
 
 	ManagementRoomText bridgeconfig.ManagementRoomTexts `yaml:"management_room_text"`
@@ -146,8 +346,11 @@ type BridgeConfig struct {
 
 	Relay RelaybotConfig `yaml:"relay"`
 
+	Location LocationConfig `yaml:"location"`
+
 	ParsedUsernameTemplate *template.Template `yaml:"-"`
 	displaynameTemplate    *template.Template `yaml:"-"`
+	noticeTemplates        *template.Template `yaml:"-"`
 }
 
 func (bc BridgeConfig) GetDoublePuppetConfig() bridgeconfig.DoublePuppetConfig {
@@ -216,6 +419,70 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	bc.noticeTemplates = template.New("notices")
+	for name, format := range bc.NoticeTemplates {
+		_, err = bc.noticeTemplates.New(name).Parse(format)
+		if err != nil {
+			return fmt.Errorf("failed to parse notice template %s: %w", name, err)
+		}
+	}
+
+	switch bc.BridgeNotices {
+	case NoticeModeBridge, NoticeModePrefix, NoticeModeDrop:
+	case "":
+		bc.BridgeNotices = NoticeModeBridge
+	default:
+		return fmt.Errorf("invalid m.notice bridging mode %q", bc.BridgeNotices)
+	}
+
+	switch bc.ContactsArrayMode {
+	case ContactsArrayModeSplit, ContactsArrayModeCombined:
+	case "":
+		bc.ContactsArrayMode = ContactsArrayModeSplit
+	default:
+		return fmt.Errorf("invalid contacts array mode %q", bc.ContactsArrayMode)
+	}
+
+	switch bc.AboutChangeNotices {
+	case AboutChangeNoticeOff, AboutChangeNoticePortal, AboutChangeNoticeManagementRoom:
+	case "":
+		bc.AboutChangeNotices = AboutChangeNoticeOff
+	default:
+		return fmt.Errorf("invalid about change notice mode %q", bc.AboutChangeNotices)
+	}
+
+	switch bc.OutgoingVoiceMode {
+	case VoiceMessageModeMSC3245, VoiceMessageModeAlways, VoiceMessageModeNever:
+	case "":
+		bc.OutgoingVoiceMode = VoiceMessageModeMSC3245
+	default:
+		return fmt.Errorf("invalid outgoing voice message mode %q", bc.OutgoingVoiceMode)
+	}
+
+	// whatsmeow's automatic reconnection is disabled in favor of the configurable backoff, which means dead
+	// connections (e.g. keepalives failing) are only recovered by the health check.
+	if bc.Reconnect.HealthCheckInterval <= 0 {
+		return fmt.Errorf("invalid reconnect health check interval %d: must be positive", bc.Reconnect.HealthCheckInterval)
+	} else if bc.Reconnect.KeepaliveTimeout <= 0 {
+		return fmt.Errorf("invalid reconnect keepalive timeout %d: must be positive", bc.Reconnect.KeepaliveTimeout)
+	}
+
+	// Keep in sync with the translations in i18n.go
+	bc.Language = strings.ToLower(bc.Language)
+	switch bc.Language {
+	case "", "en", "de", "es":
+	default:
+		return fmt.Errorf("invalid language %q", bc.Language)
+	}
+
+	switch bc.CaptionMode {
+	case CaptionModeSplit, CaptionModeMerged:
+	case "":
+		bc.CaptionMode = CaptionModeSplit
+	default:
+		return fmt.Errorf("invalid caption mode %q", bc.CaptionMode)
+	}
+
 	if bc.MessageHandlingTimeout.ErrorAfterStr != "" {
 		bc.MessageHandlingTimeout.ErrorAfter, err = time.ParseDuration(bc.MessageHandlingTimeout.ErrorAfterStr)
 		if err != nil {
@@ -232,6 +499,19 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// FormatNotice renders the notice template with the given name, or returns the default text if there's no template.
+func (bc BridgeConfig) FormatNotice(name, defaultText string, data map[string]any) string {
+	if bc.noticeTemplates == nil || bc.noticeTemplates.Lookup(name) == nil {
+		return defaultText
+	}
+	var buf strings.Builder
+	err := bc.noticeTemplates.ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		return defaultText
+	}
+	return buf.String()
+}
+
 type UsernameTemplateArgs struct {
 	UserID id.UserID
 }
@@ -282,9 +562,23 @@ func (bc BridgeConfig) FormatUsername(username string) string {
 	return buf.String()
 }
 
+type RelaySenderStyle string
+
+const (
+	// RelaySenderStyleTemplate formats relayed messages using the message_formats templates.
+	RelaySenderStyleTemplate RelaySenderStyle = ""
+	// RelaySenderStyleBold prefixes messages with the sender name in bold, followed by a colon.
+	RelaySenderStyleBold RelaySenderStyle = "bold"
+	// RelaySenderStyleBrackets prefixes messages with the sender name in square brackets.
+	RelaySenderStyleBrackets RelaySenderStyle = "brackets"
+	// RelaySenderStyleNewline puts the sender name in bold on a separate line above the message.
+	RelaySenderStyleNewline RelaySenderStyle = "newline"
+)
+
 type RelaybotConfig struct {
 	Enabled          bool                         `yaml:"enabled"`
 	AdminOnly        bool                         `yaml:"admin_only"`
+	SenderStyle      RelaySenderStyle             `yaml:"sender_style"`
 	MessageFormats   map[event.MessageType]string `yaml:"message_formats"`
 	messageTemplates *template.Template           `yaml:"-"`
 }
@@ -297,6 +591,12 @@ func (rc *RelaybotConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 		return err
 	}
 
+	switch rc.SenderStyle {
+	case RelaySenderStyleTemplate, RelaySenderStyleBold, RelaySenderStyleBrackets, RelaySenderStyleNewline:
+	default:
+		return fmt.Errorf("invalid relay sender style %q", rc.SenderStyle)
+	}
+
 	rc.messageTemplates = template.New("messageTemplates")
 	for key, format := range rc.MessageFormats {
 		_, err := rc.messageTemplates.New(string(key)).Parse(format)
@@ -308,6 +608,66 @@ func (rc *RelaybotConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	return nil
 }
 
+type LocationConfig struct {
+	StaticMapURL    string `yaml:"static_map_url"`
+	PreferStaticMap bool   `yaml:"prefer_static_map"`
+
+	ReverseGeocoding struct {
+		URL         string `yaml:"url"`
+		AddressPath string `yaml:"address_path"`
+		CacheSize   int    `yaml:"cache_size"`
+	} `yaml:"reverse_geocoding"`
+
+	staticMapURL      *template.Template `yaml:"-"`
+	reverseGeocodeURL *template.Template `yaml:"-"`
+}
+
+type umLocationConfig LocationConfig
+
+func (lc *LocationConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	err := unmarshal((*umLocationConfig)(lc))
+	if err != nil {
+		return err
+	}
+	if lc.StaticMapURL != "" {
+		lc.staticMapURL, err = template.New("static_map_url").Parse(lc.StaticMapURL)
+		if err != nil {
+			return fmt.Errorf("failed to parse static map URL template: %w", err)
+		}
+	}
+	if lc.ReverseGeocoding.URL != "" {
+		lc.reverseGeocodeURL, err = template.New("reverse_geocoding_url").Parse(lc.ReverseGeocoding.URL)
+		if err != nil {
+			return fmt.Errorf("failed to parse reverse geocoding URL template: %w", err)
+		}
+	}
+	return nil
+}
+
+func formatCoordinateURL(tpl *template.Template, lat, long float64) string {
+	if tpl == nil {
+		return ""
+	}
+	var buf strings.Builder
+	_ = tpl.Execute(&buf, map[string]string{
+		"Latitude":  fmt.Sprintf("%.5f", lat),
+		"Longitude": fmt.Sprintf("%.5f", long),
+	})
+	return buf.String()
+}
+
+// FormatStaticMapURL returns the URL of a static map image centered on the given coordinates,
+// or an empty string if no static map provider is configured.
+func (lc LocationConfig) FormatStaticMapURL(lat, long float64) string {
+	return formatCoordinateURL(lc.staticMapURL, lat, long)
+}
+
+// FormatReverseGeocodeURL returns the reverse geocoding API URL for the given coordinates,
+// or an empty string if reverse geocoding is disabled.
+func (lc LocationConfig) FormatReverseGeocodeURL(lat, long float64) string {
+	return formatCoordinateURL(lc.reverseGeocodeURL, lat, long)
+}
+
 type Sender struct {
 	UserID string
 	event.MemberEventContent
@@ -324,8 +684,16 @@ func (rc *RelaybotConfig) FormatMessage(content *event.MessageEventContent, send
 		member.Displayname = sender.String()
 	}
 	member.Displayname = template.HTMLEscapeString(member.Displayname)
+	if formatted, ok := rc.formatWithSenderStyle(content, member.Displayname); ok {
+		return formatted, nil
+	}
+	templateName := string(content.MsgType)
+	if hasMediaCaption(content) && rc.messageTemplates.Lookup(string(event.MsgText)) != nil {
+		// The media templates don't include the message, so use the text template to keep the caption
+		templateName = string(event.MsgText)
+	}
 	var output strings.Builder
-	err := rc.messageTemplates.ExecuteTemplate(&output, string(content.MsgType), formatData{
+	err := rc.messageTemplates.ExecuteTemplate(&output, templateName, formatData{
 		Sender: Sender{
 			UserID:             template.HTMLEscapeString(sender.String()),
 			MemberEventContent: member,
@@ -335,3 +703,37 @@ func (rc *RelaybotConfig) FormatMessage(content *event.MessageEventContent, send
 	})
 	return output.String(), err
 }
+
+func hasMediaCaption(content *event.MessageEventContent) bool {
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		return content.FileName != "" && content.FileName != content.Body
+	default:
+		return false
+	}
+}
+
+// formatWithSenderStyle formats text messages and media captions using the configured sender style.
+// It returns false if the style is not set, or if the message has no text to attach the name to
+// (e.g. emotes and media without captions), in which case the message templates should be used.
+func (rc *RelaybotConfig) formatWithSenderStyle(content *event.MessageEventContent, displayname string) (string, bool) {
+	switch content.MsgType {
+	case event.MsgText, event.MsgNotice:
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		if !hasMediaCaption(content) {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	switch rc.SenderStyle {
+	case RelaySenderStyleBold:
+		return fmt.Sprintf("<b>%s</b>: %s", displayname, content.FormattedBody), true
+	case RelaySenderStyleBrackets:
+		return fmt.Sprintf("[%s] %s", displayname, content.FormattedBody), true
+	case RelaySenderStyleNewline:
+		return fmt.Sprintf("<b>%s</b><br>%s", displayname, content.FormattedBody), true
+	default:
+		return "", false
+	}
+}
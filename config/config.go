@@ -28,6 +28,8 @@ type Config struct {
 		Host   string `yaml:"host"`
 		Token  string `yaml:"token"`
 		UserID string `yaml:"user_id"`
+
+		MessageEvents bool `yaml:"message_events"`
 	}
 
 	Metrics struct {
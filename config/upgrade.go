@@ -30,6 +30,7 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Str|up.Null, "analytics", "host")
 	helper.Copy(up.Str|up.Null, "analytics", "token")
 	helper.Copy(up.Str|up.Null, "analytics", "user_id")
+	helper.Copy(up.Bool, "analytics", "message_events")
 
 	helper.Copy(up.Bool, "metrics", "enabled")
 	helper.Copy(up.Str, "metrics", "listen")
@@ -45,7 +46,32 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "message_error_notices")
 	helper.Copy(up.Int, "bridge", "portal_message_buffer")
 	helper.Copy(up.Bool, "bridge", "call_start_notices")
+	helper.Copy(up.Map, "bridge", "notice_templates")
+	helper.Copy(up.Bool, "bridge", "self_chat_commands", "enabled")
+	helper.Copy(up.Str, "bridge", "self_chat_commands", "prefix")
+	helper.Copy(up.Str, "bridge", "language")
 	helper.Copy(up.Bool, "bridge", "identity_change_notices")
+	helper.Copy(up.Str, "bridge", "about_change_notices")
+	helper.Copy(up.Str, "bridge", "outgoing_voice_mode")
+	helper.Copy(up.Bool, "bridge", "avatar_change_notices")
+	helper.Copy(up.Bool, "bridge", "disappearing_retention")
+	helper.Copy(up.Bool, "bridge", "disappearing_topic")
+	helper.Copy(up.Bool, "bridge", "redact_revoked_messages")
+	helper.Copy(up.Bool, "bridge", "delete_redacted_media")
+	helper.Copy(up.Bool, "bridge", "unknown_message_dump")
+	helper.Copy(up.Int, "bridge", "undecryptable_rerequest", "window")
+	helper.Copy(up.Int, "bridge", "undecryptable_rerequest", "max_messages")
+	helper.Copy(up.Map, "bridge", "reaction_mapping", "to_whatsapp")
+	helper.Copy(up.Map, "bridge", "reaction_mapping", "to_matrix")
+	helper.Copy(up.Str, "bridge", "reaction_mapping", "fallback")
+	helper.Copy(up.List, "bridge", "webhooks", "targets")
+	helper.Copy(up.Int, "bridge", "webhooks", "max_retries")
+	helper.Copy(up.Bool, "bridge", "contact_portals", "create")
+	helper.Copy(up.Int, "bridge", "contact_portals", "delay")
+	helper.Copy(up.Int, "bridge", "message_pruning", "max_age_days")
+	helper.Copy(up.Bool, "bridge", "message_pruning", "only_disappearing")
+	helper.Copy(up.Int, "bridge", "message_pruning", "batch_size")
+	helper.Copy(up.Int, "bridge", "message_pruning", "batch_delay")
 	helper.Copy(up.Bool, "bridge", "history_sync", "backfill")
 	helper.Copy(up.Bool, "bridge", "history_sync", "request_full_sync")
 	helper.Copy(up.Int|up.Null, "bridge", "history_sync", "full_sync_config", "days_limit")
@@ -58,14 +84,27 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Int, "bridge", "history_sync", "max_initial_conversations")
 	helper.Copy(up.Int, "bridge", "history_sync", "message_count")
 	helper.Copy(up.Int, "bridge", "history_sync", "unread_hours_threshold")
+	helper.Copy(up.Bool, "bridge", "history_sync", "silent")
+	helper.Copy(up.Bool, "bridge", "history_sync", "membership_history")
+	helper.Copy(up.Bool, "bridge", "history_sync", "recent_stickers")
+	helper.Copy(up.Int, "bridge", "history_sync", "portal_create_delay")
+	helper.Copy(up.Int, "bridge", "history_sync", "portal_create_progress_interval")
 	helper.Copy(up.Int, "bridge", "history_sync", "immediate", "worker_count")
 	helper.Copy(up.Int, "bridge", "history_sync", "immediate", "max_events")
 	helper.Copy(up.List, "bridge", "history_sync", "deferred")
 	helper.Copy(up.Bool, "bridge", "user_avatar_sync")
 	helper.Copy(up.Bool, "bridge", "bridge_matrix_leave")
+	helper.Copy(up.Bool, "bridge", "bridge_matrix_leave_confirm")
+	helper.Copy(up.Bool, "bridge", "matrix_profile_sync", "avatar")
+	helper.Copy(up.Bool, "bridge", "matrix_profile_sync", "displayname")
 	helper.Copy(up.Bool, "bridge", "sync_direct_chat_list")
 	helper.Copy(up.Bool, "bridge", "default_bridge_presence")
+	helper.Copy(up.Bool, "bridge", "send_read_receipts")
 	helper.Copy(up.Bool, "bridge", "send_presence_on_typing")
+	helper.Copy(up.Bool, "bridge", "typing_notifications", "send")
+	helper.Copy(up.Bool, "bridge", "typing_notifications", "receive")
+	helper.Copy(up.Bool, "bridge", "presence", "receive")
+	helper.Copy(up.Bool, "bridge", "presence", "offline_after_send")
 	helper.Copy(up.Bool, "bridge", "force_active_delivery_receipts")
 	helper.Copy(up.Map, "bridge", "double_puppet_server_map")
 	helper.Copy(up.Bool, "bridge", "double_puppet_allow_discovery")
@@ -85,8 +124,22 @@ func DoUpgrade(helper *up.Helper) {
 	} else {
 		helper.Copy(up.Str, "bridge", "private_chat_portal_meta")
 	}
+	helper.Copy(up.Str|up.Null, "bridge", "note_to_self_name")
 	helper.Copy(up.Bool, "bridge", "parallel_member_sync")
-	helper.Copy(up.Bool, "bridge", "bridge_notices")
+	helper.Copy(up.Int, "bridge", "lazy_member_threshold")
+	helper.Copy(up.Int, "bridge", "max_ghosts_per_portal")
+	if legacyBridgeNotices, ok := helper.Get(up.Bool, "bridge", "bridge_notices"); ok {
+		noticeMode := "bridge"
+		if legacyBridgeNotices == "false" {
+			noticeMode = "drop"
+		}
+		helper.Set(up.Str, noticeMode, "bridge", "bridge_notices")
+	} else {
+		helper.Copy(up.Str, "bridge", "bridge_notices")
+	}
+	helper.Copy(up.Str, "bridge", "notice_prefix")
+	helper.Copy(up.Int, "bridge", "notice_loop_protection", "max_notices")
+	helper.Copy(up.Int, "bridge", "notice_loop_protection", "window")
 	helper.Copy(up.Bool, "bridge", "resend_bridge_info")
 	helper.Copy(up.Bool, "bridge", "mute_bridging")
 	helper.Copy(up.Str|up.Null, "bridge", "archive_tag")
@@ -96,14 +149,41 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "disable_status_broadcast_send")
 	helper.Copy(up.Bool, "bridge", "mute_status_broadcast")
 	helper.Copy(up.Str|up.Null, "bridge", "status_broadcast_tag")
+	helper.Copy(up.Bool, "bridge", "broadcast_list_portals")
+	helper.Copy(up.List, "bridge", "ignored_jids")
 	helper.Copy(up.Bool, "bridge", "whatsapp_thumbnail")
+	helper.Copy(up.Bool, "bridge", "document_thumbnails")
 	helper.Copy(up.Bool, "bridge", "allow_user_invite")
 	helper.Copy(up.Str, "bridge", "command_prefix")
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
 	helper.Copy(up.Bool, "bridge", "disable_bridge_alerts")
 	helper.Copy(up.Bool, "bridge", "crash_on_stream_replaced")
+	helper.Copy(up.Int, "bridge", "reconnect", "initial_delay")
+	helper.Copy(up.Int, "bridge", "reconnect", "max_delay")
+	helper.Copy(up.Float, "bridge", "reconnect", "jitter")
+	helper.Copy(up.Int, "bridge", "reconnect", "health_check_interval")
+	helper.Copy(up.Int, "bridge", "reconnect", "keepalive_timeout")
+	helper.Copy(up.Int, "bridge", "reconnect", "idle_timeout")
+	helper.Copy(up.Int, "bridge", "phone_offline", "warning_after")
+	helper.Copy(up.Int, "bridge", "phone_offline", "ping_after")
+	helper.Copy(up.Int, "bridge", "phone_offline", "warning_interval")
+	helper.Copy(up.Bool, "bridge", "phone_offline", "send_warnings")
+	helper.Copy(up.Bool, "bridge", "offline_queue", "enabled")
+	helper.Copy(up.Int, "bridge", "offline_queue", "max_messages")
+	helper.Copy(up.Int, "bridge", "offline_queue", "expiry")
+	helper.Copy(up.Int, "bridge", "connection_alerts", "cooldown")
+	helper.Copy(up.Int, "bridge", "connection_alerts", "transient_threshold")
 	helper.Copy(up.Bool, "bridge", "url_previews")
-	helper.Copy(up.Bool, "bridge", "caption_in_message")
+	if legacyCaptionInMessage, ok := helper.Get(up.Bool, "bridge", "caption_in_message"); ok {
+		captionMode := "split"
+		if legacyCaptionInMessage == "true" {
+			captionMode = "merged"
+		}
+		helper.Set(up.Str, captionMode, "bridge", "caption_mode")
+	} else {
+		helper.Copy(up.Str, "bridge", "caption_mode")
+	}
+	helper.Copy(up.Str, "bridge", "contacts_array_mode")
 	helper.Copy(up.Bool, "bridge", "beeper_galleries")
 	if intPolls, ok := helper.Get(up.Int, "bridge", "extev_polls"); ok {
 		val := "false"
@@ -114,8 +194,28 @@ func DoUpgrade(helper *up.Helper) {
 	} else {
 		helper.Copy(up.Bool, "bridge", "extev_polls")
 	}
+	helper.Copy(up.Bool, "bridge", "anonymous_poll_votes")
 	helper.Copy(up.Bool, "bridge", "cross_room_replies")
 	helper.Copy(up.Bool, "bridge", "disable_reply_fallbacks")
+	helper.Copy(up.Bool, "bridge", "video_transcode", "enabled")
+	helper.Copy(up.Int, "bridge", "video_transcode", "max_size")
+	helper.Copy(up.List, "bridge", "video_transcode", "allowed_codecs")
+	helper.Copy(up.Bool, "bridge", "outgoing_video_transcode", "enabled")
+	helper.Copy(up.List, "bridge", "outgoing_video_transcode", "allowed_codecs")
+	helper.Copy(up.Int, "bridge", "outgoing_video_transcode", "max_resolution")
+	helper.Copy(up.Int, "bridge", "outgoing_video_transcode", "bitrate")
+	helper.Copy(up.Int, "bridge", "outgoing_video_transcode", "min_bitrate")
+	helper.Copy(up.Int, "bridge", "outgoing_video_transcode", "audio_bitrate")
+	helper.Copy(up.Bool, "bridge", "voice_loudnorm", "outgoing")
+	helper.Copy(up.Bool, "bridge", "voice_loudnorm", "incoming")
+	helper.Copy(up.Int, "bridge", "voice_loudnorm", "target")
+	helper.Copy(up.Int, "bridge", "media_size_limits", "image")
+	helper.Copy(up.Int, "bridge", "media_size_limits", "video")
+	helper.Copy(up.Int, "bridge", "media_size_limits", "audio")
+	helper.Copy(up.Int, "bridge", "media_size_limits", "document")
+	helper.Copy(up.Bool, "bridge", "media_size_limits", "downscale_images")
+	helper.Copy(up.Int, "bridge", "media_size_limits", "min_image_quality")
+	helper.Copy(up.Int, "bridge", "media_size_limits", "min_image_dimension")
 	helper.Copy(up.Str|up.Null, "bridge", "message_handling_timeout", "error_after")
 	helper.Copy(up.Str|up.Null, "bridge", "message_handling_timeout", "deadline")
 
@@ -173,7 +273,13 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Map, "bridge", "permissions")
 	helper.Copy(up.Bool, "bridge", "relay", "enabled")
 	helper.Copy(up.Bool, "bridge", "relay", "admin_only")
+	helper.Copy(up.Str, "bridge", "relay", "sender_style")
 	helper.Copy(up.Map, "bridge", "relay", "message_formats")
+	helper.Copy(up.Str, "bridge", "location", "static_map_url")
+	helper.Copy(up.Bool, "bridge", "location", "prefer_static_map")
+	helper.Copy(up.Str, "bridge", "location", "reverse_geocoding", "url")
+	helper.Copy(up.Str, "bridge", "location", "reverse_geocoding", "address_path")
+	helper.Copy(up.Int, "bridge", "location", "reverse_geocoding", "cache_size")
 }
 
 var SpacedBlocks = [][]string{
@@ -193,5 +299,6 @@ var SpacedBlocks = [][]string{
 	{"bridge", "provisioning"},
 	{"bridge", "permissions"},
 	{"bridge", "relay"},
+	{"bridge", "location"},
 	{"logging"},
 }
@@ -0,0 +1,177 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type ConnectionAlertClass string
+
+const (
+	ConnAlertStreamReplaced   ConnectionAlertClass = "stream-replaced"
+	ConnAlertStreamError      ConnectionAlertClass = "stream-error"
+	ConnAlertConnectFailure   ConnectionAlertClass = "connect-failure"
+	ConnAlertClientOutdated   ConnectionAlertClass = "client-outdated"
+	ConnAlertTemporaryBan     ConnectionAlertClass = "temporary-ban"
+	ConnAlertDisconnected     ConnectionAlertClass = "disconnected"
+	ConnAlertKeepaliveTimeout ConnectionAlertClass = "keepalive-timeout"
+)
+
+type connectionAlertInfo struct {
+	// Title is the first sentence of the alert. It's used as-is for the first alert in a cooldown period,
+	// and prefixed with the number of occurrences in summaries.
+	Title string
+	// Summary is the format string used for summaries, with the count and the cooldown length as arguments.
+	Summary string
+	// NextSteps tells the user what they can do about the problem.
+	NextSteps string
+	// Transient alerts are only sent as summaries, and only if they happen often enough.
+	Transient bool
+}
+
+var connectionAlertInfos = map[ConnectionAlertClass]connectionAlertInfo{
+	ConnAlertStreamReplaced: {
+		Title:     "The bridge was started in another location.",
+		Summary:   "The bridge was started in another location %d more times in the last %s.",
+		NextSteps: "Use `reconnect` to reconnect this one. If this keeps happening, make sure the same session isn't used by two bridge instances.",
+	},
+	ConnAlertStreamError: {
+		Title:     "WhatsApp closed the connection with an unknown stream error.",
+		Summary:   "WhatsApp closed the connection with a stream error %d more times in the last %s.",
+		NextSteps: "Use `reconnect` to try again. If the error persists, ask the bridge administrator to check the logs.",
+	},
+	ConnAlertConnectFailure: {
+		Title:     "Connecting to WhatsApp failed.",
+		Summary:   "Connecting to WhatsApp failed %d more times in the last %s.",
+		NextSteps: "Use `reconnect` to try again. If the error persists, you may need to `logout` and log in again.",
+	},
+	ConnAlertClientOutdated: {
+		Title:     "WhatsApp rejected the connection because the bridge is outdated.",
+		Summary:   "WhatsApp rejected the connection because the bridge is outdated %d more times in the last %s.",
+		NextSteps: "Ask the bridge administrator to update the bridge. Reconnecting won't help until then.",
+	},
+	ConnAlertTemporaryBan: {
+		Title:     "Your WhatsApp account has been temporarily banned.",
+		Summary:   "WhatsApp reported a temporary ban %d more times in the last %s.",
+		NextSteps: "Wait until the ban expires before reconnecting, and avoid sending messages that may be considered spam.",
+	},
+	ConnAlertDisconnected: {
+		Summary:   "The connection to WhatsApp was interrupted %d times in the last %s.",
+		NextSteps: "The bridge reconnects automatically, but frequent disconnects usually mean the network connection of the bridge server is unstable.",
+		Transient: true,
+	},
+	ConnAlertKeepaliveTimeout: {
+		Summary:   "WhatsApp didn't respond to keepalive pings %d times in the last %s.",
+		NextSteps: "This means the bridge server's connection to WhatsApp's servers is unreliable, not that your phone is offline. The bridge reconnects automatically, use `reconnect` if messages aren't coming through.",
+		Transient: true,
+	},
+}
+
+type connectionAlertState struct {
+	count      int
+	lastDetail string
+	timer      *time.Timer
+}
+
+// connectionAlerts collects connection warnings for a user, so that repeated
+// events are sent as one summary per cooldown period instead of one alert each.
+type connectionAlerts struct {
+	lock   sync.Mutex
+	states map[ConnectionAlertClass]*connectionAlertState
+}
+
+// sendConnectionAlert reports a connection problem in the management room. The first alert of a class
+// is sent immediately (unless the class is transient), and any further ones are counted and summarized
+// once the cooldown ends.
+func (user *User) sendConnectionAlert(ctx context.Context, class ConnectionAlertClass, detail string) {
+	info := connectionAlertInfos[class]
+	cfg := user.bridge.Config.Bridge.ConnectionAlerts
+	if cfg.Cooldown <= 0 {
+		if !info.Transient {
+			user.sendConnectionAlertNow(ctx, user.T(info.Title), detail, user.T(info.NextSteps))
+		}
+		return
+	} else if info.Transient && cfg.TransientThreshold <= 0 {
+		return
+	}
+
+	user.connAlerts.lock.Lock()
+	defer user.connAlerts.lock.Unlock()
+	if user.connAlerts.states == nil {
+		user.connAlerts.states = make(map[ConnectionAlertClass]*connectionAlertState)
+	}
+	state, ok := user.connAlerts.states[class]
+	if !ok {
+		state = &connectionAlertState{}
+		user.connAlerts.states[class] = state
+	}
+	if detail != "" {
+		state.lastDetail = detail
+	}
+	if state.timer != nil {
+		state.count++
+		return
+	}
+	cooldown := time.Duration(cfg.Cooldown) * time.Second
+	state.timer = time.AfterFunc(cooldown, func() {
+		user.flushConnectionAlert(class, cooldown)
+	})
+	if info.Transient {
+		state.count = 1
+	} else {
+		state.count = 0
+		go user.sendConnectionAlertNow(ctx, user.T(info.Title), detail, user.T(info.NextSteps))
+	}
+}
+
+func (user *User) flushConnectionAlert(class ConnectionAlertClass, cooldown time.Duration) {
+	user.connAlerts.lock.Lock()
+	state := user.connAlerts.states[class]
+	count, detail := state.count, state.lastDetail
+	state.count = 0
+	state.lastDetail = ""
+	state.timer = nil
+	user.connAlerts.lock.Unlock()
+
+	info := connectionAlertInfos[class]
+	if count == 0 || (info.Transient && count < user.bridge.Config.Bridge.ConnectionAlerts.TransientThreshold) {
+		return
+	}
+	ctx := user.zlog.With().Str("action", "send connection alert summary").Logger().WithContext(context.Background())
+	title := user.T(info.Summary, count, user.formatAlertCooldown(cooldown))
+	user.sendConnectionAlertNow(ctx, title, detail, user.T(info.NextSteps))
+}
+
+func (user *User) sendConnectionAlertNow(ctx context.Context, title, detail, nextSteps string) {
+	if detail != "" {
+		user.sendMarkdownBridgeAlert(ctx, "%s (%s)\n\n%s", title, detail, nextSteps)
+	} else {
+		user.sendMarkdownBridgeAlert(ctx, "%s\n\n%s", title, nextSteps)
+	}
+}
+
+func (user *User) formatAlertCooldown(dur time.Duration) string {
+	if dur < 2*time.Minute {
+		return user.T("%d seconds", int(dur.Seconds()))
+	} else if dur < 2*time.Hour {
+		return user.T("%d minutes", int(dur.Minutes()))
+	}
+	return user.T("%d hours", int(dur.Hours()))
+}
@@ -0,0 +1,73 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/util/dbutil"
+)
+
+type ContactAboutQuery struct {
+	*dbutil.QueryHelper[*ContactAbout]
+}
+
+func newContactAbout(qh *dbutil.QueryHelper[*ContactAbout]) *ContactAbout {
+	return &ContactAbout{
+		qh: qh,
+	}
+}
+
+const (
+	getContactAboutQuery    = `SELECT user_mxid, jid, about FROM contact_about WHERE user_mxid=$1 AND jid=$2`
+	upsertContactAboutQuery = `
+		INSERT INTO contact_about (user_mxid, jid, about) VALUES ($1, $2, $3)
+		ON CONFLICT (user_mxid, jid) DO UPDATE SET about=excluded.about
+	`
+)
+
+func (caq *ContactAboutQuery) New() *ContactAbout {
+	return &ContactAbout{qh: caq.QueryHelper}
+}
+
+// Get returns the last about text of the contact seen by the given user, or nil if it hasn't been fetched yet.
+func (caq *ContactAboutQuery) Get(ctx context.Context, userID id.UserID, jid types.JID) (*ContactAbout, error) {
+	return caq.QueryOne(ctx, getContactAboutQuery, userID, jid)
+}
+
+type ContactAbout struct {
+	qh *dbutil.QueryHelper[*ContactAbout]
+
+	UserMXID id.UserID
+	JID      types.JID
+	About    string
+}
+
+func (ca *ContactAbout) Scan(row dbutil.Scannable) (*ContactAbout, error) {
+	err := row.Scan(&ca.UserMXID, &ca.JID, &ca.About)
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+func (ca *ContactAbout) Upsert(ctx context.Context) error {
+	return ca.qh.Exec(ctx, upsertContactAboutQuery, ca.UserMXID, ca.JID, ca.About)
+}
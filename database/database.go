@@ -48,6 +48,13 @@ type Database struct {
 	BackfillState        *BackfillStateQuery
 	HistorySync          *HistorySyncQuery
 	MediaBackfillRequest *MediaBackfillRequestQuery
+	GroupInvite          *GroupInviteQuery
+	PollVote             *PollVoteQuery
+	RecentSticker        *RecentStickerQuery
+	ScheduledMessage     *ScheduledMessageQuery
+	QueuedMessage        *QueuedMessageQuery
+	IgnoredJID           *IgnoredJIDQuery
+	ContactAbout         *ContactAboutQuery
 }
 
 func New(db *dbutil.Database) *Database {
@@ -65,6 +72,13 @@ func New(db *dbutil.Database) *Database {
 		BackfillState:        &BackfillStateQuery{dbutil.MakeQueryHelper(db, newBackfillState)},
 		HistorySync:          &HistorySyncQuery{dbutil.MakeQueryHelper(db, newHistorySyncConversation)},
 		MediaBackfillRequest: &MediaBackfillRequestQuery{dbutil.MakeQueryHelper(db, newMediaBackfillRequest)},
+		GroupInvite:          &GroupInviteQuery{dbutil.MakeQueryHelper(db, newGroupInvite)},
+		PollVote:             &PollVoteQuery{dbutil.MakeQueryHelper(db, newPollVote)},
+		RecentSticker:        &RecentStickerQuery{dbutil.MakeQueryHelper(db, newRecentSticker)},
+		ScheduledMessage:     &ScheduledMessageQuery{dbutil.MakeQueryHelper(db, newScheduledMessage)},
+		QueuedMessage:        &QueuedMessageQuery{dbutil.MakeQueryHelper(db, newQueuedMessage)},
+		IgnoredJID:           &IgnoredJIDQuery{dbutil.MakeQueryHelper(db, newIgnoredJID)},
+		ContactAbout:         &ContactAboutQuery{dbutil.MakeQueryHelper(db, newContactAbout)},
 	}
 }
 
@@ -52,6 +52,7 @@ const (
 	getAllScheduledDisappearingMessagesQuery = `
 		SELECT room_id, event_id, expire_in, expire_at FROM disappearing_message WHERE expire_at IS NOT NULL AND expire_at <= $1
 	`
+	getDisappearingMessageQuery          = "SELECT room_id, event_id, expire_in, expire_at FROM disappearing_message WHERE room_id=$1 AND event_id=$2"
 	insertDisappearingMessageQuery       = `INSERT INTO disappearing_message (room_id, event_id, expire_in, expire_at) VALUES ($1, $2, $3, $4)`
 	updateDisappearingMessageExpiryQuery = "UPDATE disappearing_message SET expire_at=$1 WHERE room_id=$2 AND event_id=$3"
 	deleteDisappearingMessageQuery       = "DELETE FROM disappearing_message WHERE room_id=$1 AND event_id=$2"
@@ -61,6 +62,10 @@ func (dmq *DisappearingMessageQuery) GetUpcomingScheduled(ctx context.Context, d
 	return dmq.QueryMany(ctx, getAllScheduledDisappearingMessagesQuery, time.Now().Add(duration).UnixMilli())
 }
 
+func (dmq *DisappearingMessageQuery) GetByEventID(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*DisappearingMessage, error) {
+	return dmq.QueryOne(ctx, getDisappearingMessageQuery, roomID, eventID)
+}
+
 type DisappearingMessage struct {
 	qh *dbutil.QueryHelper[*DisappearingMessage]
 
@@ -93,8 +98,12 @@ func (msg *DisappearingMessage) Insert(ctx context.Context) error {
 }
 
 func (msg *DisappearingMessage) StartTimer(ctx context.Context) error {
-	msg.ExpireAt = time.Now().Add(msg.ExpireIn * time.Second)
-	return msg.qh.Exec(ctx, updateDisappearingMessageExpiryQuery, msg.ExpireAt.Unix(), msg.RoomID, msg.EventID)
+	return msg.SetExpireAt(ctx, time.Now().Add(msg.ExpireIn))
+}
+
+func (msg *DisappearingMessage) SetExpireAt(ctx context.Context, expireAt time.Time) error {
+	msg.ExpireAt = expireAt
+	return msg.qh.Exec(ctx, updateDisappearingMessageExpiryQuery, msg.ExpireAt.UnixMilli(), msg.RoomID, msg.EventID)
 }
 
 func (msg *DisappearingMessage) Delete(ctx context.Context) error {
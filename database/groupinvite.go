@@ -0,0 +1,101 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/util/dbutil"
+)
+
+type GroupInviteQuery struct {
+	*dbutil.QueryHelper[*GroupInvite]
+}
+
+func newGroupInvite(qh *dbutil.QueryHelper[*GroupInvite]) *GroupInvite {
+	return &GroupInvite{
+		qh: qh,
+	}
+}
+
+const (
+	getGroupInvitesQuery = `
+		SELECT user_mxid, group_jid, group_name, inviter, code, expiration FROM group_invite
+		WHERE user_mxid=$1
+		ORDER BY expiration
+	`
+	upsertGroupInviteQuery = `
+		INSERT INTO group_invite (user_mxid, group_jid, group_name, inviter, code, expiration)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_mxid, group_jid) DO UPDATE
+			SET group_name=excluded.group_name, inviter=excluded.inviter, code=excluded.code, expiration=excluded.expiration
+	`
+	deleteGroupInviteQuery         = "DELETE FROM group_invite WHERE user_mxid=$1 AND group_jid=$2"
+	deleteExpiredGroupInvitesQuery = "DELETE FROM group_invite WHERE expiration<=$1"
+)
+
+func (giq *GroupInviteQuery) New() *GroupInvite {
+	return &GroupInvite{qh: giq.QueryHelper}
+}
+
+// GetAll returns all stored invites of the given user, ordered by expiration time.
+// Expired invites are only removed by DeleteExpired, so it should be called first.
+func (giq *GroupInviteQuery) GetAll(ctx context.Context, userID id.UserID) ([]*GroupInvite, error) {
+	return giq.QueryMany(ctx, getGroupInvitesQuery, userID)
+}
+
+// DeleteExpired deletes the invites of all users that can no longer be accepted.
+func (giq *GroupInviteQuery) DeleteExpired(ctx context.Context) error {
+	return giq.Exec(ctx, deleteExpiredGroupInvitesQuery, time.Now().Unix())
+}
+
+type GroupInvite struct {
+	qh *dbutil.QueryHelper[*GroupInvite]
+
+	UserMXID   id.UserID
+	GroupJID   types.JID
+	GroupName  string
+	Inviter    types.JID
+	Code       string
+	Expiration time.Time
+}
+
+func (invite *GroupInvite) Scan(row dbutil.Scannable) (*GroupInvite, error) {
+	var expiration int64
+	err := row.Scan(&invite.UserMXID, &invite.GroupJID, &invite.GroupName, &invite.Inviter, &invite.Code, &expiration)
+	if err != nil {
+		return nil, err
+	}
+	invite.Expiration = time.Unix(expiration, 0)
+	return invite, nil
+}
+
+func (invite *GroupInvite) sqlVariables() []any {
+	return []any{invite.UserMXID, invite.GroupJID, invite.GroupName, invite.Inviter, invite.Code, invite.Expiration.Unix()}
+}
+
+func (invite *GroupInvite) Upsert(ctx context.Context) error {
+	return invite.qh.Exec(ctx, upsertGroupInviteQuery, invite.sqlVariables()...)
+}
+
+func (invite *GroupInvite) Delete(ctx context.Context) error {
+	return invite.qh.Exec(ctx, deleteGroupInviteQuery, invite.UserMXID, invite.GroupJID)
+}
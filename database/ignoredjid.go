@@ -0,0 +1,73 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/util/dbutil"
+)
+
+type IgnoredJIDQuery struct {
+	*dbutil.QueryHelper[*IgnoredJID]
+}
+
+func newIgnoredJID(qh *dbutil.QueryHelper[*IgnoredJID]) *IgnoredJID {
+	return &IgnoredJID{
+		qh: qh,
+	}
+}
+
+const (
+	getIgnoredJIDsQuery   = `SELECT user_mxid, jid FROM ignored_jid WHERE user_mxid=$1`
+	insertIgnoredJIDQuery = `INSERT INTO ignored_jid (user_mxid, jid) VALUES ($1, $2) ON CONFLICT (user_mxid, jid) DO NOTHING`
+	deleteIgnoredJIDQuery = `DELETE FROM ignored_jid WHERE user_mxid=$1 AND jid=$2`
+)
+
+func (ijq *IgnoredJIDQuery) New() *IgnoredJID {
+	return &IgnoredJID{qh: ijq.QueryHelper}
+}
+
+func (ijq *IgnoredJIDQuery) GetAllForUser(ctx context.Context, userID id.UserID) ([]*IgnoredJID, error) {
+	return ijq.QueryMany(ctx, getIgnoredJIDsQuery, userID)
+}
+
+type IgnoredJID struct {
+	qh *dbutil.QueryHelper[*IgnoredJID]
+
+	UserMXID id.UserID
+	JID      types.JID
+}
+
+func (ij *IgnoredJID) Scan(row dbutil.Scannable) (*IgnoredJID, error) {
+	err := row.Scan(&ij.UserMXID, &ij.JID)
+	if err != nil {
+		return nil, err
+	}
+	return ij, nil
+}
+
+func (ij *IgnoredJID) Insert(ctx context.Context) error {
+	return ij.qh.Exec(ctx, insertIgnoredJIDQuery, ij.UserMXID, ij.JID)
+}
+
+func (ij *IgnoredJID) Delete(ctx context.Context) error {
+	return ij.qh.Exec(ctx, deleteIgnoredJIDQuery, ij.UserMXID, ij.JID)
+}
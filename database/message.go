@@ -60,14 +60,37 @@ const (
 		SELECT chat_jid, chat_receiver, jid, mxid, sender, sender_mxid, timestamp, sent, type, error, broadcast_list_jid FROM message
 		WHERE chat_jid=$1 AND chat_receiver=$2 AND timestamp>$3 AND timestamp<=$4 AND sent=true AND error='' ORDER BY timestamp ASC
 	`
+	getUndecryptableMessagesSinceQuery = `
+		SELECT message.chat_jid, message.chat_receiver, message.jid, message.mxid, message.sender, message.sender_mxid,
+		       message.timestamp, message.sent, message.type, message.error, message.broadcast_list_jid
+		FROM message
+		INNER JOIN user_portal
+			ON user_portal.portal_jid=message.chat_jid AND user_portal.portal_receiver=message.chat_receiver
+		WHERE user_portal.user_mxid=$1 AND message.error='decryption_failed' AND NOT message.rerequested AND message.timestamp>$2
+		ORDER BY message.timestamp ASC LIMIT $3
+	`
 	insertMessageQuery = `
 		INSERT INTO message
 			(chat_jid, chat_receiver, jid, mxid, sender, sender_mxid, timestamp, sent, type, error, broadcast_list_jid)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 	`
-	markMessageSentQuery   = "UPDATE message SET sent=true, timestamp=$1 WHERE chat_jid=$2 AND chat_receiver=$3 AND jid=$4"
-	updateMessageMXIDQuery = "UPDATE message SET mxid=$1, type=$2, error=$3 WHERE chat_jid=$4 AND chat_receiver=$5 AND jid=$6"
-	deleteMessageQuery     = "DELETE FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3"
+	markMessageSentQuery      = "UPDATE message SET sent=true, timestamp=$1 WHERE chat_jid=$2 AND chat_receiver=$3 AND jid=$4"
+	markRerequestedQuery      = "UPDATE message SET rerequested=true WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3"
+	updateMessageMXIDQuery    = "UPDATE message SET mxid=$1, type=$2, error=$3 WHERE chat_jid=$4 AND chat_receiver=$5 AND jid=$6"
+	deleteMessageQuery        = "DELETE FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3"
+	deleteMessagesByMXIDQuery = `DELETE FROM message WHERE mxid=$1 OR mxid LIKE $2 ESCAPE '\'`
+	pruneMessagesQuery        = `
+		DELETE FROM message WHERE (chat_jid, chat_receiver, jid) IN (
+			SELECT chat_jid, chat_receiver, jid FROM message WHERE timestamp>0 AND timestamp<$1 LIMIT $2
+		)
+	`
+	pruneDisappearingMessagesQuery = `
+		DELETE FROM message WHERE (chat_jid, chat_receiver, jid) IN (
+			SELECT message.chat_jid, message.chat_receiver, message.jid FROM message
+			INNER JOIN portal ON message.chat_jid=portal.jid AND message.chat_receiver=portal.receiver
+			WHERE portal.expiration_time>0 AND message.timestamp>0 AND message.timestamp<$1 LIMIT $2
+		)
+	`
 )
 
 func (mq *MessageQuery) GetAll(ctx context.Context, chat PortalKey) ([]*Message, error) {
@@ -82,6 +105,13 @@ func (mq *MessageQuery) GetByMXID(ctx context.Context, mxid id.EventID) (*Messag
 	return mq.QueryOne(ctx, getMessageByMXIDQuery, mxid)
 }
 
+// DeleteAllByMXID deletes all rows of the given Matrix event, including the rows of the other parts of a gallery.
+func (mq *MessageQuery) DeleteAllByMXID(ctx context.Context, mxid id.EventID) error {
+	escaper := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	galleryPattern := "com.beeper.gallery::%:" + escaper.Replace(mxid.String())
+	return mq.Exec(ctx, deleteMessagesByMXIDQuery, mxid, galleryPattern)
+}
+
 func (mq *MessageQuery) GetLastInChat(ctx context.Context, chat PortalKey) (*Message, error) {
 	return mq.GetLastInChatBefore(ctx, chat, time.Now().Add(60*time.Second))
 }
@@ -99,10 +129,30 @@ func (mq *MessageQuery) GetFirstInChat(ctx context.Context, chat PortalKey) (*Me
 	return mq.QueryOne(ctx, getFirstMessageInChatQuery, chat.JID, chat.Receiver)
 }
 
+// GetUndecryptableSince returns messages that are still undecryptable in the portals the given user is in,
+// excluding messages that have already been requested from the phone.
+func (mq *MessageQuery) GetUndecryptableSince(ctx context.Context, userID id.UserID, since time.Time, limit int) ([]*Message, error) {
+	return mq.QueryMany(ctx, getUndecryptableMessagesSinceQuery, userID, since.Unix(), limit)
+}
+
 func (mq *MessageQuery) GetMessagesBetween(ctx context.Context, chat PortalKey, minTimestamp, maxTimestamp time.Time) ([]*Message, error) {
 	return mq.QueryMany(ctx, getMessagesBetweenQuery, chat.JID, chat.Receiver, minTimestamp.Unix(), maxTimestamp.Unix())
 }
 
+// Prune deletes up to limit messages older than the given time. Reactions to the messages are deleted by cascade.
+// If onlyDisappearing is true, only messages in portals with a disappearing timer are deleted.
+func (mq *MessageQuery) Prune(ctx context.Context, before time.Time, onlyDisappearing bool, limit int) (int64, error) {
+	query := pruneMessagesQuery
+	if onlyDisappearing {
+		query = pruneDisappearingMessagesQuery
+	}
+	res, err := mq.GetDB().Exec(ctx, query, before.Unix(), limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 type MessageErrorType string
 
 const (
@@ -187,6 +237,12 @@ func (msg *Message) MarkSent(ctx context.Context, ts time.Time) error {
 	return msg.qh.Exec(ctx, markMessageSentQuery, ts.Unix(), msg.Chat.JID, msg.Chat.Receiver, msg.JID)
 }
 
+// MarkRerequested marks the message as already requested from the phone,
+// so it won't be requested again after every reconnection.
+func (msg *Message) MarkRerequested(ctx context.Context) error {
+	return msg.qh.Exec(ctx, markRerequestedQuery, msg.Chat.JID, msg.Chat.Receiver, msg.JID)
+}
+
 func (msg *Message) UpdateMXID(ctx context.Context, mxid id.EventID, newType MessageType, newError MessageErrorType) error {
 	msg.MXID = mxid
 	msg.Type = newType
@@ -0,0 +1,108 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/util/dbutil"
+)
+
+type PollVoteQuery struct {
+	*dbutil.QueryHelper[*PollVote]
+}
+
+func newPollVote(qh *dbutil.QueryHelper[*PollVote]) *PollVote {
+	return &PollVote{
+		qh: qh,
+	}
+}
+
+const (
+	getPollVotesQuery   = "SELECT msg_mxid, voter_jid, options FROM poll_vote WHERE msg_mxid=$1"
+	upsertPollVoteQuery = `
+		INSERT INTO poll_vote (msg_mxid, voter_jid, options) VALUES ($1, $2, $3)
+		ON CONFLICT (msg_mxid, voter_jid) DO UPDATE SET options=excluded.options
+	`
+	deletePollVoteQuery  = "DELETE FROM poll_vote WHERE msg_mxid=$1 AND voter_jid=$2"
+	getPollTallyQuery    = "SELECT tally_mxid FROM poll_tally WHERE msg_mxid=$1"
+	upsertPollTallyQuery = `
+		INSERT INTO poll_tally (msg_mxid, tally_mxid) VALUES ($1, $2)
+		ON CONFLICT (msg_mxid) DO UPDATE SET tally_mxid=excluded.tally_mxid
+	`
+)
+
+func (pvq *PollVoteQuery) New() *PollVote {
+	return &PollVote{qh: pvq.QueryHelper}
+}
+
+// GetAllByPoll returns the latest vote of every user who has voted in the given poll.
+func (pvq *PollVoteQuery) GetAllByPoll(ctx context.Context, pollMXID id.EventID) ([]*PollVote, error) {
+	return pvq.QueryMany(ctx, getPollVotesQuery, pollMXID)
+}
+
+// GetTallyMXID returns the event ID of the anonymous tally notice of the given poll, if one has been sent.
+func (pvq *PollVoteQuery) GetTallyMXID(ctx context.Context, pollMXID id.EventID) (tallyMXID id.EventID, err error) {
+	err = pvq.GetDB().QueryRow(ctx, getPollTallyQuery, pollMXID).Scan(&tallyMXID)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (pvq *PollVoteQuery) SetTallyMXID(ctx context.Context, pollMXID, tallyMXID id.EventID) error {
+	return pvq.Exec(ctx, upsertPollTallyQuery, pollMXID, tallyMXID)
+}
+
+type PollVote struct {
+	qh *dbutil.QueryHelper[*PollVote]
+
+	PollMXID id.EventID
+	Voter    types.JID
+	Options  []string
+}
+
+func (vote *PollVote) Scan(row dbutil.Scannable) (*PollVote, error) {
+	var options string
+	err := row.Scan(&vote.PollMXID, &vote.Voter, &options)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(options), &vote.Options)
+	if err != nil {
+		return nil, err
+	}
+	return vote, nil
+}
+
+func (vote *PollVote) Upsert(ctx context.Context) error {
+	options, err := json.Marshal(vote.Options)
+	if err != nil {
+		return err
+	}
+	return vote.qh.Exec(ctx, upsertPollVoteQuery, vote.PollMXID, vote.Voter, string(options))
+}
+
+func (vote *PollVote) Delete(ctx context.Context) error {
+	return vote.qh.Exec(ctx, deletePollVoteQuery, vote.PollMXID, vote.Voter)
+}
@@ -64,8 +64,10 @@ func newPortal(qh *dbutil.QueryHelper[*Portal]) *Portal {
 const (
 	getAllPortalsQuery = `
 		SELECT jid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set,
-		       encrypted, last_sync, is_parent, parent_group, in_space,
-		       first_event_id, next_batch_id, relay_user_id, expiration_time
+		       encrypted, last_sync, is_parent, parent_group, in_space, is_default_sub_group,
+		       linked_announce_group, is_announce, is_locked, is_incognito, bridge_matrix_leave,
+		       typing_notifications, first_event_id, next_batch_id, relay_user_id, expiration_time, read_only,
+		       outgoing_voice_mode
 		FROM portal
 	`
 	getPortalByJIDQuery                   = getAllPortalsQuery + " WHERE jid=$1 AND receiver=$2"
@@ -78,19 +80,24 @@ const (
 		    LEFT JOIN user_portal ON portal.jid=user_portal.portal_jid AND portal.receiver=user_portal.portal_receiver
 		WHERE mxid<>'' AND receiver=$1 AND (user_portal.in_space=false OR user_portal.in_space IS NULL)
 	`
+	getUsersWithPortalInSpaceQuery = "SELECT user_mxid FROM user_portal WHERE portal_jid=$1 AND portal_receiver=$2 AND in_space=true"
 
 	insertPortalQuery = `
 		INSERT INTO portal (
 			jid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set,
-			encrypted, last_sync, is_parent, parent_group, in_space,
-			first_event_id, next_batch_id, relay_user_id, expiration_time
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+			encrypted, last_sync, is_parent, parent_group, in_space, is_default_sub_group,
+			linked_announce_group, is_announce, is_locked, is_incognito, bridge_matrix_leave,
+			typing_notifications, first_event_id, next_batch_id, relay_user_id, expiration_time, read_only,
+			outgoing_voice_mode
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28)
 	`
 	updatePortalQuery = `
 		UPDATE portal
 		SET mxid=$3, name=$4, name_set=$5, topic=$6, topic_set=$7, avatar=$8, avatar_url=$9, avatar_set=$10,
-		    encrypted=$11, last_sync=$12, is_parent=$13, parent_group=$14, in_space=$15,
-		    first_event_id=$16, next_batch_id=$17, relay_user_id=$18, expiration_time=$19
+		    encrypted=$11, last_sync=$12, is_parent=$13, parent_group=$14, in_space=$15, is_default_sub_group=$16,
+		    linked_announce_group=$17, is_announce=$18, is_locked=$19, is_incognito=$20, bridge_matrix_leave=$21,
+		    typing_notifications=$22, first_event_id=$23, next_batch_id=$24, relay_user_id=$25, expiration_time=$26,
+		    read_only=$27, outgoing_voice_mode=$28
 		WHERE jid=$1 AND receiver=$2
 	`
 	clearPortalInSpaceQuery = "UPDATE portal SET in_space=false WHERE parent_group=$1"
@@ -133,6 +140,12 @@ func (pq *PortalQuery) FindPrivateChatsNotInSpace(ctx context.Context, receiver
 		AsList()
 }
 
+func (pq *PortalQuery) GetUsersWithPortalInSpace(ctx context.Context, key PortalKey) ([]id.UserID, error) {
+	return dbutil.ConvertRowFn[id.UserID](dbutil.ScanSingleColumn[id.UserID]).
+		NewRowIter(pq.GetDB().Query(ctx, getUsersWithPortalInSpaceQuery, key.JID, key.Receiver)).
+		AsList()
+}
+
 type Portal struct {
 	qh *dbutil.QueryHelper[*Portal]
 
@@ -149,9 +162,25 @@ type Portal struct {
 	Encrypted bool
 	LastSync  time.Time
 
-	IsParent    bool
-	ParentGroup types.JID
-	InSpace     bool
+	IsParent          bool
+	ParentGroup       types.JID
+	InSpace           bool
+	IsDefaultSubGroup bool
+
+	// LinkedAnnounceGroup is the JID of the announcement group of a community. Only set for community portals.
+	LinkedAnnounceGroup types.JID
+	IsAnnounce          bool
+	IsLocked            bool
+	IsIncognito         bool
+
+	// BridgeMatrixLeave overrides the bridge_matrix_leave config option for this portal if set.
+	BridgeMatrixLeave *bool
+	// TypingNotifications overrides whether typing notifications are bridged in either direction for this portal if set.
+	TypingNotifications *bool
+	// ReadOnly prevents anything from being sent to WhatsApp in this portal.
+	ReadOnly bool
+	// OutgoingVoiceMode overrides the outgoing_voice_mode config option for this portal if set.
+	OutgoingVoiceMode string
 
 	FirstEventID   id.EventID
 	NextBatchID    id.BatchID
@@ -160,13 +189,16 @@ type Portal struct {
 }
 
 func (portal *Portal) Scan(row dbutil.Scannable) (*Portal, error) {
-	var mxid, avatarURL, firstEventID, nextBatchID, relayUserID, parentGroupJID sql.NullString
+	var mxid, avatarURL, firstEventID, nextBatchID, relayUserID, parentGroupJID, linkedAnnounceGroupJID sql.NullString
 	var lastSyncTs int64
+	var bridgeMatrixLeave, typingNotifications sql.NullBool
 	err := row.Scan(
 		&portal.Key.JID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.NameSet,
 		&portal.Topic, &portal.TopicSet, &portal.Avatar, &avatarURL, &portal.AvatarSet, &portal.Encrypted,
-		&lastSyncTs, &portal.IsParent, &parentGroupJID, &portal.InSpace,
-		&firstEventID, &nextBatchID, &relayUserID, &portal.ExpirationTime,
+		&lastSyncTs, &portal.IsParent, &parentGroupJID, &portal.InSpace, &portal.IsDefaultSubGroup,
+		&linkedAnnounceGroupJID, &portal.IsAnnounce, &portal.IsLocked, &portal.IsIncognito, &bridgeMatrixLeave,
+		&typingNotifications, &firstEventID, &nextBatchID, &relayUserID, &portal.ExpirationTime, &portal.ReadOnly,
+		&portal.OutgoingVoiceMode,
 	)
 	if err != nil {
 		return nil, err
@@ -179,6 +211,15 @@ func (portal *Portal) Scan(row dbutil.Scannable) (*Portal, error) {
 	if parentGroupJID.Valid {
 		portal.ParentGroup, _ = types.ParseJID(parentGroupJID.String)
 	}
+	if bridgeMatrixLeave.Valid {
+		portal.BridgeMatrixLeave = &bridgeMatrixLeave.Bool
+	}
+	if typingNotifications.Valid {
+		portal.TypingNotifications = &typingNotifications.Bool
+	}
+	if linkedAnnounceGroupJID.Valid {
+		portal.LinkedAnnounceGroup, _ = types.ParseJID(linkedAnnounceGroupJID.String)
+	}
 	portal.FirstEventID = id.EventID(firstEventID.String)
 	portal.NextBatchID = id.BatchID(nextBatchID.String)
 	portal.RelayUserID = id.UserID(relayUserID.String)
@@ -193,8 +234,10 @@ func (portal *Portal) sqlVariables() []any {
 	return []any{
 		portal.Key.JID, portal.Key.Receiver, dbutil.StrPtr(portal.MXID), portal.Name, portal.NameSet,
 		portal.Topic, portal.TopicSet, portal.Avatar, portal.AvatarURL.String(), portal.AvatarSet, portal.Encrypted,
-		lastSyncTS, portal.IsParent, dbutil.StrPtr(portal.ParentGroup.String()), portal.InSpace,
-		portal.FirstEventID.String(), portal.NextBatchID.String(), dbutil.StrPtr(portal.RelayUserID), portal.ExpirationTime,
+		lastSyncTS, portal.IsParent, dbutil.StrPtr(portal.ParentGroup.String()), portal.InSpace, portal.IsDefaultSubGroup,
+		dbutil.StrPtr(portal.LinkedAnnounceGroup.String()), portal.IsAnnounce, portal.IsLocked, portal.IsIncognito, portal.BridgeMatrixLeave,
+		portal.TypingNotifications, portal.FirstEventID.String(), portal.NextBatchID.String(), dbutil.StrPtr(portal.RelayUserID), portal.ExpirationTime,
+		portal.ReadOnly, portal.OutgoingVoiceMode,
 	}
 }
 
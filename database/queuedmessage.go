@@ -0,0 +1,106 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/util/dbutil"
+)
+
+type QueuedMessageQuery struct {
+	*dbutil.QueryHelper[*QueuedMessage]
+}
+
+func newQueuedMessage(qh *dbutil.QueryHelper[*QueuedMessage]) *QueuedMessage {
+	return &QueuedMessage{
+		qh: qh,
+	}
+}
+
+const (
+	getQueuedMessagesBySenderQuery = `
+		SELECT event_id, room_id, portal_jid, portal_receiver, sender, event_type, content, queued_at FROM queued_message
+		WHERE sender=$1
+		ORDER BY queued_at
+	`
+	countQueuedMessagesInPortalQuery = `
+		SELECT COUNT(*) FROM queued_message WHERE sender=$1 AND portal_jid=$2 AND portal_receiver=$3
+	`
+	insertQueuedMessageQuery = `
+		INSERT INTO queued_message (event_id, room_id, portal_jid, portal_receiver, sender, event_type, content, queued_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	deleteQueuedMessageQuery = `DELETE FROM queued_message WHERE event_id=$1`
+)
+
+func (qmq *QueuedMessageQuery) New() *QueuedMessage {
+	return &QueuedMessage{qh: qmq.QueryHelper}
+}
+
+// GetAllBySender returns all messages the given user sent while disconnected, oldest first.
+func (qmq *QueuedMessageQuery) GetAllBySender(ctx context.Context, userID id.UserID) ([]*QueuedMessage, error) {
+	return qmq.QueryMany(ctx, getQueuedMessagesBySenderQuery, userID)
+}
+
+func (qmq *QueuedMessageQuery) CountInPortal(ctx context.Context, userID id.UserID, portal PortalKey) (count int, err error) {
+	err = qmq.GetDB().QueryRow(ctx, countQueuedMessagesInPortalQuery, userID, portal.JID, portal.Receiver).Scan(&count)
+	return
+}
+
+type QueuedMessage struct {
+	qh *dbutil.QueryHelper[*QueuedMessage]
+
+	EventID   id.EventID
+	RoomID    id.RoomID
+	Portal    PortalKey
+	Sender    id.UserID
+	EventType string
+	Content   json.RawMessage
+	QueuedAt  time.Time
+}
+
+func (msg *QueuedMessage) Scan(row dbutil.Scannable) (*QueuedMessage, error) {
+	var content string
+	var queuedAt int64
+	err := row.Scan(&msg.EventID, &msg.RoomID, &msg.Portal.JID, &msg.Portal.Receiver, &msg.Sender, &msg.EventType, &content, &queuedAt)
+	if err != nil {
+		return nil, err
+	}
+	msg.Content = json.RawMessage(content)
+	msg.QueuedAt = time.UnixMilli(queuedAt)
+	return msg, nil
+}
+
+func (msg *QueuedMessage) sqlVariables() []any {
+	return []any{
+		msg.EventID, msg.RoomID, msg.Portal.JID, msg.Portal.Receiver, msg.Sender, msg.EventType,
+		string(msg.Content), msg.QueuedAt.UnixMilli(),
+	}
+}
+
+func (msg *QueuedMessage) Insert(ctx context.Context) error {
+	return msg.qh.Exec(ctx, insertQueuedMessageQuery, msg.sqlVariables()...)
+}
+
+func (msg *QueuedMessage) Delete(ctx context.Context) error {
+	return msg.qh.Exec(ctx, deleteQueuedMessageQuery, msg.EventID)
+}
@@ -0,0 +1,137 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/util/dbutil"
+)
+
+type RecentStickerQuery struct {
+	*dbutil.QueryHelper[*RecentSticker]
+}
+
+func newRecentSticker(qh *dbutil.QueryHelper[*RecentSticker]) *RecentSticker {
+	return &RecentSticker{
+		qh: qh,
+	}
+}
+
+const (
+	getRecentStickersQuery = `
+		SELECT user_mxid, file_sha256, direct_path, media_key, file_enc_sha256, file_length, mimetype, width, height,
+		       mxc, emojis, last_used
+		FROM recent_sticker
+		WHERE user_mxid=$1
+		ORDER BY last_used DESC
+		LIMIT $2
+	`
+	upsertRecentStickerQuery = `
+		INSERT INTO recent_sticker (
+			user_mxid, file_sha256, direct_path, media_key, file_enc_sha256, file_length, mimetype, width, height,
+			mxc, emojis, last_used
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (user_mxid, file_sha256) DO UPDATE
+			SET direct_path=excluded.direct_path, media_key=excluded.media_key, file_enc_sha256=excluded.file_enc_sha256,
+				file_length=excluded.file_length, mimetype=excluded.mimetype, width=excluded.width, height=excluded.height,
+				last_used=excluded.last_used
+	`
+	updateRecentStickerUploadQuery = `
+		UPDATE recent_sticker SET mxc=$3, emojis=$4 WHERE user_mxid=$1 AND file_sha256=$2
+	`
+	pruneRecentStickersQuery = `
+		DELETE FROM recent_sticker
+		WHERE user_mxid=$1 AND file_sha256 NOT IN (
+			SELECT file_sha256 FROM recent_sticker WHERE user_mxid=$1 ORDER BY last_used DESC LIMIT $2
+		)
+	`
+)
+
+func (rsq *RecentStickerQuery) New() *RecentSticker {
+	return &RecentSticker{qh: rsq.QueryHelper}
+}
+
+// GetRecent returns the stickers the given user has most recently used on WhatsApp, newest first.
+func (rsq *RecentStickerQuery) GetRecent(ctx context.Context, userID id.UserID, limit int) ([]*RecentSticker, error) {
+	return rsq.QueryMany(ctx, getRecentStickersQuery, userID, limit)
+}
+
+// Prune deletes all but the given number of most recently used stickers of the user.
+func (rsq *RecentStickerQuery) Prune(ctx context.Context, userID id.UserID, keep int) error {
+	return rsq.Exec(ctx, pruneRecentStickersQuery, userID, keep)
+}
+
+type RecentSticker struct {
+	qh *dbutil.QueryHelper[*RecentSticker]
+
+	UserMXID      id.UserID
+	FileSHA256    string
+	DirectPath    string
+	MediaKey      []byte
+	FileEncSHA256 []byte
+	FileLength    int64
+	MimeType      string
+	Width         int
+	Height        int
+	// MXC is empty until the sticker is imported into a Matrix sticker pack for the first time.
+	MXC      id.ContentURIString
+	Emojis   []string
+	LastUsed time.Time
+}
+
+func (sticker *RecentSticker) Scan(row dbutil.Scannable) (*RecentSticker, error) {
+	var emojis string
+	var lastUsed int64
+	err := row.Scan(
+		&sticker.UserMXID, &sticker.FileSHA256, &sticker.DirectPath, &sticker.MediaKey, &sticker.FileEncSHA256,
+		&sticker.FileLength, &sticker.MimeType, &sticker.Width, &sticker.Height, &sticker.MXC, &emojis, &lastUsed,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if emojis != "" {
+		sticker.Emojis = strings.Split(emojis, " ")
+	}
+	sticker.LastUsed = time.Unix(lastUsed, 0)
+	return sticker, nil
+}
+
+func (sticker *RecentSticker) sqlVariables() []any {
+	return []any{
+		sticker.UserMXID, sticker.FileSHA256, sticker.DirectPath, sticker.MediaKey, sticker.FileEncSHA256,
+		sticker.FileLength, sticker.MimeType, sticker.Width, sticker.Height, sticker.MXC,
+		strings.Join(sticker.Emojis, " "), sticker.LastUsed.Unix(),
+	}
+}
+
+// Upsert inserts the sticker or updates its WhatsApp metadata. The uploaded Matrix copy is never overwritten.
+func (sticker *RecentSticker) Upsert(ctx context.Context) error {
+	return sticker.qh.Exec(ctx, upsertRecentStickerQuery, sticker.sqlVariables()...)
+}
+
+// SetUploaded stores the Matrix copy of the sticker and the emojis parsed from the file.
+func (sticker *RecentSticker) SetUploaded(ctx context.Context, mxc id.ContentURIString, emojis []string) error {
+	sticker.MXC = mxc
+	sticker.Emojis = emojis
+	return sticker.qh.Exec(ctx, updateRecentStickerUploadQuery, sticker.UserMXID, sticker.FileSHA256, mxc, strings.Join(emojis, " "))
+}
@@ -0,0 +1,127 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/util/dbutil"
+)
+
+type ScheduledMessageQuery struct {
+	*dbutil.QueryHelper[*ScheduledMessage]
+}
+
+func newScheduledMessage(qh *dbutil.QueryHelper[*ScheduledMessage]) *ScheduledMessage {
+	return &ScheduledMessage{
+		qh: qh,
+	}
+}
+
+const (
+	getDueScheduledMessagesQuery = `
+		SELECT event_id, room_id, portal_jid, portal_receiver, sender, event_type, content, send_at FROM scheduled_message
+		WHERE send_at<=$1
+		ORDER BY send_at
+	`
+	getScheduledMessagesByRoomQuery = `
+		SELECT event_id, room_id, portal_jid, portal_receiver, sender, event_type, content, send_at FROM scheduled_message
+		WHERE room_id=$1
+		ORDER BY send_at
+	`
+	getScheduledMessageByEventIDQuery = `
+		SELECT event_id, room_id, portal_jid, portal_receiver, sender, event_type, content, send_at FROM scheduled_message
+		WHERE event_id=$1
+	`
+	getNextScheduledMessageTimeQuery = `SELECT MIN(send_at) FROM scheduled_message`
+	insertScheduledMessageQuery      = `
+		INSERT INTO scheduled_message (event_id, room_id, portal_jid, portal_receiver, sender, event_type, content, send_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	deleteScheduledMessageQuery = `DELETE FROM scheduled_message WHERE event_id=$1 AND room_id=$2`
+)
+
+func (smq *ScheduledMessageQuery) New() *ScheduledMessage {
+	return &ScheduledMessage{qh: smq.QueryHelper}
+}
+
+// GetDue returns all scheduled messages that should be sent at or before the given time, oldest first.
+func (smq *ScheduledMessageQuery) GetDue(ctx context.Context, now time.Time) ([]*ScheduledMessage, error) {
+	return smq.QueryMany(ctx, getDueScheduledMessagesQuery, now.UnixMilli())
+}
+
+func (smq *ScheduledMessageQuery) GetAllByRoom(ctx context.Context, roomID id.RoomID) ([]*ScheduledMessage, error) {
+	return smq.QueryMany(ctx, getScheduledMessagesByRoomQuery, roomID)
+}
+
+func (smq *ScheduledMessageQuery) GetByEventID(ctx context.Context, eventID id.EventID) (*ScheduledMessage, error) {
+	return smq.QueryOne(ctx, getScheduledMessageByEventIDQuery, eventID)
+}
+
+// GetNextSendTime returns the time when the next scheduled message should be sent,
+// or a zero time if there are no scheduled messages.
+func (smq *ScheduledMessageQuery) GetNextSendTime(ctx context.Context) (next time.Time, err error) {
+	var nextTS *int64
+	err = smq.GetDB().QueryRow(ctx, getNextScheduledMessageTimeQuery).Scan(&nextTS)
+	if nextTS != nil {
+		next = time.UnixMilli(*nextTS)
+	}
+	return
+}
+
+type ScheduledMessage struct {
+	qh *dbutil.QueryHelper[*ScheduledMessage]
+
+	EventID   id.EventID
+	RoomID    id.RoomID
+	Portal    PortalKey
+	Sender    id.UserID
+	EventType string
+	Content   json.RawMessage
+	SendAt    time.Time
+}
+
+func (msg *ScheduledMessage) Scan(row dbutil.Scannable) (*ScheduledMessage, error) {
+	var content string
+	var sendAt int64
+	err := row.Scan(&msg.EventID, &msg.RoomID, &msg.Portal.JID, &msg.Portal.Receiver, &msg.Sender, &msg.EventType, &content, &sendAt)
+	if err != nil {
+		return nil, err
+	}
+	msg.Content = json.RawMessage(content)
+	msg.SendAt = time.UnixMilli(sendAt)
+	return msg, nil
+}
+
+func (msg *ScheduledMessage) sqlVariables() []any {
+	return []any{
+		msg.EventID, msg.RoomID, msg.Portal.JID, msg.Portal.Receiver, msg.Sender, msg.EventType,
+		string(msg.Content), msg.SendAt.UnixMilli(),
+	}
+}
+
+func (msg *ScheduledMessage) Insert(ctx context.Context) error {
+	return msg.qh.Exec(ctx, insertScheduledMessageQuery, msg.sqlVariables()...)
+}
+
+func (msg *ScheduledMessage) Delete(ctx context.Context) error {
+	return msg.qh.Exec(ctx, deleteScheduledMessageQuery, msg.EventID, msg.RoomID)
+}
@@ -1,4 +1,4 @@
--- v0 -> v57 (compatible with v45+): Latest revision
+-- v0 -> v76 (compatible with v45+): Latest revision
 
 CREATE TABLE "user" (
     mxid     TEXT PRIMARY KEY,
@@ -12,7 +12,16 @@ CREATE TABLE "user" (
     phone_last_seen   BIGINT,
     phone_last_pinged BIGINT,
 
-    timezone TEXT
+    timezone TEXT,
+
+    send_read_receipts BOOLEAN,
+    send_typing        BOOLEAN,
+    receive_typing     BOOLEAN,
+    receive_presence   BOOLEAN,
+    offline_after_send BOOLEAN,
+
+    language  TEXT,
+    read_only BOOLEAN NOT NULL DEFAULT false
 );
 
 CREATE TABLE portal (
@@ -33,6 +42,17 @@ CREATE TABLE portal (
     parent_group TEXT,
     in_space     BOOLEAN NOT NULL DEFAULT false,
 
+    is_default_sub_group BOOLEAN NOT NULL DEFAULT false,
+
+    linked_announce_group TEXT,
+    is_announce           BOOLEAN NOT NULL DEFAULT false,
+    is_locked             BOOLEAN NOT NULL DEFAULT false,
+    is_incognito          BOOLEAN NOT NULL DEFAULT false,
+    bridge_matrix_leave   BOOLEAN,
+    typing_notifications  BOOLEAN,
+    read_only             BOOLEAN NOT NULL DEFAULT false,
+    outgoing_voice_mode   TEXT NOT NULL DEFAULT '',
+
     first_event_id  TEXT,
     next_batch_id   TEXT,
     relay_user_id   TEXT,
@@ -77,12 +97,14 @@ CREATE TABLE message (
     type          TEXT,
 
     broadcast_list_jid TEXT,
+    rerequested        BOOLEAN NOT NULL DEFAULT false,
 
     PRIMARY KEY (chat_jid, chat_receiver, jid),
     FOREIGN KEY (chat_jid, chat_receiver) REFERENCES portal(jid, receiver) ON DELETE CASCADE
 );
 
 CREATE INDEX message_timestamp_idx ON message (chat_jid, chat_receiver, timestamp);
+CREATE INDEX message_prune_idx ON message (timestamp);
 
 CREATE TABLE poll_option_id (
     msg_mxid TEXT,
@@ -94,6 +116,22 @@ CREATE TABLE poll_option_id (
     CONSTRAINT message_mxid_fkey FOREIGN KEY (msg_mxid) REFERENCES message(mxid) ON DELETE CASCADE ON UPDATE CASCADE
 );
 
+CREATE TABLE poll_vote (
+    msg_mxid  TEXT,
+    voter_jid TEXT,
+    options   TEXT NOT NULL,
+
+    PRIMARY KEY (msg_mxid, voter_jid),
+    CONSTRAINT message_mxid_fkey FOREIGN KEY (msg_mxid) REFERENCES message(mxid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE poll_tally (
+    msg_mxid   TEXT PRIMARY KEY,
+    tally_mxid TEXT NOT NULL,
+
+    CONSTRAINT message_mxid_fkey FOREIGN KEY (msg_mxid) REFERENCES message(mxid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
 CREATE TABLE reaction (
     chat_jid      TEXT,
     chat_receiver TEXT,
@@ -206,3 +244,73 @@ CREATE TABLE history_sync_message (
     FOREIGN KEY (user_mxid)                  REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE,
     FOREIGN KEY (user_mxid, conversation_id) REFERENCES history_sync_conversation(user_mxid, conversation_id) ON DELETE CASCADE
 );
+
+CREATE TABLE group_invite (
+    user_mxid  TEXT,
+    group_jid  TEXT,
+    group_name TEXT NOT NULL,
+    inviter    TEXT NOT NULL,
+    code       TEXT NOT NULL,
+    expiration BIGINT NOT NULL,
+    PRIMARY KEY (user_mxid, group_jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE recent_sticker (
+    user_mxid       TEXT,
+    file_sha256     TEXT,
+    direct_path     TEXT    NOT NULL,
+    media_key       bytea,
+    file_enc_sha256 bytea,
+    file_length     BIGINT  NOT NULL,
+    mimetype        TEXT    NOT NULL,
+    width           INTEGER NOT NULL,
+    height          INTEGER NOT NULL,
+    mxc             TEXT    NOT NULL,
+    emojis          TEXT    NOT NULL,
+    last_used       BIGINT  NOT NULL,
+    PRIMARY KEY (user_mxid, file_sha256),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE scheduled_message (
+    event_id        TEXT PRIMARY KEY,
+    room_id         TEXT   NOT NULL,
+    portal_jid      TEXT   NOT NULL,
+    portal_receiver TEXT   NOT NULL,
+    sender          TEXT   NOT NULL,
+    event_type      TEXT   NOT NULL,
+    content         TEXT   NOT NULL,
+    send_at         BIGINT NOT NULL,
+    FOREIGN KEY (portal_jid, portal_receiver) REFERENCES portal(jid, receiver) ON DELETE CASCADE
+);
+CREATE INDEX scheduled_message_send_at_idx ON scheduled_message (send_at);
+
+CREATE TABLE queued_message (
+    event_id        TEXT PRIMARY KEY,
+    room_id         TEXT   NOT NULL,
+    portal_jid      TEXT   NOT NULL,
+    portal_receiver TEXT   NOT NULL,
+    sender          TEXT   NOT NULL,
+    event_type      TEXT   NOT NULL,
+    content         TEXT   NOT NULL,
+    queued_at       BIGINT NOT NULL,
+    FOREIGN KEY (sender) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (portal_jid, portal_receiver) REFERENCES portal(jid, receiver) ON DELETE CASCADE
+);
+CREATE INDEX queued_message_sender_idx ON queued_message (sender, queued_at);
+
+CREATE TABLE ignored_jid (
+    user_mxid TEXT,
+    jid       TEXT,
+    PRIMARY KEY (user_mxid, jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE TABLE contact_about (
+    user_mxid TEXT,
+    jid       TEXT,
+    about     TEXT NOT NULL,
+    PRIMARY KEY (user_mxid, jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
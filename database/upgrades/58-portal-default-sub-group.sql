@@ -0,0 +1,2 @@
+-- v58 (compatible with v45+): Store whether a group is the announcement group of its community
+ALTER TABLE portal ADD COLUMN is_default_sub_group BOOLEAN NOT NULL DEFAULT false;
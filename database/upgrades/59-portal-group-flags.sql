@@ -0,0 +1,5 @@
+-- v59 (compatible with v45+): Store community and group setting flags for portals
+ALTER TABLE portal ADD COLUMN linked_announce_group TEXT;
+ALTER TABLE portal ADD COLUMN is_announce BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE portal ADD COLUMN is_locked BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE portal ADD COLUMN is_incognito BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,11 @@
+-- v60 (compatible with v45+): Store pending group invites
+CREATE TABLE group_invite (
+    user_mxid  TEXT,
+    group_jid  TEXT,
+    group_name TEXT NOT NULL,
+    inviter    TEXT NOT NULL,
+    code       TEXT NOT NULL,
+    expiration BIGINT NOT NULL,
+    PRIMARY KEY (user_mxid, group_jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
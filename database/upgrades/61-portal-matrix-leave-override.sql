@@ -0,0 +1,2 @@
+-- v61 (compatible with v45+): Allow overriding whether Matrix leaves are bridged per portal
+ALTER TABLE portal ADD COLUMN bridge_matrix_leave BOOLEAN;
@@ -0,0 +1,2 @@
+-- v62 (compatible with v45+): Allow overriding whether read receipts are sent to WhatsApp per user
+ALTER TABLE "user" ADD COLUMN send_read_receipts BOOLEAN;
@@ -0,0 +1,4 @@
+-- v63 (compatible with v45+): Allow overriding whether typing notifications are bridged per user and per portal
+ALTER TABLE "user" ADD COLUMN send_typing BOOLEAN;
+ALTER TABLE "user" ADD COLUMN receive_typing BOOLEAN;
+ALTER TABLE portal ADD COLUMN typing_notifications BOOLEAN;
@@ -0,0 +1,3 @@
+-- v64 (compatible with v45+): Allow overriding presence bridging options per user
+ALTER TABLE "user" ADD COLUMN receive_presence BOOLEAN;
+ALTER TABLE "user" ADD COLUMN offline_after_send BOOLEAN;
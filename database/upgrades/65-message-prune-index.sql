@@ -0,0 +1,2 @@
+-- v65 (compatible with v45+): Add index for pruning old messages
+CREATE INDEX message_prune_idx ON message (timestamp);
@@ -0,0 +1,2 @@
+-- v66 (compatible with v45+): Add per-user language for bridge messages
+ALTER TABLE "user" ADD COLUMN language TEXT;
@@ -0,0 +1,16 @@
+-- v67 (compatible with v45+): Store poll votes for anonymous poll tallies
+CREATE TABLE poll_vote (
+    msg_mxid  TEXT,
+    voter_jid TEXT,
+    options   TEXT NOT NULL,
+
+    PRIMARY KEY (msg_mxid, voter_jid),
+    CONSTRAINT message_mxid_fkey FOREIGN KEY (msg_mxid) REFERENCES message(mxid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE poll_tally (
+    msg_mxid   TEXT PRIMARY KEY,
+    tally_mxid TEXT NOT NULL,
+
+    CONSTRAINT message_mxid_fkey FOREIGN KEY (msg_mxid) REFERENCES message(mxid) ON DELETE CASCADE ON UPDATE CASCADE
+);
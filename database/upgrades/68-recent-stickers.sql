@@ -0,0 +1,17 @@
+-- v68 (compatible with v45+): Remember the user's recent WhatsApp stickers for sticker pack imports
+CREATE TABLE recent_sticker (
+    user_mxid       TEXT,
+    file_sha256     TEXT,
+    direct_path     TEXT    NOT NULL,
+    media_key       bytea,
+    file_enc_sha256 bytea,
+    file_length     BIGINT  NOT NULL,
+    mimetype        TEXT    NOT NULL,
+    width           INTEGER NOT NULL,
+    height          INTEGER NOT NULL,
+    mxc             TEXT    NOT NULL,
+    emojis          TEXT    NOT NULL,
+    last_used       BIGINT  NOT NULL,
+    PRIMARY KEY (user_mxid, file_sha256),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
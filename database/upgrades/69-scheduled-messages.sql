@@ -0,0 +1,13 @@
+-- v69 (compatible with v45+): Store messages scheduled to be sent to WhatsApp later
+CREATE TABLE scheduled_message (
+    event_id        TEXT PRIMARY KEY,
+    room_id         TEXT   NOT NULL,
+    portal_jid      TEXT   NOT NULL,
+    portal_receiver TEXT   NOT NULL,
+    sender          TEXT   NOT NULL,
+    event_type      TEXT   NOT NULL,
+    content         TEXT   NOT NULL,
+    send_at         BIGINT NOT NULL,
+    FOREIGN KEY (portal_jid, portal_receiver) REFERENCES portal(jid, receiver) ON DELETE CASCADE
+);
+CREATE INDEX scheduled_message_send_at_idx ON scheduled_message (send_at);
@@ -0,0 +1,14 @@
+-- v70 (compatible with v45+): Store messages sent while the user was disconnected from WhatsApp
+CREATE TABLE queued_message (
+    event_id        TEXT PRIMARY KEY,
+    room_id         TEXT   NOT NULL,
+    portal_jid      TEXT   NOT NULL,
+    portal_receiver TEXT   NOT NULL,
+    sender          TEXT   NOT NULL,
+    event_type      TEXT   NOT NULL,
+    content         TEXT   NOT NULL,
+    queued_at       BIGINT NOT NULL,
+    FOREIGN KEY (sender) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (portal_jid, portal_receiver) REFERENCES portal(jid, receiver) ON DELETE CASCADE
+);
+CREATE INDEX queued_message_sender_idx ON queued_message (sender, queued_at);
@@ -0,0 +1,3 @@
+-- v71 (compatible with v45+): Add read-only mode for portals and logins
+ALTER TABLE portal ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE "user" ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,7 @@
+-- v72 (compatible with v45+): Add per-user list of ignored WhatsApp users and chats
+CREATE TABLE ignored_jid (
+    user_mxid TEXT,
+    jid       TEXT,
+    PRIMARY KEY (user_mxid, jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
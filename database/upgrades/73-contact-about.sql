@@ -0,0 +1,8 @@
+-- v73 (compatible with v45+): Remember contacts' about texts per user to notice when they change
+CREATE TABLE contact_about (
+    user_mxid TEXT,
+    jid       TEXT,
+    about     TEXT NOT NULL,
+    PRIMARY KEY (user_mxid, jid),
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+-- v74 (compatible with v45+): Remember which undecryptable messages were already requested from the phone
+ALTER TABLE message ADD COLUMN rerequested BOOLEAN NOT NULL DEFAULT false;
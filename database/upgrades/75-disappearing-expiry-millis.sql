@@ -0,0 +1,6 @@
+-- v75 (compatible with v45+): Restart disappearing message timers that were stored in seconds instead of milliseconds
+
+-- only: postgres
+UPDATE disappearing_message SET expire_at=CAST(EXTRACT(EPOCH FROM now()) * 1000 AS BIGINT) + expire_in WHERE expire_at < 100000000000 OR expire_at > 100000000000000;
+-- only: sqlite
+UPDATE disappearing_message SET expire_at=CAST(strftime('%s', 'now') AS BIGINT) * 1000 + expire_in WHERE expire_at < 100000000000 OR expire_at > 100000000000000;
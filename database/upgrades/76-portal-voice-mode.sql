@@ -0,0 +1,2 @@
+-- v76 (compatible with v45+): Add per-portal override for sending audio as voice messages
+ALTER TABLE portal ADD COLUMN outgoing_voice_mode TEXT NOT NULL DEFAULT '';
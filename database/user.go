@@ -42,21 +42,24 @@ func newUser(qh *dbutil.QueryHelper[*User]) *User {
 }
 
 const (
-	getAllUsersQuery       = `SELECT mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone FROM "user"`
+	getAllUsersQuery       = `SELECT mxid, username, agent, device, management_room, space_room, phone_last_seen, phone_last_pinged, timezone, send_read_receipts, send_typing, receive_typing, receive_presence, offline_after_send, language, read_only FROM "user"`
 	getUserByMXIDQuery     = getAllUsersQuery + ` WHERE mxid=$1`
 	getUserByUsernameQuery = getAllUsersQuery + ` WHERE username=$1`
 	insertUserQuery        = `
 		INSERT INTO "user" (
 			mxid, username, agent, device,
 			management_room, space_room,
-			phone_last_seen, phone_last_pinged, timezone
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			phone_last_seen, phone_last_pinged, timezone,
+			send_read_receipts, send_typing, receive_typing, receive_presence, offline_after_send, language, read_only
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
 	`
 	updateUserQuery = `
 		UPDATE "user"
 		SET username=$2, agent=$3, device=$4,
 		    management_room=$5, space_room=$6,
-		    phone_last_seen=$7, phone_last_pinged=$8, timezone=$9
+		    phone_last_seen=$7, phone_last_pinged=$8, timezone=$9,
+		    send_read_receipts=$10, send_typing=$11, receive_typing=$12, receive_presence=$13, offline_after_send=$14,
+		    language=$15, read_only=$16
 		WHERE mxid=$1
 	`
 	getUserLastAppStateKeyIDQuery = "SELECT key_id FROM whatsmeow_app_state_sync_keys WHERE jid=$1 ORDER BY timestamp DESC LIMIT 1"
@@ -84,6 +87,18 @@ type User struct {
 	PhoneLastSeen   time.Time
 	PhoneLastPinged time.Time
 	Timezone        string
+	// SendReadReceipts overrides the send_read_receipts config option for this user if set.
+	SendReadReceipts *bool
+	// SendTyping and ReceiveTyping override the typing_notifications config options for this user if set.
+	SendTyping    *bool
+	ReceiveTyping *bool
+	// ReceivePresence and OfflineAfterSend override the presence config options for this user if set.
+	ReceivePresence  *bool
+	OfflineAfterSend *bool
+	// Language overrides the language config option for bridge messages sent to this user if set.
+	Language string
+	// ReadOnly prevents anything from being sent to WhatsApp using this login.
+	ReadOnly bool
 
 	lastReadCache     map[PortalKey]time.Time
 	lastReadCacheLock sync.Mutex
@@ -92,14 +107,35 @@ type User struct {
 }
 
 func (user *User) Scan(row dbutil.Scannable) (*User, error) {
-	var username, timezone sql.NullString
+	var username, timezone, language sql.NullString
 	var device, agent sql.NullInt16
 	var phoneLastSeen, phoneLastPinged sql.NullInt64
-	err := row.Scan(&user.MXID, &username, &agent, &device, &user.ManagementRoom, &user.SpaceRoom, &phoneLastSeen, &phoneLastPinged, &timezone)
+	var sendReadReceipts, sendTyping, receiveTyping, receivePresence, offlineAfterSend sql.NullBool
+	err := row.Scan(
+		&user.MXID, &username, &agent, &device, &user.ManagementRoom, &user.SpaceRoom,
+		&phoneLastSeen, &phoneLastPinged, &timezone, &sendReadReceipts, &sendTyping, &receiveTyping,
+		&receivePresence, &offlineAfterSend, &language, &user.ReadOnly,
+	)
 	if err != nil {
 		return nil, err
 	}
+	if sendReadReceipts.Valid {
+		user.SendReadReceipts = &sendReadReceipts.Bool
+	}
+	if sendTyping.Valid {
+		user.SendTyping = &sendTyping.Bool
+	}
+	if receiveTyping.Valid {
+		user.ReceiveTyping = &receiveTyping.Bool
+	}
+	if receivePresence.Valid {
+		user.ReceivePresence = &receivePresence.Bool
+	}
+	if offlineAfterSend.Valid {
+		user.OfflineAfterSend = &offlineAfterSend.Bool
+	}
 	user.Timezone = timezone.String
+	user.Language = language.String
 	if len(username.String) > 0 {
 		user.JID = types.JID{
 			User:   username.String,
@@ -128,7 +164,8 @@ func (user *User) sqlVariables() []any {
 	return []any{
 		user.MXID, username, agent, device, user.ManagementRoom, user.SpaceRoom,
 		dbutil.UnixPtr(user.PhoneLastSeen), dbutil.UnixPtr(user.PhoneLastPinged),
-		user.Timezone,
+		user.Timezone, user.SendReadReceipts, user.SendTyping, user.ReceiveTyping,
+		user.ReceivePresence, user.OfflineAfterSend, dbutil.StrPtr(user.Language), user.ReadOnly,
 	}
 }
 
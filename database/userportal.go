@@ -112,3 +112,10 @@ func (user *User) MarkInSpace(ctx context.Context, portal PortalKey) {
 		user.inSpaceCache[portal] = true
 	}
 }
+
+// ForgetInSpace removes the cached in space status of a portal. The database row is removed when the portal is deleted.
+func (user *User) ForgetInSpace(portal PortalKey) {
+	user.inSpaceCacheLock.Lock()
+	delete(user.inSpaceCache, portal)
+	user.inSpaceCacheLock.Unlock()
+}
@@ -18,17 +18,101 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
 	"maunium.net/go/mautrix-whatsapp/database"
 )
 
+const disappearRetryDelay = 10 * time.Minute
+
+var StateRoomRetention = event.Type{Type: "m.room.retention", Class: event.StateEventType}
+
+type RoomRetentionEventContent struct {
+	MaxLifetime int64 `json:"max_lifetime,omitempty"`
+}
+
+var StateDisappearingTimer = event.Type{Type: "fi.mau.whatsapp.disappearing_timer", Class: event.StateEventType}
+
+type DisappearingTimerEventContent struct {
+	// Timer is the disappearing message timer in seconds, or 0 if disappearing messages are disabled.
+	Timer uint32 `json:"timer"`
+}
+
+// getRetentionEventContent returns the m.room.retention content matching the disappearing timer of the portal.
+// If the timer is disabled, the content is empty, which removes any previous retention policy.
+func (portal *Portal) getRetentionEventContent() *RoomRetentionEventContent {
+	return &RoomRetentionEventContent{
+		MaxLifetime: (time.Duration(portal.ExpirationTime) * time.Second).Milliseconds(),
+	}
+}
+
+// UpdateDisappearingTimerState updates the room state to match the disappearing timer. This includes the
+// m.room.retention event (if enabled), the custom timer state event and the topic suffix (if enabled).
+func (portal *Portal) UpdateDisappearingTimerState(ctx context.Context) {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	if portal.bridge.Config.Bridge.DisappearingRetention {
+		_, err := portal.MainIntent().SendStateEvent(ctx, portal.MXID, StateRoomRetention, "", portal.getRetentionEventContent())
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to update room retention policy")
+		}
+	}
+	_, err := portal.MainIntent().SendStateEvent(ctx, portal.MXID, StateDisappearingTimer, "", &DisappearingTimerEventContent{
+		Timer: portal.ExpirationTime,
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to update disappearing timer state event")
+	}
+	if portal.bridge.Config.Bridge.DisappearingTopic && portal.TopicSet {
+		_, err = portal.MainIntent().SetRoomTopic(ctx, portal.MXID, portal.matrixTopic())
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to update disappearing timer in room topic")
+		}
+	}
+}
+
+// disappearingTopicSuffix returns the suffix added to the room topic when the disappearing timer is active.
+func (portal *Portal) disappearingTopicSuffix() string {
+	if !portal.bridge.Config.Bridge.DisappearingTopic || portal.ExpirationTime == 0 {
+		return ""
+	}
+	return portal.T("Disappearing messages: %s", formatDuration(time.Duration(portal.ExpirationTime)*time.Second))
+}
+
+// matrixTopic returns the topic of the portal as it should be shown on Matrix.
+func (portal *Portal) matrixTopic() string {
+	suffix := portal.disappearingTopicSuffix()
+	if suffix == "" {
+		return portal.Topic
+	} else if portal.Topic == "" {
+		return suffix
+	}
+	return fmt.Sprintf("%s\n\n%s", portal.Topic, suffix)
+}
+
+// stripDisappearingTopicSuffix removes the disappearing timer suffix from a topic set on Matrix.
+func (portal *Portal) stripDisappearingTopicSuffix(topic string) string {
+	suffix := portal.disappearingTopicSuffix()
+	if suffix == "" {
+		return topic
+	} else if topic == suffix {
+		return ""
+	}
+	return strings.TrimSuffix(topic, "\n\n"+suffix)
+}
+
 func (portal *Portal) MarkDisappearing(ctx context.Context, eventID id.EventID, expiresIn time.Duration, startsAt time.Time) {
 	if expiresIn == 0 {
 		return
@@ -45,6 +129,26 @@ func (portal *Portal) MarkDisappearing(ctx context.Context, eventID id.EventID,
 	}
 }
 
+// MarkEditDisappearing makes an edit event disappear at the same time as the message it edits.
+// Edit events contain the full new content, so they would otherwise stay in the room after the original is redacted.
+func (portal *Portal) MarkEditDisappearing(ctx context.Context, editEventID, targetEventID id.EventID) {
+	target, err := portal.bridge.DB.DisappearingMessage.GetByEventID(ctx, portal.MXID, targetEventID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get disappearing message info of edit target")
+		return
+	} else if target == nil || target.ExpireAt.IsZero() {
+		return
+	}
+	msg := portal.bridge.DB.DisappearingMessage.NewWithValues(portal.MXID, editEventID, target.ExpireIn, target.ExpireAt)
+	err = msg.Insert(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to insert disappearing message for edit")
+	}
+	if msg.ExpireAt.Before(time.Now().Add(1 * time.Hour)) {
+		go portal.sleepAndDelete(context.WithoutCancel(ctx), msg)
+	}
+}
+
 func (br *WABridge) SleepAndDeleteUpcoming(ctx context.Context) {
 	msgs, err := br.DB.DisappearingMessage.GetUpcomingScheduled(ctx, 1*time.Hour)
 	if err != nil {
@@ -80,11 +184,22 @@ func (portal *Portal) sleepAndDelete(ctx context.Context, msg *database.Disappea
 		Dur("sleep_time", sleepTime).
 		Msg("Sleeping before making message disappear")
 	time.Sleep(sleepTime)
-	_, err := portal.MainIntent().RedactEvent(ctx, msg.RoomID, msg.EventID, mautrix.ReqRedact{
+	err := portal.redactAndCleanup(ctx, portal.MainIntent(), msg.EventID, mautrix.ReqRedact{
 		Reason: "Message expired",
 		TxnID:  fmt.Sprintf("mxwa_disappear_%s", msg.EventID),
 	})
-	if err != nil {
+	if err != nil && !errors.Is(err, mautrix.MNotFound) && !errors.Is(err, mautrix.MForbidden) {
+		// Keep the row in the database, so the redaction is retried on the next scheduling round
+		log.Err(err).
+			Stringer("room_id", portal.MXID).
+			Stringer("event_id", msg.EventID).
+			Msg("Failed to make event disappear, will retry later")
+		err = msg.SetExpireAt(ctx, time.Now().Add(disappearRetryDelay))
+		if err != nil {
+			log.Err(err).Msg("Failed to postpone disappearing message in database")
+		}
+		return
+	} else if err != nil {
 		log.Err(err).
 			Stringer("room_id", portal.MXID).
 			Stringer("event_id", msg.EventID).
@@ -100,3 +215,80 @@ func (portal *Portal) sleepAndDelete(ctx context.Context, msg *database.Disappea
 		log.Err(err).Msg("Failed to delete disapperaing message row in database after redacting event")
 	}
 }
+
+// redactAndCleanup redacts a bridged event and deletes the data associated with it: the message mapping in the
+// database and, if delete_redacted_media is enabled, the media of the event on the homeserver.
+func (portal *Portal) redactAndCleanup(ctx context.Context, intent *appservice.IntentAPI, eventID id.EventID, req mautrix.ReqRedact) error {
+	var mediaURLs []id.ContentURI
+	if portal.bridge.Config.Bridge.DeleteRedactedMedia {
+		mediaURLs = portal.getEventMediaURLs(ctx, eventID)
+	}
+	_, err := intent.RedactEvent(ctx, portal.MXID, eventID, req)
+	if errors.Is(err, mautrix.MForbidden) && intent != portal.MainIntent() {
+		_, err = portal.MainIntent().RedactEvent(ctx, portal.MXID, eventID, req)
+	}
+	if err != nil {
+		return err
+	}
+	log := zerolog.Ctx(ctx).With().Stringer("event_id", eventID).Logger()
+	err = portal.bridge.DB.Message.DeleteAllByMXID(ctx, eventID)
+	if err != nil {
+		log.Err(err).Msg("Failed to delete redacted message from database")
+	}
+	for _, mxc := range mediaURLs {
+		err = portal.deleteHomeserverMedia(ctx, mxc)
+		if err != nil {
+			log.Warn().Err(err).Stringer("mxc", mxc).Msg("Failed to delete media of redacted message")
+		}
+	}
+	return nil
+}
+
+// getEventMediaURLs fetches an event and returns the media and thumbnail URLs in it that are stored on the bridge's homeserver.
+func (portal *Portal) getEventMediaURLs(ctx context.Context, eventID id.EventID) []id.ContentURI {
+	log := zerolog.Ctx(ctx).With().Stringer("event_id", eventID).Logger()
+	evt, err := portal.MainIntent().GetEvent(ctx, portal.MXID, eventID)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get event to find media before redacting")
+		return nil
+	}
+	_ = evt.Content.ParseRaw(evt.Type)
+	if evt.Type == event.EventEncrypted {
+		if portal.bridge.Crypto == nil {
+			return nil
+		}
+		evt, err = portal.bridge.Crypto.Decrypt(ctx, evt)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to decrypt event to find media before redacting")
+			return nil
+		}
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok {
+		return nil
+	}
+	urls := []id.ContentURIString{content.URL}
+	if content.File != nil {
+		urls = append(urls, content.File.URL)
+	}
+	if content.Info != nil {
+		urls = append(urls, content.Info.ThumbnailURL)
+		if content.Info.ThumbnailFile != nil {
+			urls = append(urls, content.Info.ThumbnailFile.URL)
+		}
+	}
+	var mediaURLs []id.ContentURI
+	for _, url := range urls {
+		parsed, err := url.Parse()
+		if err == nil && parsed.Homeserver == portal.bridge.Config.Homeserver.Domain {
+			mediaURLs = append(mediaURLs, parsed)
+		}
+	}
+	return mediaURLs
+}
+
+func (portal *Portal) deleteHomeserverMedia(ctx context.Context, mxc id.ContentURI) error {
+	bot := portal.bridge.Bot
+	_, err := bot.MakeRequest(ctx, http.MethodDelete, bot.BuildURL(mautrix.SynapseAdminURLPath{"v1", "media", mxc.Homeserver, mxc.FileID}), nil, nil)
+	return err
+}
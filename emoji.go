@@ -0,0 +1,121 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"maunium.net/go/mautrix/event"
+)
+
+var emojiRanges = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x00a9, Hi: 0x00ae, Stride: 5},
+		{Lo: 0x203c, Hi: 0x203c, Stride: 1},
+		{Lo: 0x2049, Hi: 0x2049, Stride: 1},
+		{Lo: 0x2122, Hi: 0x2122, Stride: 1},
+		{Lo: 0x2139, Hi: 0x2139, Stride: 1},
+		{Lo: 0x2194, Hi: 0x21aa, Stride: 1},
+		{Lo: 0x2300, Hi: 0x23ff, Stride: 1},
+		{Lo: 0x24c2, Hi: 0x24c2, Stride: 1},
+		{Lo: 0x25aa, Hi: 0x25fe, Stride: 1},
+		{Lo: 0x2600, Hi: 0x27bf, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2b00, Hi: 0x2bff, Stride: 1},
+		{Lo: 0x3030, Hi: 0x3030, Stride: 1},
+		{Lo: 0x303d, Hi: 0x303d, Stride: 1},
+		{Lo: 0x3297, Hi: 0x3299, Stride: 2},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f000, Hi: 0x1faff, Stride: 1},
+	},
+	LatinOffset: 1,
+}
+
+const (
+	zeroWidthJoiner    = '\u200d'
+	keycapCombiningMod = '\u20e3'
+)
+
+// isEmojiModifier checks if the rune is part of an emoji sequence without being an emoji by itself,
+// like variation selectors, skin tone modifiers (which are in the emoji range) and tag characters of subdivision flags.
+func isEmojiModifier(r rune) bool {
+	return r == zeroWidthJoiner || r == keycapCombiningMod || (r >= 0xfe00 && r <= 0xfe0f) || (r >= 0xe0020 && r <= 0xe007f)
+}
+
+// isEmojiOnly checks if the text consists only of emojis (and whitespace), which both Matrix clients
+// and WhatsApp display as large emojis.
+func isEmojiOnly(text string) bool {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) == 0 {
+		return false
+	}
+	hasEmoji := false
+	for i, r := range runes {
+		switch {
+		case unicode.Is(emojiRanges, r):
+			hasEmoji = true
+		case isEmojiModifier(r), unicode.IsSpace(r):
+		case (r >= '0' && r <= '9') || r == '#' || r == '*':
+			// Keycap emojis start with a normal character, so only allow those when followed by the keycap modifiers
+			if i+1 >= len(runes) || (runes[i+1] != keycapCombiningMod && runes[i+1] != '\ufe0f') {
+				return false
+			}
+			hasEmoji = true
+		default:
+			return false
+		}
+	}
+	return hasEmoji
+}
+
+// isEmojiReaction checks if the reaction key looks like an emoji rather than text or a custom emoji.
+func isEmojiReaction(key string) bool {
+	if key == "" || strings.HasPrefix(key, "mxc://") {
+		return false
+	}
+	runes := []rune(key)
+	hasEmoji := false
+	for i, r := range runes {
+		switch {
+		case unicode.Is(emojiRanges, r):
+			hasEmoji = true
+		case isEmojiModifier(r):
+		case (r >= '0' && r <= '9') || r == '#' || r == '*':
+			// Keycap emoji bases are only allowed when followed by the keycap modifiers
+			if i+1 >= len(runes) || (runes[i+1] != keycapCombiningMod && runes[i+1] != '\ufe0f') {
+				return false
+			}
+			hasEmoji = true
+		default:
+			return false
+		}
+	}
+	return hasEmoji
+}
+
+// normalizeEmojiOnlyContent strips formatting and surrounding whitespace from emoji-only messages,
+// as Matrix clients only render big emojis when the message doesn't contain anything else.
+func normalizeEmojiOnlyContent(content *event.MessageEventContent) {
+	if !isEmojiOnly(content.Body) {
+		return
+	}
+	content.Body = strings.TrimSpace(content.Body)
+	content.Format = ""
+	content.FormattedBody = ""
+}
@@ -37,6 +37,7 @@ var boldRegex = regexp.MustCompile("([\\s>_~]|^)\\*(.+?)\\*([^a-zA-Z\\d]|$)")
 var strikethroughRegex = regexp.MustCompile("([\\s>_*]|^)~(.+?)~([^a-zA-Z\\d]|$)")
 var codeBlockRegex = regexp.MustCompile("```(?:.|\n)+?```")
 var inlineURLRegex = regexp.MustCompile(`\[(.+?)]\((.+?)\)`)
+var matrixHeadingRegex = regexp.MustCompile(`(?is)<h[1-6](?:\s[^>]*)?>(.*?)</h[1-6]>`)
 
 const mentionedJIDsContextKey = "fi.mau.whatsapp.mentioned_jids"
 const allowedMentionsContextKey = "fi.mau.whatsapp.allowed_mentions"
@@ -81,11 +82,14 @@ func NewFormatter(bridge *WABridge) *Formatter {
 				}
 				return displayname
 			},
-			BoldConverter:           func(text string, _ format.Context) string { return fmt.Sprintf("*%s*", text) },
-			ItalicConverter:         func(text string, _ format.Context) string { return fmt.Sprintf("_%s_", text) },
-			StrikethroughConverter:  func(text string, _ format.Context) string { return fmt.Sprintf("~%s~", text) },
-			MonospaceConverter:      func(text string, _ format.Context) string { return fmt.Sprintf("```%s```", text) },
-			MonospaceBlockConverter: func(text, language string, _ format.Context) string { return fmt.Sprintf("```%s```", text) },
+			BoldConverter:          func(text string, _ format.Context) string { return wrapWhatsAppFormat("*", text) },
+			ItalicConverter:        func(text string, _ format.Context) string { return wrapWhatsAppFormat("_", text) },
+			StrikethroughConverter: func(text string, _ format.Context) string { return wrapWhatsAppFormat("~", text) },
+			MonospaceConverter:     func(text string, _ format.Context) string { return wrapWhatsAppFormat("```", text) },
+			MonospaceBlockConverter: func(text, language string, _ format.Context) string {
+				// Code blocks usually end with a newline, which would otherwise end up inside the block
+				return fmt.Sprintf("```%s```", strings.TrimRight(text, "\n"))
+			},
 		},
 		waReplString: map[*regexp.Regexp]string{
 			italicRegex:        "$1<em>$2</em>$3",
@@ -106,6 +110,26 @@ func NewFormatter(bridge *WABridge) *Formatter {
 	return formatter
 }
 
+// wrapWhatsAppFormat wraps the text in the given formatting marker. WhatsApp only applies formatting when the markers
+// are directly next to non-whitespace characters, so surrounding whitespace is moved outside the markers.
+func wrapWhatsAppFormat(marker, text string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	start := strings.Index(text, trimmed)
+	return text[:start] + marker + trimmed + marker + text[start+len(trimmed):]
+}
+
+// convertMatrixHeadings replaces headings with bold paragraphs, as WhatsApp doesn't have headings.
+// Lists, blockquotes and code blocks are already converted into their WhatsApp equivalents by the HTML parser.
+func convertMatrixHeadings(html string) string {
+	if !strings.Contains(html, "<h") && !strings.Contains(html, "<H") {
+		return html
+	}
+	return matrixHeadingRegex.ReplaceAllString(html, "<p><strong>$1</strong></p>")
+}
+
 func (formatter *Formatter) getMatrixInfoByJID(ctx context.Context, roomID id.RoomID, jid types.JID) (mxid id.UserID, displayname string) {
 	if puppet := formatter.bridge.GetPuppetByJID(jid); puppet != nil {
 		mxid = puppet.MXID
@@ -192,7 +216,7 @@ func (formatter *Formatter) ParseMatrix(html string, mentions *event.Mentions) (
 		}
 		ctx.ReturnData[allowedMentionsContextKey] = allowedMentions
 	}
-	result := formatter.matrixHTMLParser.Parse(html, ctx)
+	result := formatter.matrixHTMLParser.Parse(convertMatrixHeadings(html), ctx)
 	if mentions == nil {
 		mentionedJIDs, _ = ctx.ReturnData[mentionedJIDsContextKey].([]string)
 		sort.Strings(mentionedJIDs)
@@ -204,5 +228,5 @@ func (formatter *Formatter) ParseMatrix(html string, mentions *event.Mentions) (
 func (formatter *Formatter) ParseMatrixWithoutMentions(html string) string {
 	ctx := format.NewContext(context.TODO())
 	ctx.ReturnData[allowedMentionsContextKey] = map[types.JID]struct{}{}
-	return formatter.matrixHTMLParser.Parse(html, ctx)
+	return formatter.matrixHTMLParser.Parse(convertMatrixHeadings(html), ctx)
 }
@@ -0,0 +1,107 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+)
+
+const maxReverseGeocodeResponseSize = 1024 * 1024
+
+// reverseGeocodeCache is a bounded in-memory cache of reverse geocoded addresses.
+// When the cache is full, the oldest entry is evicted.
+type reverseGeocodeCache struct {
+	lock    sync.Mutex
+	entries map[string]string
+	order   []string
+}
+
+func (rgc *reverseGeocodeCache) get(key string) (string, bool) {
+	rgc.lock.Lock()
+	defer rgc.lock.Unlock()
+	address, ok := rgc.entries[key]
+	return address, ok
+}
+
+func (rgc *reverseGeocodeCache) put(key, address string, maxSize int) {
+	if maxSize <= 0 {
+		return
+	}
+	rgc.lock.Lock()
+	defer rgc.lock.Unlock()
+	if rgc.entries == nil {
+		rgc.entries = make(map[string]string)
+	}
+	if _, exists := rgc.entries[key]; !exists {
+		rgc.order = append(rgc.order, key)
+	}
+	rgc.entries[key] = address
+	for len(rgc.order) > maxSize {
+		delete(rgc.entries, rgc.order[0])
+		rgc.order = rgc.order[1:]
+	}
+}
+
+// ReverseGeocode looks up a human-readable address for the given coordinates using the configured provider.
+// It returns an empty string if reverse geocoding is disabled or the lookup fails.
+func (br *WABridge) ReverseGeocode(ctx context.Context, lat, long float64) string {
+	cfg := &br.Config.Bridge.Location
+	url := cfg.FormatReverseGeocodeURL(lat, long)
+	if url == "" {
+		return ""
+	}
+	// Four decimals is roughly 10 meters, which is close enough to share addresses
+	cacheKey := fmt.Sprintf("%.4f,%.4f", lat, long)
+	if address, ok := br.reverseGeocodeCache.get(cacheKey); ok {
+		return address
+	}
+	log := zerolog.Ctx(ctx)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to prepare reverse geocoding request")
+		return ""
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", br.Name, br.Version))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to reverse geocode location")
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Warn().Int("status_code", resp.StatusCode).Msg("Unexpected status code from reverse geocoding provider")
+		return ""
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxReverseGeocodeResponseSize))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read reverse geocoding response")
+		return ""
+	}
+	address := gjson.GetBytes(data, cfg.ReverseGeocoding.AddressPath).String()
+	br.reverseGeocodeCache.put(cacheKey, address, cfg.ReverseGeocoding.CacheSize)
+	return address
+}
@@ -0,0 +1,103 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+)
+
+// getRepresentedSenderName checks if the ghost user cap of the portal has been reached and the sender doesn't have
+// a ghost in the room yet. If so, it returns the name of the sender, which should be prefixed to the message sent by
+// the bridge bot. Otherwise, it returns an empty string, which means the sender's own ghost should be used.
+//
+// This is checked before the ghost is touched at all, so that no appservice users are registered for such senders.
+func (portal *Portal) getRepresentedSenderName(ctx context.Context, source *User, info *types.MessageInfo) string {
+	maxGhosts := portal.bridge.Config.Bridge.MaxGhostsPerPortal
+	if maxGhosts <= 0 || len(portal.MXID) == 0 || !portal.IsGroupChat() || info.IsFromMe || info.Sender.Server != types.DefaultUserServer {
+		return ""
+	} else if portal.bridge.GetUserByJID(info.Sender) != nil {
+		// Users of the bridge always get their own ghost, so that double puppeting and invites work
+		return ""
+	}
+	ghostMXID := portal.bridge.FormatPuppetMXID(info.Sender)
+	if portal.bridge.StateStore.IsInRoom(ctx, portal.MXID, ghostMXID) {
+		return ""
+	}
+	members, err := portal.bridge.StateStore.GetRoomJoinedOrInvitedMembers(ctx, portal.MXID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to get room members to check ghost user cap")
+		return ""
+	}
+	ghostCount := 0
+	for _, member := range members {
+		if _, isGhost := portal.bridge.ParsePuppetMXID(member); isGhost {
+			ghostCount++
+		}
+	}
+	if ghostCount < maxGhosts {
+		return ""
+	}
+	var contact types.ContactInfo
+	if source.Client != nil {
+		contact, _ = source.Client.Store.Contacts.GetContact(info.Sender)
+	}
+	if contact.PushName == "" {
+		contact.PushName = info.PushName
+	}
+	name, _ := portal.bridge.Config.Bridge.FormatDisplayname(info.Sender, contact)
+	zerolog.Ctx(ctx).Debug().
+		Int("ghost_count", ghostCount).
+		Msg("Ghost user cap reached, sending message through bridge bot")
+	return name
+}
+
+// getCappedMessageIntent returns the intent that should be used for a message, taking the ghost user cap into account.
+// If the message should be sent through the bridge bot, the name of the sender is returned too.
+func (portal *Portal) getCappedMessageIntent(ctx context.Context, source *User, info *types.MessageInfo) (*appservice.IntentAPI, string) {
+	if name := portal.getRepresentedSenderName(ctx, source, info); name != "" {
+		return portal.MainIntent(), name
+	}
+	return portal.getMessageIntent(ctx, source, info), ""
+}
+
+// addRepresentedSenderName prefixes the name of the original sender to a message sent through the bridge bot.
+func addRepresentedSenderName(converted *ConvertedMessage, name string) {
+	content := converted.Content
+	if converted.Caption != nil {
+		content = converted.Caption
+	}
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		if content.FileName == "" || content.FileName == content.Body {
+			// Media without a caption: use the name as the caption (the body is the caption when it differs from the file name)
+			content.FileName = content.Body
+			content.Body = fmt.Sprintf("%s:", name)
+			return
+		}
+	}
+	if content.Format == event.FormatHTML {
+		content.FormattedBody = fmt.Sprintf("<strong>%s</strong>: %s", html.EscapeString(name), content.FormattedBody)
+	}
+	content.Body = fmt.Sprintf("%s: %s", name, content.Body)
+}
@@ -0,0 +1,159 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"maunium.net/go/mautrix/event"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// isMembershipHistoryStub checks if a history sync message is a group membership or subject change notification
+// that should be backfilled as a notice.
+func isMembershipHistoryStub(webMsg *waProto.WebMessageInfo) bool {
+	switch webMsg.GetMessageStubType() {
+	case waProto.WebMessageInfo_GROUP_CREATE,
+		waProto.WebMessageInfo_GROUP_CHANGE_SUBJECT,
+		waProto.WebMessageInfo_GROUP_PARTICIPANT_ADD,
+		waProto.WebMessageInfo_GROUP_PARTICIPANT_INVITE,
+		waProto.WebMessageInfo_GROUP_PARTICIPANT_REMOVE,
+		waProto.WebMessageInfo_GROUP_PARTICIPANT_LEAVE:
+		return true
+	default:
+		return false
+	}
+}
+
+func (br *WABridge) shouldBackfillMembershipStub(chat types.JID, webMsg *waProto.WebMessageInfo) bool {
+	return br.Config.Bridge.HistorySync.MembershipHistory && chat.Server == types.GroupServer && isMembershipHistoryStub(webMsg)
+}
+
+func (portal *Portal) formatStubParticipants(params []string) string {
+	names := make([]string, 0, len(params))
+	for _, param := range params {
+		jid, err := types.ParseJID(param)
+		if err != nil || jid.Server != types.DefaultUserServer {
+			continue
+		}
+		puppet := portal.bridge.GetPuppetByJID(jid)
+		if puppet != nil && puppet.Displayname != "" {
+			names = append(names, puppet.Displayname)
+		} else {
+			names = append(names, "+"+jid.User)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// formatMembershipStub returns the notice text for a membership history stub. Like other group change notices,
+// the text is phrased without a subject, as the notice is sent by the ghost of the user who made the change.
+func (portal *Portal) formatMembershipStub(info *types.MessageInfo, webMsg *waProto.WebMessageInfo) string {
+	params := webMsg.GetMessageStubParameters()
+	switch webMsg.GetMessageStubType() {
+	case waProto.WebMessageInfo_GROUP_CREATE:
+		if len(params) > 0 && params[0] != "" {
+			return fmt.Sprintf("Created the group %s", params[0])
+		}
+		return "Created the group"
+	case waProto.WebMessageInfo_GROUP_CHANGE_SUBJECT:
+		if len(params) > 0 && params[0] != "" {
+			return fmt.Sprintf("Changed the group name to %s", params[0])
+		}
+		return "Changed the group name"
+	case waProto.WebMessageInfo_GROUP_PARTICIPANT_INVITE:
+		return "Joined the group using an invite link"
+	case waProto.WebMessageInfo_GROUP_PARTICIPANT_LEAVE:
+		return "Left the group"
+	case waProto.WebMessageInfo_GROUP_PARTICIPANT_ADD:
+		if len(params) == 0 || (len(params) == 1 && params[0] == info.Sender.ToNonAD().String()) {
+			return "Joined the group"
+		}
+		return fmt.Sprintf("Added %s", portal.formatStubParticipants(params))
+	case waProto.WebMessageInfo_GROUP_PARTICIPANT_REMOVE:
+		return fmt.Sprintf("Removed %s", portal.formatStubParticipants(params))
+	default:
+		return ""
+	}
+}
+
+// fixMembershipStubSender fills the sender of stubs where WhatsApp only includes the affected user in the parameters.
+func fixMembershipStubSender(info *types.MessageInfo, webMsg *waProto.WebMessageInfo) {
+	if !info.Sender.IsEmpty() || len(webMsg.GetMessageStubParameters()) == 0 {
+		return
+	}
+	switch webMsg.GetMessageStubType() {
+	case waProto.WebMessageInfo_GROUP_PARTICIPANT_LEAVE, waProto.WebMessageInfo_GROUP_PARTICIPANT_INVITE:
+		if jid, err := types.ParseJID(webMsg.GetMessageStubParameters()[0]); err == nil {
+			info.Sender = jid
+		}
+	}
+}
+
+// convertMembershipStub converts a membership history stub into a notice at the original timestamp.
+func (portal *Portal) convertMembershipStub(ctx context.Context, source *User, info *types.MessageInfo, webMsg *waProto.WebMessageInfo) *ConvertedMessage {
+	fixMembershipStubSender(info, webMsg)
+	text := portal.formatMembershipStub(info, webMsg)
+	if text == "" {
+		return nil
+	}
+	puppet := portal.getMessagePuppet(ctx, source, info)
+	if puppet == nil {
+		return nil
+	}
+	return &ConvertedMessage{
+		Intent: puppet.IntentFor(portal),
+		Type:   event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    text,
+		},
+	}
+}
+
+// handleMembershipStub sends a membership history stub to Matrix when backfilling without batch sending.
+func (portal *Portal) handleMembershipStub(ctx context.Context, source *User, msgEvt *events.Message, webMsg *waProto.WebMessageInfo) {
+	log := zerolog.Ctx(ctx)
+	existingMsg, err := portal.bridge.DB.Message.GetByJID(ctx, portal.Key, msgEvt.Info.ID)
+	if err != nil {
+		log.Err(err).Msg("Failed to check if membership history notice is duplicate")
+		return
+	} else if existingMsg != nil {
+		return
+	}
+	converted := portal.convertMembershipStub(ctx, source, &msgEvt.Info, webMsg)
+	if converted == nil {
+		return
+	}
+	var extra map[string]any
+	if portal.bridge.Config.Bridge.HistorySync.Silent {
+		extra = map[string]any{SilentBackfillKey: SilentBackfillValue}
+	}
+	resp, err := portal.sendMessage(ctx, converted.Intent, converted.Type, converted.Content, extra, msgEvt.Info.Timestamp.UnixMilli())
+	if err != nil {
+		log.Err(err).Msg("Failed to send membership history notice")
+		return
+	}
+	portal.markHandled(ctx, nil, &msgEvt.Info, resp.EventID, converted.Intent.UserID, true, false, database.MsgFake, 0, database.MsgNoError)
+}
@@ -159,6 +159,7 @@ func (user *User) backfillAll() {
 		Msg("Probably received all history sync blobs, now backfilling conversations")
 	limit := user.bridge.Config.Bridge.HistorySync.MaxInitialConversations
 	bridgedCount := 0
+	var toCreate []*Portal
 	// Find the portals for all the conversations.
 	for _, conv := range conversations {
 		jid, err := types.ParseJID(conv.ConversationID)
@@ -190,12 +191,48 @@ func (user *User) backfillAll() {
 			}
 		} else if limit < 0 || bridgedCount < limit {
 			bridgedCount++
-			err = portal.CreateMatrixRoom(ctx, user, nil, nil, true, true)
-			if err != nil {
-				log.Err(err).Msg("Failed to create Matrix room for backfill")
-			}
+			toCreate = append(toCreate, portal)
+		}
+	}
+	user.createHistorySyncPortals(ctx, toCreate)
+}
+
+// waitPortalCreateDelay blocks until enough time has passed since the previous portal was created from history sync.
+func (user *User) waitPortalCreateDelay() {
+	user.portalCreateLock.Lock()
+	defer user.portalCreateLock.Unlock()
+	delay := time.Duration(user.bridge.Config.Bridge.HistorySync.PortalCreateDelay) * time.Second
+	if wait := time.Until(user.lastPortalCreate.Add(delay)); wait > 0 {
+		time.Sleep(wait)
+	}
+	user.lastPortalCreate = time.Now()
+}
+
+// createHistorySyncPortals creates rooms for the given portals in order (most recent first) with a delay between
+// each room, and reports progress in the management room.
+func (user *User) createHistorySyncPortals(ctx context.Context, portals []*Portal) {
+	log := zerolog.Ctx(ctx)
+	interval := user.bridge.Config.Bridge.HistorySync.PortalCreateProgressInterval
+	reportProgress := interval > 0 && len(portals) > interval
+	if reportProgress {
+		user.sendMarkdownBridgeAlert(ctx, "Creating portals for %d chats from history sync, starting with the most recent ones", len(portals))
+	}
+	created := 0
+	for i, portal := range portals {
+		user.waitPortalCreateDelay()
+		err := portal.CreateMatrixRoom(ctx, user, nil, nil, true, true)
+		if err != nil {
+			log.Err(err).Str("portal_jid", portal.Key.JID.String()).Msg("Failed to create Matrix room for backfill")
+		} else {
+			created++
+		}
+		if reportProgress && (i+1)%interval == 0 && i+1 < len(portals) {
+			user.sendMarkdownBridgeAlert(ctx, "Created portals for %d/%d chats from history sync", i+1, len(portals))
 		}
 	}
+	if reportProgress {
+		user.sendMarkdownBridgeAlert(ctx, "Finished creating portals from history sync: %d/%d created successfully", created, len(portals))
+	}
 }
 
 func (portal *Portal) legacyBackfill(ctx context.Context, user *User) {
@@ -232,6 +269,10 @@ func (portal *Portal) legacyBackfill(ctx context.Context, user *User) {
 			Stringer("message_sender", msgEvt.Info.Sender).
 			Logger().
 			WithContext(ctx)
+		if portal.bridge.shouldBackfillMembershipStub(portal.Key.JID, messages[i]) {
+			portal.handleMembershipStub(ctx, user, msgEvt, messages[i])
+			continue
+		}
 		portal.handleMessage(ctx, user, msgEvt, true)
 	}
 	if conv != nil {
@@ -240,15 +281,49 @@ func (portal *Portal) legacyBackfill(ctx context.Context, user *User) {
 		shouldMarkAsRead := !isUnread || isTooOld
 		if shouldMarkAsRead {
 			user.markSelfReadFull(ctx, portal)
+		} else if user.bridge.Config.Bridge.HistorySync.Silent && conv.UnreadCount > 0 {
+			for i := findLastReadHistoryMessage(messages, int(conv.UnreadCount)); i >= 0 && i < len(messages); i++ {
+				// Not all messages are bridged, so use the newest bridged message that has been read
+				lastRead, err := user.bridge.DB.Message.GetByJID(ctx, portal.Key, messages[i].GetKey().GetId())
+				if err != nil {
+					log.Err(err).Msg("Failed to get last read message to mark as read after silent backfill")
+					break
+				} else if lastRead != nil {
+					user.markSelfReadUpTo(ctx, portal, lastRead)
+					break
+				}
+			}
 		}
 	}
 	log.Info().Msg("Backfill complete, deleting leftover messages from database")
+	Analytics.Track(user.MXID, "WhatsApp backfill completed", map[string]interface{}{
+		"group": portal.IsGroupChat(),
+	})
 	err = user.bridge.DB.HistorySync.DeleteConversation(ctx, user.MXID, portal.Key.JID.String())
 	if err != nil {
 		log.Err(err).Msg("Failed to delete history sync conversation from database after backfill")
 	}
 }
 
+// findLastReadHistoryMessage returns the index of the newest message that has been read on the phone,
+// or -1 if all the given messages are unread. The messages must be sorted newest first.
+//
+// The unread count of a conversation only includes incoming messages, so own messages, system messages,
+// reactions and other protocol messages are skipped when counting.
+func findLastReadHistoryMessage(messages []*waProto.WebMessageInfo, unreadCount int) int {
+	unread := 0
+	for i, msg := range messages {
+		if unread >= unreadCount {
+			return i
+		}
+		content := msg.GetMessage()
+		if !msg.GetKey().GetFromMe() && content != nil && content.ReactionMessage == nil && content.ProtocolMessage == nil {
+			unread++
+		}
+	}
+	return -1
+}
+
 func (user *User) dailyMediaRequestLoop() {
 	log := user.zlog.With().
 		Str("action", "daily media request loop").
@@ -413,6 +488,7 @@ func (user *User) backfillInChunks(ctx context.Context, req *database.BackfillTa
 
 	if len(portal.MXID) == 0 {
 		log.Debug().Msg("Creating portal for chat as part of history sync handling")
+		user.waitPortalCreateDelay()
 		err = portal.CreateMatrixRoom(ctx, user, nil, nil, true, false)
 		if err != nil {
 			log.Err(err).Msg("Failed to create room for chat during backfill")
@@ -517,6 +593,9 @@ func (user *User) storeHistorySync(evt *waProto.HistorySync) {
 	if evt.GetGlobalSettings() != nil {
 		log.Debug().Interface("global_settings", evt.GetGlobalSettings()).Msg("Got global settings in history sync")
 	}
+	if evt.GetSyncType() == waProto.HistorySync_NON_BLOCKING_DATA {
+		user.storeRecentStickers(ctx, evt.GetRecentStickers())
+	}
 	if evt.GetSyncType() == waProto.HistorySync_INITIAL_STATUS_V3 || evt.GetSyncType() == waProto.HistorySync_PUSH_NAME || evt.GetSyncType() == waProto.HistorySync_NON_BLOCKING_DATA {
 		log.Debug().
 			Int("conversation_count", len(evt.GetConversations())).
@@ -545,11 +624,17 @@ func (user *User) storeHistorySync(evt *waProto.HistorySync) {
 				Msg("Failed to parse chat JID in history sync")
 			continue
 		} else if jid.Server == types.BroadcastServer {
+			if user.bridge.Config.Bridge.BroadcastListPortals && jid != types.StatusBroadcastJID {
+				user.syncBroadcastListFromHistory(ctx, jid, conv)
+			}
 			log.Debug().Str("chat_jid", jid.String()).Msg("Skipping broadcast list in history sync")
 			continue
 		} else if jid.Server == types.HiddenUserServer {
 			log.Debug().Str("chat_jid", jid.String()).Msg("Skipping hidden user JID chat in history sync")
 			continue
+		} else if user.isIgnored(jid) {
+			log.Debug().Str("chat_jid", jid.String()).Msg("Skipping ignored chat in history sync")
+			continue
 		}
 		totalMessageCount += len(conv.GetMessages())
 		log := log.With().
@@ -609,9 +694,13 @@ func (user *User) storeHistorySync(evt *waProto.HistorySync) {
 			}
 
 			msgType := getMessageType(msgEvt.Message)
-			if msgType == "unknown" || msgType == "ignore" || strings.HasPrefix(msgType, "unknown_protocol_") || !containsSupportedMessage(msgEvt.Message) {
+			// Membership changes don't have message content, but they're stored to be backfilled as notices
+			isMembershipStub := user.bridge.shouldBackfillMembershipStub(jid, rawMsg.GetMessage())
+			if !isMembershipStub && (msgType == "unknown" || msgType == "ignore" || strings.HasPrefix(msgType, "unknown_protocol_") || !containsSupportedMessage(msgEvt.Message)) {
 				unsupportedTypes++
 				continue
+			} else if user.isIgnored(msgEvt.Info.Sender) {
+				continue
 			}
 
 			initPortal()
@@ -672,6 +761,20 @@ func (user *User) storeHistorySync(evt *waProto.HistorySync) {
 	}
 }
 
+func (user *User) syncBroadcastListFromHistory(ctx context.Context, jid types.JID, conv *waProto.Conversation) {
+	info := &BroadcastListInfo{Name: conv.GetName()}
+	if len(conv.GetParticipant()) > 0 {
+		info.Recipients = make([]types.JID, 0, len(conv.GetParticipant()))
+		for _, participant := range conv.GetParticipant() {
+			participantJID, err := types.ParseJID(participant.GetUserJid())
+			if err == nil {
+				info.Recipients = append(info.Recipients, participantJID)
+			}
+		}
+	}
+	go user.GetPortalByJID(jid).SyncBroadcastList(ctx, user, info)
+}
+
 func getConversationTimestamp(conv *waProto.Conversation) uint64 {
 	convTs := conv.GetConversationTimestamp()
 	if convTs == 0 && len(conv.GetMessages()) > 0 {
@@ -778,6 +881,25 @@ func (portal *Portal) backfill(ctx context.Context, source *User, messages []*wa
 			Logger()
 		ctx := log.WithContext(ctx)
 
+		if portal.bridge.shouldBackfillMembershipStub(portal.Key.JID, webMsg) {
+			converted := portal.convertMembershipStub(ctx, source, &msgEvt.Info, webMsg)
+			if converted == nil {
+				continue
+			}
+			evt, err := portal.wrapBatchEvent(ctx, &msgEvt.Info, converted.Intent, converted.Type, converted.Content, nil, "")
+			if err != nil {
+				log.Err(err).Msg("Failed to handle membership history notice in backfill")
+				continue
+			}
+			req.Events = append(req.Events, evt)
+			infos = append(infos, &wrappedInfo{
+				MessageInfo: &msgEvt.Info,
+				Type:        database.MsgFake,
+				SenderMXID:  evt.Sender,
+			})
+			continue
+		}
+
 		msgType := getMessageType(msgEvt.Message)
 		if msgType == "unknown" || msgType == "ignore" || msgType == "unknown_protocol" {
 			if msgType != "ignore" {
@@ -863,7 +985,7 @@ func (portal *Portal) requestMediaRetries(ctx context.Context, source *User, eve
 }
 
 func (portal *Portal) appendBatchEvents(ctx context.Context, source *User, converted *ConvertedMessage, info *types.MessageInfo, raw *waProto.WebMessageInfo, eventsArray *[]*event.Event, infoArray *[]*wrappedInfo) error {
-	if portal.bridge.Config.Bridge.CaptionInMessage {
+	if portal.bridge.Config.Bridge.CaptionMode == config.CaptionModeMerged {
 		converted.MergeCaption()
 	}
 	mainEvt, err := portal.wrapBatchEvent(ctx, info, converted.Intent, converted.Type, converted.Content, converted.Extra, "")
@@ -0,0 +1,338 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// translations maps language codes to translations of user-visible bridge strings.
+// The keys are the English format strings used in the code, which are also the fallback
+// when a string hasn't been translated.
+var translations = map[string]map[string]string{
+	"de": {
+		// Type names
+		"message":          "Nachricht",
+		"reaction":         "Reaktion",
+		"redaction":        "Löschung",
+		"poll response":    "Umfrageantwort",
+		"poll start":       "Umfrage",
+		"unknown event":    "Unbekannte Aktion",
+		"photo":            "Foto",
+		"sticker":          "Sticker",
+		"video attachment": "Video",
+		"video message":    "Videonachricht",
+		"audio attachment": "Audiodatei",
+		"voice message":    "Sprachnachricht",
+		"file attachment":  "Datei",
+		"location":         "Standort",
+		"contact":          "Kontakt",
+
+		// Call notices
+		"Incoming call. Use the WhatsApp app to answer.":    "Eingehender Anruf. Verwende die WhatsApp-App, um ihn anzunehmen.",
+		"Incoming %s call. Use the WhatsApp app to answer.": "Eingehender Anruf (%s). Verwende die WhatsApp-App, um ihn anzunehmen.",
+		"group": "Gruppe",
+		"video": "Video",
+		"audio": "Audio",
+
+		// Error notices
+		"⚠ Your %s was not bridged: %v":                              "⚠ %s wurde nicht übertragen: %v",
+		"⚠ Your %s may not have been bridged: %v":                    "⚠ %s wurde möglicherweise nicht übertragen: %v",
+		"⚠ Bridging your %s is taking longer than usual":             "⚠ Das Übertragen dauert länger als üblich (%s)",
+		"⚠ Your message wasn't delivered to %d of %d recipients: %s": "⚠ Deine Nachricht wurde %d von %d Empfängern nicht zugestellt: %s",
+		UndecryptableMessageNotice: "Entschlüsseln der Nachricht von WhatsApp fehlgeschlagen, warte darauf, dass der Absender sie erneut sendet... " +
+			"([mehr erfahren](https://faq.whatsapp.com/general/security-and-privacy/seeing-waiting-for-this-message-this-may-take-a-while))",
+		"Your phone didn't resend the message. It may no longer be available on your phone.": "Dein Telefon hat die Nachricht nicht erneut gesendet. Möglicherweise ist sie dort nicht mehr verfügbar.",
+		"Failed to bridge media: %v":                             "Übertragen der Medien fehlgeschlagen: %v",
+		"Large %s not bridged - please use WhatsApp app to view": "Große Datei (%s) nicht übertragen - bitte in der WhatsApp-App ansehen",
+		"Old %s.": "Veraltete Medien (%s).",
+		" Media will be automatically requested from your phone later.":            " Die Medien werden später automatisch von deinem Telefon angefordert.",
+		" React with the ♻ (recycle) emoji to request this media from your phone.": " Reagiere mit dem ♻-Emoji (Recycling), um die Medien von deinem Telefon anzufordern.",
+
+		// Unsupported message placeholders
+		"Unsupported business message":   "Nicht unterstützte Geschäftsnachricht",
+		"Unsupported location message":   "Nicht unterstützte Standortnachricht",
+		"Unsupported list reply message": "Nicht unterstützte Listenantwort",
+		"Unsupported message type":       "Nicht unterstützter Nachrichtentyp",
+
+		// Polls
+		"Poll results (%d voters):": "Umfrageergebnisse (%d Teilnehmende):",
+		"Poll results (1 voter):":   "Umfrageergebnisse (1 Teilnehmende*r):",
+
+		// Reply fallbacks
+		"in %s":           "in %s",
+		"on your status":  "in deinem Status",
+		"on their status": "in ihrem Status",
+
+		// Room metadata
+		"Disappearing messages: %s": "Selbstlöschende Nachrichten: %s",
+
+		// Group and contact change notices
+		"Changed the group settings to allow only admins to send messages":                               "Hat die Gruppeneinstellungen geändert, sodass nur Admins Nachrichten senden dürfen",
+		"Changed the group settings to allow all participants to send messages":                          "Hat die Gruppeneinstellungen geändert, sodass alle Mitglieder Nachrichten senden dürfen",
+		"Changed the group settings to allow only admins to edit the group info":                         "Hat die Gruppeneinstellungen geändert, sodass nur Admins die Gruppeninfo bearbeiten dürfen",
+		"Changed the group settings to allow all participants to edit the group info":                    "Hat die Gruppeneinstellungen geändert, sodass alle Mitglieder die Gruppeninfo bearbeiten dürfen",
+		"Removed the group description":                                                                  "Hat die Gruppenbeschreibung entfernt",
+		"Changed the group description":                                                                  "Hat die Gruppenbeschreibung geändert",
+		"Turned off disappearing messages":                                                               "Hat selbstlöschende Nachrichten deaktiviert",
+		"Set the disappearing message timer to %s":                                                       "Hat selbstlöschende Nachrichten auf %s gestellt",
+		"Automatically enabled disappearing message timer (%s) because incoming message is disappearing": "Selbstlöschende Nachrichten (%s) wurden automatisch aktiviert, weil eine eingehende Nachricht selbstlöschend ist",
+		"Removed their profile picture":                                                                  "Hat das Profilbild entfernt",
+		"Changed their profile picture":                                                                  "Hat das Profilbild geändert",
+		"Cleared their about text":                                                                       "Hat den Infotext entfernt",
+		"Changed their about text to: %s":                                                                "Hat den Infotext geändert: %s",
+		"%s cleared their about text.":                                                                   "%s hat den Infotext entfernt.",
+		"%s changed their about text to:\n\n> %s":                                                        "%s hat den Infotext geändert:\n\n> %s",
+
+		// Forwarded messages
+		forwardedPrefix:           "Weitergeleitet",
+		frequentlyForwardedPrefix: "Häufig weitergeleitet",
+
+		// Management room alerts
+		"You left the portal room for **%s**. Use `leave-group %s` to also leave the WhatsApp group.":                                    "Du hast den Portalraum für **%s** verlassen. Verwende `leave-group %s`, um auch die WhatsApp-Gruppe zu verlassen.",
+		"The bridge was started in another location.":                                                                                    "Die Bridge wurde an einem anderen Ort gestartet.",
+		"The bridge was started in another location %d more times in the last %s.":                                                       "Die Bridge wurde in den letzten %[2]s noch %[1]d Mal an einem anderen Ort gestartet.",
+		"Use `reconnect` to reconnect this one. If this keeps happening, make sure the same session isn't used by two bridge instances.": "Verwende `reconnect`, um diese Instanz neu zu verbinden. Wenn das öfter passiert, stelle sicher, dass nicht zwei Bridge-Instanzen dieselbe Sitzung verwenden.",
+		"WhatsApp closed the connection with an unknown stream error.":                                                                   "WhatsApp hat die Verbindung mit einem unbekannten Stream-Fehler geschlossen.",
+		"WhatsApp closed the connection with a stream error %d more times in the last %s.":                                               "WhatsApp hat die Verbindung in den letzten %[2]s noch %[1]d Mal mit einem Stream-Fehler geschlossen.",
+		"Use `reconnect` to try again. If the error persists, ask the bridge administrator to check the logs.":                           "Verwende `reconnect`, um es erneut zu versuchen. Wenn der Fehler bestehen bleibt, bitte den Bridge-Administrator, die Logs zu prüfen.",
+		"Connecting to WhatsApp failed.":                                                                                                      "Die Verbindung zu WhatsApp ist fehlgeschlagen.",
+		"Connecting to WhatsApp failed %d more times in the last %s.":                                                                         "Die Verbindung zu WhatsApp ist in den letzten %[2]s noch %[1]d Mal fehlgeschlagen.",
+		"Use `reconnect` to try again. If the error persists, you may need to `logout` and log in again.":                                     "Verwende `reconnect`, um es erneut zu versuchen. Wenn der Fehler bestehen bleibt, musst du dich eventuell mit `logout` abmelden und erneut anmelden.",
+		"WhatsApp rejected the connection because the bridge is outdated.":                                                                    "WhatsApp hat die Verbindung abgelehnt, weil die Bridge veraltet ist.",
+		"WhatsApp rejected the connection because the bridge is outdated %d more times in the last %s.":                                       "WhatsApp hat die Verbindung in den letzten %[2]s noch %[1]d Mal abgelehnt, weil die Bridge veraltet ist.",
+		"Ask the bridge administrator to update the bridge. Reconnecting won't help until then.":                                              "Bitte den Bridge-Administrator, die Bridge zu aktualisieren. Bis dahin hilft erneutes Verbinden nicht.",
+		"Your WhatsApp account has been temporarily banned.":                                                                                  "Dein WhatsApp-Konto wurde vorübergehend gesperrt.",
+		"WhatsApp reported a temporary ban %d more times in the last %s.":                                                                     "WhatsApp hat in den letzten %[2]s noch %[1]d Mal eine vorübergehende Sperre gemeldet.",
+		"Wait until the ban expires before reconnecting, and avoid sending messages that may be considered spam.":                             "Warte mit dem erneuten Verbinden, bis die Sperre abgelaufen ist, und vermeide Nachrichten, die als Spam gelten könnten.",
+		"The connection to WhatsApp was interrupted %d times in the last %s.":                                                                 "Die Verbindung zu WhatsApp wurde in den letzten %[2]s %[1]d Mal unterbrochen.",
+		"The bridge reconnects automatically, but frequent disconnects usually mean the network connection of the bridge server is unstable.": "Die Bridge verbindet sich automatisch neu, aber häufige Unterbrechungen bedeuten meist, dass die Netzwerkverbindung des Bridge-Servers instabil ist.",
+		"WhatsApp didn't respond to keepalive pings %d times in the last %s.":                                                                 "WhatsApp hat in den letzten %[2]s %[1]d Mal nicht auf Keepalive-Pings geantwortet.",
+		"This means the bridge server's connection to WhatsApp's servers is unreliable, not that your phone is offline. The bridge reconnects automatically, use `reconnect` if messages aren't coming through.": "Das bedeutet, dass die Verbindung des Bridge-Servers zu den WhatsApp-Servern unzuverlässig ist, nicht dass dein Telefon offline ist. Die Bridge verbindet sich automatisch neu, verwende `reconnect`, wenn keine Nachrichten ankommen.",
+		"%d seconds": "%d Sekunden",
+		"%d minutes": "%d Minuten",
+		"%d hours":   "%d Stunden",
+
+		// Self-chat commands
+		selfChatHelp: "Verfügbare Bridge-Befehle:\n" +
+			"%[1]s status - Verbindungsstatus der Bridge anzeigen\n" +
+			"%[1]s sync - Kontakte und Gruppen neu synchronisieren\n" +
+			"%[1]s help - diese Nachricht anzeigen",
+		"Resynced contacts and groups":                                 "Kontakte und Gruppen wurden neu synchronisiert",
+		"Failed to resync contacts: %v":                                "Synchronisieren der Kontakte fehlgeschlagen: %v",
+		"Failed to resync groups: %v":                                  "Synchronisieren der Gruppen fehlgeschlagen: %v",
+		"Unknown command %q. Send \"%s help\" for a list of commands.": "Unbekannter Befehl %q. Sende \"%s help\" für eine Liste der Befehle.",
+		"Bridge is connected as +%s (device #%d)":                      "Die Bridge ist als +%s verbunden (Gerät #%d)",
+		"Bridge is not connected to WhatsApp":                          "Die Bridge ist nicht mit WhatsApp verbunden",
+		"Bridge state: %s":                                             "Bridge-Status: %s",
+		"Phone last seen %s ago":                                       "Telefon zuletzt vor %s gesehen",
+		"Matrix account: %s":                                           "Matrix-Konto: %s",
+	},
+	"es": {
+		// Type names
+		"message":          "mensaje",
+		"reaction":         "reacción",
+		"redaction":        "eliminación",
+		"poll response":    "respuesta de encuesta",
+		"poll start":       "encuesta",
+		"unknown event":    "evento desconocido",
+		"photo":            "foto",
+		"sticker":          "sticker",
+		"video attachment": "vídeo",
+		"video message":    "videomensaje",
+		"audio attachment": "audio",
+		"voice message":    "mensaje de voz",
+		"file attachment":  "archivo",
+		"location":         "ubicación",
+		"contact":          "contacto",
+
+		// Call notices
+		"Incoming call. Use the WhatsApp app to answer.":    "Llamada entrante. Usa la app de WhatsApp para responder.",
+		"Incoming %s call. Use the WhatsApp app to answer.": "Llamada entrante (%s). Usa la app de WhatsApp para responder.",
+		"group": "grupo",
+		"video": "vídeo",
+		"audio": "audio",
+
+		// Error notices
+		"⚠ Your %s was not bridged: %v":                              "⚠ No se pudo transferir tu %s: %v",
+		"⚠ Your %s may not have been bridged: %v":                    "⚠ Puede que no se haya transferido tu %s: %v",
+		"⚠ Bridging your %s is taking longer than usual":             "⚠ Transferir tu %s está tardando más de lo habitual",
+		"⚠ Your message wasn't delivered to %d of %d recipients: %s": "⚠ Tu mensaje no se entregó a %d de %d destinatarios: %s",
+		UndecryptableMessageNotice: "No se pudo descifrar el mensaje de WhatsApp, esperando a que el remitente lo reenvíe... " +
+			"([más información](https://faq.whatsapp.com/general/security-and-privacy/seeing-waiting-for-this-message-this-may-take-a-while))",
+		"Your phone didn't resend the message. It may no longer be available on your phone.": "Tu teléfono no reenvió el mensaje. Puede que ya no esté disponible en tu teléfono.",
+		"Failed to bridge media: %v":                             "No se pudo transferir el archivo multimedia: %v",
+		"Large %s not bridged - please use WhatsApp app to view": "Archivo grande (%s) no transferido: ábrelo en la app de WhatsApp",
+		"Old %s.": "Archivo multimedia antiguo (%s).",
+		" Media will be automatically requested from your phone later.":            " El archivo se pedirá automáticamente a tu teléfono más tarde.",
+		" React with the ♻ (recycle) emoji to request this media from your phone.": " Reacciona con el emoji ♻ (reciclaje) para pedir el archivo a tu teléfono.",
+
+		// Unsupported message placeholders
+		"Unsupported business message":   "Mensaje de empresa no compatible",
+		"Unsupported location message":   "Mensaje de ubicación no compatible",
+		"Unsupported list reply message": "Respuesta de lista no compatible",
+		"Unsupported message type":       "Tipo de mensaje no compatible",
+
+		// Polls
+		"Poll results (%d voters):": "Resultados de la encuesta (%d votantes):",
+		"Poll results (1 voter):":   "Resultados de la encuesta (1 votante):",
+
+		// Reply fallbacks
+		"in %s":           "en %s",
+		"on your status":  "en tu estado",
+		"on their status": "en su estado",
+
+		// Room metadata
+		"Disappearing messages: %s": "Mensajes temporales: %s",
+
+		// Group and contact change notices
+		"Changed the group settings to allow only admins to send messages":                               "Cambió los ajustes del grupo para que solo los administradores puedan enviar mensajes",
+		"Changed the group settings to allow all participants to send messages":                          "Cambió los ajustes del grupo para que todos los participantes puedan enviar mensajes",
+		"Changed the group settings to allow only admins to edit the group info":                         "Cambió los ajustes del grupo para que solo los administradores puedan editar la info del grupo",
+		"Changed the group settings to allow all participants to edit the group info":                    "Cambió los ajustes del grupo para que todos los participantes puedan editar la info del grupo",
+		"Removed the group description":                                                                  "Eliminó la descripción del grupo",
+		"Changed the group description":                                                                  "Cambió la descripción del grupo",
+		"Turned off disappearing messages":                                                               "Desactivó los mensajes temporales",
+		"Set the disappearing message timer to %s":                                                       "Estableció la duración de los mensajes temporales en %s",
+		"Automatically enabled disappearing message timer (%s) because incoming message is disappearing": "Se activaron automáticamente los mensajes temporales (%s) porque un mensaje entrante es temporal",
+		"Removed their profile picture":                                                                  "Eliminó su foto de perfil",
+		"Changed their profile picture":                                                                  "Cambió su foto de perfil",
+		"Cleared their about text":                                                                       "Borró su info",
+		"Changed their about text to: %s":                                                                "Cambió su info a: %s",
+		"%s cleared their about text.":                                                                   "%s borró su info.",
+		"%s changed their about text to:\n\n> %s":                                                        "%s cambió su info a:\n\n> %s",
+
+		// Forwarded messages
+		forwardedPrefix:           "Reenviado",
+		frequentlyForwardedPrefix: "Reenviado muchas veces",
+
+		// Management room alerts
+		"You left the portal room for **%s**. Use `leave-group %s` to also leave the WhatsApp group.":                                    "Saliste de la sala del portal de **%s**. Usa `leave-group %s` para salir también del grupo de WhatsApp.",
+		"The bridge was started in another location.":                                                                                    "El puente se inició en otra ubicación.",
+		"The bridge was started in another location %d more times in the last %s.":                                                       "El puente se inició en otra ubicación %d veces más en los últimos %s.",
+		"Use `reconnect` to reconnect this one. If this keeps happening, make sure the same session isn't used by two bridge instances.": "Usa `reconnect` para reconectar este. Si sigue pasando, asegúrate de que dos instancias del puente no usen la misma sesión.",
+		"WhatsApp closed the connection with an unknown stream error.":                                                                   "WhatsApp cerró la conexión con un error de stream desconocido.",
+		"WhatsApp closed the connection with a stream error %d more times in the last %s.":                                               "WhatsApp cerró la conexión con un error de stream %d veces más en los últimos %s.",
+		"Use `reconnect` to try again. If the error persists, ask the bridge administrator to check the logs.":                           "Usa `reconnect` para intentarlo de nuevo. Si el error persiste, pide al administrador del puente que revise los registros.",
+		"Connecting to WhatsApp failed.":                                                                                                      "No se pudo conectar a WhatsApp.",
+		"Connecting to WhatsApp failed %d more times in the last %s.":                                                                         "No se pudo conectar a WhatsApp %d veces más en los últimos %s.",
+		"Use `reconnect` to try again. If the error persists, you may need to `logout` and log in again.":                                     "Usa `reconnect` para intentarlo de nuevo. Si el error persiste, puede que tengas que cerrar sesión con `logout` e iniciarla de nuevo.",
+		"WhatsApp rejected the connection because the bridge is outdated.":                                                                    "WhatsApp rechazó la conexión porque el puente está desactualizado.",
+		"WhatsApp rejected the connection because the bridge is outdated %d more times in the last %s.":                                       "WhatsApp rechazó la conexión porque el puente está desactualizado %d veces más en los últimos %s.",
+		"Ask the bridge administrator to update the bridge. Reconnecting won't help until then.":                                              "Pide al administrador del puente que lo actualice. Hasta entonces, reconectar no servirá.",
+		"Your WhatsApp account has been temporarily banned.":                                                                                  "Tu cuenta de WhatsApp ha sido suspendida temporalmente.",
+		"WhatsApp reported a temporary ban %d more times in the last %s.":                                                                     "WhatsApp informó de una suspensión temporal %d veces más en los últimos %s.",
+		"Wait until the ban expires before reconnecting, and avoid sending messages that may be considered spam.":                             "Espera a que termine la suspensión antes de reconectar y evita enviar mensajes que puedan considerarse spam.",
+		"The connection to WhatsApp was interrupted %d times in the last %s.":                                                                 "La conexión con WhatsApp se interrumpió %d veces en los últimos %s.",
+		"The bridge reconnects automatically, but frequent disconnects usually mean the network connection of the bridge server is unstable.": "El puente se reconecta automáticamente, pero las desconexiones frecuentes suelen indicar que la red del servidor del puente es inestable.",
+		"WhatsApp didn't respond to keepalive pings %d times in the last %s.":                                                                 "WhatsApp no respondió a los pings de keepalive %d veces en los últimos %s.",
+		"This means the bridge server's connection to WhatsApp's servers is unreliable, not that your phone is offline. The bridge reconnects automatically, use `reconnect` if messages aren't coming through.": "Esto significa que la conexión del servidor del puente con los servidores de WhatsApp no es fiable, no que tu teléfono esté desconectado. El puente se reconecta automáticamente; usa `reconnect` si no llegan mensajes.",
+		"%d seconds": "%d segundos",
+		"%d minutes": "%d minutos",
+		"%d hours":   "%d horas",
+
+		// Self-chat commands
+		selfChatHelp: "Comandos del puente disponibles:\n" +
+			"%[1]s status - muestra el estado de conexión del puente\n" +
+			"%[1]s sync - vuelve a sincronizar contactos y grupos\n" +
+			"%[1]s help - muestra este mensaje",
+		"Resynced contacts and groups":                                 "Contactos y grupos sincronizados de nuevo",
+		"Failed to resync contacts: %v":                                "No se pudieron sincronizar los contactos: %v",
+		"Failed to resync groups: %v":                                  "No se pudieron sincronizar los grupos: %v",
+		"Unknown command %q. Send \"%s help\" for a list of commands.": "Comando desconocido %q. Envía \"%s help\" para ver la lista de comandos.",
+		"Bridge is connected as +%s (device #%d)":                      "El puente está conectado como +%s (dispositivo #%d)",
+		"Bridge is not connected to WhatsApp":                          "El puente no está conectado a WhatsApp",
+		"Bridge state: %s":                                             "Estado del puente: %s",
+		"Phone last seen %s ago":                                       "Teléfono visto por última vez hace %s",
+		"Matrix account: %s":                                           "Cuenta de Matrix: %s",
+	},
+}
+
+// SupportedLanguages returns the language codes that bridge messages can be translated to.
+func SupportedLanguages() []string {
+	langs := []string{"en"}
+	for lang := range translations {
+		langs = append(langs, lang)
+	}
+	slices.Sort(langs)
+	return langs
+}
+
+func isSupportedLanguage(lang string) bool {
+	_, ok := translations[lang]
+	return ok || lang == "en"
+}
+
+// allTranslations returns the given English string followed by all of its translations.
+func allTranslations(format string) []string {
+	all := []string{format}
+	for _, lang := range translations {
+		if translated, ok := lang[format]; ok {
+			all = append(all, translated)
+		}
+	}
+	return all
+}
+
+// Translate returns the given format string translated to the given language, with the args formatted into it.
+// If there's no translation, the English string is used.
+func Translate(lang, format string, args ...any) string {
+	if translated, ok := translations[strings.ToLower(lang)][format]; ok {
+		format = translated
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+func (br *WABridge) defaultLanguage() string {
+	if br.Config.Bridge.Language == "" {
+		return "en"
+	}
+	return br.Config.Bridge.Language
+}
+
+func (user *User) language() string {
+	if user.Language != "" {
+		return user.Language
+	}
+	return user.bridge.defaultLanguage()
+}
+
+// language returns the language for bridge messages in the portal.
+// Private chats use the language of the receiver, other chats use the bridge default.
+func (portal *Portal) language() string {
+	if portal.IsPrivateChat() {
+		if user := portal.bridge.GetUserByJID(portal.Key.Receiver); user != nil {
+			return user.language()
+		}
+	}
+	return portal.bridge.defaultLanguage()
+}
+
+// T translates a bridge message to the user's language.
+func (user *User) T(format string, args ...any) string {
+	return Translate(user.language(), format, args...)
+}
+
+// T translates a bridge message to the portal's language.
+func (portal *Portal) T(format string, args ...any) string {
+	return Translate(portal.language(), format, args...)
+}
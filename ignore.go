@@ -0,0 +1,219 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+// parseIgnoreTarget parses a phone number or JID given to the ignore command or in the ignored_jids config option.
+func parseIgnoreTarget(input string) (types.JID, error) {
+	input = strings.TrimSpace(input)
+	if strings.ContainsRune(input, '@') {
+		jid, err := types.ParseJID(input)
+		if err != nil {
+			return jid, err
+		}
+		return jid.ToNonAD(), nil
+	}
+	number := strings.Map(func(r rune) rune {
+		switch r {
+		case '+', ' ', '-', '(', ')':
+			return -1
+		}
+		return r
+	}, input)
+	if number == "" {
+		return types.EmptyJID, fmt.Errorf("empty phone number")
+	}
+	for _, r := range number {
+		if r < '0' || r > '9' {
+			return types.EmptyJID, fmt.Errorf("%q is not a phone number or JID", input)
+		}
+	}
+	return types.NewJID(number, types.DefaultUserServer), nil
+}
+
+func (br *WABridge) loadConfigIgnoredJIDs() {
+	br.configIgnoredJIDs = make(map[types.JID]struct{}, len(br.Config.Bridge.IgnoredJIDs))
+	for _, entry := range br.Config.Bridge.IgnoredJIDs {
+		jid, err := parseIgnoreTarget(entry)
+		if err != nil {
+			br.ZLog.Warn().Err(err).Str("entry", entry).Msg("Invalid entry in ignored JID list")
+			continue
+		}
+		br.configIgnoredJIDs[jid] = struct{}{}
+	}
+}
+
+func (user *User) loadIgnoredJIDs(ctx context.Context) map[types.JID]struct{} {
+	user.ignoredJIDsLock.Lock()
+	defer user.ignoredJIDsLock.Unlock()
+	if user.ignoredJIDs != nil {
+		return user.ignoredJIDs
+	}
+	entries, err := user.bridge.DB.IgnoredJID.GetAllForUser(ctx, user.MXID)
+	if err != nil {
+		user.zlog.Err(err).Msg("Failed to load ignored JIDs")
+		return nil
+	}
+	user.ignoredJIDs = make(map[types.JID]struct{}, len(entries))
+	for _, entry := range entries {
+		user.ignoredJIDs[entry.JID] = struct{}{}
+	}
+	return user.ignoredJIDs
+}
+
+// isIgnored checks if any of the given users or chats are on the ignore list of the bridge or this user.
+// Events from ignored JIDs are dropped before any portals or ghosts are created.
+func (user *User) isIgnored(jids ...types.JID) bool {
+	userIgnored := user.loadIgnoredJIDs(context.TODO())
+	user.ignoredJIDsLock.Lock()
+	defer user.ignoredJIDsLock.Unlock()
+	for _, jid := range jids {
+		if jid.IsEmpty() {
+			continue
+		}
+		jid = jid.ToNonAD()
+		if _, ignored := user.bridge.configIgnoredJIDs[jid]; ignored {
+			return true
+		} else if _, ignored = userIgnored[jid]; ignored {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *User) getIgnoredJIDs(ctx context.Context) []types.JID {
+	ignored := user.loadIgnoredJIDs(ctx)
+	user.ignoredJIDsLock.Lock()
+	defer user.ignoredJIDsLock.Unlock()
+	jids := make([]types.JID, 0, len(ignored))
+	for jid := range ignored {
+		jids = append(jids, jid)
+	}
+	return jids
+}
+
+func (user *User) setIgnored(ctx context.Context, jid types.JID, ignored bool) error {
+	user.loadIgnoredJIDs(ctx)
+	entry := user.bridge.DB.IgnoredJID.New()
+	entry.UserMXID = user.MXID
+	entry.JID = jid
+	var err error
+	if ignored {
+		err = entry.Insert(ctx)
+	} else {
+		err = entry.Delete(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	user.ignoredJIDsLock.Lock()
+	if user.ignoredJIDs != nil {
+		if ignored {
+			user.ignoredJIDs[jid] = struct{}{}
+		} else {
+			delete(user.ignoredJIDs, jid)
+		}
+	}
+	user.ignoredJIDsLock.Unlock()
+	return nil
+}
+
+var cmdIgnore = &commands.FullHandler{
+	Func: wrapCommand(fnIgnore),
+	Name: "ignore",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Silently drop all messages from a WhatsApp user or group. Unlike blocking, this isn't visible on WhatsApp. Use `list` to see ignored users and groups.",
+		Args:        "<_phone number_|_JID_|`list`>",
+	},
+	RequiresLogin: true,
+}
+
+func fnIgnore(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `ignore <phone number or JID>` or `ignore list`")
+		return
+	} else if strings.ToLower(ce.Args[0]) == "list" {
+		ignored := ce.User.getIgnoredJIDs(ce.Ctx)
+		if len(ignored) == 0 && len(ce.Bridge.configIgnoredJIDs) == 0 {
+			ce.Reply("You're not ignoring anyone")
+			return
+		}
+		var lines []string
+		for jid := range ce.Bridge.configIgnoredJIDs {
+			lines = append(lines, fmt.Sprintf("* `%s` (ignored by bridge config)", jid))
+		}
+		for _, jid := range ignored {
+			lines = append(lines, fmt.Sprintf("* `%s`", jid))
+		}
+		ce.Reply("Ignored users and groups:\n\n%s", strings.Join(lines, "\n"))
+		return
+	}
+	jid, err := parseIgnoreTarget(strings.Join(ce.Args, ""))
+	if err != nil {
+		ce.Reply("Invalid phone number or JID: %v", err)
+		return
+	}
+	err = ce.User.setIgnored(ce.Ctx, jid, true)
+	if err != nil {
+		ce.ZLog.Err(err).Stringer("jid", jid).Msg("Failed to add JID to ignore list")
+		ce.Reply("Failed to save ignore list: %v", err)
+		return
+	}
+	ce.Reply("Messages from `%s` will now be ignored. Use `unignore %s` to undo.", jid, jid)
+}
+
+var cmdUnignore = &commands.FullHandler{
+	Func: wrapCommand(fnUnignore),
+	Name: "unignore",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Stop ignoring messages from a WhatsApp user or group.",
+		Args:        "<_phone number_|_JID_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnUnignore(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `unignore <phone number or JID>`")
+		return
+	}
+	jid, err := parseIgnoreTarget(strings.Join(ce.Args, ""))
+	if err != nil {
+		ce.Reply("Invalid phone number or JID: %v", err)
+		return
+	} else if _, ok := ce.Bridge.configIgnoredJIDs[jid]; ok {
+		ce.Reply("`%s` is ignored in the bridge config and can't be unignored with this command", jid)
+		return
+	}
+	err = ce.User.setIgnored(ce.Ctx, jid, false)
+	if err != nil {
+		ce.ZLog.Err(err).Stringer("jid", jid).Msg("Failed to remove JID from ignore list")
+		ce.Reply("Failed to save ignore list: %v", err)
+		return
+	}
+	ce.Reply("Messages from `%s` are no longer ignored", jid)
+}
@@ -0,0 +1,143 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// extractInlineImages removes <img> tags pointing at mxc URIs from the formatted body and returns them as image
+// message contents. The returned string is the remaining formatted body, which should be used as the caption.
+func extractInlineImages(formattedBody string) (images []*event.MessageEventContent, remaining string, hasText bool) {
+	if !strings.Contains(formattedBody, "<img") {
+		return nil, formattedBody, false
+	}
+	body := &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"}
+	nodes, err := html.ParseFragment(strings.NewReader(formattedBody), body)
+	if err != nil {
+		return nil, formattedBody, false
+	}
+	for _, node := range nodes {
+		body.AppendChild(node)
+	}
+	images = collectInlineImages(body, images)
+	if len(images) == 0 {
+		return nil, formattedBody, false
+	}
+	var buf strings.Builder
+	for child := body.FirstChild; child != nil; child = child.NextSibling {
+		_ = html.Render(&buf, child)
+	}
+	return images, buf.String(), hasTextContent(body)
+}
+
+func collectInlineImages(node *html.Node, images []*event.MessageEventContent) []*event.MessageEventContent {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type == html.ElementNode && child.DataAtom == atom.Img {
+			if img := inlineImageToContent(child); img != nil {
+				images = append(images, img)
+				node.RemoveChild(child)
+			}
+		} else {
+			images = collectInlineImages(child, images)
+		}
+		child = next
+	}
+	return images
+}
+
+func inlineImageToContent(node *html.Node) *event.MessageEventContent {
+	var src, alt string
+	for _, attr := range node.Attr {
+		switch attr.Key {
+		case "src":
+			src = attr.Val
+		case "alt":
+			alt = attr.Val
+		}
+	}
+	if !strings.HasPrefix(src, "mxc://") {
+		return nil
+	}
+	if alt == "" {
+		alt = "image"
+	}
+	return &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    alt,
+		URL:     id.ContentURIString(src),
+		// The mime type is detected from the data when the image is downloaded
+		Info: &event.FileInfo{},
+	}
+}
+
+func hasTextContent(node *html.Node) bool {
+	if node.Type == html.TextNode {
+		return strings.TrimSpace(node.Data) != ""
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if hasTextContent(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// convertInlineImages turns a formatted text message with inline images into an image message,
+// or a gallery if there are multiple images. If galleries aren't allowed, the message is turned into
+// the first image and the rest of the images are returned, so that they can be sent as separate messages.
+// Returns false if the message doesn't contain any inline images.
+func (portal *Portal) convertInlineImages(content *event.MessageEventContent, allowGallery bool) (converted bool, extraImages []*event.MessageEventContent) {
+	if content.MsgType != event.MsgText || content.Format != event.FormatHTML {
+		return false, nil
+	}
+	images, caption, hasCaption := extractInlineImages(content.FormattedBody)
+	if len(images) == 0 {
+		return false, nil
+	}
+	if len(images) == 1 || !allowGallery {
+		img := images[0]
+		content.MsgType = event.MsgImage
+		content.URL = img.URL
+		content.Info = img.Info
+		content.FileName = img.Body
+		if hasCaption {
+			content.FormattedBody = caption
+			// The body just needs to differ from the file name, the caption itself is taken from the formatted body
+			if content.Body == content.FileName {
+				content.Body = caption
+			}
+		} else {
+			content.Body = content.FileName
+			content.Format = ""
+			content.FormattedBody = ""
+		}
+		return true, images[1:]
+	}
+	content.MsgType = event.MsgBeeperGallery
+	content.BeeperGalleryImages = images
+	if hasCaption {
+		content.BeeperGalleryCaption, _ = portal.bridge.Formatter.ParseMatrix(caption, content.Mentions)
+	}
+	return true, nil
+}
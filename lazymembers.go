@@ -0,0 +1,74 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/event"
+)
+
+var StateMemberList = event.Type{Type: "fi.mau.whatsapp.member_list", Class: event.StateEventType}
+
+type MemberListEventContent struct {
+	// Partial is true if ghost users are only joined to the room after they send something.
+	Partial bool `json:"partial"`
+	// TotalMembers is the number of participants in the WhatsApp group.
+	TotalMembers int `json:"total_members"`
+}
+
+// isLazyMemberSync checks if the group is large enough that ghosts should only be joined when they first speak.
+func (portal *Portal) isLazyMemberSync(metadata *types.GroupInfo) bool {
+	threshold := portal.bridge.Config.Bridge.LazyMemberThreshold
+	return threshold > 0 && len(metadata.Participants) > threshold
+}
+
+// shouldSyncParticipantEagerly checks if a participant should be joined to the room during member sync
+// even when lazy member sync is enabled for the group. Admins are needed for the power levels to be meaningful,
+// and Matrix users need to be invited to see the room at all.
+func shouldSyncParticipantEagerly(participant types.GroupParticipant, user *User) bool {
+	return user != nil || participant.IsAdmin || participant.IsSuperAdmin
+}
+
+func (portal *Portal) getMemberListEventContent(metadata *types.GroupInfo) *MemberListEventContent {
+	return &MemberListEventContent{
+		Partial:      portal.isLazyMemberSync(metadata),
+		TotalMembers: len(metadata.Participants),
+	}
+}
+
+// updateMemberListState updates the member list marker in the room. The marker is only sent
+// if the member list is partial, or if it was previously marked as partial.
+func (portal *Portal) updateMemberListState(ctx context.Context, metadata *types.GroupInfo) {
+	if len(portal.MXID) == 0 || portal.bridge.Config.Bridge.LazyMemberThreshold <= 0 {
+		return
+	}
+	content := portal.getMemberListEventContent(metadata)
+	if !content.Partial {
+		var existing MemberListEventContent
+		err := portal.MainIntent().StateEvent(ctx, portal.MXID, StateMemberList, "", &existing)
+		if err != nil || !existing.Partial {
+			return
+		}
+	}
+	_, err := portal.MainIntent().SendStateEvent(ctx, portal.MXID, StateMemberList, "", content)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to update member list state event")
+	}
+}
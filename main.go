@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -67,6 +68,7 @@ type WABridge struct {
 	Provisioning *ProvisioningAPI
 	Formatter    *Formatter
 	Metrics      *MetricsHandler
+	Webhooks     *WebhookSender
 	WAContainer  *sqlstore.Container
 	WAVersion    string
 
@@ -83,14 +85,21 @@ type WABridge struct {
 	puppets             map[types.JID]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
+
+	pruningMessages      atomic.Bool
+	reverseGeocodeCache  reverseGeocodeCache
+	scheduledMessageWake chan struct{}
+	configIgnoredJIDs    map[types.JID]struct{}
 }
 
 func (br *WABridge) Init() {
 	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
 	br.RegisterCommands()
+	br.loadConfigIgnoredJIDs()
 
 	// TODO this is a weird place for this
 	br.EventProcessor.On(event.EphemeralEventPresence, br.HandlePresence)
+	br.EventProcessor.On(event.StateMember, br.HandleMatrixProfileChange)
 	br.EventProcessor.On(TypeMSC3381PollStart, br.MatrixHandler.HandleMessage)
 	br.EventProcessor.On(TypeMSC3381PollResponse, br.MatrixHandler.HandleMessage)
 	br.EventProcessor.On(TypeMSC3381V2PollResponse, br.MatrixHandler.HandleMessage)
@@ -103,6 +112,7 @@ func (br *WABridge) Init() {
 	}).String()
 	Analytics.key = br.Config.Analytics.Token
 	Analytics.userID = br.Config.Analytics.UserID
+	Analytics.messageEvents = br.Config.Analytics.MessageEvents
 	if Analytics.IsEnabled() {
 		Analytics.log.Info().Str("override_user_id", Analytics.userID).Msg("Analytics metrics are enabled")
 	}
@@ -119,6 +129,7 @@ func (br *WABridge) Init() {
 	br.Formatter = NewFormatter(br)
 	br.Metrics = NewMetricsHandler(br.Config.Metrics.Listen, br.ZLog.With().Str("component", "metrics").Logger(), br.DB)
 	br.MatrixHandler.TrackEventDuration = br.Metrics.TrackMatrixEvent
+	br.Webhooks = NewWebhookSender(br)
 
 	store.BaseClientPayload.UserAgent.OsVersion = proto.String(br.WAVersion)
 	store.BaseClientPayload.UserAgent.OsBuildNumber = proto.String(br.WAVersion)
@@ -163,6 +174,8 @@ func (br *WABridge) Start() {
 	}
 
 	go br.Loop()
+	go br.ScheduledMessageLoop()
+	go br.ConnectionHealthLoop()
 }
 
 func (br *WABridge) CheckWhatsAppUpdate() {
@@ -200,11 +213,43 @@ func (br *WABridge) Loop() {
 	ctx := br.ZLog.With().Str("action", "background loop").Logger().WithContext(context.TODO())
 	for {
 		br.SleepAndDeleteUpcoming(ctx)
+		go br.PruneOldMessages(ctx)
 		time.Sleep(1 * time.Hour)
 		br.WarnUsersAboutDisconnection()
 	}
 }
 
+// PruneOldMessages deletes old message mappings from the database in batches according to the message_pruning config.
+func (br *WABridge) PruneOldMessages(ctx context.Context) {
+	cfg := br.Config.Bridge.MessagePruning
+	if cfg.MaxAgeDays <= 0 || !br.pruningMessages.CompareAndSwap(false, true) {
+		return
+	}
+	defer br.pruningMessages.Store(false)
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	before := time.Now().AddDate(0, 0, -cfg.MaxAgeDays)
+	log := zerolog.Ctx(ctx).With().Time("prune_before", before).Logger()
+	var total int64
+	for {
+		deleted, err := br.DB.Message.Prune(ctx, before, cfg.OnlyDisappearing, batchSize)
+		if err != nil {
+			log.Err(err).Msg("Failed to prune old messages")
+			break
+		}
+		total += deleted
+		if deleted < int64(batchSize) {
+			break
+		}
+		time.Sleep(time.Duration(cfg.BatchDelay) * time.Second)
+	}
+	if total > 0 {
+		log.Info().Int64("deleted_count", total).Msg("Pruned old messages from database")
+	}
+}
+
 func (br *WABridge) WarnUsersAboutDisconnection() {
 	br.usersLock.Lock()
 	for _, user := range br.usersByUsername {
@@ -273,6 +318,8 @@ func main() {
 		portalsByJID:        make(map[database.PortalKey]*Portal),
 		puppets:             make(map[types.JID]*Puppet),
 		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
+
+		scheduledMessageWake: make(chan struct{}, 1),
 	}
 	br.Bridge = bridge.Bridge{
 		Name:              "mautrix-whatsapp",
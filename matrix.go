@@ -79,6 +79,10 @@ func (br *WABridge) createPrivatePortalFromInvite(ctx context.Context, roomID id
 	portal.updateLogger()
 	portal.Topic = PrivateChatTopic
 	portal.Name = puppet.Displayname
+	if portal.IsNoteToSelf() {
+		portal.Topic = NoteToSelfTopic
+		portal.Name = br.Config.Bridge.NoteToSelfName
+	}
 	portal.AvatarURL = puppet.AvatarURL
 	portal.Avatar = puppet.Avatar
 	log.Info().Msg("Created private chat portal from invite")
@@ -137,11 +141,49 @@ func (br *WABridge) HandlePresence(ctx context.Context, evt *event.Event) {
 	} else {
 		user.zlog.Debug().Msg("Marking online")
 	}
-	user.lastPresence = presence
+	user.setLastPresence(presence)
 	if user.Client.Store.PushName != "" {
-		err := user.Client.SendPresence(presence)
+		err := user.sendPresence(presence)
 		if err != nil {
 			user.zlog.Err(err).Msg("Failed to set presence")
 		}
 	}
 }
+
+// HandleMatrixProfileChange syncs Matrix profile changes of double puppeted users to WhatsApp.
+func (br *WABridge) HandleMatrixProfileChange(ctx context.Context, evt *event.Event) {
+	syncConfig := br.Config.Bridge.MatrixProfileSync
+	if (!syncConfig.Avatar && !syncConfig.Displayname) || evt.StateKey == nil || *evt.StateKey != evt.Sender.String() {
+		return
+	}
+	content := evt.Content.AsMember()
+	if content.Membership != event.MembershipJoin || evt.Unsigned.PrevContent == nil {
+		return
+	}
+	_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+	prevContent, ok := evt.Unsigned.PrevContent.Parsed.(*event.MemberEventContent)
+	if !ok || prevContent.Membership != event.MembershipJoin {
+		return
+	}
+	user := br.GetUserByMXIDIfExists(evt.Sender)
+	if user == nil || !user.IsLoggedIn() || user.ReadOnly || br.GetPuppetByCustomMXID(user.MXID) == nil {
+		return
+	}
+	ctx = user.zlog.WithContext(ctx)
+	// The same profile change is sent to every room the user is in, so changes are deduplicated using the last synced values
+	if syncConfig.Avatar && prevContent.AvatarURL != content.AvatarURL {
+		avatarURL, err := content.AvatarURL.Parse()
+		if err == nil {
+			err = user.syncMatrixAvatar(ctx, avatarURL)
+			if err != nil {
+				user.zlog.Err(err).Msg("Failed to sync Matrix avatar to WhatsApp")
+			}
+		}
+	}
+	if syncConfig.Displayname && prevContent.Displayname != content.Displayname && content.Displayname != "" {
+		err := user.syncMatrixName(ctx, content.Displayname)
+		if err != nil {
+			user.zlog.Err(err).Msg("Failed to sync Matrix displayname to WhatsApp")
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow"
+	"golang.org/x/image/draw"
+	"maunium.net/go/mautrix/event"
+)
+
+var errImageCantFit = errors.New("image doesn't fit in the size limit even at the lowest allowed quality and resolution")
+
+func (portal *Portal) getMediaSizeLimit(mediaType whatsmeow.MediaType) (limit int, name string) {
+	limits := &portal.bridge.Config.Bridge.MediaSizeLimits
+	switch mediaType {
+	case whatsmeow.MediaImage:
+		return limits.Image, "images"
+	case whatsmeow.MediaVideo:
+		return limits.Video, "videos"
+	case whatsmeow.MediaAudio:
+		return limits.Audio, "audio files"
+	case whatsmeow.MediaDocument:
+		return limits.Document, "files"
+	default:
+		return 0, ""
+	}
+}
+
+func formatFileSize(size int) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.1f GiB", float64(size)/1024/1024/1024)
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MiB", float64(size)/1024/1024)
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KiB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
+
+// fitMediaSizeLimit makes sure outgoing media isn't larger than what WhatsApp accepts. Images are recompressed
+// and downscaled if enabled, other media that's too large is rejected with an error describing the limit.
+func (portal *Portal) fitMediaSizeLimit(ctx context.Context, data []byte, content *event.MessageEventContent, mediaType whatsmeow.MediaType) ([]byte, error) {
+	limit, name := portal.getMediaSizeLimit(mediaType)
+	if limit <= 0 || len(data) <= limit {
+		return data, nil
+	}
+	cfg := &portal.bridge.Config.Bridge.MediaSizeLimits
+	if mediaType == whatsmeow.MediaImage && cfg.DownscaleImages {
+		downscaled, width, height, err := downscaleImage(data, limit, cfg.MinImageQuality, cfg.MinImageDimension)
+		if err == nil {
+			zerolog.Ctx(ctx).Debug().
+				Int("original_size", len(data)).
+				Int("downscaled_size", len(downscaled)).
+				Int("width", width).
+				Int("height", height).
+				Msg("Downscaled image to fit WhatsApp size limit")
+			content.Info.MimeType = "image/jpeg"
+			content.Info.Width = width
+			content.Info.Height = height
+			content.Info.Size = len(downscaled)
+			return downscaled, nil
+		}
+		zerolog.Ctx(ctx).Warn().Err(err).Int("size", len(data)).Msg("Failed to downscale image to fit size limit")
+	}
+	return nil, fmt.Errorf("%w: the file is %s, but WhatsApp only allows %s up to %s", errMediaTooLarge, formatFileSize(len(data)), name, formatFileSize(limit))
+}
+
+// flattenImage draws the image on a white background with the given size, so that transparent areas
+// don't turn black when encoding as JPEG.
+func flattenImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Rect, image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Rect, src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+// downscaleImage re-encodes the image as JPEG with decreasing quality until it fits in the size limit.
+// If the lowest allowed quality isn't enough, the resolution is reduced and the process is repeated.
+// The dimensions of the resulting image are returned along with the data.
+func downscaleImage(data []byte, limit, minQuality, minDimension int) ([]byte, int, int, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+	minQuality = min(max(minQuality, 1), 100)
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	var buf bytes.Buffer
+	for {
+		img := flattenImage(src, width, height)
+		for quality := max(90, minQuality); quality >= minQuality; quality -= 10 {
+			buf.Reset()
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+			if err != nil {
+				return nil, 0, 0, fmt.Errorf("failed to encode image: %w", err)
+			} else if buf.Len() <= limit {
+				return buf.Bytes(), width, height, nil
+			}
+		}
+		width, height = width*3/4, height*3/4
+		if max(width, height) < minDimension || width < 1 || height < 1 {
+			return nil, 0, 0, errImageCantFit
+		}
+	}
+}
@@ -19,15 +19,16 @@ package main
 import (
 	"context"
 	"errors"
-	"fmt"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
+	"go.mau.fi/util/exerrors"
 
 	"go.mau.fi/whatsmeow"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -39,14 +40,16 @@ var (
 	errUserNotLoggedIn             = errors.New("user is not logged in and chat has no relay bot")
 	errRelaybotNotLoggedIn         = errors.New("neither user nor relay bot of chat are logged in")
 	errMNoticeDisabled             = errors.New("bridging m.notice messages is disabled")
+	errMNoticeLoop                 = errors.New("too many m.notice messages in a short time, possible bot loop")
 	errUnexpectedParsedContentType = errors.New("unexpected parsed content type")
 	errInvalidGeoURI               = errors.New("invalid `geo:` URI in message")
-	errUnknownMsgType              = errors.New("unknown msgtype")
+	errUnknownMsgType              = errors.New("unsupported message type")
 	errMediaDownloadFailed         = errors.New("failed to download media")
 	errMediaDecryptFailed          = errors.New("failed to decrypt media")
 	errMediaConvertFailed          = errors.New("failed to convert media")
 	errMediaWhatsAppUploadFailed   = errors.New("failed to upload media to WhatsApp")
 	errMediaUnsupportedType        = errors.New("unsupported media type")
+	errMediaTooLarge               = errors.New("file is too large for WhatsApp")
 	errTargetNotFound              = errors.New("target event not found")
 	errReactionDatabaseNotFound    = errors.New("reaction database entry not found")
 	errReactionTargetNotFound      = errors.New("reaction target message not found")
@@ -56,38 +59,53 @@ var (
 	errPollMissingQuestion         = errors.New("poll message is missing question")
 	errPollDuplicateOption         = errors.New("poll options must be unique")
 
-	errGalleryRelay   = errors.New("can't send gallery through relay user")
-	errGalleryCaption = errors.New("can't send gallery with caption")
+	errGalleryRelay        = errors.New("can't send gallery through relay user")
+	errInlineImagesDropped = errors.New("only one inline image can be sent to this chat")
 
 	errEditUnknownTarget     = errors.New("unknown edit target message")
 	errEditUnknownTargetType = errors.New("unsupported edited message type")
 	errEditDifferentSender   = errors.New("can't edit message sent by another user")
 	errEditTooOld            = errors.New("message is too old to be edited")
 
-	errBroadcastReactionNotSupported = errors.New("reacting to status messages is not currently supported")
-	errBroadcastSendDisabled         = errors.New("sending status messages is disabled")
+	errBroadcastReactionNotSupported  = errors.New("reacting to status messages is not currently supported")
+	errBroadcastSendDisabled          = errors.New("sending status messages is disabled")
+	errBroadcastNoRecipients          = errors.New("the broadcast list doesn't have any known recipients")
+	errBroadcastListActionUnsupported = errors.New("reactions, edits and deletions can't be sent to broadcast lists")
+
+	errAnnounceGroupNotAdmin = errors.New("only admins can send messages to this group")
+	errReadOnly              = errors.New("this chat is in read-only mode, nothing is sent to WhatsApp")
 
 	errMessageDisconnected      = &whatsmeow.DisconnectedError{Action: "message send"}
 	errMessageRetryDisconnected = &whatsmeow.DisconnectedError{Action: "message send (retry)"}
 
 	errMessageTakingLong     = errors.New("bridging the message is taking longer than usual")
 	errTimeoutBeforeHandling = errors.New("message timed out before handling was started")
+
+	errMessageQueuedOffline = errors.New("you are not connected to WhatsApp, the message will be sent after reconnecting")
+	errQueuedMessageExpired = errors.New("the message was queued for too long while disconnected from WhatsApp")
 )
 
 func errorToStatusReason(err error) (reason event.MessageStatusReason, status event.MessageStatus, isCertain, sendNotice bool, humanMessage string) {
 	switch {
+	case errors.Is(err, errUnexpectedParsedContentType),
+		errors.Is(err, whatsmeow.ErrUnknownServer),
+		errors.Is(err, whatsmeow.ErrRecipientADJID):
+		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, ""
+	case errors.Is(err, errMNoticeDisabled),
+		errors.Is(err, errMNoticeLoop):
+		return event.MessageStatusUnsupported, event.MessageStatusFail, true, false, ""
 	case errors.Is(err, whatsmeow.ErrBroadcastListUnsupported),
-		errors.Is(err, errUnexpectedParsedContentType),
 		errors.Is(err, errUnknownMsgType),
 		errors.Is(err, errInvalidGeoURI),
-		errors.Is(err, whatsmeow.ErrUnknownServer),
-		errors.Is(err, whatsmeow.ErrRecipientADJID),
 		errors.Is(err, errBroadcastReactionNotSupported),
-		errors.Is(err, errBroadcastSendDisabled):
-		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, ""
-	case errors.Is(err, errMNoticeDisabled):
-		return event.MessageStatusUnsupported, event.MessageStatusFail, true, false, ""
-	case errors.Is(err, errMediaUnsupportedType),
+		errors.Is(err, errBroadcastSendDisabled),
+		errors.Is(err, errMediaUnsupportedType),
+		errors.Is(err, errMediaTooLarge),
+		errors.Is(err, errBroadcastNoRecipients),
+		errors.Is(err, errBroadcastListActionUnsupported),
+		errors.Is(err, errInlineImagesDropped),
+		errors.Is(err, errAnnounceGroupNotAdmin),
+		errors.Is(err, errReadOnly),
 		errors.Is(err, errPollMissingQuestion),
 		errors.Is(err, errPollDuplicateOption),
 		errors.Is(err, errEditDifferentSender),
@@ -95,12 +113,23 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		errors.Is(err, errEditUnknownTarget),
 		errors.Is(err, errEditUnknownTargetType):
 		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, errMediaConvertFailed):
+		// Only include the high-level part of the error, the low-level one is usually ffmpeg output
+		var dualErr exerrors.DualError
+		if errors.As(err, &dualErr) {
+			return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, dualErr.High.Error()
+		}
+		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, err.Error()
 	case errors.Is(err, errTimeoutBeforeHandling):
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, true, true, "the message was too old when it reached the bridge, so it was not handled"
 	case errors.Is(err, context.DeadlineExceeded):
 		return event.MessageStatusTooOld, event.MessageStatusRetriable, false, true, "handling the message took too long and was cancelled"
 	case errors.Is(err, errMessageTakingLong):
 		return event.MessageStatusTooOld, event.MessageStatusPending, false, true, err.Error()
+	case errors.Is(err, errMessageQueuedOffline):
+		return event.MessageStatusGenericError, event.MessageStatusPending, false, false, err.Error()
+	case errors.Is(err, errQueuedMessageExpired):
+		return event.MessageStatusTooOld, event.MessageStatusRetriable, true, true, err.Error()
 	case errors.Is(err, errTargetNotFound),
 		errors.Is(err, errTargetIsFake),
 		errors.Is(err, errReactionDatabaseNotFound),
@@ -123,7 +152,7 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 	}
 }
 
-func (portal *Portal) sendErrorMessage(ctx context.Context, evt *event.Event, err error, confirmed bool, editID id.EventID) id.EventID {
+func (portal *Portal) sendErrorMessage(ctx context.Context, evt *event.Event, err error, humanMessage string, confirmed bool, editID id.EventID) id.EventID {
 	if !portal.bridge.Config.Bridge.MessageErrorNotices {
 		return ""
 	}
@@ -146,9 +175,23 @@ func (portal *Portal) sendErrorMessage(ctx context.Context, evt *event.Event, er
 	default:
 		msgType = "unknown event"
 	}
-	msg := fmt.Sprintf("\u26a0 Your %s %s bridged: %v", msgType, certainty, err)
+	// Prefer the human-readable message, which names what exactly isn't supported without internal details
+	reason := humanMessage
+	if reason == "" {
+		reason = err.Error()
+	}
+	msg := portal.T("\u26a0 Your %s may not have been bridged: %v", portal.T(msgType), reason)
+	if confirmed {
+		msg = portal.T("\u26a0 Your %s was not bridged: %v", portal.T(msgType), reason)
+	}
+	msg = portal.bridge.Config.Bridge.FormatNotice("message_error", msg, map[string]any{
+		"Type":      msgType,
+		"Certainty": certainty,
+		"Error":     reason,
+	})
 	if errors.Is(err, errMessageTakingLong) {
-		msg = fmt.Sprintf("\u26a0 Bridging your %s is taking longer than usual", msgType)
+		msg = portal.T("\u26a0 Bridging your %s is taking longer than usual", portal.T(msgType))
+		msg = portal.bridge.Config.Bridge.FormatNotice("message_taking_long", msg, map[string]any{"Type": msgType})
 	}
 	content := &event.MessageEventContent{
 		MsgType: event.MsgNotice,
@@ -174,11 +217,6 @@ func (portal *Portal) sendStatusEvent(ctx context.Context, evtID, lastRetry id.E
 	if lastRetry == evtID {
 		lastRetry = ""
 	}
-	intent := portal.bridge.Bot
-	if !portal.Encrypted {
-		// Bridge bot isn't present in unencrypted DMs
-		intent = portal.MainIntent()
-	}
 	content := event.BeeperMessageStatusEventContent{
 		Network: portal.getBridgeInfoStateKey(),
 		RelatesTo: event.RelatesTo{
@@ -194,12 +232,21 @@ func (portal *Portal) sendStatusEvent(ctx context.Context, evtID, lastRetry id.E
 		content.Reason, content.Status, _, _, content.Message = errorToStatusReason(err)
 		content.Error = err.Error()
 	}
-	_, err = intent.SendMessageEvent(ctx, portal.MXID, event.BeeperMessageStatus, &content)
+	_, err = portal.statusIntent().SendMessageEvent(ctx, portal.MXID, event.BeeperMessageStatus, &content)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to send message status event")
 	}
 }
 
+// statusIntent returns the intent used for sending message status events and other bridge notices.
+func (portal *Portal) statusIntent() *appservice.IntentAPI {
+	if !portal.Encrypted {
+		// Bridge bot isn't present in unencrypted DMs
+		return portal.MainIntent()
+	}
+	return portal.bridge.Bot
+}
+
 func (portal *Portal) sendDeliveryReceipt(ctx context.Context, eventID id.EventID) {
 	if portal.bridge.Config.Bridge.DeliveryReceipts {
 		err := portal.bridge.Bot.SendReceipt(ctx, portal.MXID, eventID, event.ReceiptTypeRead, nil)
@@ -220,15 +267,23 @@ func (portal *Portal) sendMessageMetrics(ctx context.Context, evt *event.Event,
 			level = zerolog.DebugLevel
 		}
 		zerolog.Ctx(ctx).WithLevel(level).Err(err).Msg(part + " Matrix event")
-		reason, statusCode, isCertain, sendNotice, _ := errorToStatusReason(err)
+		reason, statusCode, isCertain, sendNotice, humanMessage := errorToStatusReason(err)
+		if part != "Ignoring" {
+			Analytics.Track(evt.Sender, "Matrix message failed", map[string]interface{}{
+				"event_type": evt.Type.Type,
+				"reason":     string(reason),
+				"status":     string(statusCode),
+			})
+		}
 		checkpointStatus := status.ReasonToCheckpointStatus(reason, statusCode)
 		portal.bridge.SendMessageCheckpoint(evt, status.MsgStepRemote, err, checkpointStatus, ms.getRetryNum())
 		if sendNotice {
-			ms.setNoticeID(portal.sendErrorMessage(ctx, evt, err, isCertain, ms.getNoticeID()))
+			ms.setNoticeID(portal.sendErrorMessage(ctx, evt, err, humanMessage, isCertain, ms.getNoticeID()))
 		}
 		portal.sendStatusEvent(ctx, origEvtID, evt.ID, err, nil)
 	} else {
 		zerolog.Ctx(ctx).Debug().Msg("Successfully handled Matrix event")
+		Analytics.TrackMessage(evt.Sender, "to_whatsapp", evt.Type.Type)
 		portal.sendDeliveryReceipt(ctx, evt.ID)
 		portal.bridge.SendMessageSuccessCheckpoint(evt, status.MsgStepRemote, ms.getRetryNum())
 		var deliveredTo *[]id.UserID
@@ -272,6 +327,25 @@ func (mt *messageTimings) MarshalZerologObject(e *zerolog.Event) {
 		Dur("total_send", mt.totalSend)
 }
 
+// remoteMessageTimings contains the durations of the stages of bridging a WhatsApp message to Matrix.
+// The convert stage includes media transfers. The receive age is only set for live messages,
+// as the age of backfilled messages doesn't say anything about the bridge's performance.
+type remoteMessageTimings struct {
+	receiveAge time.Duration
+	convert    time.Duration
+	matrixSend time.Duration
+	total      time.Duration
+}
+
+func (rt *remoteMessageTimings) MarshalZerologObject(e *zerolog.Event) {
+	if rt.receiveAge != 0 {
+		e.Dur("receive_age", rt.receiveAge)
+	}
+	e.Dur("convert", rt.convert).
+		Dur("matrix_send", rt.matrixSend).
+		Dur("total", rt.total)
+}
+
 type metricSender struct {
 	portal         *Portal
 	previousNotice id.EventID
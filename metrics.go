@@ -50,6 +50,8 @@ type MetricsHandler struct {
 	matrixEventHandling     *prometheus.HistogramVec
 	whatsappMessageAge      prometheus.Histogram
 	whatsappMessageHandling *prometheus.HistogramVec
+	messageConversion       *prometheus.HistogramVec
+	conversionErrors        *prometheus.CounterVec
 	countCollection         prometheus.Histogram
 	disconnections          *prometheus.CounterVec
 	incomingRetryReceipts   *prometheus.CounterVec
@@ -62,6 +64,7 @@ type MetricsHandler struct {
 	encryptedPrivateCount   prometheus.Gauge
 	unencryptedGroupCount   prometheus.Gauge
 	unencryptedPrivateCount prometheus.Gauge
+	portalParticipants      *prometheus.GaugeVec
 
 	connected          prometheus.Gauge
 	connectedState     map[string]bool
@@ -95,6 +98,14 @@ func NewMetricsHandler(address string, log zerolog.Logger, db *database.Database
 			Name: "remote_event",
 			Help: "Time spent processing WhatsApp messages",
 		}, []string{"message_type"}),
+		messageConversion: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "whatsapp_message_conversion",
+			Help: "Time spent converting messages between WhatsApp and Matrix, including media transfers",
+		}, []string{"direction", "message_type"}),
+		conversionErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "whatsapp_message_conversion_errors",
+			Help: "Number of messages that failed to convert between WhatsApp and Matrix",
+		}, []string{"direction", "message_type", "reason"}),
 		countCollection: promauto.NewHistogram(prometheus.HistogramOpts{
 			Name: "whatsapp_count_collection",
 			Help: "Time spent collecting the whatsapp_*_total metrics",
@@ -128,6 +139,10 @@ func NewMetricsHandler(address string, log zerolog.Logger, db *database.Database
 		encryptedPrivateCount:   portalCount.With(prometheus.Labels{"type": "private", "encrypted": "true"}),
 		unencryptedGroupCount:   portalCount.With(prometheus.Labels{"type": "group", "encrypted": "false"}),
 		unencryptedPrivateCount: portalCount.With(prometheus.Labels{"type": "private", "encrypted": "false"}),
+		portalParticipants: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "whatsapp_portal_participants",
+			Help: "Number of participants in WhatsApp groups that have portal rooms, as of the last member sync",
+		}, []string{"portal_jid"}),
 
 		loggedIn: promauto.NewGauge(prometheus.GaugeOpts{
 			Name: "bridge_logged_in",
@@ -172,6 +187,25 @@ func (mh *MetricsHandler) TrackWhatsAppMessage(timestamp time.Time, messageType
 	}
 }
 
+// TrackConversion starts timing a message conversion. The returned function must be called with the failure reason,
+// or an empty string if the conversion succeeded. The direction is either "to_matrix" or "to_whatsapp".
+func (mh *MetricsHandler) TrackConversion(direction, messageType string) func(failReason string) {
+	if !mh.running {
+		return func(string) {}
+	}
+	start := time.Now()
+	return func(failReason string) {
+		mh.messageConversion.
+			With(prometheus.Labels{"direction": direction, "message_type": messageType}).
+			Observe(time.Since(start).Seconds())
+		if failReason != "" {
+			mh.conversionErrors.
+				With(prometheus.Labels{"direction": direction, "message_type": messageType, "reason": failReason}).
+				Inc()
+		}
+	}
+}
+
 func (mh *MetricsHandler) TrackDisconnection(userID id.UserID) {
 	if !mh.running {
 		return
@@ -230,6 +264,20 @@ func (mh *MetricsHandler) TrackConnectionState(jid types.JID, connected bool) {
 	}
 }
 
+func (mh *MetricsHandler) TrackPortalParticipants(jid types.JID, count int) {
+	if !mh.running {
+		return
+	}
+	mh.portalParticipants.With(prometheus.Labels{"portal_jid": jid.String()}).Set(float64(count))
+}
+
+func (mh *MetricsHandler) ForgetPortal(jid types.JID) {
+	if !mh.running {
+		return
+	}
+	mh.portalParticipants.Delete(prometheus.Labels{"portal_jid": jid.String()})
+}
+
 func (mh *MetricsHandler) updateStats() {
 	start := time.Now()
 	var puppetCount int
@@ -271,7 +319,7 @@ func (mh *MetricsHandler) updateStats() {
 		mh.encryptedGroupCount.Set(float64(encryptedGroupCount))
 		mh.encryptedPrivateCount.Set(float64(encryptedPrivateCount))
 		mh.unencryptedGroupCount.Set(float64(unencryptedGroupCount))
-		mh.unencryptedPrivateCount.Set(float64(encryptedPrivateCount))
+		mh.unencryptedPrivateCount.Set(float64(unencryptedPrivateCount))
 	}
 	mh.countCollection.Observe(time.Now().Sub(start).Seconds())
 }
@@ -0,0 +1,170 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/event"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+var errOfflineQueueFull = errors.New("offline queue is full")
+
+// shouldQueueOffline checks if a message from the given user should be put in the offline queue
+// instead of being sent right away, i.e. the user has a WhatsApp session, but isn't currently connected
+// or the messages queued during the previous disconnection are still being sent.
+//
+// The caller must hold the sender's offlineQueueLock.
+func (portal *Portal) shouldQueueOffline(sender *User, fromOfflineQueue bool) bool {
+	if !portal.bridge.Config.Bridge.OfflineQueue.Enabled || sender.Session == nil || portal.isReadOnlyFor(sender) {
+		return false
+	} else if sender.IsLoggedIn() && (fromOfflineQueue || !sender.offlineQueueFlushing) {
+		return false
+	}
+	return !portal.IsPrivateChat() || sender.JID.User == portal.Key.Receiver.User
+}
+
+// tryQueueOffline puts the event in the offline queue if shouldQueueOffline says so.
+// Returns true if the event was queued and shouldn't be sent now.
+func (portal *Portal) tryQueueOffline(ctx context.Context, sender *User, evt *event.Event, fromOfflineQueue bool) bool {
+	sender.offlineQueueLock.Lock()
+	defer sender.offlineQueueLock.Unlock()
+	if !portal.shouldQueueOffline(sender, fromOfflineQueue) {
+		return false
+	}
+	err := portal.queueOfflineMessage(ctx, sender, evt)
+	if err == nil {
+		return true
+	} else if !errors.Is(err, errOfflineQueueFull) {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to queue message while disconnected")
+	}
+	return false
+}
+
+// queueOfflineMessage stores a Matrix event to be sent once the user reconnects to WhatsApp
+// and marks the message as pending.
+func (portal *Portal) queueOfflineMessage(ctx context.Context, sender *User, evt *event.Event) error {
+	cfg := portal.bridge.Config.Bridge.OfflineQueue
+	if cfg.MaxMessages > 0 {
+		count, err := portal.bridge.DB.QueuedMessage.CountInPortal(ctx, sender.MXID, portal.Key)
+		if err != nil {
+			return fmt.Errorf("failed to count queued messages: %w", err)
+		} else if count >= cfg.MaxMessages {
+			return errOfflineQueueFull
+		}
+	}
+	// Scheduled send fields are kept, so that the message is scheduled after reconnecting
+	content, err := marshalStoredContent(evt)
+	if err != nil {
+		return err
+	}
+	msg := portal.bridge.DB.QueuedMessage.New()
+	msg.EventID = evt.ID
+	msg.RoomID = portal.MXID
+	msg.Portal = portal.Key
+	msg.Sender = sender.MXID
+	msg.EventType = evt.Type.Type
+	msg.Content = content
+	msg.QueuedAt = time.Now()
+	err = msg.Insert(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save queued message: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().Msg("Queued message to be sent after reconnecting")
+	go portal.sendStatusEvent(ctx, evt.ID, "", errMessageQueuedOffline, nil)
+	return nil
+}
+
+// flushOfflineQueue sends all messages that were queued while the user was disconnected, in the order they were sent.
+// New messages are queued too until the flush is done, so that they don't overtake the older queued messages.
+func (user *User) flushOfflineQueue(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("action", "flush offline queue").Logger()
+	ctx = log.WithContext(ctx)
+	user.offlineQueueLock.Lock()
+	user.offlineQueueFlushing = true
+	user.offlineQueueLock.Unlock()
+	for {
+		// The emptiness check is done while holding the lock, so no message can be queued after the last batch
+		user.offlineQueueLock.Lock()
+		var msgs []*database.QueuedMessage
+		var err error
+		if user.IsLoggedIn() {
+			msgs, err = user.bridge.DB.QueuedMessage.GetAllBySender(ctx, user.MXID)
+		}
+		if err != nil || len(msgs) == 0 {
+			// If the connection was lost again, the rest of the queue is sent after the next reconnection
+			user.offlineQueueFlushing = false
+			user.offlineQueueLock.Unlock()
+			if err != nil {
+				log.Err(err).Msg("Failed to get queued messages")
+			}
+			return
+		}
+		user.offlineQueueLock.Unlock()
+		log.Info().Int("message_count", len(msgs)).Msg("Sending messages queued while disconnected")
+		if !user.sendQueuedMessages(ctx, msgs) {
+			user.offlineQueueLock.Lock()
+			user.offlineQueueFlushing = false
+			user.offlineQueueLock.Unlock()
+			return
+		}
+	}
+}
+
+// sendQueuedMessages passes queued messages to their portals. Returns false if a message couldn't be
+// removed from the queue, in which case flushing is stopped to avoid sending it repeatedly.
+func (user *User) sendQueuedMessages(ctx context.Context, msgs []*database.QueuedMessage) bool {
+	log := zerolog.Ctx(ctx)
+	expiry := time.Duration(user.bridge.Config.Bridge.OfflineQueue.Expiry) * time.Second
+	for _, msg := range msgs {
+		msgLog := log.With().Stringer("event_id", msg.EventID).Logger()
+		err := msg.Delete(ctx)
+		if err != nil {
+			msgLog.Err(err).Msg("Failed to delete queued message, not sending it")
+			return false
+		}
+		portal := user.bridge.GetExistingPortalByJID(msg.Portal)
+		if portal == nil || portal.MXID != msg.RoomID {
+			msgLog.Warn().Msg("Portal of queued message no longer exists, dropping message")
+			continue
+		}
+		evt, err := makeStoredEvent(msg.EventID, msg.RoomID, msg.Sender, msg.EventType, msg.Content)
+		if err != nil {
+			msgLog.Err(err).Msg("Failed to parse queued message content")
+			continue
+		}
+		if expiry > 0 && time.Since(msg.QueuedAt) > expiry {
+			portal.sendMessageMetrics(msgLog.WithContext(ctx), evt, errQueuedMessageExpired, "Dropping", nil)
+			continue
+		}
+		portal.events <- &PortalEvent{
+			MatrixMessage: &PortalMatrixMessage{
+				user:             user,
+				evt:              evt,
+				receivedAt:       time.Now(),
+				fromOfflineQueue: true,
+			},
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+type pollTallyOption struct {
+	ID    string
+	Name  string
+	Votes int
+}
+
+// handleAnonymousPollVote stores a WhatsApp poll vote and updates the tally notice of the poll
+// instead of bridging the vote as a response event from the voter's ghost.
+func (portal *Portal) handleAnonymousPollVote(ctx context.Context, source *User, info *types.MessageInfo, msg *waProto.PollUpdateMessage, existingMsg *database.Message) {
+	log := zerolog.Ctx(ctx)
+	if existingMsg != nil {
+		_, _ = portal.MainIntent().RedactEvent(ctx, portal.MXID, existingMsg.MXID, mautrix.ReqRedact{
+			Reason: "The undecryptable message was actually a poll vote",
+		})
+	}
+	pollMessage, selected := portal.decryptPollVote(ctx, source, info, msg)
+	if pollMessage == nil {
+		return
+	}
+	vote := portal.bridge.DB.PollVote.New()
+	vote.PollMXID = pollMessage.MXID
+	vote.Voter = info.Sender.ToNonAD()
+	vote.Options = selected
+	var err error
+	if len(selected) == 0 {
+		err = vote.Delete(ctx)
+	} else {
+		err = vote.Upsert(ctx)
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to save anonymous poll vote")
+		return
+	}
+	portal.updatePollTally(ctx, pollMessage.MXID)
+}
+
+func (portal *Portal) updatePollTally(ctx context.Context, pollMXID id.EventID) {
+	log := zerolog.Ctx(ctx).With().Stringer("poll_mxid", pollMXID).Logger()
+	votes, err := portal.bridge.DB.PollVote.GetAllByPoll(ctx, pollMXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get poll votes")
+		return
+	}
+	options := portal.getPollTallyOptions(ctx, pollMXID)
+	optionsByID := make(map[string]*pollTallyOption, len(options))
+	for _, opt := range options {
+		optionsByID[opt.ID] = opt
+	}
+	for _, vote := range votes {
+		for _, optID := range vote.Options {
+			opt, ok := optionsByID[optID]
+			if !ok {
+				// The poll start event couldn't be parsed, fall back to listing option IDs
+				opt = &pollTallyOption{ID: optID, Name: optID}
+				optionsByID[optID] = opt
+				options = append(options, opt)
+			}
+			opt.Votes++
+		}
+	}
+	content := portal.formatPollTally(len(votes), options)
+	tallyMXID, err := portal.bridge.DB.PollVote.GetTallyMXID(ctx, pollMXID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get poll tally event ID")
+		return
+	}
+	if tallyMXID != "" {
+		content.SetEdit(tallyMXID)
+	} else {
+		content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(pollMXID)
+	}
+	resp, err := portal.sendMainIntentMessage(ctx, content)
+	if err != nil {
+		log.Err(err).Msg("Failed to send poll tally")
+	} else if tallyMXID == "" {
+		err = portal.bridge.DB.PollVote.SetTallyMXID(ctx, pollMXID, resp.EventID)
+		if err != nil {
+			log.Err(err).Msg("Failed to save poll tally event ID")
+		}
+	}
+}
+
+// getPollTallyOptions returns the options of a bridged poll by reading the poll start event from the room.
+func (portal *Portal) getPollTallyOptions(ctx context.Context, pollMXID id.EventID) []*pollTallyOption {
+	evt, err := portal.MainIntent().GetEvent(ctx, portal.MXID, pollMXID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to get poll start event for tally")
+		return nil
+	}
+	if evt.Type == event.EventEncrypted && portal.bridge.Crypto != nil {
+		_ = evt.Content.ParseRaw(evt.Type)
+		decryptedEvt, err := portal.bridge.Crypto.Decrypt(ctx, evt)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to decrypt poll start event for tally")
+			return nil
+		}
+		evt = decryptedEvt
+	}
+	var options []*pollTallyOption
+	gjson.GetBytes(evt.Content.VeryRaw, `org\.matrix\.msc3381\.poll\.start.answers`).ForEach(func(_, answer gjson.Result) bool {
+		name := answer.Get(`org\.matrix\.msc1767\.text`).String()
+		if name == "" {
+			name = answer.Get(`m\.text`).String()
+		}
+		options = append(options, &pollTallyOption{ID: answer.Get("id").String(), Name: name})
+		return true
+	})
+	return options
+}
+
+func (portal *Portal) formatPollTally(voterCount int, options []*pollTallyOption) *event.MessageEventContent {
+	var body, formattedBody strings.Builder
+	header := portal.T("Poll results (%d voters):", voterCount)
+	if voterCount == 1 {
+		header = portal.T("Poll results (1 voter):")
+	}
+	body.WriteString(header)
+	formattedBody.WriteString(html.EscapeString(header))
+	formattedBody.WriteString("<ul>")
+	for _, opt := range options {
+		_, _ = fmt.Fprintf(&body, "\n• %s: %d", opt.Name, opt.Votes)
+		_, _ = fmt.Fprintf(&formattedBody, "<li>%s: %d</li>", html.EscapeString(opt.Name), opt.Votes)
+	}
+	formattedBody.WriteString("</ul>")
+	return &event.MessageEventContent{
+		MsgType:       event.MsgNotice,
+		Body:          body.String(),
+		Format:        event.FormatHTML,
+		FormattedBody: formattedBody.String(),
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"image"
 	"image/color"
 	_ "image/gif"
@@ -35,6 +36,9 @@ import (
 	"math"
 	"mime"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime/debug"
 	"strconv"
@@ -53,6 +57,7 @@ import (
 	"golang.org/x/exp/slices"
 	"golang.org/x/image/draw"
 	"golang.org/x/image/webp"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 
 	"go.mau.fi/util/exerrors"
@@ -71,6 +76,7 @@ import (
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 
+	"maunium.net/go/mautrix-whatsapp/config"
 	"maunium.net/go/mautrix-whatsapp/database"
 )
 
@@ -79,8 +85,10 @@ const StatusBroadcastName = "WhatsApp Status Broadcast"
 const BroadcastTopic = "WhatsApp broadcast list"
 const UnnamedBroadcastName = "Unnamed broadcast list"
 const PrivateChatTopic = "WhatsApp private chat"
+const NoteToSelfTopic = "Your WhatsApp \"Message yourself\" chat"
 
 var ErrStatusBroadcastDisabled = errors.New("status bridging is disabled")
+var ErrBroadcastListPortalsDisabled = errors.New("broadcast list portals are disabled")
 
 func (br *WABridge) GetPortalByMXID(mxid id.RoomID) *Portal {
 	ctx := context.TODO()
@@ -283,6 +291,8 @@ type PortalMatrixMessage struct {
 	evt        *event.Event
 	user       *User
 	receivedAt time.Time
+
+	fromOfflineQueue bool
 }
 
 type recentlyHandledWrapper struct {
@@ -311,6 +321,9 @@ type Portal struct {
 	currentlyTyping     []id.UserID
 	currentlyTypingLock sync.Mutex
 
+	recentNotices     map[id.UserID][]time.Time
+	recentNoticesLock sync.Mutex
+
 	events chan *PortalEvent
 
 	mediaErrorCache map[types.MessageID]*FailedMediaMeta
@@ -320,8 +333,13 @@ type Portal struct {
 	galleryCacheStart     time.Time
 	galleryCacheReplyTo   *ReplyInfo
 	galleryCacheSender    types.JID
+	galleryCacheCaption   string
 
 	currentlySleepingToDelete sync.Map
+	// pendingDecryptRetries contains the IDs of undecryptable messages that were requested from the phone
+	pendingDecryptRetries sync.Map
+	// relayRequests maps users who were asked to act as the relay by a room moderator to the moderator who asked
+	relayRequests sync.Map
 
 	relayUser    *User
 	parentPortal *Portal
@@ -336,22 +354,29 @@ func (portal *Portal) stopGallery() {
 		portal.galleryCacheReplyTo = nil
 		portal.galleryCacheStart = time.Time{}
 		portal.galleryCacheRootEvent = ""
+		portal.galleryCacheCaption = ""
 	}
 }
 
-func (portal *Portal) startGallery(evt *events.Message, msg *ConvertedMessage) {
-	portal.galleryCache = []*event.MessageEventContent{msg.Content}
+// startGallery starts collecting a gallery. The item content is stored separately from the converted message,
+// as the converted message content may have the caption merged into it.
+func (portal *Portal) startGallery(evt *events.Message, msg *ConvertedMessage, item *event.MessageEventContent) {
+	portal.galleryCache = []*event.MessageEventContent{item}
 	portal.galleryCacheSender = evt.Info.Sender.ToNonAD()
 	portal.galleryCacheReplyTo = msg.ReplyTo
 	portal.galleryCacheStart = time.Now()
 }
 
-func (portal *Portal) extendGallery(msg *ConvertedMessage) int {
-	portal.galleryCache = append(portal.galleryCache, msg.Content)
+func (portal *Portal) extendGallery(msg *ConvertedMessage, item *event.MessageEventContent) int {
+	portal.galleryCache = append(portal.galleryCache, item)
 	msg.Content = &event.MessageEventContent{
-		MsgType:             event.MsgBeeperGallery,
-		Body:                "Sent a gallery",
-		BeeperGalleryImages: portal.galleryCache,
+		MsgType:              event.MsgBeeperGallery,
+		Body:                 "Sent a gallery",
+		BeeperGalleryImages:  portal.galleryCache,
+		BeeperGalleryCaption: portal.galleryCacheCaption,
+	}
+	if portal.galleryCacheCaption != "" {
+		msg.Content.Body = portal.galleryCacheCaption
 	}
 	msg.Content.SetEdit(portal.galleryCacheRootEvent)
 	// Don't set the gallery images in the edit fallback
@@ -365,6 +390,7 @@ var (
 	_ bridge.MembershipHandlingPortal  = (*Portal)(nil)
 	_ bridge.MetaHandlingPortal        = (*Portal)(nil)
 	_ bridge.TypingPortal              = (*Portal)(nil)
+	_ bridge.PowerLevelHandlingPortal  = (*Portal)(nil)
 )
 
 func (portal *Portal) handleWhatsAppMessageLoopItem(msg *PortalMessage) {
@@ -446,7 +472,7 @@ func (portal *Portal) handleMatrixMessageLoopItem(msg *PortalMatrixMessage) {
 	timings.implicitRR = time.Since(implicitRRStart)
 	switch msg.evt.Type {
 	case event.EventMessage, event.EventSticker, TypeMSC3381V2PollResponse, TypeMSC3381PollResponse, TypeMSC3381PollStart:
-		portal.HandleMatrixMessage(ctx, msg.user, msg.evt, timings)
+		portal.HandleMatrixMessage(ctx, msg.user, msg.evt, timings, msg.fromOfflineQueue)
 	case event.EventRedaction:
 		log.UpdateContext(func(c zerolog.Context) zerolog.Context {
 			return c.Stringer("redaction_target_mxid", msg.evt.Redacts)
@@ -495,6 +521,13 @@ func (portal *Portal) handleReceipt(ctx context.Context, receipt *events.Receipt
 		portal.handleDeliveryReceipt(ctx, receipt, source)
 		return
 	}
+	if receipt.Sender.User != source.JID.User {
+		// If the sender is also logged into the bridge, their own connection will receive the receipt too,
+		// so only handle it there to avoid duplicate read markers when multiple logins share a group.
+		if senderUser := portal.bridge.GetUserByJID(receipt.Sender); senderUser != nil && senderUser.IsLoggedIn() {
+			return
+		}
+	}
 	// The order of the message ID array depends on the sender's platform, so we just have to find
 	// the last message based on timestamp. Also, timestamps only have second precision, so if
 	// there are many messages at the same second just mark them all as read, because we don't
@@ -720,6 +753,20 @@ func formatDuration(d time.Duration) string {
 }
 
 func (portal *Portal) convertMessage(ctx context.Context, intent *appservice.IntentAPI, source *User, info *types.MessageInfo, waMsg *waProto.Message, isBackfill bool) *ConvertedMessage {
+	// Strip mime types and other details from the message type to keep the metric cardinality low
+	msgType, _, _ := strings.Cut(getMessageType(waMsg), " ")
+	doneConverting := portal.bridge.Metrics.TrackConversion("to_matrix", msgType)
+	converted := portal.convertMessageContent(ctx, intent, source, info, waMsg, isBackfill)
+	if converted != nil {
+		converted.addForwardedInfo(getMessageContextInfo(waMsg), portal.language())
+		doneConverting(string(converted.Error))
+	} else {
+		doneConverting("unsupported")
+	}
+	return converted
+}
+
+func (portal *Portal) convertMessageContent(ctx context.Context, intent *appservice.IntentAPI, source *User, info *types.MessageInfo, waMsg *waProto.Message, isBackfill bool) *ConvertedMessage {
 	switch {
 	case waMsg.Conversation != nil || waMsg.ExtendedTextMessage != nil:
 		return portal.convertTextMessage(ctx, intent, source, waMsg)
@@ -766,13 +813,14 @@ func (portal *Portal) convertMessage(ctx context.Context, intent *appservice.Int
 	case waMsg.LiveLocationMessage != nil:
 		return portal.convertLiveLocationMessage(ctx, intent, waMsg.GetLiveLocationMessage())
 	case waMsg.GroupInviteMessage != nil:
-		return portal.convertGroupInviteMessage(ctx, intent, info, waMsg.GetGroupInviteMessage())
+		return portal.convertGroupInviteMessage(ctx, intent, source, info, waMsg.GetGroupInviteMessage())
 	case waMsg.ProtocolMessage != nil && waMsg.ProtocolMessage.GetType() == waProto.ProtocolMessage_EPHEMERAL_SETTING:
 		portal.ExpirationTime = waMsg.ProtocolMessage.GetEphemeralExpiration()
 		err := portal.Update(ctx)
 		if err != nil {
 			zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after updating expiration timer")
 		}
+		portal.UpdateDisappearingTimerState(ctx)
 		return &ConvertedMessage{
 			Intent: intent,
 			Type:   event.EventMessage,
@@ -782,8 +830,67 @@ func (portal *Portal) convertMessage(ctx context.Context, intent *appservice.Int
 			},
 		}
 	default:
+		return portal.convertUnknownMessage(ctx, intent, waMsg)
+	}
+}
+
+const RawMessageDumpKey = "fi.mau.whatsapp.raw_message"
+
+// unknownMessageStripFields are fields that are removed from raw message dumps,
+// either because they're secret (media keys) or just large (thumbnails).
+var unknownMessageStripFields = []string{"mediaKey", "jpegThumbnail", "thumbnailDirectPath", "directPath"}
+
+func stripRawMessageFields(data any) {
+	switch typedData := data.(type) {
+	case map[string]any:
+		for key, val := range typedData {
+			if slices.Contains(unknownMessageStripFields, key) {
+				delete(typedData, key)
+			} else {
+				stripRawMessageFields(val)
+			}
+		}
+	case []any:
+		for _, val := range typedData {
+			stripRawMessageFields(val)
+		}
+	}
+}
+
+// convertUnknownMessage logs messages of unknown types at debug level and, if enabled in the config,
+// converts them into a notice with the raw message attached to help diagnose new message types.
+func (portal *Portal) convertUnknownMessage(ctx context.Context, intent *appservice.IntentAPI, waMsg *waProto.Message) *ConvertedMessage {
+	log := zerolog.Ctx(ctx)
+	dumpEnabled := portal.bridge.Config.Bridge.UnknownMessageDump
+	if getMessageType(waMsg) != "unknown" || (!dumpEnabled && !log.Debug().Enabled()) {
+		return nil
+	}
+	var rawMessage map[string]any
+	marshaled, err := protojson.Marshal(waMsg)
+	if err == nil {
+		err = json.Unmarshal(marshaled, &rawMessage)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to marshal unknown message to JSON")
+		return nil
+	}
+	stripRawMessageFields(rawMessage)
+	log.Debug().Any("raw_message", rawMessage).Msg("Received message of unknown type")
+	if !dumpEnabled {
 		return nil
 	}
+	return &ConvertedMessage{
+		Intent: intent,
+		Type:   event.EventMessage,
+		Content: &event.MessageEventContent{
+			Body:    portal.T("Unsupported message type"),
+			MsgType: event.MsgNotice,
+		},
+		Extra: map[string]any{
+			RawMessageDumpKey: rawMessage,
+		},
+		ExpiresIn: time.Duration(getMessageContextInfo(waMsg).GetExpiration()) * time.Second,
+	}
 }
 
 func (portal *Portal) implicitlyEnableDisappearingMessages(ctx context.Context, timer time.Duration) {
@@ -792,6 +899,7 @@ func (portal *Portal) implicitlyEnableDisappearingMessages(ctx context.Context,
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after implicitly enabling disappearing timer")
 	}
+	portal.UpdateDisappearingTimerState(ctx)
 	intent := portal.MainIntent()
 	if portal.Encrypted {
 		intent = portal.bridge.Bot
@@ -799,7 +907,7 @@ func (portal *Portal) implicitlyEnableDisappearingMessages(ctx context.Context,
 	duration := formatDuration(time.Duration(portal.ExpirationTime) * time.Second)
 	_, err = portal.sendMessage(ctx, intent, event.EventMessage, &event.MessageEventContent{
 		MsgType: event.MsgNotice,
-		Body:    fmt.Sprintf("Automatically enabled disappearing message timer (%s) because incoming message is disappearing", duration),
+		Body:    portal.T("Automatically enabled disappearing message timer (%s) because incoming message is disappearing", duration),
 	}, nil, 0)
 	if err != nil {
 		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to send notice about implicit disappearing timer")
@@ -815,29 +923,36 @@ func (portal *Portal) UpdateGroupDisappearingMessages(ctx context.Context, sende
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after updating expiration timer")
 	}
+	portal.UpdateDisappearingTimerState(ctx)
+	portal.sendGroupChangeNotice(ctx, sender, timestamp, portal.formatDisappearingMessageNotice())
+}
+
+// sendGroupChangeNotice sends a notice about a group setting change. The notice is sent by the ghost of the user
+// who made the change, so the text should be phrased without a subject (e.g. "Changed the group description").
+func (portal *Portal) sendGroupChangeNotice(ctx context.Context, sender *types.JID, timestamp time.Time, text string) {
 	intent := portal.MainIntent()
 	if sender != nil && sender.Server == types.DefaultUserServer {
 		intent = portal.bridge.GetPuppetByJID(sender.ToNonAD()).IntentFor(portal)
 	} else {
 		sender = &types.EmptyJID
 	}
-	_, err = portal.sendMessage(ctx, intent, event.EventMessage, &event.MessageEventContent{
-		Body:    portal.formatDisappearingMessageNotice(),
+	_, err := portal.sendMessage(ctx, intent, event.EventMessage, &event.MessageEventContent{
+		Body:    text,
 		MsgType: event.MsgNotice,
 	}, nil, timestamp.UnixMilli())
 	if err != nil {
 		zerolog.Ctx(ctx).Warn().Err(err).
-			Uint32("new_timer", timer).
+			Str("notice_text", text).
 			Stringer("sender_jid", sender).
-			Msg("Failed to notify portal about disappearing message timer change")
+			Msg("Failed to send group change notice to portal")
 	}
 }
 
 func (portal *Portal) formatDisappearingMessageNotice() string {
 	if portal.ExpirationTime == 0 {
-		return "Turned off disappearing messages"
+		return portal.T("Turned off disappearing messages")
 	}
-	return fmt.Sprintf("Set the disappearing message timer to %s", formatDuration(time.Duration(portal.ExpirationTime)*time.Second))
+	return portal.T("Set the disappearing message timer to %s", formatDuration(time.Duration(portal.ExpirationTime)*time.Second))
 }
 
 const UndecryptableMessageNotice = "Decrypting message from WhatsApp failed, waiting for sender to re-send... " +
@@ -873,11 +988,19 @@ func (portal *Portal) handleUndecryptableMessage(ctx context.Context, source *Us
 		"messageID":         evt.Info.ID,
 		"undecryptableType": metricType,
 	})
-	intent := portal.getMessageIntent(ctx, source, &evt.Info)
+	intent, _ := portal.getCappedMessageIntent(ctx, source, &evt.Info)
 	if intent == nil {
 		return
 	}
 	content := undecryptableMessageContent
+	if translated := portal.T(UndecryptableMessageNotice); translated != UndecryptableMessageNotice {
+		content = format.RenderMarkdown(translated, true, false)
+		content.MsgType = event.MsgNotice
+	}
+	if notice := portal.bridge.Config.Bridge.FormatNotice("undecryptable", "", nil); notice != "" {
+		content = format.RenderMarkdown(notice, true, false)
+		content.MsgType = event.MsgNotice
+	}
 	resp, err := portal.sendMessage(ctx, intent, event.EventMessage, &content, nil, evt.Info.Timestamp.UnixMilli())
 	if err != nil {
 		log.Err(err).Msg("Failed to send WhatsApp decryption error message to Matrix")
@@ -886,6 +1009,57 @@ func (portal *Portal) handleUndecryptableMessage(ctx context.Context, source *Us
 	portal.finishHandling(ctx, nil, &evt.Info, resp.EventID, intent.UserID, database.MsgUnknown, 0, database.MsgErrDecryptionFailed)
 }
 
+// RequestUnavailableMessage asks the user's phone to resend a message that couldn't be decrypted.
+// If the phone responds, the message is handled like a normal message and replaces the placeholder.
+// If notifyFailure is true, a notice is sent to the room if the phone doesn't respond in time.
+func (portal *Portal) RequestUnavailableMessage(ctx context.Context, user *User, msg *database.Message, notifyFailure bool) error {
+	if msg.Error != database.MsgErrDecryptionFailed {
+		return fmt.Errorf("message is not undecryptable")
+	} else if user.Client == nil || !user.IsLoggedIn() {
+		return errUserNotLoggedIn
+	}
+	req := user.Client.BuildUnavailableMessageRequest(portal.Key.JID, msg.Sender, msg.JID)
+	resp, err := user.Client.SendMessage(ctx, user.JID.ToNonAD(), req, whatsmeow.SendRequestExtra{Peer: true})
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("message_id", msg.JID).
+		Str("request_id", resp.ID).
+		Msg("Sent request for unavailable message to phone")
+	portal.pendingDecryptRetries.Store(msg.JID, time.Now())
+	go portal.checkDecryptRetryResult(zerolog.Ctx(ctx).WithContext(context.Background()), user, msg, notifyFailure)
+	return nil
+}
+
+const decryptRetryTimeout = 2 * time.Minute
+
+// checkDecryptRetryResult waits for the phone to resend a requested message
+// and optionally sends a notice replying to the placeholder if it doesn't arrive in time.
+func (portal *Portal) checkDecryptRetryResult(ctx context.Context, user *User, msg *database.Message, notifyFailure bool) {
+	time.Sleep(decryptRetryTimeout)
+	if _, stillPending := portal.pendingDecryptRetries.LoadAndDelete(msg.JID); !stillPending {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Str("message_id", msg.JID).Logger()
+	log.Debug().Msg("Decryption retry didn't succeed in time")
+	Analytics.Track(user.MXID, "WhatsApp decryption retry failed", map[string]interface{}{
+		"messageID": msg.JID,
+	})
+	if !notifyFailure {
+		return
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    portal.T("Your phone didn't resend the message. It may no longer be available on your phone."),
+	}
+	content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(msg.MXID)
+	_, err := portal.sendMainIntentMessage(ctx, content)
+	if err != nil {
+		log.Err(err).Msg("Failed to send notice about failed decryption retry")
+	}
+}
+
 func (portal *Portal) handleFakeMessage(ctx context.Context, msg fakeMessage) {
 	log := zerolog.Ctx(ctx)
 	if portal.isRecentlyHandled(msg.ID, database.MsgNoError) {
@@ -929,7 +1103,20 @@ func (portal *Portal) handleFakeMessage(ctx context.Context, msg fakeMessage) {
 	}
 }
 
+// SilentBackfillKey is added to the content of backfilled messages when silent backfilling is enabled,
+// so that push rules can be used to suppress notifications for them. The value is a string, because
+// event_match push rule conditions can't match booleans.
+const (
+	SilentBackfillKey   = "fi.mau.whatsapp.silent_backfill"
+	SilentBackfillValue = "true"
+)
+
 func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *events.Message, historical bool) {
+	handleStart := time.Now()
+	var timings remoteMessageTimings
+	if !historical {
+		timings.receiveAge = handleStart.Sub(evt.Info.Timestamp)
+	}
 	log := zerolog.Ctx(ctx)
 	if len(portal.MXID) == 0 {
 		log.Warn().Msg("handleMessage called even though portal.MXID is empty")
@@ -961,6 +1148,14 @@ func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *even
 				"messageID":   evt.Info.ID,
 				"resolveType": resolveType,
 			})
+			if requestedAt, ok := portal.pendingDecryptRetries.LoadAndDelete(evt.Info.ID); ok {
+				log.Debug().
+					Dur("retry_duration", time.Since(requestedAt.(time.Time))).
+					Msg("Decryption retry succeeded")
+				Analytics.Track(source.MXID, "WhatsApp decryption retry succeeded", map[string]interface{}{
+					"messageID": evt.Info.ID,
+				})
+			}
 			log.Debug().Str("resolved_via", resolveType).Msg("Got decryptable version of previously undecryptable message")
 		} else {
 			log.Debug().Msg("Not handling duplicate message")
@@ -992,22 +1187,39 @@ func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *even
 		evt.Message = evt.Message.GetProtocolMessage().GetEditedMessage()
 	}
 
-	intent := portal.getMessageIntent(ctx, source, &evt.Info)
+	intent, representedSender := portal.getCappedMessageIntent(ctx, source, &evt.Info)
 	if intent == nil {
 		return
 	}
+	convertStart := time.Now()
 	converted := portal.convertMessage(ctx, intent, source, &evt.Info, evt.Message, false)
+	timings.convert = time.Since(convertStart)
 	if converted != nil {
+		if representedSender != "" {
+			addRepresentedSenderName(converted, representedSender)
+		}
 		isGalleriable := portal.bridge.Config.Bridge.BeeperGalleries &&
 			(evt.Message.ImageMessage != nil || evt.Message.VideoMessage != nil) &&
 			(portal.galleryCache == nil ||
 				(evt.Info.Sender.ToNonAD() == portal.galleryCacheSender &&
 					converted.ReplyTo.Equals(portal.galleryCacheReplyTo) &&
 					time.Since(portal.galleryCacheStart) < GalleryMaxTime)) &&
-			// Captions aren't allowed in galleries (this needs to be checked before the caption is merged)
-			converted.Caption == nil &&
-			// Images can't be edited
-			editTargetMsg == nil
+			// Albums only have one caption, so a second captioned image starts a new gallery
+			// (this needs to be checked before the caption is merged)
+			(converted.Caption == nil || portal.galleryCache == nil || portal.galleryCacheCaption == "") &&
+			// Images can't be edited, and placeholders being replaced aren't part of a gallery
+			editTargetMsg == nil && existingMsg == nil
+
+		var galleryCaption string
+		galleryItem := converted.Content
+		if isGalleriable && converted.Caption != nil {
+			// The caption of an album is kept on the gallery, and merged into the image in case the album has only one image.
+			// The gallery item is copied first, so that the merged caption doesn't end up in the gallery images.
+			galleryCaption = converted.Caption.Body
+			itemCopy := *converted.Content
+			galleryItem = &itemCopy
+			converted.MergeCaption()
+		}
 
 		if !historical && portal.IsPrivateChat() && evt.Info.Sender.Device == 0 && converted.ExpiresIn > 0 && portal.ExpirationTime == 0 {
 			log.Info().
@@ -1021,7 +1233,16 @@ func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *even
 			}
 			converted.Extra["fi.mau.whatsapp.source_broadcast_list"] = evt.Info.Chat.String()
 		}
-		if portal.bridge.Config.Bridge.CaptionInMessage {
+		if historical && portal.bridge.Config.Bridge.HistorySync.Silent {
+			if converted.Extra == nil {
+				converted.Extra = map[string]any{}
+			}
+			converted.Extra[SilentBackfillKey] = SilentBackfillValue
+			converted.Content.Mentions = &event.Mentions{}
+		}
+		// Edits can only target the media event, so captions are always merged into them.
+		// The same applies when replacing the placeholder of a previously undecryptable message.
+		if portal.bridge.Config.Bridge.CaptionMode == config.CaptionModeMerged || editTargetMsg != nil || existingMsg != nil {
 			converted.MergeCaption()
 		}
 		var eventID id.EventID
@@ -1040,11 +1261,15 @@ func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *even
 		galleryStarted := false
 		var galleryPart int
 		if isGalleriable {
+			// A new gallery always resets the caption, while later items only set it if the gallery didn't have one
+			if portal.galleryCache == nil || galleryCaption != "" {
+				portal.galleryCacheCaption = galleryCaption
+			}
 			if portal.galleryCache == nil {
-				portal.startGallery(evt, converted)
+				portal.startGallery(evt, converted, galleryItem)
 				galleryStarted = true
 			} else {
-				galleryPart = portal.extendGallery(converted)
+				galleryPart = portal.extendGallery(converted, galleryItem)
 				dbMsgType = database.MsgBeeperGallery
 			}
 		} else if editTargetMsg == nil {
@@ -1052,22 +1277,30 @@ func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *even
 			portal.stopGallery()
 		}
 		var resp *mautrix.RespSendEvent
+		sendStart := time.Now()
 		resp, err = portal.sendMessage(ctx, converted.Intent, converted.Type, converted.Content, converted.Extra, evt.Info.Timestamp.UnixMilli())
+		timings.matrixSend = time.Since(sendStart)
 		if err != nil {
 			log.Err(err).Msg("Failed to send WhatsApp message to Matrix")
 		} else {
 			if editTargetMsg == nil {
 				portal.MarkDisappearing(ctx, resp.EventID, converted.ExpiresIn, evt.Info.Timestamp)
+			} else {
+				portal.MarkEditDisappearing(ctx, resp.EventID, editTargetMsg.MXID)
 			}
 			eventID = resp.EventID
 			lastEventID = eventID
+			if existingMsg != nil {
+				// The placeholder was edited in place, so keep pointing at the original event
+				// to keep replies and reactions targeting the right event.
+				eventID = existingMsg.MXID
+			}
 			if galleryStarted {
 				portal.galleryCacheRootEvent = eventID
 			} else if galleryPart != 0 {
 				eventID = portal.galleryCacheRootEvent
 			}
 		}
-		// TODO figure out how to handle captions with undecryptable messages turning decryptable
 		if converted.Caption != nil && existingMsg == nil && editTargetMsg == nil {
 			resp, err = portal.sendMessage(ctx, converted.Intent, converted.Type, converted.Caption, nil, evt.Info.Timestamp.UnixMilli())
 			if err != nil {
@@ -1077,7 +1310,8 @@ func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *even
 				lastEventID = resp.EventID
 			}
 		}
-		if converted.MultiEvent != nil && existingMsg == nil && editTargetMsg == nil {
+		// Extra events can't be merged into the placeholder edit, so they're sent as new events rather than dropped
+		if converted.MultiEvent != nil && editTargetMsg == nil {
 			for index, subEvt := range converted.MultiEvent {
 				resp, err = portal.sendMessage(ctx, converted.Intent, converted.Type, subEvt, nil, evt.Info.Timestamp.UnixMilli())
 				if err != nil {
@@ -1099,10 +1333,17 @@ func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *even
 			}
 		}
 		if len(eventID) != 0 {
+			timings.total = time.Since(handleStart)
+			log.UpdateContext(func(c zerolog.Context) zerolog.Context {
+				return c.Object("timings", &timings)
+			})
 			portal.finishHandling(ctx, existingMsg, &evt.Info, eventID, intent.UserID, dbMsgType, galleryPart, converted.Error)
 		}
 	} else if msgType == "reaction" || msgType == "encrypted reaction" {
-		if evt.Message.GetEncReactionMessage() != nil {
+		if representedSender != "" {
+			// Reactions can't have the sender name prefixed, so bridging them through the bot would be misleading
+			log.Debug().Msg("Dropping reaction from participant without ghost user")
+		} else if evt.Message.GetEncReactionMessage() != nil {
 			log.UpdateContext(func(c zerolog.Context) zerolog.Context {
 				return c.Str("reaction_target_id", evt.Message.GetEncReactionMessage().GetTargetMessageKey().GetId())
 			})
@@ -1115,6 +1356,8 @@ func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *even
 		} else {
 			portal.HandleMessageReaction(ctx, intent, source, &evt.Info, evt.Message.GetReactionMessage(), existingMsg)
 		}
+	} else if msgType == "poll update" && portal.bridge.Config.Bridge.AnonymousPollVotes {
+		portal.handleAnonymousPollVote(ctx, source, &evt.Info, evt.Message.GetPollUpdateMessage(), existingMsg)
 	} else if msgType == "revoke" {
 		portal.HandleMessageRevoke(ctx, source, &evt.Info, evt.Message.GetProtocolMessage().GetKey())
 		if existingMsg != nil {
@@ -1140,13 +1383,17 @@ func (portal *Portal) handleMessage(ctx context.Context, source *User, evt *even
 		return
 	}
 	portal.bridge.Metrics.TrackWhatsAppMessage(evt.Info.Timestamp, strings.Split(msgType, " ")[0])
+	if !historical {
+		Analytics.TrackMessage(source.MXID, "to_matrix", strings.Split(msgType, " ")[0])
+	}
 }
 
 func (portal *Portal) isRecentlyHandled(id types.MessageID, error database.MessageErrorType) bool {
-	start := portal.recentlyHandledIndex
+	portal.recentlyHandledLock.Lock()
+	defer portal.recentlyHandledLock.Unlock()
 	lookingForMsg := recentlyHandledWrapper{id, error}
-	for i := start; i != start; i = (i - 1) % recentlyHandledLength {
-		if portal.recentlyHandled[i] == lookingForMsg {
+	for _, item := range portal.recentlyHandled {
+		if item == lookingForMsg {
 			return true
 		}
 	}
@@ -1182,10 +1429,9 @@ func (portal *Portal) markHandled(ctx context.Context, msg *database.Message, in
 
 	if recent {
 		portal.recentlyHandledLock.Lock()
-		index := portal.recentlyHandledIndex
+		portal.recentlyHandled[portal.recentlyHandledIndex] = recentlyHandledWrapper{msg.JID, errType}
 		portal.recentlyHandledIndex = (portal.recentlyHandledIndex + 1) % recentlyHandledLength
 		portal.recentlyHandledLock.Unlock()
-		portal.recentlyHandled[index] = recentlyHandledWrapper{msg.JID, errType}
 	}
 	return msg
 }
@@ -1259,20 +1505,86 @@ func (portal *Portal) kickExtraUsers(ctx context.Context, participantMap map[typ
 	}
 }
 
-//func (portal *Portal) SyncBroadcastRecipients(source *User, metadata *whatsapp.BroadcastListInfo) {
-//	participantMap := make(map[whatsapp.JID]bool)
-//	for _, recipient := range metadata.Recipients {
-//		participantMap[recipient.JID] = true
-//
-//		puppet := portal.bridge.GetPuppetByJID(recipient.JID)
-//		puppet.SyncContactIfNecessary(source)
-//		err := puppet.DefaultIntent().EnsureJoined(portal.MXID)
-//		if err != nil {
-//			portal.log.Warnfln("Failed to make puppet of %s join %s: %v", recipient.JID, portal.MXID, err)
-//		}
-//	}
-//	portal.kickExtraUsers(participantMap)
-//}
+// BroadcastListInfo contains the metadata of a broadcast list. WhatsApp doesn't have a way to fetch it directly,
+// so it's collected from history syncs and the contact store.
+type BroadcastListInfo struct {
+	Name       string
+	Recipients []types.JID
+}
+
+func (portal *Portal) getBroadcastListName(source *User) string {
+	if source.Client != nil {
+		contact, err := source.Client.Store.Contacts.GetContact(portal.Key.JID)
+		if err == nil && contact.Found && len(contact.FullName) > 0 {
+			return contact.FullName
+		}
+	}
+	if len(portal.Name) > 0 {
+		return portal.Name
+	}
+	return UnnamedBroadcastName
+}
+
+func (portal *Portal) getBroadcastListTopic(recipientCount int) string {
+	if recipientCount == 1 {
+		return fmt.Sprintf("%s with 1 recipient", BroadcastTopic)
+	} else if recipientCount > 1 {
+		return fmt.Sprintf("%s with %d recipients", BroadcastTopic, recipientCount)
+	}
+	return BroadcastTopic
+}
+
+// SyncBroadcastList updates the name and recipients of a broadcast list portal, creating the room if necessary.
+func (portal *Portal) SyncBroadcastList(ctx context.Context, source *User, info *BroadcastListInfo) {
+	if !portal.IsBroadcastList() || portal.IsStatusBroadcastList() || !portal.bridge.Config.Bridge.BroadcastListPortals {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Stringer("broadcast_list_jid", portal.Key.JID).Logger()
+	ctx = log.WithContext(ctx)
+	if len(info.Name) > 0 && len(portal.MXID) == 0 {
+		portal.Name = info.Name
+	}
+	if len(portal.MXID) == 0 {
+		err := portal.CreateMatrixRoom(ctx, source, nil, nil, true, false)
+		if err != nil {
+			log.Err(err).Msg("Failed to create broadcast list portal")
+			return
+		}
+	} else if len(info.Name) > 0 {
+		portal.UpdateName(ctx, info.Name, types.EmptyJID, false)
+	}
+	if info.Recipients != nil {
+		portal.UpdateTopic(ctx, portal.getBroadcastListTopic(len(info.Recipients)), types.EmptyJID, false)
+		portal.SyncBroadcastRecipients(ctx, source, info.Recipients)
+	}
+	err := portal.Update(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to save portal after syncing broadcast list")
+	}
+}
+
+func (portal *Portal) SyncBroadcastRecipients(ctx context.Context, source *User, recipients []types.JID) {
+	participantMap := make(map[types.JID]bool, len(recipients)+1)
+	// The user is the owner of the list, so their own puppet shouldn't be kicked
+	participantMap[source.JID.ToNonAD()] = true
+	for _, recipient := range recipients {
+		recipient = recipient.ToNonAD()
+		participantMap[recipient] = true
+
+		puppet := portal.bridge.GetPuppetByJID(recipient)
+		if puppet == nil {
+			continue
+		}
+		puppet.SyncContact(ctx, source, true, false, "broadcast list recipient")
+		err := puppet.DefaultIntent().EnsureJoined(ctx, portal.MXID)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).
+				Stringer("recipient_jid", recipient).
+				Msg("Failed to make puppet of broadcast list recipient join portal")
+		}
+	}
+	portal.kickExtraUsers(ctx, participantMap)
+}
 
 func (portal *Portal) syncParticipant(ctx context.Context, source *User, participant types.GroupParticipant, puppet *Puppet, user *User, wg *sync.WaitGroup) {
 	defer func() {
@@ -1321,6 +1633,10 @@ func (portal *Portal) SyncParticipants(ctx context.Context, source *User, metada
 	participantMap := make(map[types.JID]bool)
 	userIDs := make([]id.UserID, 0, len(metadata.Participants))
 	log := zerolog.Ctx(ctx)
+	lazy := portal.isLazyMemberSync(metadata)
+	if lazy {
+		log.Debug().Int("participant_count", len(metadata.Participants)).Msg("Group is large, only syncing admins and Matrix users")
+	}
 	for _, participant := range metadata.Participants {
 		if participant.JID.IsEmpty() || participant.JID.Server != types.DefaultUserServer {
 			wg.Done()
@@ -1332,12 +1648,20 @@ func (portal *Portal) SyncParticipants(ctx context.Context, source *User, metada
 			Bool("is_admin", participant.IsAdmin).
 			Msg("Syncing participant")
 		participantMap[participant.JID] = true
-		puppet := portal.bridge.GetPuppetByJID(participant.JID)
 		user := portal.bridge.GetUserByJID(participant.JID)
-		if portal.bridge.Config.Bridge.ParallelMemberSync {
-			go portal.syncParticipant(ctx, source, participant, puppet, user, &wg)
+		syncNow := !lazy || shouldSyncParticipantEagerly(participant, user)
+		puppetMXID := portal.bridge.FormatPuppetMXID(participant.JID)
+		var puppet *Puppet
+		if !syncNow {
+			// The ghost will be created and joined when the participant first sends something
+			wg.Done()
 		} else {
-			portal.syncParticipant(ctx, source, participant, puppet, user, &wg)
+			puppet = portal.bridge.GetPuppetByJID(participant.JID)
+			if portal.bridge.Config.Bridge.ParallelMemberSync {
+				go portal.syncParticipant(ctx, source, participant, puppet, user, &wg)
+			} else {
+				portal.syncParticipant(ctx, source, participant, puppet, user, &wg)
+			}
 		}
 
 		expectedLevel := 0
@@ -1346,13 +1670,13 @@ func (portal *Portal) SyncParticipants(ctx context.Context, source *User, metada
 		} else if participant.IsAdmin {
 			expectedLevel = 50
 		}
-		changed = levels.EnsureUserLevel(puppet.MXID, expectedLevel) || changed
+		changed = levels.EnsureUserLevel(puppetMXID, expectedLevel) || changed
 		if user != nil {
 			userIDs = append(userIDs, user.MXID)
 			changed = levels.EnsureUserLevel(user.MXID, expectedLevel) || changed
 		}
-		if user == nil || puppet.CustomMXID != user.MXID {
-			userIDs = append(userIDs, puppet.MXID)
+		if syncNow && (user == nil || puppet.CustomMXID != user.MXID) {
+			userIDs = append(userIDs, puppetMXID)
 		}
 	}
 	if portal.MXID != "" {
@@ -1363,6 +1687,8 @@ func (portal *Portal) SyncParticipants(ctx context.Context, source *User, metada
 			}
 		}
 		portal.kickExtraUsers(ctx, participantMap)
+		portal.updateMemberListState(ctx, metadata)
+		portal.bridge.Metrics.TrackPortalParticipants(portal.Key.JID, len(metadata.Participants))
 	}
 	wg.Wait()
 	log.Debug().Msg("Participant sync completed")
@@ -1399,6 +1725,9 @@ func (user *User) reuploadAvatarDirectPath(ctx context.Context, intent *appservi
 	return resp.ContentURI, nil
 }
 
+// updateAvatar fetches the full-size avatar of the given user or group and reuploads it to Matrix.
+// The WhatsApp picture ID is stored in avatarID, and passed to WhatsApp as the existing ID,
+// so the avatar is only downloaded again if it has actually changed.
 func (user *User) updateAvatar(ctx context.Context, jid types.JID, isCommunity bool, avatarID *string, avatarURL *id.ContentURI, avatarSet *bool, intent *appservice.IntentAPI) bool {
 	currentID := ""
 	if *avatarSet && *avatarID != "remove" && *avatarID != "unauthorized" {
@@ -1622,9 +1951,9 @@ func (portal *Portal) UpdateTopic(ctx context.Context, topic string, setBy types
 	if !setBy.IsEmpty() && setBy.Server == types.DefaultUserServer {
 		intent = portal.bridge.GetPuppetByJID(setBy).IntentFor(portal)
 	}
-	_, err := intent.SetRoomTopic(ctx, portal.MXID, topic)
+	_, err := intent.SetRoomTopic(ctx, portal.MXID, portal.matrixTopic())
 	if errors.Is(err, mautrix.MForbidden) && intent != portal.MainIntent() {
-		_, err = portal.MainIntent().SetRoomTopic(ctx, portal.MXID, topic)
+		_, err = portal.MainIntent().SetRoomTopic(ctx, portal.MXID, portal.matrixTopic())
 	}
 	if err != nil {
 		log.Err(err).Msg("Failed to set room topic")
@@ -1661,6 +1990,7 @@ func (portal *Portal) UpdateParentGroup(ctx context.Context, source *User, paren
 			Stringer("new_parent_group", parent).
 			Msg("Updating parent group")
 		portal.updateCommunitySpace(ctx, source, false, false)
+		portal.unlinkAnnounceGroup(ctx, portal.GetParentPortal())
 		portal.ParentGroup = parent
 		portal.parentPortal = nil
 		portal.InSpace = false
@@ -1689,17 +2019,10 @@ func (portal *Portal) UpdateMetadata(ctx context.Context, user *User, groupInfo
 		return update
 	} else if portal.IsBroadcastList() {
 		update := false
-		//broadcastMetadata, err := user.Conn.GetBroadcastMetadata(portal.Key.JID)
-		//if err == nil && broadcastMetadata.Status == 200 {
-		//	portal.SyncBroadcastRecipients(user, broadcastMetadata)
-		//	update = portal.UpdateName(broadcastMetadata.Name, "", nil, false) || update
-		//} else {
-		//	user.Conn.Store.ContactsLock.RLock()
-		//	contact, _ := user.Conn.Store.Contacts[portal.Key.JID]
-		//	user.Conn.Store.ContactsLock.RUnlock()
-		//	update = portal.UpdateName(contact.Name, "", nil, false) || update
-		//}
-		//update = portal.UpdateTopic(BroadcastTopic, "", nil, false) || update
+		update = portal.UpdateName(ctx, portal.getBroadcastListName(user), types.EmptyJID, false) || update
+		if len(portal.Topic) == 0 {
+			update = portal.UpdateTopic(ctx, BroadcastTopic, types.EmptyJID, false) || update
+		}
 		return update
 	}
 	if groupInfo == nil && portal.IsNewsletter() {
@@ -1726,10 +2049,13 @@ func (portal *Portal) UpdateMetadata(ctx context.Context, user *User, groupInfo
 	update := false
 	update = portal.UpdateName(ctx, groupInfo.Name, groupInfo.NameSetBy, false) || update
 	update = portal.UpdateTopic(ctx, groupInfo.Topic, groupInfo.TopicSetBy, false) || update
+	update = portal.UpdateDefaultSubGroup(ctx, groupInfo.IsDefaultSubGroup) || update
 	update = portal.UpdateParentGroup(ctx, user, groupInfo.LinkedParentJID, false) || update
+	portal.updateLinkedAnnounceGroup(ctx)
 	if portal.ExpirationTime != groupInfo.DisappearingTimer {
 		update = true
 		portal.ExpirationTime = groupInfo.DisappearingTimer
+		portal.UpdateDisappearingTimerState(ctx)
 	}
 	if portal.IsParent != groupInfo.IsParent {
 		if portal.MXID != "" {
@@ -1739,6 +2065,7 @@ func (portal *Portal) UpdateMetadata(ctx context.Context, user *User, groupInfo
 		update = true
 	}
 
+	update = portal.UpdateGroupFlags(groupInfo.IsAnnounce, groupInfo.IsLocked, groupInfo.IsIncognito) || update
 	portal.RestrictMessageSending(ctx, groupInfo.IsAnnounce)
 	portal.RestrictMetadataChanges(ctx, groupInfo.IsLocked)
 	if newsletterMetadata != nil && newsletterMetadata.ViewerMeta != nil {
@@ -2012,7 +2339,7 @@ func (portal *Portal) updateChildRooms(ctx context.Context) {
 }
 
 func (portal *Portal) shouldSetDMRoomMetadata() bool {
-	return !portal.IsPrivateChat() ||
+	return !portal.IsPrivateChat() || portal.IsNoteToSelf() ||
 		portal.bridge.Config.Bridge.PrivateChatPortalMeta == "always" ||
 		(portal.IsEncrypted() && portal.bridge.Config.Bridge.PrivateChatPortalMeta != "never")
 }
@@ -2046,7 +2373,6 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 
 	log.Info().Msg("Creating Matrix room")
 
-	//var broadcastMetadata *types.BroadcastListInfo
 	if portal.IsPrivateChat() {
 		puppet := portal.bridge.GetPuppetByJID(portal.Key.JID)
 		puppet.SyncContact(ctx, user, true, false, "creating private chat portal")
@@ -2054,6 +2380,10 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 		portal.AvatarURL = puppet.AvatarURL
 		portal.Avatar = puppet.Avatar
 		portal.Topic = PrivateChatTopic
+		if portal.IsNoteToSelf() {
+			portal.Name = portal.bridge.Config.Bridge.NoteToSelfName
+			portal.Topic = NoteToSelfTopic
+		}
 	} else if portal.IsStatusBroadcastList() {
 		if !portal.bridge.Config.Bridge.EnableStatusBroadcast {
 			log.Debug().Msg("Status bridging is disabled in config, not creating room after all")
@@ -2062,22 +2392,14 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 		portal.Name = StatusBroadcastName
 		portal.Topic = StatusBroadcastTopic
 	} else if portal.IsBroadcastList() {
-		//var err error
-		//broadcastMetadata, err = user.Conn.GetBroadcastMetadata(portal.Key.JID)
-		//if err == nil && broadcastMetadata.Status == 200 {
-		//	portal.Name = broadcastMetadata.Name
-		//} else {
-		//	user.Conn.Store.ContactsLock.RLock()
-		//	contact, _ := user.Conn.Store.Contacts[portal.Key.JID]
-		//	user.Conn.Store.ContactsLock.RUnlock()
-		//	portal.Name = contact.Name
-		//}
-		//if len(portal.Name) == 0 {
-		//	portal.Name = UnnamedBroadcastName
-		//}
-		//portal.Topic = BroadcastTopic
-		log.Debug().Msg("Broadcast list is not yet supported, not creating room after all")
-		return fmt.Errorf("broadcast list bridging is currently not supported")
+		if !portal.bridge.Config.Bridge.BroadcastListPortals {
+			log.Debug().Msg("Broadcast list portals are disabled in config, not creating room after all")
+			return ErrBroadcastListPortalsDisabled
+		}
+		portal.Name = portal.getBroadcastListName(user)
+		if len(portal.Topic) == 0 {
+			portal.Topic = BroadcastTopic
+		}
 	} else {
 		if portal.IsNewsletter() {
 			if newsletterMetadata == nil {
@@ -2118,6 +2440,10 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 			portal.Topic = groupInfo.Topic
 			portal.IsParent = groupInfo.IsParent
 			portal.ParentGroup = groupInfo.LinkedParentJID
+			portal.IsDefaultSubGroup = groupInfo.IsDefaultSubGroup
+			portal.IsAnnounce = groupInfo.IsAnnounce
+			portal.IsLocked = groupInfo.IsLocked
+			portal.IsIncognito = groupInfo.IsIncognito
 			if groupInfo.IsEphemeral {
 				portal.ExpirationTime = groupInfo.DisappearingTimer
 			}
@@ -2141,6 +2467,14 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 			powerLevels.EnsureEventLevel(event.StateTopic, 50)
 		}
 	}
+	if portal.IsBroadcastList() && !portal.IsStatusBroadcastList() {
+		// Broadcast lists are read-mostly: only the owner can send messages and the metadata can't be changed
+		powerLevels.EventsDefault = 50
+		powerLevels.EnsureEventLevel(event.StateRoomName, 99)
+		powerLevels.EnsureEventLevel(event.StateRoomAvatar, 99)
+		powerLevels.EnsureEventLevel(event.StateTopic, 99)
+		powerLevels.EnsureUserLevel(user.MXID, 50)
+	}
 	if newsletterMetadata != nil && newsletterMetadata.ViewerMeta != nil {
 		switch newsletterMetadata.ViewerMeta.Role {
 		case types.NewsletterRoleAdmin:
@@ -2180,6 +2514,18 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 			invite = append(invite, portal.bridge.Bot.UserID)
 		}
 	}
+	if portal.ExpirationTime > 0 && portal.bridge.Config.Bridge.DisappearingRetention {
+		initialState = append(initialState, &event.Event{
+			Type:    StateRoomRetention,
+			Content: event.Content{Parsed: portal.getRetentionEventContent()},
+		})
+	}
+	if portal.ExpirationTime > 0 {
+		initialState = append(initialState, &event.Event{
+			Type:    StateDisappearingTimer,
+			Content: event.Content{Parsed: &DisappearingTimerEventContent{Timer: portal.ExpirationTime}},
+		})
+	}
 	if !portal.AvatarURL.IsEmpty() && portal.shouldSetDMRoomMetadata() {
 		initialState = append(initialState, &event.Event{
 			Type: event.StateRoomAvatar,
@@ -2221,6 +2567,12 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 				panic(fmt.Errorf("unexpected type %s in first initial state event", initialState[0].Type.Type))
 			}
 			initialState[0].Content.Parsed = powerLevels
+			if portal.isLazyMemberSync(groupInfo) {
+				initialState = append(initialState, &event.Event{
+					Type:    StateMemberList,
+					Content: event.Content{Parsed: portal.getMemberListEventContent(groupInfo)},
+				})
+			}
 		} else {
 			invite = append(invite, user.MXID)
 		}
@@ -2228,10 +2580,10 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 	req := &mautrix.ReqCreateRoom{
 		Visibility:      "private",
 		Name:            portal.Name,
-		Topic:           portal.Topic,
+		Topic:           portal.matrixTopic(),
 		Invite:          invite,
 		Preset:          "private_chat",
-		IsDirect:        portal.IsPrivateChat(),
+		IsDirect:        portal.IsPrivateChat() && !portal.IsNoteToSelf(),
 		InitialState:    initialState,
 		CreationContent: creationContent,
 
@@ -2255,6 +2607,10 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 		return err
 	}
 	log.Info().Stringer("room_id", resp.RoomID).Msg("Matrix room created")
+	portal.bridge.Webhooks.Send(user, WebhookPortalCreate, map[string]interface{}{
+		"room_id": resp.RoomID,
+		"chat_id": portal.Key.JID,
+	})
 	portal.InSpace = false
 	portal.NameSet = len(req.Name) > 0
 	portal.TopicSet = len(req.Topic) > 0
@@ -2291,9 +2647,6 @@ func (portal *Portal) CreateMatrixRoom(ctx context.Context, user *User, groupInf
 	if !portal.IsNewsletter() && groupInfo != nil && !autoJoinInvites {
 		portal.SyncParticipants(ctx, user, groupInfo)
 	}
-	//if broadcastMetadata != nil {
-	//	portal.SyncBroadcastRecipients(user, broadcastMetadata)
-	//}
 	if portal.IsPrivateChat() {
 		puppet := user.bridge.GetPuppetByJID(portal.Key.JID)
 
@@ -2368,11 +2721,11 @@ func (portal *Portal) updateCommunitySpace(ctx context.Context, user *User, add,
 	}
 
 	var parentContent event.SpaceParentEventContent
-	var childContent event.SpaceChildEventContent
+	childContent := &event.SpaceChildEventContent{}
 	if add {
 		parentContent.Canonical = true
 		parentContent.Via = []string{portal.bridge.Config.Homeserver.Domain}
-		childContent.Via = []string{portal.bridge.Config.Homeserver.Domain}
+		childContent = portal.getSpaceChildContent()
 		log.Debug().
 			Stringer("space_mxid", space.MXID).
 			Stringer("parent_group_jid", space.Key.JID).
@@ -2384,7 +2737,7 @@ func (portal *Portal) updateCommunitySpace(ctx context.Context, user *User, add,
 			Msg("Removing room from parent group space")
 	}
 
-	_, err := space.MainIntent().SendStateEvent(ctx, space.MXID, event.StateSpaceChild, portal.MXID.String(), &childContent)
+	_, err := space.MainIntent().SendStateEvent(ctx, space.MXID, event.StateSpaceChild, portal.MXID.String(), childContent)
 	if err != nil {
 		log.Err(err).Stringer("space_mxid", space.MXID).Msg("Failed to send m.space.child event")
 		return false
@@ -2404,10 +2757,108 @@ func (portal *Portal) updateCommunitySpace(ctx context.Context, user *User, add,
 	return true
 }
 
+func (portal *Portal) getSpaceChildContent() *event.SpaceChildEventContent {
+	content := &event.SpaceChildEventContent{
+		Via: []string{portal.bridge.Config.Homeserver.Domain},
+	}
+	if portal.IsDefaultSubGroup {
+		// The announcement group is the "general" chat of the community, so show it first like WhatsApp does
+		content.Order = "0"
+		content.Suggested = true
+	}
+	return content
+}
+
+// UpdateGroupFlags updates the cached group settings. The caller is responsible for saving the portal.
+func (portal *Portal) UpdateGroupFlags(announce, locked, incognito bool) bool {
+	if portal.IsAnnounce == announce && portal.IsLocked == locked && portal.IsIncognito == incognito {
+		return false
+	}
+	portal.IsAnnounce = announce
+	portal.IsLocked = locked
+	portal.IsIncognito = incognito
+	return true
+}
+
+func (portal *Portal) saveGroupFlags(ctx context.Context, announce, locked, incognito bool) {
+	if portal.UpdateGroupFlags(announce, locked, incognito) {
+		err := portal.Update(ctx)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after updating group flags")
+		}
+	}
+}
+
+func (portal *Portal) updateLinkedAnnounceGroup(ctx context.Context) {
+	parent := portal.GetParentPortal()
+	if parent == nil {
+		return
+	} else if !portal.IsDefaultSubGroup {
+		portal.unlinkAnnounceGroup(ctx, parent)
+		return
+	} else if parent.LinkedAnnounceGroup == portal.Key.JID {
+		return
+	}
+	parent.LinkedAnnounceGroup = portal.Key.JID
+	err := parent.Update(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save community portal after updating linked announcement group")
+	}
+}
+
+// unlinkAnnounceGroup clears the linked announcement group of the given community if it's this portal.
+func (portal *Portal) unlinkAnnounceGroup(ctx context.Context, parent *Portal) {
+	if parent == nil || parent.LinkedAnnounceGroup != portal.Key.JID {
+		return
+	}
+	parent.LinkedAnnounceGroup = types.EmptyJID
+	err := parent.Update(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save community portal after clearing linked announcement group")
+	}
+}
+
+// UpdateDefaultSubGroup updates whether the portal is the announcement group of its community,
+// and updates the space child event if the portal is already in the community space.
+func (portal *Portal) UpdateDefaultSubGroup(ctx context.Context, isDefault bool) bool {
+	if portal.IsDefaultSubGroup == isDefault {
+		return false
+	}
+	portal.IsDefaultSubGroup = isDefault
+	space := portal.GetParentPortal()
+	if portal.InSpace && space != nil && space.MXID != "" {
+		_, err := space.MainIntent().SendStateEvent(ctx, space.MXID, event.StateSpaceChild, portal.MXID.String(), portal.getSpaceChildContent())
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Stringer("space_mxid", space.MXID).Msg("Failed to update m.space.child event")
+		}
+	}
+	return true
+}
+
+func (portal *Portal) updateCommunityLink(ctx context.Context, source *User, parent types.JID, isDefault bool) {
+	changed := portal.UpdateDefaultSubGroup(ctx, isDefault)
+	changed = portal.UpdateParentGroup(ctx, source, parent, false) || changed
+	portal.updateLinkedAnnounceGroup(ctx)
+	if changed {
+		portal.UpdateBridgeInfo(ctx)
+		err := portal.Update(ctx)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to save portal after updating community link")
+		}
+	}
+}
+
 func (portal *Portal) IsPrivateChat() bool {
 	return portal.Key.JID.Server == types.DefaultUserServer
 }
 
+// IsNoteToSelf checks if the portal is the user's "Message yourself" chat,
+// which is bridged as a personal notes room when note_to_self_name is set.
+func (portal *Portal) IsNoteToSelf() bool {
+	return portal.IsPrivateChat() && portal.Key.JID.User == portal.Key.Receiver.User &&
+		portal.bridge.Config.Bridge.NoteToSelfName != ""
+}
+
 func (portal *Portal) IsGroupChat() bool {
 	return portal.Key.JID.Server == types.GroupServer
 }
@@ -2486,17 +2937,28 @@ func (portal *Portal) SetReply(ctx context.Context, content *event.MessageEventC
 			content.RelatesTo.InReplyTo.UnstableRoomID = targetPortal.MXID
 		}
 	}()
-	if portal.bridge.Config.Bridge.CrossRoomReplies && !replyTo.Chat.IsEmpty() && replyTo.Chat != key.JID {
-		if replyTo.Chat.Server == types.GroupServer {
-			key = database.NewPortalKey(replyTo.Chat, types.EmptyJID)
-		} else if replyTo.Chat == types.StatusBroadcastJID {
-			key = database.NewPortalKey(replyTo.Chat, key.Receiver)
+	// LID chat JIDs can't be compared to the phone number JIDs used in portal keys, so they're assumed to be the same chat.
+	if !replyTo.Chat.IsEmpty() && replyTo.Chat.Server != types.HiddenUserServer && replyTo.Chat.ToNonAD() != key.JID {
+		// The reply target is in another chat (e.g. a status or a message in another group).
+		// If it can't be replied to across rooms, quote the referenced content inline instead
+		// of making a reply relation that points at nothing in this room.
+		if portal.bridge.Config.Bridge.CrossRoomReplies {
+			if replyTo.Chat.Server == types.GroupServer {
+				key = database.NewPortalKey(replyTo.Chat, types.EmptyJID)
+			} else if replyTo.Chat == types.StatusBroadcastJID || replyTo.Chat.Server == types.DefaultUserServer {
+				key = database.NewPortalKey(replyTo.Chat.ToNonAD(), key.Receiver)
+			}
 		}
 		if key != portal.Key {
 			targetPortal = portal.bridge.GetExistingPortalByJID(key)
-			if targetPortal == nil {
-				return false
+		}
+		if key == portal.Key || targetPortal == nil || targetPortal.MXID == "" {
+			log.Debug().Msg("Reply target is in another chat, adding inline quote instead of reply relation")
+			targetPortal = portal
+			if portal.shouldQuoteInline(replyTo) {
+				portal.addQuotedMessageFallback(ctx, content, replyTo)
 			}
+			return false
 		}
 	}
 	message, err := portal.bridge.DB.Message.GetByJID(ctx, key, replyTo.MessageID)
@@ -2510,6 +2972,9 @@ func (portal *Portal) SetReply(ctx context.Context, content *event.MessageEventC
 			return true
 		} else {
 			log.Warn().Msg("Failed to find reply target")
+			if portal.shouldQuoteInline(replyTo) {
+				portal.addQuotedMessageFallback(ctx, content, replyTo)
+			}
 		}
 		return false
 	}
@@ -2536,6 +3001,133 @@ func (portal *Portal) SetReply(ctx context.Context, content *event.MessageEventC
 	return true
 }
 
+// describeQuotedMessage returns a short plaintext description of a quoted WhatsApp message
+// and the thumbnail of quoted media, if there is one.
+func (portal *Portal) describeQuotedMessage(msg *waProto.Message) (string, []byte) {
+	withCaption := func(typeName, caption string) string {
+		if caption != "" {
+			return fmt.Sprintf("[%s] %s", portal.T(typeName), caption)
+		}
+		return fmt.Sprintf("[%s]", portal.T(typeName))
+	}
+	switch {
+	case msg.GetConversation() != "":
+		return msg.GetConversation(), nil
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetText(), msg.GetExtendedTextMessage().GetJpegThumbnail()
+	case msg.GetImageMessage() != nil:
+		return withCaption("photo", msg.GetImageMessage().GetCaption()), msg.GetImageMessage().GetJpegThumbnail()
+	case msg.GetStickerMessage() != nil:
+		return withCaption("sticker", ""), msg.GetStickerMessage().GetPngThumbnail()
+	case msg.GetVideoMessage() != nil:
+		return withCaption("video attachment", msg.GetVideoMessage().GetCaption()), msg.GetVideoMessage().GetJpegThumbnail()
+	case msg.GetPtvMessage() != nil:
+		return withCaption("video message", ""), msg.GetPtvMessage().GetJpegThumbnail()
+	case msg.GetAudioMessage() != nil:
+		if msg.GetAudioMessage().GetPtt() {
+			return withCaption("voice message", ""), nil
+		}
+		return withCaption("audio attachment", ""), nil
+	case msg.GetDocumentMessage() != nil:
+		doc := msg.GetDocumentMessage()
+		caption := doc.GetCaption()
+		if caption == "" {
+			caption = doc.GetFileName()
+		}
+		return withCaption("file attachment", caption), doc.GetJpegThumbnail()
+	case msg.GetLocationMessage() != nil:
+		return withCaption("location", msg.GetLocationMessage().GetName()), msg.GetLocationMessage().GetJpegThumbnail()
+	case msg.GetContactMessage() != nil:
+		return withCaption("contact", msg.GetContactMessage().GetDisplayName()), nil
+	case msg.GetPollCreationMessage() != nil:
+		return withCaption("poll start", msg.GetPollCreationMessage().GetName()), nil
+	case msg.GetPollCreationMessageV3() != nil:
+		return withCaption("poll start", msg.GetPollCreationMessageV3().GetName()), nil
+	default:
+		return withCaption("message", ""), nil
+	}
+}
+
+// addQuotedMessageFallback adds a quote of the replied-to message to the content
+// using the copy of the message in the WhatsApp context info. This is used when
+// the reply target wasn't bridged, so there's no Matrix event to reply to.
+func (portal *Portal) addQuotedMessageFallback(ctx context.Context, content *event.MessageEventContent, replyTo *ReplyInfo) {
+	if replyTo.Quoted == nil {
+		return
+	}
+	desc, thumbnail := portal.describeQuotedMessage(replyTo.Quoted)
+	if desc == "" {
+		return
+	}
+	senderName := replyTo.Sender.User
+	senderMXID := portal.bridge.FormatPuppetMXID(replyTo.Sender)
+	if puppet := portal.bridge.GetPuppetByJID(replyTo.Sender); puppet != nil && puppet.Displayname != "" {
+		senderName = puppet.Displayname
+	}
+	var quoteContext string
+	if !replyTo.Chat.IsEmpty() && replyTo.Chat.Server != types.HiddenUserServer && replyTo.Chat.ToNonAD() != portal.Key.JID {
+		quoteContext = portal.quotedChatContext(replyTo)
+	}
+	var thumbnailHTML string
+	// Inline images can't reference encrypted media, so the thumbnail is only included in unencrypted rooms
+	if len(thumbnail) > 0 && !portal.Encrypted {
+		uploaded, err := portal.MainIntent().UploadBytes(ctx, thumbnail, http.DetectContentType(thumbnail))
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to upload quoted message thumbnail")
+		} else {
+			thumbnailHTML = fmt.Sprintf(`<img src="%s" height="64" alt="thumbnail"><br>`, uploaded.ContentURI.CUString())
+		}
+	}
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		// The body of media messages is the file name unless there's a caption,
+		// so the file name is moved to its own field to make the quote a caption.
+		if content.FileName == "" {
+			content.FileName = content.Body
+			content.Body = ""
+			content.FormattedBody = ""
+			content.Format = ""
+		}
+	}
+	content.EnsureHasHTML()
+	quotedLines := strings.Split(desc, "\n")
+	for i, line := range quotedLines {
+		quotedLines[i] = "> " + line
+	}
+	var chatSuffix, chatSuffixHTML string
+	if quoteContext != "" {
+		chatSuffix = " " + quoteContext
+		chatSuffixHTML = " " + html.EscapeString(quoteContext)
+	}
+	content.Body = strings.TrimSuffix(fmt.Sprintf("> <%s>%s\n%s\n\n%s", senderName, chatSuffix, strings.Join(quotedLines, "\n"), content.Body), "\n\n")
+	content.FormattedBody = fmt.Sprintf(
+		`<blockquote><a href="%s">%s</a>%s<br>%s%s</blockquote>%s`,
+		senderMXID.URI().MatrixToURL(), html.EscapeString(senderName), chatSuffixHTML, thumbnailHTML,
+		strings.ReplaceAll(html.EscapeString(desc), "\n", "<br>"), content.FormattedBody,
+	)
+}
+
+// shouldQuoteInline checks if an inline quote should be added for a reply target that can't be replied to.
+// Status replies are always quoted, as the message wouldn't make sense without the status it's replying to.
+func (portal *Portal) shouldQuoteInline(replyTo *ReplyInfo) bool {
+	return !portal.bridge.Config.Bridge.DisableReplyFallbacks || replyTo.Chat == types.StatusBroadcastJID
+}
+
+// quotedChatContext describes where the target of a cross-chat reply is, e.g. "in Some Group" or "on your status".
+func (portal *Portal) quotedChatContext(replyTo *ReplyInfo) string {
+	if replyTo.Chat == types.StatusBroadcastJID {
+		if replyTo.Sender.User == portal.Key.Receiver.User {
+			return portal.T("on your status")
+		}
+		return portal.T("on their status")
+	}
+	key := database.NewPortalKey(replyTo.Chat.ToNonAD(), portal.Key.Receiver)
+	if otherPortal := portal.bridge.GetExistingPortalByJID(key); otherPortal != nil && otherPortal.Name != "" {
+		return portal.T("in %s", otherPortal.Name)
+	}
+	return portal.T("in %s", replyTo.Chat.ToNonAD().String())
+}
+
 func (portal *Portal) HandleMessageReaction(ctx context.Context, intent *appservice.IntentAPI, user *User, info *types.MessageInfo, reaction *waProto.ReactionMessage, existingMsg *database.Message) {
 	if existingMsg != nil {
 		_, _ = portal.MainIntent().RedactEvent(ctx, portal.MXID, existingMsg.MXID, mautrix.ReqRedact{
@@ -2582,7 +3174,7 @@ func (portal *Portal) HandleMessageReaction(ctx context.Context, intent *appserv
 		content.RelatesTo = event.RelatesTo{
 			Type:    event.RelAnnotation,
 			EventID: target.MXID,
-			Key:     variationselector.Add(reaction.GetText()),
+			Key:     portal.mapReactionToMatrix(reaction.GetText()),
 		}
 		resp, err := intent.SendMassagedMessageEvent(ctx, portal.MXID, event.EventReaction, &content, info.Timestamp.UnixMilli())
 		if err != nil {
@@ -2603,8 +3195,16 @@ func (portal *Portal) HandleMessageRevoke(ctx context.Context, user *User, info
 		return false
 	} else if msg == nil || msg.IsFakeMXID() {
 		return false
+	} else if !portal.bridge.Config.Bridge.RedactRevokedMessages {
+		log.Debug().Str("target_message_id", msg.JID).Msg("Not redacting revoked message as it's disabled in the config")
+		return true
+	}
+	intent := portal.bridge.GetPuppetByJID(info.Sender).IntentFor(portal)
+	err = portal.redactAndCleanup(ctx, intent, msg.MXID, mautrix.ReqRedact{Reason: "Message was deleted on WhatsApp"})
+	if err != nil {
+		log.Err(err).Stringer("event_id", msg.MXID).Msg("Failed to redact revoked message")
+		return false
 	}
-	portal.log.Debugln("Intentionally skipped redact event %s", msg.JID)
 	return true
 }
 
@@ -2619,11 +3219,9 @@ func (portal *Portal) deleteForMe(ctx context.Context, user *User, content *even
 		if msg == nil || msg.IsFakeMXID() {
 			return false
 		}
-		_, err = portal.MainIntent().RedactEvent(ctx, portal.MXID, msg.MXID)
+		err = portal.redactAndCleanup(ctx, portal.MainIntent(), msg.MXID, mautrix.ReqRedact{})
 		if err != nil {
 			portal.zlog.Err(err).Str("message_id", msg.JID).Msg("Failed to redact message from DeleteForMe")
-		} else if err = msg.Delete(ctx); err != nil {
-			portal.zlog.Err(err).Str("message_id", msg.JID).Msg("Failed to delete message from database after DeleteForMe")
 		}
 		return true
 	}
@@ -2649,6 +3247,8 @@ func (portal *Portal) encrypt(ctx context.Context, intent *appservice.IntentAPI,
 	return event.EventEncrypted, nil
 }
 
+// sendMessage sends a message event to the portal room. If timestamp is non-zero, it's used as the origin_server_ts
+// of the event, so that bridged and backfilled messages keep their original WhatsApp timestamps.
 func (portal *Portal) sendMessage(ctx context.Context, intent *appservice.IntentAPI, eventType event.Type, content *event.MessageEventContent, extraContent map[string]interface{}, timestamp int64) (*mautrix.RespSendEvent, error) {
 	wrappedContent := event.Content{Parsed: content, Raw: extraContent}
 	var err error
@@ -2669,6 +3269,9 @@ type ReplyInfo struct {
 	MessageID types.MessageID
 	Chat      types.JID
 	Sender    types.JID
+	// Quoted is the copy of the replied-to message that WhatsApp includes in the context info.
+	// It's used to build a reply fallback when the original message isn't bridged.
+	Quoted *waProto.Message
 }
 
 func (r *ReplyInfo) Equals(other *ReplyInfo) bool {
@@ -2701,11 +3304,15 @@ func GetReply(replyable Replyable) *ReplyInfo {
 		return nil
 	}
 	chat, _ := types.ParseJID(replyable.GetRemoteJid())
-	return &ReplyInfo{
+	info := &ReplyInfo{
 		MessageID: types.MessageID(replyable.GetStanzaId()),
 		Chat:      chat,
 		Sender:    sender,
 	}
+	if ctxInfo, ok := replyable.(*waProto.ContextInfo); ok {
+		info.Quoted = ctxInfo.GetQuotedMessage()
+	}
+	return info
 }
 
 type ConvertedMessage struct {
@@ -2723,34 +3330,119 @@ type ConvertedMessage struct {
 	MediaKey  []byte
 }
 
-func (cm *ConvertedMessage) MergeCaption() {
-	if cm.Caption == nil {
-		return
-	}
-	cm.Content.FileName = cm.Content.Body
-	extensibleCaption := map[string]interface{}{
-		"org.matrix.msc1767.text": cm.Caption.Body,
-	}
-	cm.Extra["org.matrix.msc1767.caption"] = extensibleCaption
-	cm.Content.Body = cm.Caption.Body
-	if cm.Caption.Format == event.FormatHTML {
-		cm.Content.Format = event.FormatHTML
-		cm.Content.FormattedBody = cm.Caption.FormattedBody
-		extensibleCaption["org.matrix.msc1767.html"] = cm.Caption.FormattedBody
-	}
-	cm.Caption = nil
+type messageWithContextInfo interface {
+	GetContextInfo() *waProto.ContextInfo
 }
-func (portal *Portal) convertTextMessage(ctx context.Context, intent *appservice.IntentAPI, source *User, msg *waProto.Message) *ConvertedMessage {
-	content := &event.MessageEventContent{
-		Body:    msg.GetConversation(),
-		MsgType: event.MsgText,
+
+func getMessageContextInfo(waMsg *waProto.Message) *waProto.ContextInfo {
+	parts := []messageWithContextInfo{
+		waMsg.GetExtendedTextMessage(), waMsg.GetImageMessage(), waMsg.GetStickerMessage(),
+		waMsg.GetVideoMessage(), waMsg.GetPtvMessage(), waMsg.GetAudioMessage(), waMsg.GetDocumentMessage(),
+		waMsg.GetContactMessage(), waMsg.GetContactsArrayMessage(), waMsg.GetLocationMessage(),
+		waMsg.GetLiveLocationMessage(), waMsg.GetGroupInviteMessage(), waMsg.GetPollCreationMessage(),
+		waMsg.GetPollCreationMessageV2(), waMsg.GetPollCreationMessageV3(),
 	}
-	if len(msg.GetExtendedTextMessage().GetText()) > 0 {
-		content.Body = msg.GetExtendedTextMessage().GetText()
+	for _, part := range parts {
+		// The getters are nil-safe, so typed nil pointers just return nil here
+		if ctxInfo := part.GetContextInfo(); ctxInfo != nil {
+			return ctxInfo
+		}
+	}
+	return nil
+}
+
+const forwardedInfoField = "fi.mau.whatsapp.forwarded"
+
+// WhatsApp marks messages as "forwarded many times" when they've been forwarded at least this many times.
+const frequentlyForwardedThreshold = 5
+
+const (
+	forwardedPrefix              = "Forwarded"
+	frequentlyForwardedPrefix    = "Forwarded many times"
+	forwardedPrefixHTMLTemplate  = "<p><em>%s</em></p>"
+	forwardedPrefixBodySeparator = "\n"
+)
+
+func (cm *ConvertedMessage) addForwardedInfo(ctxInfo *waProto.ContextInfo, lang string) {
+	if !ctxInfo.GetIsForwarded() {
+		return
+	}
+	frequentlyForwarded := ctxInfo.GetForwardingScore() >= frequentlyForwardedThreshold
+	prefix := Translate(lang, forwardedPrefix)
+	if frequentlyForwarded {
+		prefix = Translate(lang, frequentlyForwardedPrefix)
+	}
+	if cm.Extra == nil {
+		cm.Extra = make(map[string]any)
+	}
+	cm.Extra[forwardedInfoField] = map[string]any{
+		"forwarding_score":     ctxInfo.GetForwardingScore(),
+		"frequently_forwarded": frequentlyForwarded,
+	}
+	target := cm.Caption
+	if target == nil {
+		switch cm.Content.MsgType {
+		case event.MsgText, event.MsgNotice, event.MsgEmote:
+			target = cm.Content
+		default:
+			return
+		}
+	}
+	target.EnsureHasHTML()
+	target.Body = prefix + forwardedPrefixBodySeparator + target.Body
+	target.FormattedBody = fmt.Sprintf(forwardedPrefixHTMLTemplate, prefix) + target.FormattedBody
+}
+
+// stripForwardedPrefix removes the prefix added by addForwardedInfo from a Matrix message that's being
+// forwarded back to WhatsApp. The prefix may be in any of the bridge's languages. It returns the forwarding
+// score of the original message.
+func stripForwardedPrefix(raw map[string]any, content *event.MessageEventContent) (score uint32, ok bool) {
+	fwdInfo, ok := raw[forwardedInfoField].(map[string]any)
+	if !ok {
+		return 0, false
+	}
+	floatScore, _ := fwdInfo["forwarding_score"].(float64)
+	for _, prefix := range append(allTranslations(frequentlyForwardedPrefix), allTranslations(forwardedPrefix)...) {
+		bodyPrefix := prefix + forwardedPrefixBodySeparator
+		htmlPrefix := fmt.Sprintf(forwardedPrefixHTMLTemplate, prefix)
+		if strings.HasPrefix(content.Body, bodyPrefix) {
+			content.Body = strings.TrimPrefix(content.Body, bodyPrefix)
+			content.FormattedBody = strings.TrimPrefix(content.FormattedBody, htmlPrefix)
+			break
+		}
+	}
+	return uint32(floatScore), true
+}
+
+func (cm *ConvertedMessage) MergeCaption() {
+	if cm.Caption == nil {
+		return
+	}
+	cm.Content.FileName = cm.Content.Body
+	extensibleCaption := map[string]interface{}{
+		"org.matrix.msc1767.text": cm.Caption.Body,
+	}
+	cm.Extra["org.matrix.msc1767.caption"] = extensibleCaption
+	cm.Content.Body = cm.Caption.Body
+	if cm.Caption.Format == event.FormatHTML {
+		cm.Content.Format = event.FormatHTML
+		cm.Content.FormattedBody = cm.Caption.FormattedBody
+		extensibleCaption["org.matrix.msc1767.html"] = cm.Caption.FormattedBody
+	}
+	cm.Caption = nil
+}
+func (portal *Portal) convertTextMessage(ctx context.Context, intent *appservice.IntentAPI, source *User, msg *waProto.Message) *ConvertedMessage {
+	content := &event.MessageEventContent{
+		Body:    msg.GetConversation(),
+		MsgType: event.MsgText,
+	}
+	if len(msg.GetExtendedTextMessage().GetText()) > 0 {
+		content.Body = msg.GetExtendedTextMessage().GetText()
 	}
 
 	contextInfo := msg.GetExtendedTextMessage().GetContextInfo()
 	portal.bridge.Formatter.ParseWhatsApp(ctx, portal.MXID, content, contextInfo.GetMentionedJid(), false, false)
+	normalizeEmojiOnlyContent(content)
 	expiresIn := time.Duration(contextInfo.GetExpiration()) * time.Second
 	extraAttrs := map[string]interface{}{}
 	extraAttrs["com.beeper.linkpreviews"] = portal.convertURLPreviewToBeeper(ctx, intent, source, msg.GetExtendedTextMessage())
@@ -2770,7 +3462,7 @@ func (portal *Portal) convertTemplateMessage(ctx context.Context, intent *appser
 		Intent: intent,
 		Type:   event.EventMessage,
 		Content: &event.MessageEventContent{
-			Body:    "Unsupported business message",
+			Body:    portal.bridge.Config.Bridge.FormatNotice("unsupported_message", portal.T("Unsupported business message"), map[string]any{"Type": "business message"}),
 			MsgType: event.MsgText,
 		},
 		ReplyTo:   GetReply(tplMsg.GetContextInfo()),
@@ -2815,7 +3507,8 @@ func (portal *Portal) convertTemplateMessage(ctx context.Context, intent *appser
 	case *waProto.TemplateMessage_HydratedFourRowTemplate_VideoMessage:
 		convertedTitle = portal.convertMediaMessage(ctx, intent, source, info, title.VideoMessage, "video attachment", false)
 	case *waProto.TemplateMessage_HydratedFourRowTemplate_LocationMessage:
-		content = fmt.Sprintf("Unsupported location message\n\n%s", content)
+		unsupported := portal.bridge.Config.Bridge.FormatNotice("unsupported_message", portal.T("Unsupported location message"), map[string]any{"Type": "location message"})
+		content = fmt.Sprintf("%s\n\n%s", unsupported, content)
 	case *waProto.TemplateMessage_HydratedFourRowTemplate_HydratedTitleText:
 		content = fmt.Sprintf("%s\n\n%s", title.HydratedTitleText, content)
 	}
@@ -2860,7 +3553,7 @@ func (portal *Portal) convertListMessage(ctx context.Context, intent *appservice
 		Intent: intent,
 		Type:   event.EventMessage,
 		Content: &event.MessageEventContent{
-			Body:    "Unsupported business message",
+			Body:    portal.bridge.Config.Bridge.FormatNotice("unsupported_message", portal.T("Unsupported business message"), map[string]any{"Type": "business message"}),
 			MsgType: event.MsgText,
 		},
 		ReplyTo:   GetReply(msg.GetContextInfo()),
@@ -2916,7 +3609,7 @@ func (portal *Portal) convertListResponseMessage(ctx context.Context, intent *ap
 	} else if msg.GetDescription() != "" {
 		body = msg.GetDescription()
 	} else {
-		body = "Unsupported list reply message"
+		body = portal.bridge.Config.Bridge.FormatNotice("unsupported_message", portal.T("Unsupported list reply message"), map[string]any{"Type": "list reply message"})
 	}
 	return &ConvertedMessage{
 		Intent: intent,
@@ -2935,17 +3628,18 @@ func (portal *Portal) convertListResponseMessage(ctx context.Context, intent *ap
 	}
 }
 
-func (portal *Portal) convertPollUpdateMessage(ctx context.Context, intent *appservice.IntentAPI, source *User, info *types.MessageInfo, msg *waProto.PollUpdateMessage) *ConvertedMessage {
+// decryptPollVote decrypts a WhatsApp poll vote and maps the selected options to the answer IDs used in the Matrix poll.
+func (portal *Portal) decryptPollVote(ctx context.Context, source *User, info *types.MessageInfo, msg *waProto.PollUpdateMessage) (*database.Message, []string) {
 	log := zerolog.Ctx(ctx).With().
 		Str("poll_id", msg.GetPollCreationMessageKey().GetId()).
 		Logger()
 	pollMessage, err := portal.bridge.DB.Message.GetByJID(ctx, portal.Key, msg.GetPollCreationMessageKey().GetId())
 	if err != nil {
 		log.Err(err).Msg("Failed to get poll message to convert vote")
-		return nil
+		return nil, nil
 	} else if pollMessage == nil {
 		log.Warn().Msg("Poll message not found for converting vote message")
-		return nil
+		return nil, nil
 	}
 	vote, err := source.Client.DecryptPollVote(&events.Message{
 		Info:    *info,
@@ -2953,14 +3647,14 @@ func (portal *Portal) convertPollUpdateMessage(ctx context.Context, intent *apps
 	})
 	if err != nil {
 		log.Err(err).Msg("Failed to decrypt vote message")
-		return nil
+		return nil, nil
 	}
 	selectedHashes := make([]string, len(vote.GetSelectedOptions()))
 	if pollMessage.Type == database.MsgMatrixPoll {
 		mappedAnswers, err := pollMessage.GetPollOptionIDs(ctx, vote.GetSelectedOptions())
 		if err != nil {
 			log.Err(err).Msg("Failed to get poll option IDs")
-			return nil
+			return nil, nil
 		}
 		for i, opt := range vote.GetSelectedOptions() {
 			if len(opt) != 32 {
@@ -2978,6 +3672,18 @@ func (portal *Portal) convertPollUpdateMessage(ctx context.Context, intent *apps
 			selectedHashes[i] = hex.EncodeToString(opt)
 		}
 	}
+	return pollMessage, selectedHashes
+}
+
+func (portal *Portal) convertPollUpdateMessage(ctx context.Context, intent *appservice.IntentAPI, source *User, info *types.MessageInfo, msg *waProto.PollUpdateMessage) *ConvertedMessage {
+	if portal.bridge.Config.Bridge.AnonymousPollVotes {
+		// Anonymous votes are counted in handleAnonymousPollVote instead of being bridged as individual responses
+		return nil
+	}
+	pollMessage, selectedHashes := portal.decryptPollVote(ctx, source, info, msg)
+	if pollMessage == nil {
+		return nil
+	}
 
 	evtType := TypeMSC3381PollResponse
 	//if portal.bridge.Config.Bridge.ExtEvPolls == 2 {
@@ -3110,6 +3816,10 @@ func (portal *Portal) convertLocationMessage(ctx context.Context, intent *appser
 	if len(url) == 0 {
 		url = fmt.Sprintf("https://maps.google.com/?q=%.5f,%.5f", msg.GetDegreesLatitude(), msg.GetDegreesLongitude())
 	}
+	address := msg.GetAddress()
+	if len(address) == 0 {
+		address = portal.bridge.ReverseGeocode(ctx, msg.GetDegreesLatitude(), msg.GetDegreesLongitude())
+	}
 	name := msg.GetName()
 	if len(name) == 0 {
 		latChar := 'N'
@@ -3125,20 +3835,49 @@ func (portal *Portal) convertLocationMessage(ctx context.Context, intent *appser
 
 	content := &event.MessageEventContent{
 		MsgType:       event.MsgLocation,
-		Body:          fmt.Sprintf("Location: %s\n%s\n%s", name, msg.GetAddress(), url),
+		Body:          fmt.Sprintf("Location: %s\n%s\n%s", name, address, url),
 		Format:        event.FormatHTML,
-		FormattedBody: fmt.Sprintf("Location: <a href='%s'>%s</a><br>%s", url, name, msg.GetAddress()),
-		GeoURI:        fmt.Sprintf("geo:%.5f,%.5f", msg.GetDegreesLatitude(), msg.GetDegreesLongitude()),
+		FormattedBody: fmt.Sprintf("Location: <a href='%s'>%s</a><br>%s", url, name, html.EscapeString(address)),
+		GeoURI: GeoLocation{
+			Latitude:  msg.GetDegreesLatitude(),
+			Longitude: msg.GetDegreesLongitude(),
+			Accuracy:  float64(msg.GetAccuracyInMeters()),
+		}.String(),
+	}
+	description := msg.GetName()
+	if description == "" {
+		description = address
+	}
+	extra := map[string]any{
+		"org.matrix.msc1767.text": content.Body,
+		"org.matrix.msc3488.location": map[string]any{
+			"uri":         content.GeoURI,
+			"description": description,
+		},
+		"org.matrix.msc3488.asset": map[string]any{
+			"type": "m.pin",
+		},
+		"fi.mau.whatsapp.location": map[string]any{
+			"name":    msg.GetName(),
+			"address": address,
+			"url":     msg.GetUrl(),
+		},
 	}
 
-	if len(msg.GetJpegThumbnail()) > 0 {
-		thumbnailMime := http.DetectContentType(msg.GetJpegThumbnail())
-		uploadedThumbnail, _ := intent.UploadBytes(ctx, msg.GetJpegThumbnail(), thumbnailMime)
+	thumbnail := msg.GetJpegThumbnail()
+	if len(thumbnail) == 0 || portal.bridge.Config.Bridge.Location.PreferStaticMap {
+		if staticMap := portal.downloadStaticMap(ctx, msg.GetDegreesLatitude(), msg.GetDegreesLongitude()); staticMap != nil {
+			thumbnail = staticMap
+		}
+	}
+	if len(thumbnail) > 0 {
+		thumbnailMime := http.DetectContentType(thumbnail)
+		uploadedThumbnail, _ := intent.UploadBytes(ctx, thumbnail, thumbnailMime)
 		if uploadedThumbnail != nil {
-			cfg, _, _ := image.DecodeConfig(bytes.NewReader(msg.GetJpegThumbnail()))
+			cfg, _, _ := image.DecodeConfig(bytes.NewReader(thumbnail))
 			content.Info = &event.FileInfo{
 				ThumbnailInfo: &event.FileInfo{
-					Size:     len(msg.GetJpegThumbnail()),
+					Size:     len(thumbnail),
 					Width:    cfg.Width,
 					Height:   cfg.Height,
 					MimeType: thumbnailMime,
@@ -3152,12 +3891,51 @@ func (portal *Portal) convertLocationMessage(ctx context.Context, intent *appser
 		Intent:    intent,
 		Type:      event.EventMessage,
 		Content:   content,
+		Extra:     extra,
 		ReplyTo:   GetReply(msg.GetContextInfo()),
 		ExpiresIn: time.Duration(msg.GetContextInfo().GetExpiration()) * time.Second,
 	}
 }
 
-const inviteMsg = `%s<hr/>This invitation to join "%s" expires at %s. Reply to this message with <code>!wa accept</code> to accept the invite.`
+const maxStaticMapSize = 5 * 1024 * 1024
+
+// downloadStaticMap downloads a map image of the given coordinates from the configured static map provider.
+// It returns nil if no provider is configured or the download fails.
+func (portal *Portal) downloadStaticMap(ctx context.Context, lat, long float64) []byte {
+	url := portal.bridge.Config.Bridge.Location.FormatStaticMapURL(lat, long)
+	if url == "" {
+		return nil
+	}
+	log := zerolog.Ctx(ctx)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to prepare static map request")
+		return nil
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to download static map")
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Warn().Int("status_code", resp.StatusCode).Msg("Unexpected status code downloading static map")
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxStaticMapSize))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read static map")
+		return nil
+	} else if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		log.Warn().Str("content_type", http.DetectContentType(data)).Msg("Static map provider didn't return an image")
+		return nil
+	}
+	return data
+}
+
+const inviteMsg = `%s<hr/>This invitation to join "%s" expires at %s. Reply to this message with <code>!wa accept</code> to accept the invite, or use <code>!wa invites</code> to see all pending invites.`
 const inviteMsgBroken = `%s<hr/>This invitation to join "%s" expires at %s. However, the invite message is broken or unsupported and cannot be accepted.`
 const inviteMetaField = "fi.mau.whatsapp.invite"
 const escapedInviteMetaField = `fi\.mau\.whatsapp\.invite`
@@ -3169,7 +3947,21 @@ type InviteMeta struct {
 	Inviter    types.JID `json:"inviter"`
 }
 
-func (portal *Portal) convertGroupInviteMessage(ctx context.Context, intent *appservice.IntentAPI, info *types.MessageInfo, msg *waProto.GroupInviteMessage) *ConvertedMessage {
+func (portal *Portal) storePendingInvite(ctx context.Context, source *User, groupJID types.JID, groupName string, inviter types.JID, code string, expiry time.Time) {
+	invite := portal.bridge.DB.GroupInvite.New()
+	invite.UserMXID = source.MXID
+	invite.GroupJID = groupJID
+	invite.GroupName = groupName
+	invite.Inviter = inviter
+	invite.Code = code
+	invite.Expiration = expiry
+	err := invite.Upsert(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("invite_group_jid", groupJID).Msg("Failed to save pending group invite")
+	}
+}
+
+func (portal *Portal) convertGroupInviteMessage(ctx context.Context, intent *appservice.IntentAPI, source *User, info *types.MessageInfo, msg *waProto.GroupInviteMessage) *ConvertedMessage {
 	expiry := time.Unix(msg.GetInviteExpiration(), 0)
 	template := inviteMsg
 	var extraAttrs map[string]any
@@ -3186,6 +3978,9 @@ func (portal *Portal) convertGroupInviteMessage(ctx context.Context, intent *app
 				Inviter:    info.Sender.ToNonAD(),
 			},
 		}
+		if !info.IsFromMe && expiry.After(time.Now()) {
+			portal.storePendingInvite(ctx, source, groupJID, msg.GetGroupName(), info.Sender.ToNonAD(), msg.GetInviteCode(), expiry)
+		}
 	}
 
 	htmlMessage := fmt.Sprintf(template, event.TextToHTML(msg.GetCaption()), msg.GetGroupName(), expiry)
@@ -3246,6 +4041,9 @@ func (portal *Portal) convertContactsArrayMessage(ctx context.Context, intent *a
 	if len(name) == 0 {
 		name = fmt.Sprintf("%d contacts", len(msg.GetContacts()))
 	}
+	if portal.bridge.Config.Bridge.ContactsArrayMode == config.ContactsArrayModeCombined {
+		return portal.convertCombinedContactsMessage(ctx, intent, name, msg)
+	}
 	contacts := make([]*event.MessageEventContent, 0, len(msg.GetContacts()))
 	for _, contact := range msg.GetContacts() {
 		converted := portal.convertContactMessage(ctx, intent, contact)
@@ -3266,6 +4064,71 @@ func (portal *Portal) convertContactsArrayMessage(ctx context.Context, intent *a
 	}
 }
 
+// getVCardPhoneNumber returns the first phone number in a vCard.
+func getVCardPhoneNumber(vcard string) string {
+	for _, line := range strings.Split(vcard, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), ":")
+		if found && strings.HasPrefix(strings.ToUpper(key), "TEL") {
+			return value
+		}
+	}
+	return ""
+}
+
+// convertCombinedContactsMessage converts a contacts array into a single vCard file containing
+// all the contacts, with a list of the contact names and numbers as the caption.
+func (portal *Portal) convertCombinedContactsMessage(ctx context.Context, intent *appservice.IntentAPI, name string, msg *waProto.ContactsArrayMessage) *ConvertedMessage {
+	var vcards, listText, listHTML strings.Builder
+	listHTML.WriteString("<ul>")
+	for _, contact := range msg.GetContacts() {
+		vcard := strings.TrimSpace(contact.GetVcard())
+		vcards.WriteString(vcard)
+		vcards.WriteString("\r\n")
+		line := contact.GetDisplayName()
+		if phone := getVCardPhoneNumber(vcard); phone != "" {
+			line = fmt.Sprintf("%s (%s)", line, phone)
+		}
+		_, _ = fmt.Fprintf(&listText, "\n• %s", line)
+		_, _ = fmt.Fprintf(&listHTML, "<li>%s</li>", html.EscapeString(line))
+	}
+	listHTML.WriteString("</ul>")
+
+	fileName := fmt.Sprintf("%s.vcf", name)
+	data := []byte(vcards.String())
+	mimeType := "text/vcard"
+	fileSize := len(data)
+	uploadMimeType, file := portal.encryptFileInPlace(data, mimeType)
+	uploadResp, err := intent.UploadBytesWithName(ctx, data, uploadMimeType, fileName)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to upload combined vcard")
+		return nil
+	}
+	content := &event.MessageEventContent{
+		Body:          fmt.Sprintf("Sent %s:%s", name, listText.String()),
+		Format:        event.FormatHTML,
+		FormattedBody: fmt.Sprintf("Sent %s:%s", html.EscapeString(name), listHTML.String()),
+		FileName:      fileName,
+		MsgType:       event.MsgFile,
+		File:          file,
+		Info: &event.FileInfo{
+			MimeType: mimeType,
+			Size:     fileSize,
+		},
+	}
+	if content.File != nil {
+		content.File.URL = uploadResp.ContentURI.CUString()
+	} else {
+		content.URL = uploadResp.ContentURI.CUString()
+	}
+	return &ConvertedMessage{
+		Intent:    intent,
+		Type:      event.EventMessage,
+		Content:   content,
+		ReplyTo:   GetReply(msg.GetContextInfo()),
+		ExpiresIn: time.Duration(msg.GetContextInfo().GetExpiration()) * time.Second,
+	}
+}
+
 func (portal *Portal) tryKickUser(ctx context.Context, userID id.UserID, intent *appservice.IntentAPI) error {
 	_, err := intent.KickUser(ctx, portal.MXID, &mautrix.ReqKickUser{UserID: userID})
 	if errors.Is(err, mautrix.MForbidden) {
@@ -3334,6 +4197,13 @@ func (portal *Portal) HandleWhatsAppInvite(ctx context.Context, source *User, se
 		}
 		puppet := portal.bridge.GetPuppetByJID(jid)
 		puppet.SyncContact(ctx, source, true, false, "handling whatsapp invite")
+		if user := portal.bridge.GetUserByJID(jid); user != nil {
+			portal.ensureUserInvited(ctx, user)
+			if puppet.IntentFor(portal).IsCustomPuppet {
+				// The contact is represented by their real Matrix account, so the ghost doesn't need to be in the room
+				continue
+			}
+		}
 		resp, err := intent.SendStateEvent(ctx, portal.MXID, event.StateMember, puppet.MXID.String(), &event.MemberEventContent{
 			Membership:  event.MembershipInvite,
 			Displayname: puppet.Displayname,
@@ -3401,7 +4271,7 @@ func (portal *Portal) makeMediaBridgeFailureMessage(info *types.MessageInfo, bri
 		portal.zlog.Err(bridgeErr).Str("message_id", info.ID).Msg("Failed to bridge media for message")
 	}
 	if keys != nil {
-		if portal.bridge.Config.Bridge.CaptionInMessage {
+		if portal.bridge.Config.Bridge.CaptionMode == config.CaptionModeMerged {
 			converted.MergeCaption()
 		}
 		meta := &FailedMediaMeta{
@@ -3416,7 +4286,8 @@ func (portal *Portal) makeMediaBridgeFailureMessage(info *types.MessageInfo, bri
 	converted.Type = event.EventMessage
 	body := userFriendlyError
 	if body == "" {
-		body = fmt.Sprintf("Failed to bridge media: %v", bridgeErr)
+		body = portal.T("Failed to bridge media: %v", bridgeErr)
+		body = portal.bridge.Config.Bridge.FormatNotice("media_error", body, map[string]any{"Error": bridgeErr.Error()})
 	}
 	converted.Content = &event.MessageEventContent{
 		MsgType: event.MsgNotice,
@@ -3488,9 +4359,17 @@ func (portal *Portal) convertMediaMessageContent(ctx context.Context, intent *ap
 		content.Info.Height = int(messageWithDimensions.GetHeight())
 	}
 
-	msgWithName, ok := msg.(MediaMessageWithFileName)
-	if ok && len(msgWithName.GetFileName()) > 0 {
-		content.Body = msgWithName.GetFileName()
+	var fileName string
+	if msgWithName, ok := msg.(MediaMessageWithFileName); ok {
+		fileName = msgWithName.GetFileName()
+	}
+	if doc, ok := msg.(*waProto.DocumentMessage); ok && fileName == "" {
+		// Some clients only set the title of documents
+		fileName = doc.GetTitle()
+	}
+	if len(fileName) > 0 {
+		content.Body = ensureFileNameExtension(fileName, msg.GetMimetype())
+		content.FileName = content.Body
 	} else {
 		mimeClass := strings.Split(msg.GetMimetype(), "/")[0]
 		switch mimeClass {
@@ -3521,8 +4400,10 @@ func (portal *Portal) convertMediaMessageContent(ctx context.Context, intent *ap
 		}
 	}
 
+	_, isDocument := msg.(*waProto.DocumentMessage)
 	messageWithThumbnail, ok := msg.(MediaMessageWithThumbnail)
-	if ok && messageWithThumbnail.GetJpegThumbnail() != nil && (portal.bridge.Config.Bridge.WhatsappThumbnail || isGIF) {
+	useThumbnail := portal.bridge.Config.Bridge.WhatsappThumbnail || isGIF || (isDocument && portal.bridge.Config.Bridge.DocumentThumbnails)
+	if ok && messageWithThumbnail.GetJpegThumbnail() != nil && useThumbnail {
 		thumbnailData := messageWithThumbnail.GetJpegThumbnail()
 		thumbnailMime := http.DetectContentType(thumbnailData)
 		thumbnailCfg, _, _ := image.DecodeConfig(bytes.NewReader(thumbnailData))
@@ -3617,6 +4498,28 @@ func (portal *Portal) convertMediaMessageContent(ctx context.Context, intent *ap
 		portal.bridge.Formatter.ParseWhatsApp(ctx, portal.MXID, captionContent, msg.GetContextInfo().GetMentionedJid(), false, false)
 	}
 
+	if docMessage, ok := msg.(*waProto.DocumentMessage); ok && docMessage.GetPageCount() > 0 {
+		pageCount := fmt.Sprintf("%d pages", docMessage.GetPageCount())
+		if docMessage.GetPageCount() == 1 {
+			pageCount = "1 page"
+		}
+		if captionContent == nil {
+			captionContent = &event.MessageEventContent{
+				Body:          pageCount,
+				Format:        event.FormatHTML,
+				FormattedBody: fmt.Sprintf("<em>%s</em>", pageCount),
+				MsgType:       event.MsgNotice,
+			}
+		} else {
+			captionContent.EnsureHasHTML()
+			captionContent.Body += fmt.Sprintf("\n\n(%s)", pageCount)
+			captionContent.FormattedBody += fmt.Sprintf("<br><br><em>%s</em>", pageCount)
+		}
+		extraContent["info"] = map[string]interface{}{
+			"fi.mau.whatsapp.page_count": docMessage.GetPageCount(),
+		}
+	}
+
 	return &ConvertedMessage{
 		Intent:    intent,
 		Type:      eventType,
@@ -3679,18 +4582,18 @@ func (portal *Portal) uploadMedia(ctx context.Context, intent *appservice.Intent
 func (portal *Portal) convertMediaMessage(ctx context.Context, intent *appservice.IntentAPI, source *User, info *types.MessageInfo, msg MediaMessage, typeName string, isBackfill bool) *ConvertedMessage {
 	converted := portal.convertMediaMessageContent(ctx, intent, msg)
 	if msg.GetFileLength() > uint64(portal.bridge.MediaConfig.UploadSize) {
-		return portal.makeMediaBridgeFailureMessage(info, errors.New("file is too large"), converted, nil, fmt.Sprintf("Large %s not bridged - please use WhatsApp app to view", typeName))
+		return portal.makeMediaBridgeFailureMessage(info, errors.New("file is too large"), converted, nil, portal.T("Large %s not bridged - please use WhatsApp app to view", portal.T(typeName)))
 	}
 	data, err := source.Client.Download(msg)
 	if errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith403) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) {
 		converted.Error = database.MsgErrMediaNotFound
 		converted.MediaKey = msg.GetMediaKey()
 
-		errorText := fmt.Sprintf("Old %s.", typeName)
+		errorText := portal.T("Old %s.", portal.T(typeName))
 		if portal.bridge.Config.Bridge.HistorySync.MediaRequests.AutoRequestMedia && isBackfill {
-			errorText += " Media will be automatically requested from your phone later."
+			errorText += portal.T(" Media will be automatically requested from your phone later.")
 		} else {
-			errorText += " React with the \u267b (recycle) emoji to request this media from your phone."
+			errorText += portal.T(" React with the \u267b (recycle) emoji to request this media from your phone.")
 		}
 
 		return portal.makeMediaBridgeFailureMessage(info, err, converted, &FailedMediaKeys{
@@ -3709,6 +4612,11 @@ func (portal *Portal) convertMediaMessage(ctx context.Context, intent *appservic
 		return portal.makeMediaBridgeFailureMessage(info, err, converted, nil, "")
 	}
 
+	if converted.Content.MsgType == event.MsgVideo {
+		data = portal.transcodeIncomingVideo(ctx, data, converted.Content)
+	} else if audioMsg, ok := msg.(*waProto.AudioMessage); ok && audioMsg.GetPtt() {
+		data = portal.normalizeVoiceLoudness(ctx, data, true)
+	}
 	err = portal.uploadMedia(ctx, intent, data, converted.Content)
 	if err != nil {
 		if errors.Is(err, mautrix.MTooLarge) {
@@ -3722,6 +4630,186 @@ func (portal *Portal) convertMediaMessage(ctx context.Context, intent *appservic
 	return converted
 }
 
+func probeVideoCodec(ctx context.Context, path string) (string, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return "", err
+	}
+	output, err := exec.CommandContext(
+		ctx, ffprobePath, "-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=codec_name", "-of", "default=noprint_wrappers=1:nokey=1", path,
+	).Output()
+	if err != nil {
+		return "", fmt.Errorf("ffprobe error: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// normalizeVoiceLoudness runs voice messages through the ffmpeg loudnorm filter if enabled for the given direction.
+// The output is always Opus in an Ogg container, as that's what both sides use for voice messages.
+// The original data is returned if normalization is disabled or fails.
+func (portal *Portal) normalizeVoiceLoudness(ctx context.Context, data []byte, incoming bool) []byte {
+	cfg := &portal.bridge.Config.Bridge.VoiceLoudnorm
+	if (incoming && !cfg.Incoming) || (!incoming && !cfg.Outgoing) || !ffmpeg.Supported() {
+		return data
+	}
+	normalized, err := ffmpeg.ConvertBytes(ctx, data, ".ogg", nil, []string{
+		"-vn", "-af", fmt.Sprintf("loudnorm=I=%d:TP=-1.5:LRA=11", cfg.Target),
+		"-c:a", "libopus", "-b:a", "32k", "-ar", "48000", "-ac", "1",
+	}, "audio/ogg")
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Bool("incoming", incoming).Msg("Failed to normalize voice message loudness, bridging original audio")
+		return data
+	}
+	return normalized
+}
+
+// transcodeIncomingVideo re-encodes videos whose codec isn't in the configured allowlist to H.264,
+// so that they can be played in web clients. The original data is returned if transcoding is disabled,
+// not needed or fails.
+func (portal *Portal) transcodeIncomingVideo(ctx context.Context, data []byte, content *event.MessageEventContent) []byte {
+	cfg := &portal.bridge.Config.Bridge.VideoTranscode
+	if !cfg.Enabled || !ffmpeg.Supported() || (cfg.MaxSize > 0 && len(data) > cfg.MaxSize) {
+		return data
+	}
+	log := zerolog.Ctx(ctx)
+	tempDir, err := os.MkdirTemp("", "mautrix_whatsapp_video_*")
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to create temp dir for video transcoding")
+		return data
+	}
+	defer os.RemoveAll(tempDir)
+	inputPath := filepath.Join(tempDir, "input.orig")
+	err = os.WriteFile(inputPath, data, 0600)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to write video to temp file for transcoding")
+		return data
+	}
+	codec, err := probeVideoCodec(ctx, inputPath)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to detect video codec, not transcoding")
+		return data
+	} else if slices.Contains(cfg.AllowedCodecs, codec) {
+		return data
+	}
+	outputPath, err := ffmpeg.ConvertPath(ctx, inputPath, ".mp4", nil, []string{
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-c:a", "aac", "-movflags", "+faststart",
+		"-filter:v", "crop='floor(in_w/2)*2:floor(in_h/2)*2'",
+	}, false)
+	if err != nil {
+		log.Warn().Err(err).Str("codec", codec).Msg("Failed to transcode video, bridging original file")
+		return data
+	}
+	transcoded, err := os.ReadFile(outputPath)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read transcoded video, bridging original file")
+		return data
+	}
+	log.Debug().
+		Str("codec", codec).
+		Int("original_size", len(data)).
+		Int("transcoded_size", len(transcoded)).
+		Msg("Transcoded incoming video")
+	content.Info.MimeType = "video/mp4"
+	content.Body = strings.TrimSuffix(content.Body, filepath.Ext(content.Body)) + ".mp4"
+	return transcoded
+}
+
+func probeVideoDuration(ctx context.Context, path string) (float64, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return 0, err
+	}
+	output, err := exec.CommandContext(
+		ctx, ffprobePath, "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", path,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe error: %w", err)
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+}
+
+// transcodeOutgoingVideo re-encodes Matrix videos to H.264/AAC mp4 if the codec isn't in the configured allowlist
+// or if the file is above the video size limit. Videos above the limit are compressed with a bitrate calculated
+// from their duration. If forceTranscode is set, the video is transcoded regardless of the codec, which is used for
+// containers that WhatsApp doesn't accept. If transcoding fails, the original data is returned along with the error.
+func (portal *Portal) transcodeOutgoingVideo(ctx context.Context, data []byte, content *event.MessageEventContent, forceTranscode bool) ([]byte, error) {
+	cfg := &portal.bridge.Config.Bridge.OutgoingVideoTranscode
+	if !cfg.Enabled || !ffmpeg.Supported() {
+		return data, nil
+	}
+	log := zerolog.Ctx(ctx)
+	tempDir, err := os.MkdirTemp("", "mautrix_whatsapp_video_*")
+	if err != nil {
+		return data, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+	inputPath := filepath.Join(tempDir, "input.orig")
+	err = os.WriteFile(inputPath, data, 0600)
+	if err != nil {
+		return data, fmt.Errorf("failed to write video to temp file: %w", err)
+	}
+	codec, err := probeVideoCodec(ctx, inputPath)
+	if err != nil {
+		return data, fmt.Errorf("failed to detect video codec: %w", err)
+	}
+	sizeLimit, _ := portal.getMediaSizeLimit(whatsmeow.MediaVideo)
+	tooLarge := sizeLimit > 0 && len(data) > sizeLimit
+	if slices.Contains(cfg.AllowedCodecs, codec) && !tooLarge && !forceTranscode {
+		return data, nil
+	}
+	args := []string{
+		"-c:v", "libx264", "-pix_fmt", "yuv420p", "-c:a", "aac", "-movflags", "+faststart",
+		"-b:a", fmt.Sprintf("%dk", cfg.AudioBitrate),
+	}
+	if cfg.MaxResolution > 0 {
+		args = append(args, "-filter:v", fmt.Sprintf(
+			"scale='min(%[1]d,iw)':'min(%[1]d,ih)':force_original_aspect_ratio=decrease,crop='floor(in_w/2)*2:floor(in_h/2)*2'",
+			cfg.MaxResolution,
+		))
+	} else {
+		args = append(args, "-filter:v", "crop='floor(in_w/2)*2:floor(in_h/2)*2'")
+	}
+	videoBitrate := cfg.Bitrate
+	if tooLarge {
+		duration, err := probeVideoDuration(ctx, inputPath)
+		if err != nil || duration <= 0 {
+			log.Warn().Err(err).Msg("Failed to get video duration, can't calculate bitrate to fit size limit")
+		} else {
+			// Leave 10% of the limit for the container and bitrate fluctuations
+			fitBitrate := int(float64(sizeLimit)*8*0.9/duration/1000) - cfg.AudioBitrate
+			videoBitrate = max(fitBitrate, cfg.MinBitrate)
+			if videoBitrate > 0 && cfg.Bitrate > 0 {
+				videoBitrate = min(videoBitrate, cfg.Bitrate)
+			}
+		}
+	}
+	if videoBitrate > 0 {
+		args = append(args,
+			"-b:v", fmt.Sprintf("%dk", videoBitrate),
+			"-maxrate", fmt.Sprintf("%dk", videoBitrate),
+			"-bufsize", fmt.Sprintf("%dk", videoBitrate*2),
+		)
+	}
+	outputPath, err := ffmpeg.ConvertPath(ctx, inputPath, ".mp4", nil, args, false)
+	if err != nil {
+		return data, fmt.Errorf("failed to transcode video: %w", err)
+	}
+	transcoded, err := os.ReadFile(outputPath)
+	if err != nil {
+		return data, fmt.Errorf("failed to read transcoded video: %w", err)
+	}
+	log.Debug().
+		Str("codec", codec).
+		Int("video_bitrate_kbps", videoBitrate).
+		Int("original_size", len(data)).
+		Int("transcoded_size", len(transcoded)).
+		Msg("Transcoded outgoing video")
+	content.Info.MimeType = "video/mp4"
+	return transcoded, nil
+}
+
 func (portal *Portal) fetchMediaRetryEvent(ctx context.Context, msg *database.Message) (*FailedMediaMeta, error) {
 	errorMeta, ok := portal.mediaErrorCache[msg.JID]
 	if ok {
@@ -3975,6 +5063,37 @@ func createThumbnailAndGetSize(source []byte, pngThumbnail bool) ([]byte, int, i
 	return buf.Bytes(), width, height, nil
 }
 
+const whatsAppAvatarMaxSize = 640
+
+// convertAvatarForWhatsApp crops the given image into a square and converts it into a JPEG that WhatsApp accepts
+// as a profile picture.
+func convertAvatarForWhatsApp(source []byte) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode avatar: %w", err)
+	}
+	bounds := src.Bounds()
+	size := bounds.Dx()
+	if bounds.Dy() < size {
+		size = bounds.Dy()
+	}
+	crop := image.Rect(0, 0, size, size).Add(bounds.Min).Add(image.Pt((bounds.Dx()-size)/2, (bounds.Dy()-size)/2))
+	targetSize := size
+	if targetSize > whatsAppAvatarMaxSize {
+		targetSize = whatsAppAvatarMaxSize
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, targetSize, targetSize))
+	// JPEGs don't have transparency, so draw on a white background
+	draw.Draw(dst, dst.Rect, image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Rect, src, crop, draw.Over, nil)
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 90})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode avatar: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
 func createThumbnail(source []byte, png bool) ([]byte, error) {
 	data, _, _, err := createThumbnailAndGetSize(source, png)
 	return data, err
@@ -4090,8 +5209,13 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 		}
 	}
 	mimeType := content.GetInfo().MimeType
-	if mimeType == "" {
-		content.Info.MimeType = "application/octet-stream"
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		// Some clients don't send a mime type at all, so guess it to avoid sending everything as a generic file
+		mimeType = detectMediaMimeType(data, fileName)
+		content.Info.MimeType = mimeType
+	}
+	if mediaType == whatsmeow.MediaDocument {
+		fileName = ensureFileNameExtension(fileName, mimeType)
 	}
 	var convertErr error
 	// Allowed mime types from https://developers.facebook.com/docs/whatsapp/on-premises/reference/media
@@ -4104,7 +5228,7 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 	case mediaType == whatsmeow.MediaVideo:
 		switch mimeType {
 		case "video/mp4", "video/3gpp":
-			// Allowed
+			data, convertErr = portal.transcodeOutgoingVideo(ctx, data, content, false)
 		case "image/gif":
 			data, convertErr = ffmpeg.ConvertBytes(ctx, data, ".mp4", []string{"-f", "gif"}, []string{
 				"-pix_fmt", "yuv420p", "-c:v", "libx264", "-movflags", "+faststart",
@@ -4117,7 +5241,14 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 			}, mimeType)
 			content.Info.MimeType = "video/mp4"
 		default:
-			return nil, fmt.Errorf("%w %q in video message", errMediaUnsupportedType, mimeType)
+			// Other containers like video/quicktime can be sent if they're transcoded into mp4
+			if !strings.HasPrefix(mimeType, "video/") || !portal.bridge.Config.Bridge.OutgoingVideoTranscode.Enabled || !ffmpeg.Supported() {
+				return nil, fmt.Errorf("%w %q in video message", errMediaUnsupportedType, mimeType)
+			}
+			data, err = portal.transcodeOutgoingVideo(ctx, data, content, true)
+			if err != nil {
+				return nil, exerrors.NewDualError(fmt.Errorf("%w (%s to video/mp4)", errMediaConvertFailed, mimeType), err)
+			}
 		}
 	case mediaType == whatsmeow.MediaImage:
 		switch mimeType {
@@ -4131,11 +5262,12 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 		}
 	case mediaType == whatsmeow.MediaAudio:
 		switch mimeType {
-		case "audio/aac", "audio/mp4", "audio/amr", "audio/mpeg", "audio/ogg; codecs=opus":
+		case "audio/aac", "audio/mp4", "audio/amr", "audio/mpeg":
 			// Allowed
-		case "audio/ogg":
+		case "audio/ogg", "audio/ogg; codecs=opus":
 			// Hopefully it's opus already
 			content.Info.MimeType = "audio/ogg; codecs=opus"
+			data = portal.normalizeVoiceLoudness(ctx, data, false)
 		default:
 			return nil, fmt.Errorf("%w %q in audio message", errMediaUnsupportedType, mimeType)
 		}
@@ -4150,6 +5282,12 @@ func (portal *Portal) preprocessMatrixMedia(ctx context.Context, sender *User, r
 			zerolog.Ctx(ctx).Warn().Err(convertErr).Str("source_mime", mimeType).Msg("Failed to re-encode media, continuing with original file")
 		}
 	}
+	if !isSticker {
+		data, err = portal.fitMediaSizeLimit(ctx, data, content, mediaType)
+		if err != nil {
+			return nil, err
+		}
+	}
 	var uploadResp whatsmeow.UploadResponse
 	if portal.Key.JID.Server == types.NewsletterServer {
 		uploadResp, err = sender.Client.UploadNewsletter(ctx, data, mediaType)
@@ -4189,6 +5327,27 @@ type MediaUpload struct {
 	FileLength    int
 }
 
+// isNoticeLoop records an m.notice from the given Matrix user and checks if they've sent too many
+// notices recently, which usually means that bots are replying to each other through the bridge.
+func (portal *Portal) isNoticeLoop(userID id.UserID) bool {
+	cfg := portal.bridge.Config.Bridge.NoticeLoopProtection
+	if cfg.MaxNotices <= 0 || cfg.Window <= 0 {
+		return false
+	}
+	portal.recentNoticesLock.Lock()
+	defer portal.recentNoticesLock.Unlock()
+	if portal.recentNotices == nil {
+		portal.recentNotices = make(map[id.UserID][]time.Time)
+	}
+	cutoff := time.Now().Add(-time.Duration(cfg.Window) * time.Second)
+	recent := slices.DeleteFunc(portal.recentNotices[userID], func(ts time.Time) bool {
+		return ts.Before(cutoff)
+	})
+	recent = append(recent, time.Now())
+	portal.recentNotices[userID] = recent
+	return len(recent) > cfg.MaxNotices
+}
+
 func (portal *Portal) addRelaybotFormat(ctx context.Context, userID id.UserID, content *event.MessageEventContent) bool {
 	member := portal.MainIntent().Member(ctx, portal.MXID, userID)
 	if member == nil {
@@ -4203,6 +5362,69 @@ func (portal *Portal) addRelaybotFormat(ctx context.Context, userID id.UserID, c
 	return true
 }
 
+// getRelaySenderName returns the room displayname of a Matrix user whose messages are being relayed.
+func (portal *Portal) getRelaySenderName(ctx context.Context, userID id.UserID) string {
+	member := portal.MainIntent().Member(ctx, portal.MXID, userID)
+	if member == nil || member.Displayname == "" {
+		return userID.String()
+	}
+	return member.Displayname
+}
+
+// detectMediaMimeType guesses the mime type of a file based on its extension, or its content if the extension is unknown.
+func detectMediaMimeType(data []byte, fileName string) string {
+	mimeType := mime.TypeByExtension(filepath.Ext(fileName))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// ensureFileNameExtension adds an extension matching the mime type to file names that don't have one,
+// so that the file can be opened on the other side.
+func ensureFileNameExtension(fileName, mimeType string) string {
+	if fileName == "" {
+		fileName = "file"
+	}
+	if filepath.Ext(fileName) == "" && mimeType != "application/octet-stream" {
+		fileName += exmime.ExtensionFromMimetype(mimeType)
+	}
+	return fileName
+}
+
+// PTTOverrideKey is the custom event content field that can be used to choose whether an audio message
+// is sent as a WhatsApp voice message (PTT) or a normal audio attachment, regardless of the bridge config.
+const PTTOverrideKey = "fi.mau.whatsapp.ptt"
+
+// shouldSendAsVoiceMessage decides if a Matrix audio message should be sent to WhatsApp as a voice message.
+// WhatsApp only plays voice messages in Opus, so other formats are never sent as voice messages.
+func (portal *Portal) shouldSendAsVoiceMessage(evt *event.Event, content *event.MessageEventContent) bool {
+	mediaType, _, _ := mime.ParseMediaType(content.GetInfo().MimeType)
+	if mediaType != "audio/ogg" {
+		return false
+	}
+	if override, ok := evt.Content.Raw[PTTOverrideKey].(bool); ok {
+		return override
+	}
+	mode := portal.bridge.Config.Bridge.OutgoingVoiceMode
+	if portal.OutgoingVoiceMode != "" {
+		mode = config.VoiceMessageMode(portal.OutgoingVoiceMode)
+	}
+	switch mode {
+	case config.VoiceMessageModeAlways:
+		return true
+	case config.VoiceMessageModeNever:
+		return false
+	default:
+		_, isMSC3245Voice := evt.Content.Raw["org.matrix.msc3245.voice"]
+		return isMSC3245Voice
+	}
+}
+
 func addCodecToMime(mimeType, codec string) string {
 	mediaType, params, err := mime.ParseMediaType(mimeType)
 	if err != nil {
@@ -4214,20 +5436,58 @@ func addCodecToMime(mimeType, codec string) string {
 	return mime.FormatMediaType(mediaType, params)
 }
 
-func parseGeoURI(uri string) (lat, long float64, err error) {
+// GeoLocation is a location parsed from or formatted into a geo: URI (RFC 5870).
+type GeoLocation struct {
+	Latitude    float64
+	Longitude   float64
+	Altitude    float64
+	HasAltitude bool
+	// Accuracy is the uncertainty of the location in meters, or zero if unknown.
+	Accuracy float64
+}
+
+func (geo GeoLocation) String() string {
+	var uri strings.Builder
+	_, _ = fmt.Fprintf(&uri, "geo:%.5f,%.5f", geo.Latitude, geo.Longitude)
+	if geo.HasAltitude {
+		_, _ = fmt.Fprintf(&uri, ",%s", strconv.FormatFloat(geo.Altitude, 'f', -1, 64))
+	}
+	if geo.Accuracy > 0 {
+		_, _ = fmt.Fprintf(&uri, ";u=%s", strconv.FormatFloat(geo.Accuracy, 'f', -1, 64))
+	}
+	return uri.String()
+}
+
+func parseGeoURI(uri string) (geo GeoLocation, err error) {
 	if !strings.HasPrefix(uri, "geo:") {
 		err = fmt.Errorf("uri doesn't have geo: prefix")
 		return
 	}
-	// Remove geo: prefix and anything after ;
-	coordinates := strings.Split(strings.TrimPrefix(uri, "geo:"), ";")[0]
+	parts := strings.Split(strings.TrimPrefix(uri, "geo:"), ";")
 
-	if splitCoordinates := strings.Split(coordinates, ","); len(splitCoordinates) != 2 {
-		err = fmt.Errorf("didn't find exactly two numbers separated by a comma")
-	} else if lat, err = strconv.ParseFloat(splitCoordinates[0], 64); err != nil {
+	splitCoordinates := strings.Split(parts[0], ",")
+	if len(splitCoordinates) != 2 && len(splitCoordinates) != 3 {
+		err = fmt.Errorf("didn't find two or three numbers separated by a comma")
+	} else if geo.Latitude, err = strconv.ParseFloat(splitCoordinates[0], 64); err != nil {
 		err = fmt.Errorf("latitude is not a number: %w", err)
-	} else if long, err = strconv.ParseFloat(splitCoordinates[1], 64); err != nil {
+	} else if geo.Longitude, err = strconv.ParseFloat(splitCoordinates[1], 64); err != nil {
 		err = fmt.Errorf("longitude is not a number: %w", err)
+	} else if len(splitCoordinates) == 3 {
+		if geo.Altitude, err = strconv.ParseFloat(splitCoordinates[2], 64); err != nil {
+			err = fmt.Errorf("altitude is not a number: %w", err)
+		} else {
+			geo.HasAltitude = true
+		}
+	}
+	if err != nil {
+		return
+	}
+	for _, param := range parts[1:] {
+		key, value, _ := strings.Cut(param, "=")
+		if strings.ToLower(key) == "u" {
+			// Invalid uncertainty values are ignored, as they're not required for the location to be usable
+			geo.Accuracy, _ = strconv.ParseFloat(value, 64)
+		}
 	}
 	return
 }
@@ -4495,6 +5755,28 @@ func getEditError(rootMsg *database.Message, editer *User) error {
 	}
 }
 
+// extractExtensibleCaption converts MSC3552 captions (as sent by the bridge in the merged caption mode)
+// into the MSC2530 format that the rest of the media handling understands.
+func extractExtensibleCaption(raw map[string]any, content *event.MessageEventContent) {
+	captionMap, ok := raw["org.matrix.msc1767.caption"].(map[string]any)
+	if !ok {
+		return
+	}
+	captionText, _ := captionMap["org.matrix.msc1767.text"].(string)
+	if captionText == "" || captionText == content.Body {
+		return
+	}
+	content.FileName = content.Body
+	content.Body = captionText
+	if captionHTML, _ := captionMap["org.matrix.msc1767.html"].(string); captionHTML != "" {
+		content.Format = event.FormatHTML
+		content.FormattedBody = captionHTML
+	} else {
+		content.Format = ""
+		content.FormattedBody = ""
+	}
+}
+
 func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, evt *event.Event) (*waProto.Message, *User, *extraConvertMeta, error) {
 	if evt.Type == TypeMSC3381PollResponse || evt.Type == TypeMSC3381V2PollResponse {
 		return portal.convertMatrixPollVote(ctx, sender, evt)
@@ -4521,6 +5803,10 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 	log := zerolog.Ctx(ctx)
 	var editRootMsg *database.Message
 	if editEventID := content.RelatesTo.GetReplaceID(); editEventID != "" {
+		if portal.IsBroadcastList() && !portal.IsStatusBroadcastList() {
+			// Edits would have to reference the message in each recipient's private chat
+			return nil, sender, extraMeta, errBroadcastListActionUnsupported
+		}
 		log.UpdateContext(func(c zerolog.Context) zerolog.Context {
 			return c.Stringer("edit_target_mxid", editEventID)
 		})
@@ -4543,7 +5829,32 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 
 	msg := &waProto.Message{}
 	ctxInfo := portal.generateContextInfo(ctx, content.RelatesTo)
+	if fwdScore, isForward := stripForwardedPrefix(evt.Content.Raw, content); isForward && editRootMsg == nil {
+		ctxInfo.IsForwarded = proto.Bool(true)
+		ctxInfo.ForwardingScore = proto.Uint32(fwdScore + 1)
+	}
 	relaybotFormatted := isRelay && portal.addRelaybotFormat(ctx, realSenderMXID, content)
+	var extraInlineImages []*event.MessageEventContent
+	if editRootMsg == nil {
+		// Some clients inline images in the formatted body, which WhatsApp can't display, so send them as images instead
+		allowGallery := !isRelay && portal.Key.JID.Server != types.NewsletterServer
+		var converted bool
+		converted, extraInlineImages = portal.convertInlineImages(content, allowGallery)
+		if converted {
+			log.Debug().
+				Str("converted_msgtype", string(content.MsgType)).
+				Int("extra_image_count", len(extraInlineImages)).
+				Msg("Converted inline images in text message")
+		}
+		if len(extraInlineImages) > 0 && portal.Key.JID.Server == types.NewsletterServer {
+			// Media handles of multiple messages aren't handled properly, same as with galleries
+			names := make([]string, len(extraInlineImages))
+			for i, img := range extraInlineImages {
+				names[i] = img.Body
+			}
+			return nil, sender, extraMeta, fmt.Errorf("%w (%s)", errInlineImagesDropped, strings.Join(names, ", "))
+		}
+	}
 	if evt.Type == event.EventSticker {
 		if relaybotFormatted {
 			// Stickers can't have captions, so force relaybot stickers to be images
@@ -4555,20 +5866,43 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 	if content.MsgType == event.MsgImage && content.GetInfo().MimeType == "image/gif" {
 		content.MsgType = event.MsgVideo
 	}
+	switch content.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		if content.FileName == "" {
+			extractExtensibleCaption(evt.Content.Raw, content)
+		}
+	}
 	if content.MsgType == event.MsgAudio && content.FileName != "" && content.Body != content.FileName {
 		// Send audio messages with captions as files since WhatsApp doesn't support captions on audio messages
 		content.MsgType = event.MsgFile
+	} else if content.MsgType == event.MsgAudio && relaybotFormatted && !portal.shouldSendAsVoiceMessage(evt, content) {
+		// Relayed audio files are also sent as files, so that the sender attribution can be included in the caption.
+		// Voice messages are kept as-is, as WhatsApp clients only show the inline player for real voice messages.
+		content.MsgType = event.MsgFile
 	}
 
 	switch content.MsgType {
 	case event.MsgText, event.MsgEmote, event.MsgNotice:
 		text := content.Body
-		if content.MsgType == event.MsgNotice && !portal.bridge.Config.Bridge.BridgeNotices {
-			return nil, sender, extraMeta, errMNoticeDisabled
+		if content.MsgType == event.MsgNotice {
+			if portal.bridge.Config.Bridge.BridgeNotices == config.NoticeModeDrop {
+				return nil, sender, extraMeta, errMNoticeDisabled
+			} else if editRootMsg == nil && portal.isNoticeLoop(realSenderMXID) {
+				return nil, sender, extraMeta, errMNoticeLoop
+			}
 		}
 		if content.Format == event.FormatHTML {
 			text, ctxInfo.MentionedJid = portal.bridge.Formatter.ParseMatrix(content.FormattedBody, content.Mentions)
 		}
+		if isEmojiOnly(text) {
+			// WhatsApp only shows big emojis if there's nothing else in the message, not even whitespace
+			text = strings.TrimSpace(text)
+		}
+		if content.MsgType == event.MsgNotice && portal.bridge.Config.Bridge.BridgeNotices == config.NoticeModePrefix {
+			if prefix := portal.bridge.Config.Bridge.NoticePrefix; !strings.HasPrefix(text, prefix) {
+				text = prefix + text
+			}
+		}
 		if content.MsgType == event.MsgEmote && !relaybotFormatted {
 			text = "/me " + text
 		}
@@ -4580,7 +5914,7 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 		if ctx.Err() != nil {
 			return nil, sender, extraMeta, ctx.Err()
 		}
-		if ctxInfo.StanzaId == nil && ctxInfo.MentionedJid == nil && ctxInfo.Expiration == nil && !hasPreview {
+		if ctxInfo.StanzaId == nil && ctxInfo.MentionedJid == nil && ctxInfo.Expiration == nil && ctxInfo.IsForwarded == nil && !hasPreview {
 			// No need for extended message
 			msg.ExtendedTextMessage = nil
 			msg.Conversation = &text
@@ -4607,35 +5941,30 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 	case event.MsgBeeperGallery:
 		if isRelay {
 			return nil, sender, extraMeta, errGalleryRelay
-		} else if content.BeeperGalleryCaption != "" {
-			return nil, sender, extraMeta, errGalleryCaption
 		} else if portal.Key.JID.Server == types.NewsletterServer {
 			// We don't handle the media handles properly for multiple messages
 			return nil, sender, extraMeta, fmt.Errorf("can't send gallery to newsletter")
 		}
+		// The parts are sent as consecutive messages, which WhatsApp clients display as an album.
+		// Like in albums sent from WhatsApp, the caption is attached to the first item.
 		for i, part := range content.BeeperGalleryImages {
-			// TODO support videos
-			media, err := portal.preprocessMatrixMedia(ctx, sender, false, part, evt.ID, whatsmeow.MediaImage)
-			if media == nil {
-				return nil, sender, extraMeta, fmt.Errorf("failed to handle image #%d: %w", i+1, err)
+			partCtxInfo := ctxInfo
+			var caption string
+			if i == 0 {
+				caption = content.BeeperGalleryCaption
+			} else {
+				// Only the first item replies to the target message
+				partCtxInfo = &waProto.ContextInfo{Expiration: ctxInfo.Expiration}
 			}
-			imageMsg := &waProto.ImageMessage{
-				ContextInfo:   ctxInfo,
-				JpegThumbnail: media.Thumbnail,
-				Url:           &media.URL,
-				DirectPath:    &media.DirectPath,
-				MediaKey:      media.MediaKey,
-				Mimetype:      &part.GetInfo().MimeType,
-				FileEncSha256: media.FileEncSHA256,
-				FileSha256:    media.FileSHA256,
-				FileLength:    proto.Uint64(uint64(media.FileLength)),
+			partMsg, err := portal.convertMatrixGalleryPart(ctx, sender, part, evt.ID, partCtxInfo, caption)
+			if err != nil {
+				return nil, sender, extraMeta, fmt.Errorf("failed to handle gallery item #%d: %w", i+1, err)
 			}
 			if i == 0 {
-				msg.ImageMessage = imageMsg
+				msg.ImageMessage = partMsg.ImageMessage
+				msg.VideoMessage = partMsg.VideoMessage
 			} else {
-				extraMeta.GalleryExtraParts = append(extraMeta.GalleryExtraParts, &waProto.Message{
-					ImageMessage: imageMsg,
-				})
+				extraMeta.GalleryExtraParts = append(extraMeta.GalleryExtraParts, partMsg)
 			}
 		}
 	case event.MessageType(event.EventSticker.Type):
@@ -4697,8 +6026,7 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			FileSha256:    media.FileSHA256,
 			FileLength:    proto.Uint64(uint64(media.FileLength)),
 		}
-		_, isMSC3245Voice := evt.Content.Raw["org.matrix.msc3245.voice"]
-		if isMSC3245Voice {
+		if portal.shouldSendAsVoiceMessage(evt, content) {
 			msg.AudioMessage.Waveform = getUnstableWaveform(evt.Content.Raw)
 			msg.AudioMessage.Ptt = proto.Bool(true)
 			// hacky hack to add the codecs param that whatsapp seems to require
@@ -4709,6 +6037,10 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 		if media == nil {
 			return nil, sender, extraMeta, err
 		}
+		if relaybotFormatted && strings.TrimSpace(media.Caption) == "" {
+			// The relay format didn't produce a caption, so put the sender in the file name instead
+			media.FileName = fmt.Sprintf("%s - %s", portal.getRelaySenderName(ctx, realSenderMXID), media.FileName)
+		}
 		extraMeta.MediaHandle = media.Handle
 		msg.DocumentMessage = &waProto.DocumentMessage{
 			ContextInfo:   ctxInfo,
@@ -4733,19 +6065,38 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 			msg.DocumentMessage = nil
 		}
 	case event.MsgLocation:
-		lat, long, err := parseGeoURI(content.GeoURI)
+		geoURI := content.GeoURI
+		msc3488Location, _ := evt.Content.Raw["org.matrix.msc3488.location"].(map[string]any)
+		if msc3488URI, _ := msc3488Location["uri"].(string); geoURI == "" && msc3488URI != "" {
+			geoURI = msc3488URI
+		}
+		geo, err := parseGeoURI(geoURI)
 		if err != nil {
 			return nil, sender, extraMeta, fmt.Errorf("%w: %v", errInvalidGeoURI, err)
 		}
 		msg.LocationMessage = &waProto.LocationMessage{
-			DegreesLatitude:  &lat,
-			DegreesLongitude: &long,
+			DegreesLatitude:  proto.Float64(geo.Latitude),
+			DegreesLongitude: proto.Float64(geo.Longitude),
 			Comment:          &content.Body,
 			ContextInfo:      ctxInfo,
 		}
+		if geo.Accuracy > 0 {
+			msg.LocationMessage.AccuracyInMeters = proto.Uint32(uint32(math.Round(geo.Accuracy)))
+		}
+		if description, _ := msc3488Location["description"].(string); description != "" {
+			msg.LocationMessage.Name = proto.String(description)
+		}
 	default:
 		return nil, sender, extraMeta, fmt.Errorf("%w %q", errUnknownMsgType, content.MsgType)
 	}
+	// Inline images that couldn't be sent as a gallery are sent as separate messages after the first one
+	for i, img := range extraInlineImages {
+		partMsg, err := portal.convertMatrixGalleryPart(ctx, sender, img, evt.ID, &waProto.ContextInfo{Expiration: ctxInfo.Expiration}, "")
+		if err != nil {
+			return nil, sender, extraMeta, fmt.Errorf("failed to handle inline image #%d: %w", i+2, err)
+		}
+		extraMeta.GalleryExtraParts = append(extraMeta.GalleryExtraParts, partMsg)
+	}
 
 	if editRootMsg != nil {
 		msg = &waProto.Message{
@@ -4769,6 +6120,49 @@ func (portal *Portal) convertMatrixMessage(ctx context.Context, sender *User, ev
 	return msg, sender, extraMeta, nil
 }
 
+// convertMatrixGalleryPart uploads a single image or video of a gallery and converts it into a WhatsApp message.
+func (portal *Portal) convertMatrixGalleryPart(ctx context.Context, sender *User, part *event.MessageEventContent, eventID id.EventID, ctxInfo *waProto.ContextInfo, caption string) (*waProto.Message, error) {
+	mediaType := whatsmeow.MediaImage
+	if part.MsgType == event.MsgVideo {
+		mediaType = whatsmeow.MediaVideo
+	}
+	media, err := portal.preprocessMatrixMedia(ctx, sender, false, part, eventID, mediaType)
+	if media == nil {
+		return nil, err
+	}
+	var captionPtr *string
+	if caption != "" {
+		captionPtr = proto.String(caption)
+	}
+	if mediaType == whatsmeow.MediaVideo {
+		return &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			ContextInfo:   ctxInfo,
+			Caption:       captionPtr,
+			JpegThumbnail: media.Thumbnail,
+			Url:           &media.URL,
+			DirectPath:    &media.DirectPath,
+			MediaKey:      media.MediaKey,
+			Mimetype:      &part.GetInfo().MimeType,
+			Seconds:       proto.Uint32(uint32(part.GetInfo().Duration / 1000)),
+			FileEncSha256: media.FileEncSHA256,
+			FileSha256:    media.FileSHA256,
+			FileLength:    proto.Uint64(uint64(media.FileLength)),
+		}}, nil
+	}
+	return &waProto.Message{ImageMessage: &waProto.ImageMessage{
+		ContextInfo:   ctxInfo,
+		Caption:       captionPtr,
+		JpegThumbnail: media.Thumbnail,
+		Url:           &media.URL,
+		DirectPath:    &media.DirectPath,
+		MediaKey:      media.MediaKey,
+		Mimetype:      &part.GetInfo().MimeType,
+		FileEncSha256: media.FileEncSHA256,
+		FileSha256:    media.FileSHA256,
+		FileLength:    proto.Uint64(uint64(media.FileLength)),
+	}}, nil
+}
+
 func (portal *Portal) generateMessageInfo(sender *User) *types.MessageInfo {
 	return &types.MessageInfo{
 		ID:        sender.Client.GenerateMessageID(),
@@ -4782,18 +6176,32 @@ func (portal *Portal) generateMessageInfo(sender *User) *types.MessageInfo {
 	}
 }
 
-func (portal *Portal) HandleMatrixMessage(ctx context.Context, sender *User, evt *event.Event, timings messageTimings) {
+func (portal *Portal) HandleMatrixMessage(ctx context.Context, sender *User, evt *event.Event, timings messageTimings, fromOfflineQueue bool) {
 	start := time.Now()
 	ms := metricSender{portal: portal, timings: &timings}
 	log := zerolog.Ctx(ctx)
 
 	allowRelay := evt.Type != TypeMSC3381PollResponse && evt.Type != TypeMSC3381V2PollResponse && evt.Type != TypeMSC3381PollStart
-	if err := portal.canBridgeFrom(sender, allowRelay, true); err != nil {
+	if err := portal.canBridgeFrom(sender, allowRelay, true); err != nil && !errors.Is(err, errUserNotConnected) {
 		go ms.sendMessageMetrics(ctx, evt, err, "Ignoring", true)
 		return
 	} else if portal.Key.JID == types.StatusBroadcastJID && portal.bridge.Config.Bridge.DisableStatusBroadcastSend {
 		go ms.sendMessageMetrics(ctx, evt, errBroadcastSendDisabled, "Ignoring", true)
 		return
+	} else if portal.tryQueueOffline(ctx, sender, evt, fromOfflineQueue) {
+		return
+	} else if err != nil {
+		go ms.sendMessageMetrics(ctx, evt, err, "Ignoring", true)
+		return
+	}
+
+	if sendAt := getScheduledSendTime(evt); !sendAt.IsZero() && evt.Type == event.EventMessage {
+		err := portal.scheduleMatrixMessage(ctx, sender, evt, sendAt)
+		if err != nil {
+			log.Err(err).Msg("Failed to schedule message")
+			go ms.sendMessageMetrics(ctx, evt, err, "Error scheduling", true)
+		}
+		return
 	}
 
 	messageAge := timings.totalReceive
@@ -4862,8 +6270,19 @@ func (portal *Portal) HandleMatrixMessage(ctx context.Context, sender *User, evt
 
 	timings.preproc = time.Since(start)
 	start = time.Now()
+	metricMsgType := string(evt.Content.AsMessage().MsgType)
+	if metricMsgType == "" {
+		metricMsgType = evt.Type.Type
+	}
+	doneConverting := portal.bridge.Metrics.TrackConversion("to_whatsapp", metricMsgType)
 	msg, sender, extraMeta, err := portal.convertMatrixMessage(timedCtx, sender, evt)
 	timings.convert = time.Since(start)
+	if msg == nil {
+		reason, _, _, _, _ := errorToStatusReason(err)
+		doneConverting(string(reason))
+	} else {
+		doneConverting("")
+	}
 	if msg == nil {
 		go ms.sendMessageMetrics(ctx, evt, err, "Error converting", true)
 		return
@@ -4871,6 +6290,10 @@ func (portal *Portal) HandleMatrixMessage(ctx context.Context, sender *User, evt
 	if extraMeta == nil {
 		extraMeta = &extraConvertMeta{}
 	}
+	if msg.PollUpdateMessage == nil && portal.isSendRestricted(ctx, sender) {
+		go ms.sendMessageMetrics(ctx, evt, errAnnounceGroupNotAdmin, "Ignoring", true)
+		return
+	}
 	dbMsgType := database.MsgNormal
 	if msg.PollCreationMessage != nil || msg.PollCreationMessageV2 != nil || msg.PollCreationMessageV3 != nil {
 		dbMsgType = database.MsgMatrixPoll
@@ -4878,6 +6301,9 @@ func (portal *Portal) HandleMatrixMessage(ctx context.Context, sender *User, evt
 		portal.MarkDisappearing(ctx, origEvtID, time.Duration(portal.ExpirationTime)*time.Second, time.Now())
 	} else {
 		dbMsgType = database.MsgEdit
+		if extraMeta.EditRootMsg != nil {
+			portal.MarkEditDisappearing(ctx, evt.ID, extraMeta.EditRootMsg.MXID)
+		}
 	}
 	info := portal.generateMessageInfo(sender)
 	if dbMsg == nil {
@@ -4896,7 +6322,7 @@ func (portal *Portal) HandleMatrixMessage(ctx context.Context, sender *User, evt
 	}
 	log.Debug().Msg("Sending Matrix event to WhatsApp")
 	start = time.Now()
-	resp, err := sender.Client.SendMessage(timedCtx, portal.Key.JID, msg, whatsmeow.SendRequestExtra{
+	resp, err := portal.sendWhatsAppMessage(timedCtx, sender, msg, whatsmeow.SendRequestExtra{
 		ID:          info.ID,
 		MediaHandle: extraMeta.MediaHandle,
 	})
@@ -4915,7 +6341,7 @@ func (portal *Portal) HandleMatrixMessage(ctx context.Context, sender *User, evt
 			partInfo := portal.generateMessageInfo(sender)
 			partDBMsg := portal.markHandled(ctx, nil, partInfo, evt.ID, evt.Sender, false, true, database.MsgBeeperGallery, i+1, database.MsgNoError)
 			log.Debug().Int("part_index", i+1).Str("wa_part_message_id", partInfo.ID).Msg("Sending gallery part to WhatsApp")
-			resp, err = sender.Client.SendMessage(timedCtx, portal.Key.JID, part, whatsmeow.SendRequestExtra{ID: partInfo.ID})
+			resp, err = portal.sendWhatsAppMessage(timedCtx, sender, part, whatsmeow.SendRequestExtra{ID: partInfo.ID})
 			if err != nil {
 				go ms.sendMessageMetrics(ctx, evt, err, "Error sending", true)
 				return
@@ -4932,11 +6358,120 @@ func (portal *Portal) HandleMatrixMessage(ctx context.Context, sender *User, evt
 	go ms.sendMessageMetrics(ctx, evt, nil, "", true)
 }
 
+// isSendRestricted checks if the group only allows admins to send messages and the given user isn't an admin.
+// The power levels in the room are kept in sync with the group's admin list, so they're used instead of fetching
+// the group info from WhatsApp for every message.
+func (portal *Portal) isSendRestricted(ctx context.Context, sender *User) bool {
+	if portal.Key.JID.Server != types.GroupServer || !portal.IsAnnounce {
+		return false
+	}
+	levels, err := portal.bridge.AS.StateStore.GetPowerLevels(ctx, portal.MXID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to get power levels to check if sending is restricted")
+		return false
+	} else if levels == nil {
+		return false
+	}
+	return isPowerLevelsAnnounce(levels) && levels.GetUserLevel(sender.MXID) < 50
+}
+
+func (portal *Portal) sendWhatsAppMessage(ctx context.Context, sender *User, msg *waProto.Message, extra whatsmeow.SendRequestExtra) (resp whatsmeow.SendResponse, err error) {
+	if !portal.IsBroadcastList() || portal.IsStatusBroadcastList() {
+		resp, err = sender.Client.SendMessage(ctx, portal.Key.JID, msg, extra)
+	} else {
+		var recipients []types.JID
+		recipients, err = portal.getBroadcastRecipients(ctx, sender)
+		if err != nil {
+			return
+		}
+		resp, err = portal.sendBroadcastListMessage(ctx, sender, recipients, msg, extra)
+	}
+	if err == nil && sender.shouldAnnounceOfflineAfterSend() {
+		go sender.announceOffline()
+	}
+	return
+}
+
+// getBroadcastRecipients returns the recipients of a broadcast list portal based on the ghosts in the room.
+func (portal *Portal) getBroadcastRecipients(ctx context.Context, sender *User) ([]types.JID, error) {
+	if len(portal.MXID) == 0 {
+		return nil, errBroadcastNoRecipients
+	}
+	members, err := portal.MainIntent().JoinedMembers(ctx, portal.MXID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get broadcast list members: %w", err)
+	}
+	recipients := make([]types.JID, 0, len(members.Joined))
+	for member := range members.Joined {
+		jid, ok := portal.bridge.ParsePuppetMXID(member)
+		if ok && jid.User != sender.JID.User {
+			recipients = append(recipients, jid)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errBroadcastNoRecipients
+	}
+	return recipients, nil
+}
+
+// sendBroadcastListMessage sends a message to every recipient of a broadcast list.
+//
+// whatsmeow can't encrypt messages for non-status broadcast lists, so the fan-out is done by sending the message
+// to each recipient's private chat with the same message ID, which is also how broadcast messages appear to recipients.
+// The response of the last successful send is returned, and an error is only returned if every send failed.
+// If only some of the sends failed, a notice listing the recipients who didn't get the message is sent to the room.
+func (portal *Portal) sendBroadcastListMessage(ctx context.Context, sender *User, recipients []types.JID, msg *waProto.Message, extra whatsmeow.SendRequestExtra) (resp whatsmeow.SendResponse, err error) {
+	log := zerolog.Ctx(ctx)
+	if len(recipients) == 0 {
+		return resp, errBroadcastNoRecipients
+	}
+	if extra.ID == "" {
+		extra.ID = sender.Client.GenerateMessageID()
+	}
+	var firstErr error
+	var failed []string
+	for _, recipient := range recipients {
+		recipientResp, sendErr := sender.Client.SendMessage(ctx, recipient, msg, extra)
+		if sendErr != nil {
+			log.Warn().Err(sendErr).
+				Stringer("recipient_jid", recipient).
+				Msg("Failed to send broadcast list message to recipient")
+			if firstErr == nil {
+				firstErr = sendErr
+			}
+			failed = append(failed, "+"+recipient.User)
+			continue
+		}
+		resp = recipientResp
+	}
+	log.Debug().
+		Int("recipient_count", len(recipients)).
+		Int("failed_count", len(failed)).
+		Str("message_id", extra.ID).
+		Msg("Sent broadcast list message")
+	if len(failed) == len(recipients) {
+		return resp, firstErr
+	} else if len(failed) > 0 {
+		_, noticeErr := portal.sendMainIntentMessage(ctx, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body: portal.T("\u26a0 Your message wasn't delivered to %d of %d recipients: %s",
+				len(failed), len(recipients), strings.Join(failed, ", ")),
+		})
+		if noticeErr != nil {
+			log.Warn().Err(noticeErr).Msg("Failed to send notice about partially failed broadcast list message")
+		}
+	}
+	return resp, nil
+}
+
 func (portal *Portal) HandleMatrixReaction(ctx context.Context, sender *User, evt *event.Event) {
 	log := zerolog.Ctx(ctx)
 	if err := portal.canBridgeFrom(sender, false, true); err != nil {
 		go portal.sendMessageMetrics(ctx, evt, err, "Ignoring", nil)
 		return
+	} else if portal.IsBroadcastList() && !portal.IsStatusBroadcastList() {
+		go portal.sendMessageMetrics(ctx, evt, errBroadcastListActionUnsupported, "Ignoring", nil)
+		return
 	} else if portal.Key.JID.Server == types.BroadcastServer {
 		// TODO implement this, probably by only sending the reaction to the sender of the status message?
 		//      (whatsapp hasn't published the feature yet)
@@ -4980,13 +6515,52 @@ func (portal *Portal) handleMatrixReaction(ctx context.Context, sender *User, ev
 	dbMsg := portal.markHandled(ctx, nil, info, evt.ID, evt.Sender, false, true, database.MsgReaction, 0, database.MsgNoError)
 	portal.upsertReaction(ctx, nil, target.JID, sender.JID, evt.ID, info.ID)
 	log.Debug().Str("whatsapp_reaction_id", info.ID).Msg("Sending Matrix reaction to WhatsApp")
-	resp, err := portal.sendReactionToWhatsApp(sender, info.ID, target, content.RelatesTo.Key, evt.Timestamp)
+	key := portal.mapReactionToWhatsApp(evt, content.RelatesTo.Key)
+	if key != content.RelatesTo.Key {
+		log.Debug().Str("original_key", content.RelatesTo.Key).Str("mapped_key", key).Msg("Mapped reaction key")
+	}
+	resp, err := portal.sendReactionToWhatsApp(sender, info.ID, target, key, evt.Timestamp)
 	if err == nil {
 		err = dbMsg.MarkSent(ctx, resp.Timestamp)
 	}
 	return err
 }
 
+// mapReactionToMatrix converts a WhatsApp reaction emoji into a Matrix reaction key using the configured mapping.
+func (portal *Portal) mapReactionToMatrix(emoji string) string {
+	mapping := portal.bridge.Config.Bridge.ReactionMapping.ToMatrix
+	if mapped, ok := mapping[emoji]; ok {
+		return mapped
+	} else if mapped, ok = mapping[variationselector.Remove(emoji)]; ok {
+		return mapped
+	}
+	return variationselector.Add(emoji)
+}
+
+// mapReactionToWhatsApp converts a Matrix reaction key into an emoji that WhatsApp accepts.
+// Custom emojis are looked up by their shortcode as well as their mxc URI.
+func (portal *Portal) mapReactionToWhatsApp(evt *event.Event, key string) string {
+	mapping := portal.bridge.Config.Bridge.ReactionMapping.ToWhatsApp
+	candidates := []string{key, variationselector.Remove(key)}
+	for _, field := range []string{"shortcode", "com.beeper.reaction.shortcode"} {
+		if shortcode, ok := evt.Content.Raw[field].(string); ok && shortcode != "" {
+			candidates = append(candidates, shortcode, strings.Trim(shortcode, ":"))
+		}
+	}
+	if strings.HasPrefix(key, ":") && strings.HasSuffix(key, ":") {
+		candidates = append(candidates, strings.Trim(key, ":"))
+	}
+	for _, candidate := range candidates {
+		if mapped, ok := mapping[candidate]; ok {
+			return mapped
+		}
+	}
+	if fallback := portal.bridge.Config.Bridge.ReactionMapping.Fallback; fallback != "" && !isEmojiReaction(key) {
+		return fallback
+	}
+	return key
+}
+
 func (portal *Portal) sendReactionToWhatsApp(sender *User, id types.MessageID, target *database.Message, key string, timestamp int64) (whatsmeow.SendResponse, error) {
 	var messageKeyParticipant *string
 	if !portal.IsPrivateChat() {
@@ -5050,6 +6624,9 @@ func (portal *Portal) HandleMatrixRedaction(ctx context.Context, sender *User, e
 	if err := portal.canBridgeFrom(sender, true, true); err != nil {
 		go portal.sendMessageMetrics(ctx, evt, err, "Ignoring", nil)
 		return
+	} else if portal.IsBroadcastList() && !portal.IsStatusBroadcastList() {
+		go portal.sendMessageMetrics(ctx, evt, errBroadcastListActionUnsupported, "Ignoring", nil)
+		return
 	}
 	log.Debug().Msg("Received Matrix redaction")
 
@@ -5134,6 +6711,9 @@ func (portal *Portal) handleMatrixReadReceipt(ctx context.Context, sender *User,
 		}
 		return
 	}
+	if portal.isReadOnlyFor(sender) {
+		return
+	}
 
 	maxTimestamp := receiptTimestamp
 	// Implicit read receipts don't have an event ID that's already bridged
@@ -5160,6 +6740,13 @@ func (portal *Portal) handleMatrixReadReceipt(ctx context.Context, sender *User,
 	if len(messages) > 0 {
 		sender.SetLastReadTS(ctx, portal.Key, messages[len(messages)-1].Timestamp)
 	}
+	// The last read timestamp is still updated above, so that re-enabling receipts doesn't mark old messages as read
+	if !sender.shouldSendReadReceipts() {
+		if isExplicit {
+			log.Debug().Msg("Not sending read receipt: read receipts are disabled for user")
+		}
+		return
+	}
 	groupedMessages := make(map[types.JID][]types.MessageID)
 	for _, msg := range messages {
 		var key types.JID
@@ -5223,7 +6810,7 @@ OuterPrev:
 func (portal *Portal) setTyping(userIDs []id.UserID, state types.ChatPresence) {
 	for _, userID := range userIDs {
 		user := portal.bridge.GetUserByMXIDIfExists(userID)
-		if user == nil || !user.IsLoggedIn() {
+		if user == nil || !user.IsLoggedIn() || !user.shouldSendTyping(portal) || portal.isReadOnlyFor(user) {
 			continue
 		}
 		portal.zlog.Debug().
@@ -5239,8 +6826,8 @@ func (portal *Portal) setTyping(userIDs []id.UserID, state types.ChatPresence) {
 				Str("state", string(state)).
 				Msg("Failed to send chat presence")
 		}
-		if portal.bridge.Config.Bridge.SendPresenceOnTyping {
-			err = user.Client.SendPresence(types.PresenceAvailable)
+		if portal.bridge.Config.Bridge.SendPresenceOnTyping && user.canSendAvailablePresence() {
+			err = user.sendPresence(types.PresenceAvailable)
 			if err != nil {
 				user.zlog.Warn().Err(err).Msg("Failed to set presence on typing")
 			}
@@ -5257,9 +6844,19 @@ func (portal *Portal) HandleMatrixTyping(newTyping []id.UserID) {
 	portal.setTyping(stoppedTyping, types.ChatPresencePaused)
 }
 
+// isReadOnlyFor checks if nothing should be sent to WhatsApp in this portal on behalf of the given user.
+func (portal *Portal) isReadOnlyFor(user *User) bool {
+	return portal.ReadOnly || user.ReadOnly
+}
+
 func (portal *Portal) canBridgeFrom(sender *User, allowRelay, reconnectWait bool) error {
-	if !sender.IsLoggedIn() {
+	if portal.isReadOnlyFor(sender) {
+		return errReadOnly
+	} else if !sender.IsLoggedIn() {
 		if allowRelay && portal.HasRelaybot() {
+			if portal.GetRelayUser().ReadOnly {
+				return errReadOnly
+			}
 			return nil
 		} else if sender.Session != nil {
 			return errUserNotConnected
@@ -5290,11 +6887,36 @@ func (portal *Portal) resetChildSpaceStatus() {
 	}
 }
 
+func (portal *Portal) removeFromPersonalSpaces(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	userIDs, err := portal.bridge.DB.Portal.GetUsersWithPortalInSpace(ctx, portal.Key)
+	if err != nil {
+		log.Err(err).Msg("Failed to get users who have portal in their personal filtering space")
+		return
+	}
+	for _, userID := range userIDs {
+		user := portal.bridge.GetUserByMXIDIfExists(userID)
+		if user == nil {
+			continue
+		}
+		user.ForgetInSpace(portal.Key)
+		if len(user.SpaceRoom) == 0 || len(portal.MXID) == 0 {
+			continue
+		}
+		_, err = portal.bridge.Bot.SendStateEvent(ctx, user.SpaceRoom, event.StateSpaceChild, portal.MXID.String(), &event.SpaceChildEventContent{})
+		if err != nil {
+			log.Err(err).Stringer("space_id", user.SpaceRoom).Msg("Failed to remove portal from user's personal filtering space")
+		}
+	}
+}
+
 func (portal *Portal) Delete(ctx context.Context) {
+	portal.removeFromPersonalSpaces(ctx)
 	err := portal.Portal.Delete(ctx)
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to delete portal from database")
 	}
+	portal.bridge.Metrics.ForgetPortal(portal.Key.JID)
 	portal.bridge.portalsLock.Lock()
 	delete(portal.bridge.portalsByJID, portal.Key)
 	if len(portal.MXID) > 0 {
@@ -5374,6 +6996,13 @@ func (portal *Portal) Cleanup(ctx context.Context, puppetsOnly bool) {
 	}
 }
 
+func (portal *Portal) shouldBridgeMatrixLeave() bool {
+	if portal.BridgeMatrixLeave != nil {
+		return *portal.BridgeMatrixLeave
+	}
+	return portal.bridge.Config.Bridge.BridgeMatrixLeave
+}
+
 func (portal *Portal) HandleMatrixLeave(brSender bridge.User, evt *event.Event) {
 	log := portal.zlog.With().
 		Str("action", "handle matrix leave").
@@ -5387,13 +7016,19 @@ func (portal *Portal) HandleMatrixLeave(brSender bridge.User, evt *event.Event)
 		portal.Delete(ctx)
 		portal.Cleanup(ctx, false)
 		return
-	} else if portal.bridge.Config.Bridge.BridgeMatrixLeave {
-		err := sender.Client.LeaveGroup(portal.Key.JID)
-		if err != nil {
-			log.Err(err).Msg("Failed to leave group")
-			return
+	} else if portal.shouldBridgeMatrixLeave() && sender.IsLoggedIn() && !portal.isReadOnlyFor(sender) {
+		if portal.bridge.Config.Bridge.BridgeMatrixLeaveConfirm {
+			log.Debug().Msg("Asking user to confirm leaving WhatsApp group")
+			sender.sendMarkdownBridgeAlert(ctx,
+				"You left the portal room for **%s**. Use `leave-group %s` to also leave the WhatsApp group.",
+				portal.Name, portal.Key.JID.User)
+		} else {
+			err := sender.Client.LeaveGroup(portal.Key.JID)
+			if err != nil {
+				log.Err(err).Msg("Failed to leave group")
+				return
+			}
 		}
-		//portal.log.Infoln("Leave response:", <-resp)
 	}
 	portal.CleanupIfEmpty(ctx)
 }
@@ -5401,6 +7036,9 @@ func (portal *Portal) HandleMatrixLeave(brSender bridge.User, evt *event.Event)
 func (portal *Portal) HandleMatrixKick(brSender bridge.User, brTarget bridge.Ghost, evt *event.Event) {
 	sender := brSender.(*User)
 	target := brTarget.(*Puppet)
+	if portal.isReadOnlyFor(sender) {
+		return
+	}
 	_, err := sender.Client.UpdateGroupParticipants(portal.Key.JID, []types.JID{target.JID}, whatsmeow.ParticipantChangeRemove)
 	if err != nil {
 		portal.zlog.Err(err).
@@ -5416,6 +7054,9 @@ func (portal *Portal) HandleMatrixKick(brSender bridge.User, brTarget bridge.Gho
 func (portal *Portal) HandleMatrixInvite(brSender bridge.User, brTarget bridge.Ghost, evt *event.Event) {
 	sender := brSender.(*User)
 	target := brTarget.(*Puppet)
+	if portal.isReadOnlyFor(sender) {
+		return
+	}
 	_, err := sender.Client.UpdateGroupParticipants(portal.Key.JID, []types.JID{target.JID}, whatsmeow.ParticipantChangeAdd)
 	if err != nil {
 		portal.zlog.Err(err).
@@ -5428,9 +7069,59 @@ func (portal *Portal) HandleMatrixInvite(brSender bridge.User, brTarget bridge.G
 	//portal.log.Infofln("Add %s response: %s", puppet.JID, <-resp)
 }
 
+func isPowerLevelsAnnounce(levels *event.PowerLevelsEventContent) bool {
+	return levels.EventsDefault >= 50
+}
+
+func isPowerLevelsLocked(levels *event.PowerLevelsEventContent) bool {
+	return levels.GetEventLevel(event.StateRoomName) >= 50 &&
+		levels.GetEventLevel(event.StateTopic) >= 50 &&
+		levels.GetEventLevel(event.StateRoomAvatar) >= 50
+}
+
+// HandleMatrixPowerLevels maps changes to the default message sending and metadata change levels
+// to the announce and locked settings of the WhatsApp group.
+func (portal *Portal) HandleMatrixPowerLevels(brSender bridge.User, evt *event.Event) {
+	sender := brSender.(*User)
+	// Changes made by the bridge bot and ghosts are mirrored from WhatsApp and are already filtered out by mautrix
+	if !portal.IsGroupChat() || !sender.IsLoggedIn() {
+		return
+	}
+	log := portal.zlog.With().
+		Str("action", "handle matrix power levels").
+		Stringer("event_id", evt.ID).
+		Stringer("sender", sender.MXID).
+		Logger()
+	if portal.isReadOnlyFor(sender) {
+		return
+	}
+	content := evt.Content.AsPowerLevels()
+	prevContent := portal.GetBasePowerLevels()
+	if evt.Unsigned.PrevContent != nil {
+		_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+		if parsed, ok := evt.Unsigned.PrevContent.Parsed.(*event.PowerLevelsEventContent); ok {
+			prevContent = parsed
+		}
+	}
+	if announce := isPowerLevelsAnnounce(content); announce != isPowerLevelsAnnounce(prevContent) {
+		log.Debug().Bool("announce", announce).Msg("Updating group announce setting")
+		err := sender.Client.SetGroupAnnounce(portal.Key.JID, announce)
+		if err != nil {
+			log.Err(err).Msg("Failed to update group announce setting")
+		}
+	}
+	if locked := isPowerLevelsLocked(content); locked != isPowerLevelsLocked(prevContent) {
+		log.Debug().Bool("locked", locked).Msg("Updating group locked setting")
+		err := sender.Client.SetGroupLocked(portal.Key.JID, locked)
+		if err != nil {
+			log.Err(err).Msg("Failed to update group locked setting")
+		}
+	}
+}
+
 func (portal *Portal) HandleMatrixMeta(brSender bridge.User, evt *event.Event) {
 	sender := brSender.(*User)
-	if !sender.Whitelisted || !sender.IsLoggedIn() {
+	if !sender.Whitelisted || !sender.IsLoggedIn() || portal.isReadOnlyFor(sender) {
 		return
 	}
 	log := portal.zlog.With().
@@ -5453,11 +7144,12 @@ func (portal *Portal) HandleMatrixMeta(brSender bridge.User, evt *event.Event) {
 			return
 		}
 	case *event.TopicEventContent:
-		if content.Topic == portal.Topic {
+		topic := portal.stripDisappearingTopicSuffix(content.Topic)
+		if topic == portal.Topic {
 			return
 		}
-		portal.Topic = content.Topic
-		err := sender.Client.SetGroupTopic(portal.Key.JID, "", "", content.Topic)
+		portal.Topic = topic
+		err := sender.Client.SetGroupTopic(portal.Key.JID, "", "", topic)
 		if err != nil {
 			log.Err(err).Msg("Failed to update group topic")
 			return
@@ -17,12 +17,16 @@
 package main
 
 import (
+	"archive/zip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,6 +43,8 @@ import (
 
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/database"
 )
 
 type ProvisioningAPI struct {
@@ -68,6 +74,14 @@ func (prov *ProvisioningAPI) Init() {
 	r.HandleFunc("/v1/group/open/{groupID}", prov.OpenGroup).Methods(http.MethodPost)
 	r.HandleFunc("/v1/group/resolve/{inviteCode}", prov.ResolveGroupInvite).Methods(http.MethodPost)
 	r.HandleFunc("/v1/group/join/{inviteCode}", prov.JoinGroup).Methods(http.MethodPost)
+	r.HandleFunc("/v1/message_map", prov.ExportMessageMap).Methods(http.MethodGet)
+	r.HandleFunc("/v1/message_map", prov.ImportMessageMap).Methods(http.MethodPost)
+	r.HandleFunc("/v1/import_export/{jid}", prov.ImportChatExport).Methods(http.MethodPost)
+	r.HandleFunc("/v1/export/{jid}", prov.ExportChat).Methods(http.MethodGet)
+	r.HandleFunc("/v1/admin/logins", prov.AdminListLogins).Methods(http.MethodGet)
+	r.HandleFunc("/v1/admin/logins/{userID}/reconnect", prov.adminUserHandler(prov.Reconnect)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/admin/logins/{userID}/logout", prov.adminUserHandler(prov.Logout)).Methods(http.MethodPost)
+	r.HandleFunc("/v1/admin/logins/{userID}", prov.adminUserHandler(prov.DeleteSession)).Methods(http.MethodDelete)
 	prov.bridge.AS.Router.HandleFunc("/_matrix/app/com.beeper.asmux/ping", prov.BridgeStatePing).Methods(http.MethodPost)
 	prov.bridge.AS.Router.HandleFunc("/_matrix/app/com.beeper.bridge_state", prov.BridgeStatePing).Methods(http.MethodPost)
 
@@ -616,9 +630,264 @@ func (prov *ProvisioningAPI) Logout(w http.ResponseWriter, r *http.Request) {
 	user.bridge.Metrics.TrackConnectionState(user.JID, false)
 	user.removeFromJIDMap(status.BridgeState{StateEvent: status.StateLoggedOut})
 	user.DeleteSession(r.Context())
+	prov.bridge.Webhooks.Send(user, WebhookLogout, map[string]interface{}{"remote": false})
 	jsonResponse(w, http.StatusOK, Response{true, "Logged out successfully."})
 }
 
+// maxChatExportSize is the maximum size of chat export zip files that can be imported.
+const maxChatExportSize = 512 * 1024 * 1024
+
+// ImportChatExport imports a zip file created with the "Export chat" feature of WhatsApp into the portal of the given chat.
+// The import happens in the background, and the user is notified in their management room when it's done.
+func (prov *ProvisioningAPI) ImportChatExport(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if !user.IsLoggedIn() {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "User is not logged into WhatsApp",
+			ErrCode: "no session",
+		})
+		return
+	}
+	jid, err := types.ParseJID(mux.Vars(r)["jid"])
+	if err != nil || jid.User == "" {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Invalid chat JID",
+			ErrCode: "invalid jid",
+		})
+		return
+	}
+	portal := prov.bridge.GetExistingPortalByJID(database.NewPortalKey(jid, user.JID))
+	if portal == nil || len(portal.MXID) == 0 {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Chat doesn't have a portal room",
+			ErrCode: "M_NOT_FOUND",
+		})
+		return
+	}
+	// The upload is buffered on disk, as exports with media can be far too large to keep in memory
+	tempFile, err := os.CreateTemp("", "mautrix_whatsapp_export_*.zip")
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to create temporary file for chat export")
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to create temporary file for chat export",
+			ErrCode: "M_UNKNOWN",
+		})
+		return
+	}
+	cleanup := func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}
+	size, err := io.Copy(tempFile, http.MaxBytesReader(w, r.Body, maxChatExportSize))
+	if err != nil {
+		cleanup()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			jsonResponse(w, http.StatusRequestEntityTooLarge, Error{
+				Error:   fmt.Sprintf("Chat export is too large (maximum size is %s)", formatFileSize(maxChatExportSize)),
+				ErrCode: "M_TOO_LARGE",
+			})
+		} else {
+			jsonResponse(w, http.StatusBadRequest, Error{
+				Error:   fmt.Sprintf("Failed to read request body: %v", err),
+				ErrCode: "M_BAD_JSON",
+			})
+		}
+		return
+	}
+	zipReader, err := zip.NewReader(tempFile, size)
+	if err != nil {
+		cleanup()
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("Failed to read zip file: %v", err),
+			ErrCode: "invalid zip",
+		})
+		return
+	}
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	export, err := ParseChatExport(zipReader, loc)
+	if err != nil {
+		cleanup()
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("Failed to parse chat export: %v", err),
+			ErrCode: "invalid export",
+		})
+		return
+	}
+	log := hlog.FromRequest(r).With().
+		Str("action", "import chat export").
+		Stringer("chat_jid", portal.Key.JID).
+		Int("message_count", len(export.Messages)).
+		Logger()
+	go func() {
+		defer cleanup()
+		ctx := log.WithContext(context.Background())
+		log.Info().Msg("Importing chat export")
+		imported, err := portal.ImportChatExport(ctx, user, export)
+		if err != nil {
+			log.Err(err).Int("imported_count", imported).Msg("Failed to import chat export")
+			user.sendMarkdownBridgeAlert(ctx, "Failed to import chat export into %s after %d messages: %v", portal.MXID, imported, err)
+		} else {
+			log.Info().Int("imported_count", imported).Msg("Finished importing chat export")
+			user.sendMarkdownBridgeAlert(ctx, "Imported %d messages from chat export into %s", imported, portal.MXID)
+		}
+	}()
+	jsonResponse(w, http.StatusAccepted, map[string]interface{}{
+		"success":       true,
+		"room_id":       portal.MXID,
+		"message_count": len(export.Messages),
+	})
+}
+
+// ExportChat returns the history of a portal room as a zip file in the WhatsApp chat export format.
+func (prov *ProvisioningAPI) ExportChat(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if !user.IsLoggedIn() {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "User is not logged into WhatsApp",
+			ErrCode: "no session",
+		})
+		return
+	}
+	jid, err := types.ParseJID(mux.Vars(r)["jid"])
+	if err != nil || jid.User == "" {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Invalid chat JID",
+			ErrCode: "invalid jid",
+		})
+		return
+	}
+	portal := prov.bridge.GetExistingPortalByJID(database.NewPortalKey(jid, user.JID))
+	if portal == nil || len(portal.MXID) == 0 {
+		jsonResponse(w, http.StatusNotFound, Error{
+			Error:   "Chat doesn't have a portal room",
+			ErrCode: "M_NOT_FOUND",
+		})
+		return
+	}
+	loc, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	log := hlog.FromRequest(r)
+	// The zip is built in a temporary file first, so that errors can still be returned properly
+	// instead of sending a truncated archive with a successful status code.
+	tempFile, err := os.CreateTemp("", "mautrix_whatsapp_export_*.zip")
+	if err != nil {
+		log.Err(err).Msg("Failed to create temporary file for chat export")
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to create temporary file for chat export",
+			ErrCode: "M_UNKNOWN",
+		})
+		return
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+	exported, err := portal.ExportChat(r.Context(), tempFile, loc)
+	if err != nil {
+		log.Err(err).Int("exported_count", exported).Msg("Failed to export chat")
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   fmt.Sprintf("Failed to export chat: %v", err),
+			ErrCode: "M_UNKNOWN",
+		})
+		return
+	}
+	size, err := tempFile.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = tempFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to rewind chat export file")
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Failed to read chat export",
+			ErrCode: "M_UNKNOWN",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="WhatsApp Chat - %s.zip"`, portal.Key.JID.User))
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, tempFile)
+	if err != nil {
+		log.Err(err).Msg("Failed to send chat export")
+	} else {
+		log.Info().Int("exported_count", exported).Stringer("room_id", portal.MXID).Msg("Exported chat")
+	}
+}
+
+type AdminLoginInfo struct {
+	MXID            id.UserID          `json:"mxid"`
+	JID             string             `json:"jid,omitempty"`
+	Platform        string             `json:"platform,omitempty"`
+	HasSession      bool               `json:"has_session"`
+	IsConnected     bool               `json:"is_connected"`
+	IsLoggedIn      bool               `json:"is_logged_in"`
+	PhoneLastSeen   int64              `json:"phone_last_seen,omitempty"`
+	PhoneLastPinged int64              `json:"phone_last_pinged,omitempty"`
+	BridgeState     status.BridgeState `json:"bridge_state"`
+}
+
+func unixMilliOrZero(ts time.Time) int64 {
+	if ts.IsZero() {
+		return 0
+	}
+	return ts.UnixMilli()
+}
+
+// AdminListLogins lists all users who have a WhatsApp login or a stored session, along with their connection state.
+func (prov *ProvisioningAPI) AdminListLogins(w http.ResponseWriter, r *http.Request) {
+	logins := make([]AdminLoginInfo, 0)
+	for _, user := range prov.bridge.GetAllUsers() {
+		if user.JID.IsEmpty() && user.Session == nil {
+			continue
+		}
+		info := AdminLoginInfo{
+			MXID:            user.MXID,
+			HasSession:      user.Session != nil,
+			PhoneLastSeen:   unixMilliOrZero(user.PhoneLastSeen),
+			PhoneLastPinged: unixMilliOrZero(user.PhoneLastPinged),
+			BridgeState:     user.BridgeState.GetPrev(),
+		}
+		if !user.JID.IsEmpty() {
+			info.JID = user.JID.String()
+		}
+		if user.Session != nil {
+			info.Platform = user.Session.Platform
+		}
+		if user.Client != nil {
+			info.IsConnected = user.Client.IsConnected()
+			info.IsLoggedIn = user.Client.IsLoggedIn()
+		}
+		logins = append(logins, info)
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"logins": logins,
+	})
+}
+
+// adminUserHandler wraps a per-user provisioning handler so that it acts on the user in the path
+// rather than the user_id query parameter.
+func (prov *ProvisioningAPI) adminUserHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := prov.bridge.GetUserByMXIDIfExists(id.UserID(mux.Vars(r)["userID"]))
+		if user == nil {
+			jsonResponse(w, http.StatusNotFound, Error{
+				Error:   "User not found",
+				ErrCode: "M_NOT_FOUND",
+			})
+			return
+		}
+		hlog.FromRequest(r).Info().Stringer("target_user_id", user.MXID).Msg("Handling admin login management request")
+		handler(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
+	}
+}
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
@@ -777,3 +1046,160 @@ func (prov *ProvisioningAPI) Login(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+const messageMapVersion = 1
+
+// MessageMap is the format used for exporting and importing the mapping between WhatsApp message IDs and Matrix
+// event IDs. The version field is incremented if the format changes incompatibly.
+type MessageMap struct {
+	Version  int               `json:"version"`
+	Messages []MessageMapEntry `json:"messages"`
+}
+
+// MessageMapEntry is a single WhatsApp message ID to Matrix event ID mapping. The timestamp is in unix seconds.
+// The room ID is informational: on import, messages are attached to the portal identified by the chat JID and receiver.
+type MessageMapEntry struct {
+	ChatJID      types.JID            `json:"chat_jid"`
+	ChatReceiver types.JID            `json:"chat_receiver"`
+	RoomID       id.RoomID            `json:"room_id,omitempty"`
+	MessageID    types.MessageID      `json:"message_id"`
+	EventID      id.EventID           `json:"event_id"`
+	Sender       types.JID            `json:"sender"`
+	SenderMXID   id.UserID            `json:"sender_mxid,omitempty"`
+	Timestamp    int64                `json:"timestamp"`
+	Type         database.MessageType `json:"type"`
+	GalleryPart  int                  `json:"gallery_part,omitempty"`
+}
+
+// ExportMessageMap exports the message ID mapping of all portals, or a single portal if the room_id query param is set.
+func (prov *ProvisioningAPI) ExportMessageMap(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var portals []*database.Portal
+	var err error
+	if roomID := id.RoomID(r.URL.Query().Get("room_id")); roomID != "" {
+		var portal *database.Portal
+		portal, err = prov.bridge.DB.Portal.GetByMXID(ctx, roomID)
+		if err == nil && portal == nil {
+			jsonResponse(w, http.StatusNotFound, Error{
+				Error:   "Room is not a portal",
+				ErrCode: "M_NOT_FOUND",
+			})
+			return
+		}
+		portals = []*database.Portal{portal}
+	} else {
+		portals, err = prov.bridge.DB.Portal.GetAll(ctx)
+	}
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get portals for message map export")
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Internal server error while fetching portals",
+			ErrCode: "M_UNKNOWN",
+		})
+		return
+	}
+	export := MessageMap{Version: messageMapVersion, Messages: []MessageMapEntry{}}
+	for _, portal := range portals {
+		messages, err := prov.bridge.DB.Message.GetAll(ctx, portal.Key)
+		if err != nil {
+			hlog.FromRequest(r).Err(err).Stringer("portal_key", portal.Key).Msg("Failed to get messages for message map export")
+			jsonResponse(w, http.StatusInternalServerError, Error{
+				Error:   "Internal server error while fetching messages",
+				ErrCode: "M_UNKNOWN",
+			})
+			return
+		}
+		for _, msg := range messages {
+			if msg.IsFakeMXID() {
+				continue
+			}
+			export.Messages = append(export.Messages, MessageMapEntry{
+				ChatJID:      msg.Chat.JID,
+				ChatReceiver: msg.Chat.Receiver,
+				RoomID:       portal.MXID,
+				MessageID:    msg.JID,
+				EventID:      msg.MXID,
+				Sender:       msg.Sender,
+				SenderMXID:   msg.SenderMXID,
+				Timestamp:    msg.Timestamp.Unix(),
+				Type:         msg.Type,
+				GalleryPart:  msg.GalleryPart,
+			})
+		}
+	}
+	jsonResponse(w, http.StatusOK, export)
+}
+
+// ImportMessageMap imports a message ID mapping exported with ExportMessageMap.
+// Entries whose portal doesn't exist or whose message or event ID is already mapped are skipped.
+func (prov *ProvisioningAPI) ImportMessageMap(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := hlog.FromRequest(r)
+	var data MessageMap
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Failed to parse request body",
+			ErrCode: "M_BAD_JSON",
+		})
+		return
+	} else if data.Version != messageMapVersion {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   fmt.Sprintf("Unsupported message map version %d", data.Version),
+			ErrCode: "M_BAD_JSON",
+		})
+		return
+	}
+	var imported, skipped int
+	existingPortals := make(map[database.PortalKey]bool)
+	for _, entry := range data.Messages {
+		key := database.PortalKey{JID: entry.ChatJID, Receiver: entry.ChatReceiver}
+		portalExists, ok := existingPortals[key]
+		if !ok {
+			portal, err := prov.bridge.DB.Portal.GetByJID(ctx, key)
+			if err != nil {
+				log.Err(err).Stringer("portal_key", key).Msg("Failed to get portal for message map import")
+			}
+			portalExists = portal != nil
+			existingPortals[key] = portalExists
+		}
+		if !portalExists || entry.MessageID == "" || entry.EventID == "" {
+			skipped++
+			continue
+		}
+		existing, err := prov.bridge.DB.Message.GetByJID(ctx, key, entry.MessageID)
+		if err == nil && existing == nil && entry.GalleryPart == 0 {
+			existing, err = prov.bridge.DB.Message.GetByMXID(ctx, entry.EventID)
+		}
+		if err != nil || existing != nil {
+			skipped++
+			continue
+		}
+		msg := prov.bridge.DB.Message.New()
+		msg.Chat = key
+		msg.JID = entry.MessageID
+		msg.MXID = entry.EventID
+		msg.Sender = entry.Sender
+		msg.SenderMXID = entry.SenderMXID
+		msg.Timestamp = time.Unix(entry.Timestamp, 0)
+		msg.Sent = true
+		msg.Type = entry.Type
+		msg.GalleryPart = entry.GalleryPart
+		err = msg.Insert(ctx)
+		if err != nil {
+			log.Err(err).
+				Stringer("portal_key", key).
+				Str("message_id", entry.MessageID).
+				Msg("Failed to insert imported message mapping")
+			skipped++
+		} else {
+			imported++
+		}
+	}
+	log.Info().Int("imported", imported).Int("skipped", skipped).Msg("Imported message map")
+	jsonResponse(w, http.StatusOK, map[string]any{
+		"success":  true,
+		"imported": imported,
+		"skipped":  skipped,
+	})
+}
@@ -344,6 +344,10 @@ func (puppet *Puppet) updatePortalAvatar(ctx context.Context) {
 
 func (puppet *Puppet) updatePortalName(ctx context.Context) {
 	puppet.updatePortalMeta(func(portal *Portal) {
+		if portal.IsNoteToSelf() {
+			// The notes room has a fixed name rather than the user's own name
+			return
+		}
 		portal.UpdateName(ctx, puppet.Displayname, types.EmptyJID, true)
 	})
 }
@@ -0,0 +1,122 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow"
+
+	"maunium.net/go/mautrix/bridge/status"
+)
+
+// reconnectDelay returns the exponential backoff delay for the given reconnect attempt, with random jitter applied.
+func (br *WABridge) reconnectDelay(attempt int) time.Duration {
+	cfg := br.Config.Bridge.Reconnect
+	delay := time.Duration(cfg.InitialDelay) * time.Second
+	maxDelay := time.Duration(cfg.MaxDelay) * time.Second
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	if cfg.Jitter > 0 && delay > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * cfg.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// reconnectWithBackoff reconnects the current WhatsApp client after an unexpected disconnection.
+// The automatic reconnection in whatsmeow is disabled so that the delay between attempts can be configured.
+// That also disables whatsmeow's forced reconnect after keepalive failures, which checkConnectionHealth replaces.
+func (user *User) reconnectWithBackoff(ctx context.Context) {
+	if !user.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	defer user.reconnecting.Store(false)
+	log := zerolog.Ctx(ctx)
+	client := user.Client
+	for attempt := 0; ; attempt++ {
+		delay := user.bridge.reconnectDelay(attempt)
+		log.Debug().Int("attempt", attempt+1).Dur("delay", delay).Msg("Reconnecting to WhatsApp after delay")
+		time.Sleep(delay)
+		if client == nil || user.Client != client || client.Store.ID == nil {
+			log.Debug().Msg("Client was replaced or logged out, stopping reconnect loop")
+			return
+		}
+		err := client.Connect()
+		if err == nil || errors.Is(err, whatsmeow.ErrAlreadyConnected) {
+			return
+		}
+		log.Warn().Err(err).Int("attempt", attempt+1).Msg("Failed to reconnect to WhatsApp")
+		user.bridge.Metrics.TrackConnectionFailure("reconnect-failed")
+	}
+}
+
+// cycleConnection throws away the current WhatsApp client and creates a new one.
+func (user *User) cycleConnection(ctx context.Context, reason string) {
+	zerolog.Ctx(ctx).Warn().Str("reason", reason).Msg("WhatsApp connection seems to be dead, forcing reconnect")
+	user.bridge.Metrics.TrackConnectionFailure("zombie-" + reason)
+	user.lastEventReceived.Store(time.Now().UnixMilli())
+	user.keepAliveFailingSince.Store(0)
+	user.DeleteConnection()
+	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: WADisconnected})
+	user.Connect()
+}
+
+// checkConnectionHealth detects connections that are still open, but don't receive anything
+// (e.g. keepalives timing out for a long time), and forcibly reconnects them.
+func (user *User) checkConnectionHealth(ctx context.Context) {
+	if !user.IsConnected() || user.reconnecting.Load() {
+		return
+	}
+	cfg := user.bridge.Config.Bridge.Reconnect
+	now := time.Now()
+	failingSince := user.keepAliveFailingSince.Load()
+	lastEvent := user.lastEventReceived.Load()
+	if cfg.KeepaliveTimeout > 0 && failingSince != 0 &&
+		now.Sub(time.UnixMilli(failingSince)) > time.Duration(cfg.KeepaliveTimeout)*time.Second {
+		user.cycleConnection(ctx, "keepalive")
+	} else if cfg.IdleTimeout > 0 && lastEvent != 0 &&
+		now.Sub(time.UnixMilli(lastEvent)) > time.Duration(cfg.IdleTimeout)*time.Second {
+		user.cycleConnection(ctx, "idle")
+	}
+}
+
+func (br *WABridge) ConnectionHealthLoop() {
+	interval := time.Duration(br.Config.Bridge.Reconnect.HealthCheckInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		br.usersLock.Lock()
+		users := make([]*User, 0, len(br.usersByUsername))
+		for _, user := range br.usersByUsername {
+			users = append(users, user)
+		}
+		br.usersLock.Unlock()
+		for _, user := range users {
+			user.checkConnectionHealth(user.zlog.With().Str("action", "connection health check").Logger().WithContext(context.TODO()))
+		}
+	}
+}
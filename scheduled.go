@@ -0,0 +1,374 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// ScheduledSendKey is the custom event content field that can be used to ask the bridge to send a message later.
+// The value is a unix timestamp in milliseconds.
+const ScheduledSendKey = "fi.mau.whatsapp.scheduled_send"
+
+// scheduledMessageMaxSleep is the maximum time the scheduler sleeps before checking the database again.
+const scheduledMessageMaxSleep = 1 * time.Hour
+
+const scheduleTimeFormat = "2006-01-02 15:04 MST"
+
+var errScheduleTimeInPast = errors.New("time is in the past")
+
+// getScheduledSendTime returns the time when the given event was requested to be sent,
+// or a zero time if it should be sent immediately.
+func getScheduledSendTime(evt *event.Event) time.Time {
+	ts, ok := evt.Content.Raw[ScheduledSendKey].(float64)
+	if !ok || ts <= 0 {
+		return time.Time{}
+	}
+	sendAt := time.UnixMilli(int64(ts))
+	if time.Until(sendAt) < 5*time.Second {
+		return time.Time{}
+	}
+	return sendAt
+}
+
+// scheduleMatrixMessage stores a Matrix event to be sent to WhatsApp at the given time.
+func (portal *Portal) scheduleMatrixMessage(ctx context.Context, sender *User, evt *event.Event, sendAt time.Time) error {
+	content, err := marshalStoredContent(evt, ScheduledSendKey)
+	if err != nil {
+		return err
+	}
+	msg := portal.bridge.DB.ScheduledMessage.New()
+	msg.EventID = evt.ID
+	msg.RoomID = portal.MXID
+	msg.Portal = portal.Key
+	msg.Sender = sender.MXID
+	msg.EventType = evt.Type.Type
+	msg.Content = content
+	msg.SendAt = sendAt
+	err = msg.Insert(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save scheduled message: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().Time("send_at", sendAt).Msg("Scheduled message to be sent later")
+	portal.bridge.wakeScheduledMessageLoop()
+	portal.sendScheduledStatusEvent(ctx, sender, evt.ID, sendAt)
+	return nil
+}
+
+// sendScheduledStatusEvent marks a scheduled message as pending until it's actually sent.
+func (portal *Portal) sendScheduledStatusEvent(ctx context.Context, sender *User, evtID id.EventID, sendAt time.Time) {
+	if !portal.bridge.Config.Bridge.MessageStatusEvents {
+		return
+	}
+	loc, err := time.LoadLocation(sender.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	content := event.BeeperMessageStatusEventContent{
+		Network: portal.getBridgeInfoStateKey(),
+		RelatesTo: event.RelatesTo{
+			Type:    event.RelReference,
+			EventID: evtID,
+		},
+		Status:  event.MessageStatusPending,
+		Message: fmt.Sprintf("Scheduled to be sent at %s", sendAt.In(loc).Format(scheduleTimeFormat)),
+	}
+	_, err = portal.statusIntent().SendMessageEvent(ctx, portal.MXID, event.BeeperMessageStatus, &content)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to send pending status for scheduled message")
+	}
+}
+
+// sendScheduledMessageEcho sends a message scheduled with the schedule command to the room, so that the message
+// has its own event that replies and edits from WhatsApp can be mapped to once it's sent. The message is sent with
+// the user's double puppet if possible, and as a notice from the bridge otherwise.
+func (portal *Portal) sendScheduledMessageEcho(ctx context.Context, sender *User, content *event.MessageEventContent) (id.EventID, error) {
+	if puppet := portal.bridge.GetPuppetByCustomMXID(sender.MXID); puppet != nil && puppet.CustomIntent() != nil {
+		resp, err := portal.sendMessage(ctx, puppet.CustomIntent(), event.EventMessage, content, nil, 0)
+		if err != nil {
+			return "", err
+		}
+		return resp.EventID, nil
+	}
+	notice := format.RenderMarkdown(fmt.Sprintf("Scheduled message from %s:\n\n%s", sender.MXID, content.Body), true, false)
+	notice.MsgType = event.MsgNotice
+	resp, err := portal.sendMessage(ctx, portal.statusIntent(), event.EventMessage, &notice, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+func (br *WABridge) wakeScheduledMessageLoop() {
+	select {
+	case br.scheduledMessageWake <- struct{}{}:
+	default:
+	}
+}
+
+// ScheduledMessageLoop sends scheduled messages once their send time is reached.
+// The messages are stored in the database, so they survive bridge restarts.
+func (br *WABridge) ScheduledMessageLoop() {
+	log := br.ZLog.With().Str("action", "scheduled message loop").Logger()
+	ctx := log.WithContext(context.Background())
+	for {
+		br.sendDueScheduledMessages(ctx)
+		sleep := scheduledMessageMaxSleep
+		next, err := br.DB.ScheduledMessage.GetNextSendTime(ctx)
+		if err != nil {
+			log.Err(err).Msg("Failed to get next scheduled message time")
+		} else if !next.IsZero() {
+			sleep = max(min(time.Until(next), sleep), 0)
+		}
+		select {
+		case <-time.After(sleep):
+		case <-br.scheduledMessageWake:
+		}
+	}
+}
+
+func (br *WABridge) sendDueScheduledMessages(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	msgs, err := br.DB.ScheduledMessage.GetDue(ctx, time.Now())
+	if err != nil {
+		log.Err(err).Msg("Failed to get due scheduled messages")
+		return
+	}
+	for _, msg := range msgs {
+		// Delete the message first to avoid sending it twice if something goes wrong
+		err = msg.Delete(ctx)
+		if err != nil {
+			log.Err(err).Stringer("event_id", msg.EventID).Msg("Failed to delete scheduled message, not sending it")
+			continue
+		}
+		br.sendScheduledMessage(ctx, msg)
+	}
+}
+
+func (br *WABridge) sendScheduledMessage(ctx context.Context, msg *database.ScheduledMessage) {
+	log := zerolog.Ctx(ctx).With().
+		Stringer("event_id", msg.EventID).
+		Stringer("sender", msg.Sender).
+		Stringer("portal_jid", msg.Portal.JID).
+		Logger()
+	portal := br.GetExistingPortalByJID(msg.Portal)
+	user := br.GetUserByMXIDIfExists(msg.Sender)
+	if portal == nil || portal.MXID != msg.RoomID {
+		log.Warn().Msg("Portal of scheduled message no longer exists, dropping message")
+		return
+	} else if user == nil {
+		log.Warn().Msg("Sender of scheduled message not found, dropping message")
+		return
+	}
+	evt, err := makeStoredEvent(msg.EventID, msg.RoomID, msg.Sender, msg.EventType, msg.Content)
+	if err != nil {
+		log.Err(err).Msg("Failed to parse scheduled message content")
+		return
+	}
+	log.Debug().Time("scheduled_time", msg.SendAt).Msg("Sending scheduled message")
+	portal.ReceiveMatrixEvent(user, evt)
+}
+
+// marshalStoredContent serializes the content of a Matrix event for storing it in the database,
+// leaving out the given keys.
+func marshalStoredContent(evt *event.Event, skipKeys ...string) (json.RawMessage, error) {
+	raw := make(map[string]any, len(evt.Content.Raw))
+	for key, value := range evt.Content.Raw {
+		if !slices.Contains(skipKeys, key) {
+			raw[key] = value
+		}
+	}
+	content, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal content: %w", err)
+	}
+	return content, nil
+}
+
+// makeStoredEvent recreates a Matrix event that was stored in the database to be sent later.
+// The timestamp is set to the current time, so that it isn't treated as a message that timed out.
+func makeStoredEvent(eventID id.EventID, roomID id.RoomID, sender id.UserID, evtType string, content json.RawMessage) (*event.Event, error) {
+	evt := &event.Event{
+		Sender:    sender,
+		Type:      event.Type{Type: evtType, Class: event.MessageEventType},
+		Timestamp: time.Now().UnixMilli(),
+		ID:        eventID,
+		RoomID:    roomID,
+		Content:   event.Content{VeryRaw: content},
+	}
+	err := evt.Content.ParseRaw(evt.Type)
+	if err != nil {
+		return nil, err
+	}
+	evt.Mautrix.ReceivedAt = time.Now()
+	return evt, nil
+}
+
+// parseScheduleTime parses a time for the schedule command. It accepts durations like 1h30m,
+// times of day like 18:00 (which refer to the next occurrence) and full dates like 2006-01-02T15:04.
+func parseScheduleTime(input string, now time.Time, loc *time.Location) (time.Time, error) {
+	if dur, err := time.ParseDuration(input); err == nil {
+		if dur <= 0 {
+			return time.Time{}, errScheduleTimeInPast
+		}
+		return now.Add(dur), nil
+	}
+	localNow := now.In(loc)
+	if ts, err := time.ParseInLocation("15:04", input, loc); err == nil {
+		sendAt := time.Date(localNow.Year(), localNow.Month(), localNow.Day(), ts.Hour(), ts.Minute(), 0, 0, loc)
+		if !sendAt.After(now) {
+			sendAt = sendAt.AddDate(0, 0, 1)
+		}
+		return sendAt, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04"} {
+		if ts, err := time.ParseInLocation(layout, input, loc); err == nil {
+			if !ts.After(now) {
+				return time.Time{}, errScheduleTimeInPast
+			}
+			return ts, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", input)
+}
+
+var cmdSchedule = &commands.FullHandler{
+	Func: wrapCommand(fnSchedule),
+	Name: "schedule",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Send a message to this chat later. The time can be a duration (`1h30m`), a time of day (`18:00`) or a date (`2006-01-02T15:04`). Use `list` to see scheduled messages and `cancel` to remove one.",
+		Args:        "<_time_> <_message_> | list | cancel <_event ID_>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+const scheduleUsage = "**Usage:** `schedule <time> <message>`, `schedule list` or `schedule cancel <event ID>`"
+
+func fnSchedule(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply(scheduleUsage)
+		return
+	}
+	loc, err := time.LoadLocation(ce.User.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "list":
+		msgs, err := ce.Bridge.DB.ScheduledMessage.GetAllByRoom(ce.Ctx, ce.RoomID)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to get scheduled messages")
+			ce.Reply("Failed to get scheduled messages: %v", err)
+			return
+		} else if len(msgs) == 0 {
+			ce.Reply("There are no scheduled messages in this chat")
+			return
+		}
+		lines := make([]string, len(msgs))
+		for i, msg := range msgs {
+			lines[i] = fmt.Sprintf("* %s: [%s](%s)", msg.SendAt.In(loc).Format(scheduleTimeFormat), msg.EventID, msg.RoomID.EventURI(msg.EventID).MatrixToURL())
+		}
+		ce.Reply("Scheduled messages:\n\n%s", strings.Join(lines, "\n"))
+	case "cancel":
+		if len(ce.Args) < 2 {
+			ce.Reply(scheduleUsage)
+			return
+		}
+		msg, err := ce.Bridge.DB.ScheduledMessage.GetByEventID(ce.Ctx, id.EventID(ce.Args[1]))
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to get scheduled message")
+			ce.Reply("Failed to get scheduled message: %v", err)
+			return
+		} else if msg == nil || msg.RoomID != ce.RoomID {
+			// Messages in other rooms are treated as nonexistent to avoid leaking their existence
+			ce.Reply("There is no scheduled message with that ID in this chat")
+			return
+		} else if msg.Sender != ce.User.MXID && !ce.User.Admin {
+			ce.Reply("You can only cancel your own scheduled messages")
+			return
+		}
+		err = msg.Delete(ce.Ctx)
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to delete scheduled message")
+			ce.Reply("Failed to cancel scheduled message: %v", err)
+		} else {
+			_, err = ce.Portal.statusIntent().RedactEvent(ce.Ctx, ce.RoomID, msg.EventID, mautrix.ReqRedact{Reason: "Scheduled message cancelled"})
+			if err != nil {
+				ce.ZLog.Warn().Err(err).Msg("Failed to redact cancelled scheduled message")
+			}
+			ce.Reply("Cancelled scheduled message %s", msg.EventID)
+		}
+	default:
+		if len(ce.Args) < 2 {
+			ce.Reply(scheduleUsage)
+			return
+		}
+		sendAt, err := parseScheduleTime(ce.Args[0], time.Now(), loc)
+		if err != nil {
+			ce.Reply("Invalid time: %v", err)
+			return
+		}
+		text := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(ce.RawArgs), ce.Args[0]))
+		content := format.RenderMarkdown(text, true, false)
+		evt := &event.Event{
+			Sender:  ce.User.MXID,
+			Type:    event.EventMessage,
+			RoomID:  ce.RoomID,
+			Content: event.Content{Parsed: &content},
+		}
+		evt.Content.Raw, err = contentToMap(&content)
+		if err == nil {
+			evt.ID, err = ce.Portal.sendScheduledMessageEcho(ce.Ctx, ce.User, &content)
+		}
+		if err == nil {
+			err = ce.Portal.scheduleMatrixMessage(ce.Ctx, ce.User, evt, sendAt)
+		}
+		if err != nil {
+			ce.ZLog.Err(err).Msg("Failed to schedule message")
+			ce.Reply("Failed to schedule message: %v", err)
+		} else {
+			ce.Reply("Message will be sent at %s", sendAt.In(loc).Format(scheduleTimeFormat))
+		}
+	}
+}
+
+func contentToMap(content any) (map[string]any, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	err = json.Unmarshal(data, &raw)
+	return raw, err
+}
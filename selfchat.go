@@ -0,0 +1,124 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+const selfChatHelp = "Available bridge commands:\n" +
+	"%[1]s status - show the bridge connection status\n" +
+	"%[1]s sync - resync contacts and groups\n" +
+	"%[1]s help - show this message"
+
+// isSelfChatCommand checks if the message was sent by the user from another device to their
+// "message yourself" chat and starts with the configured command prefix.
+func (user *User) isSelfChatCommand(evt *events.Message) bool {
+	cfg := user.bridge.Config.Bridge.SelfChatCommands
+	if !cfg.Enabled || cfg.Prefix == "" || !evt.Info.IsFromMe || evt.Info.IsGroup ||
+		evt.Info.Chat.Server != types.DefaultUserServer || evt.Info.Chat.User != user.JID.User ||
+		evt.Info.Sender.Device == user.JID.Device {
+		return false
+	}
+	text := getSelfChatText(evt.Message)
+	return text == cfg.Prefix || strings.HasPrefix(text, cfg.Prefix+" ")
+}
+
+func getSelfChatText(msg *waProto.Message) string {
+	if msg.GetConversation() != "" {
+		return strings.TrimSpace(msg.GetConversation())
+	}
+	return strings.TrimSpace(msg.GetExtendedTextMessage().GetText())
+}
+
+// handleSelfChatCommand runs a bridge command sent from the user's phone and replies in the same chat.
+func (user *User) handleSelfChatCommand(ctx context.Context, evt *events.Message) {
+	prefix := user.bridge.Config.Bridge.SelfChatCommands.Prefix
+	args := strings.Fields(strings.TrimPrefix(getSelfChatText(evt.Message), prefix))
+	command := "help"
+	if len(args) > 0 {
+		command = strings.ToLower(args[0])
+	}
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "handle self chat command").
+		Str("command", command).
+		Str("message_id", evt.Info.ID).
+		Logger()
+	ctx = log.WithContext(ctx)
+	log.Debug().Msg("Received bridge command in self chat")
+
+	var reply string
+	switch command {
+	case "status", "ping":
+		reply = user.formatSelfChatStatus()
+	case "sync":
+		reply = user.T("Resynced contacts and groups")
+		if err := user.ResyncContacts(false); err != nil {
+			log.Err(err).Msg("Failed to resync contacts")
+			reply = user.T("Failed to resync contacts: %v", err)
+		} else if err = user.ResyncGroups(false); err != nil {
+			log.Err(err).Msg("Failed to resync groups")
+			reply = user.T("Failed to resync groups: %v", err)
+		}
+	case "help":
+		reply = user.T(selfChatHelp, prefix)
+	default:
+		reply = user.T("Unknown command %q. Send \"%s help\" for a list of commands.", command, prefix)
+	}
+	user.sendSelfChatReply(ctx, evt, reply)
+}
+
+func (user *User) formatSelfChatStatus() string {
+	var lines []string
+	if user.Client != nil && user.Client.IsConnected() {
+		lines = append(lines, user.T("Bridge is connected as +%s (device #%d)", user.JID.User, user.JID.Device))
+	} else {
+		lines = append(lines, user.T("Bridge is not connected to WhatsApp"))
+	}
+	if state := user.BridgeState.GetPrev(); state.StateEvent != "" {
+		lines = append(lines, user.T("Bridge state: %s", state.StateEvent))
+	}
+	if !user.PhoneLastSeen.IsZero() {
+		lines = append(lines, user.T("Phone last seen %s ago", formatDisconnectTime(time.Since(user.PhoneLastSeen))))
+	}
+	lines = append(lines, user.T("Matrix account: %s", user.MXID))
+	return strings.Join(lines, "\n")
+}
+
+func (user *User) sendSelfChatReply(ctx context.Context, evt *events.Message, text string) {
+	_, err := user.Client.SendMessage(ctx, evt.Info.Chat.ToNonAD(), &waProto.Message{
+		ExtendedTextMessage: &waProto.ExtendedTextMessage{
+			Text: proto.String(text),
+			ContextInfo: &waProto.ContextInfo{
+				StanzaId:      proto.String(evt.Info.ID),
+				Participant:   proto.String(evt.Info.Sender.ToNonAD().String()),
+				QuotedMessage: evt.Message,
+			},
+		},
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to send reply to self chat command")
+	}
+}
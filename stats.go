@@ -0,0 +1,96 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+type bridgeStats struct {
+	Ghosts         int
+	GroupPortals   int
+	PrivatePortals int
+	OtherPortals   int
+	Users          int
+	LoggedIn       int
+	Connected      int
+}
+
+func (br *WABridge) collectStats(ctx context.Context) (*bridgeStats, error) {
+	var stats bridgeStats
+	err := br.DB.QueryRow(ctx, "SELECT COUNT(*) FROM puppet").Scan(&stats.Ghosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count ghosts: %w", err)
+	}
+	err = br.DB.QueryRow(ctx, `
+		SELECT
+			COUNT(CASE WHEN jid LIKE '%@g.us' THEN 1 END),
+			COUNT(CASE WHEN jid LIKE '%@s.whatsapp.net' THEN 1 END),
+			COUNT(CASE WHEN jid NOT LIKE '%@g.us' AND jid NOT LIKE '%@s.whatsapp.net' THEN 1 END)
+		FROM portal WHERE mxid<>''
+	`).Scan(&stats.GroupPortals, &stats.PrivatePortals, &stats.OtherPortals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count portals: %w", err)
+	}
+	err = br.DB.QueryRow(ctx, `SELECT COUNT(*) FROM "user" WHERE username<>''`).Scan(&stats.Users)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count users: %w", err)
+	}
+	br.usersLock.Lock()
+	for _, user := range br.usersByUsername {
+		if user.IsLoggedIn() {
+			stats.LoggedIn++
+		}
+		if user.IsConnected() {
+			stats.Connected++
+		}
+	}
+	br.usersLock.Unlock()
+	return &stats, nil
+}
+
+var cmdStats = &commands.FullHandler{
+	Func: wrapCommand(fnStats),
+	Name: "stats",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Show the number of ghost users, portals and logins on this bridge. Only available for bridge admins.",
+	},
+}
+
+func fnStats(ce *WrappedCommandEvent) {
+	if !ce.User.Admin {
+		ce.Reply("Only bridge admins can view bridge statistics")
+		return
+	}
+	stats, err := ce.Bridge.collectStats(ce.Ctx)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to collect bridge statistics")
+		ce.Reply("Failed to collect bridge statistics: %v", err)
+		return
+	}
+	ce.Reply("**Bridge statistics**\n\n"+
+		"* Ghost users: %d\n"+
+		"* Portals: %d (%d groups, %d private chats, %d other)\n"+
+		"* Logins: %d (%d logged in, %d connected)",
+		stats.Ghosts,
+		stats.GroupPortals+stats.PrivatePortals+stats.OtherPortals, stats.GroupPortals, stats.PrivatePortals, stats.OtherPortals,
+		stats.Users, stats.LoggedIn, stats.Connected)
+}
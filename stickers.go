@@ -0,0 +1,271 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+var (
+	StateRoomStickerPack  = event.Type{Type: "im.ponies.room_emotes", Class: event.StateEventType}
+	AccountDataUserEmotes = event.Type{Type: "im.ponies.user_emotes", Class: event.AccountDataEventType}
+
+	whatsAppStickerMetaStart = []byte(`{"sticker-pack-id"`)
+
+	errStickerExpired = errors.New("the sticker is no longer available on the WhatsApp servers")
+)
+
+const (
+	stickerPackStateKey     = "fi.mau.whatsapp.stickers"
+	defaultStickerPackLimit = 50
+	maxStickerPackLimit     = 200
+)
+
+type StickerPackImage struct {
+	URL   id.ContentURIString `json:"url"`
+	Body  string              `json:"body,omitempty"`
+	Info  *event.FileInfo     `json:"info,omitempty"`
+	Usage []string            `json:"usage,omitempty"`
+}
+
+type StickerPackMeta struct {
+	DisplayName string   `json:"display_name"`
+	Usage       []string `json:"usage"`
+}
+
+// StickerPackEventContent is the content of an MSC2545 room or user sticker pack.
+type StickerPackEventContent struct {
+	Pack   StickerPackMeta              `json:"pack"`
+	Images map[string]*StickerPackImage `json:"images"`
+}
+
+// parseStickerEmojis extracts the emojis a sticker is tagged with from the metadata
+// that WhatsApp stores as JSON in the EXIF chunk of sticker webp files.
+func parseStickerEmojis(data []byte) []string {
+	start := bytes.Index(data, whatsAppStickerMetaStart)
+	if start < 0 {
+		return nil
+	}
+	var meta struct {
+		Emojis []string `json:"emojis"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(data[start:])).Decode(&meta); err != nil {
+		return nil
+	}
+	return meta.Emojis
+}
+
+// storeRecentStickers saves the user's recently used WhatsApp stickers from a history sync, so that they can later
+// be imported into a Matrix sticker pack. Only the metadata is stored, the files are downloaded when importing.
+func (user *User) storeRecentStickers(ctx context.Context, stickers []*waProto.StickerMetadata) {
+	if !user.bridge.Config.Bridge.HistorySync.RecentStickers || len(stickers) == 0 {
+		return
+	}
+	log := zerolog.Ctx(ctx)
+	for _, meta := range stickers {
+		if len(meta.GetFileSha256()) == 0 || meta.GetDirectPath() == "" {
+			continue
+		}
+		sticker := user.bridge.DB.RecentSticker.New()
+		sticker.UserMXID = user.MXID
+		sticker.FileSHA256 = hex.EncodeToString(meta.GetFileSha256())
+		sticker.DirectPath = meta.GetDirectPath()
+		sticker.MediaKey = meta.GetMediaKey()
+		sticker.FileEncSHA256 = meta.GetFileEncSha256()
+		sticker.FileLength = int64(meta.GetFileLength())
+		sticker.MimeType = meta.GetMimetype()
+		sticker.Width = int(meta.GetWidth())
+		sticker.Height = int(meta.GetHeight())
+		sticker.LastUsed = time.UnixMilli(meta.GetLastStickerSentTs())
+		err := sticker.Upsert(ctx)
+		if err != nil {
+			log.Err(err).Str("file_sha256", sticker.FileSHA256).Msg("Failed to save recent sticker")
+		}
+	}
+	err := user.bridge.DB.RecentSticker.Prune(ctx, user.MXID, maxStickerPackLimit)
+	if err != nil {
+		log.Err(err).Msg("Failed to prune recent stickers")
+	}
+	log.Debug().Int("sticker_count", len(stickers)).Msg("Stored recent stickers from history sync")
+}
+
+// uploadRecentSticker downloads a recent sticker from WhatsApp and uploads it to Matrix, unless it has been uploaded
+// by an earlier import already. Sticker packs can't reference encrypted files, so the copy is always unencrypted.
+func (user *User) uploadRecentSticker(ctx context.Context, sticker *database.RecentSticker) error {
+	if sticker.MXC != "" {
+		return nil
+	}
+	fileHash, err := hex.DecodeString(sticker.FileSHA256)
+	if err != nil {
+		return fmt.Errorf("invalid file hash: %w", err)
+	}
+	data, err := user.Client.DownloadMediaWithPath(sticker.DirectPath, sticker.FileEncSHA256, fileHash, sticker.MediaKey, int(sticker.FileLength), whatsmeow.MediaImage, "")
+	if errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith403) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410) {
+		// The direct paths from the history sync expire after a while, and there's no way to refresh them
+		return fmt.Errorf("%w (%w)", errStickerExpired, err)
+	} else if err != nil {
+		return fmt.Errorf("failed to download sticker: %w", err)
+	}
+	uploaded, err := user.bridge.Bot.UploadBytes(ctx, data, sticker.MimeType)
+	if err != nil {
+		return fmt.Errorf("failed to upload sticker: %w", err)
+	}
+	return sticker.SetUploaded(ctx, uploaded.ContentURI.CUString(), parseStickerEmojis(data))
+}
+
+var cmdStickers = &commands.FullHandler{
+	Func: wrapCommand(fnStickers),
+	Name: "stickers",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Import your recently used WhatsApp stickers as a sticker pack in this room. With `--user`, the stickers are added to your personal sticker pack instead.",
+		Args:        "import [_limit_] [--user]",
+	},
+	RequiresLogin: true,
+}
+
+// stickerPackImageKey returns a stable shortcode for the sticker, so that importing again doesn't add duplicates.
+func stickerPackImageKey(sticker *database.RecentSticker) string {
+	return "whatsapp_" + sticker.FileSHA256[:min(len(sticker.FileSHA256), 16)]
+}
+
+func fnStickers(ce *WrappedCommandEvent) {
+	if !ce.Bridge.Config.Bridge.HistorySync.RecentStickers {
+		ce.Reply("Syncing recent stickers is not enabled on this bridge")
+		return
+	}
+	if len(ce.Args) == 0 || strings.ToLower(ce.Args[0]) != "import" {
+		ce.Reply("**Usage:** `stickers import [limit] [--user]`")
+		return
+	}
+	limit := defaultStickerPackLimit
+	toUser := false
+	for _, arg := range ce.Args[1:] {
+		if arg == "--user" {
+			toUser = true
+		} else if parsed, err := strconv.Atoi(arg); err == nil && parsed > 0 {
+			limit = min(parsed, maxStickerPackLimit)
+		} else {
+			ce.Reply("**Usage:** `stickers import [limit] [--user]`")
+			return
+		}
+	}
+	stickers, err := ce.Bridge.DB.RecentSticker.GetRecent(ce.Ctx, ce.User.MXID, limit)
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to get recent stickers")
+		ce.Reply("Failed to get recent stickers from the database")
+		return
+	} else if len(stickers) == 0 {
+		ce.Reply("No recent stickers have been synced from WhatsApp yet")
+		return
+	}
+	content := &StickerPackEventContent{
+		Pack: StickerPackMeta{
+			DisplayName: "WhatsApp stickers",
+			Usage:       []string{"sticker"},
+		},
+		Images: make(map[string]*StickerPackImage, len(stickers)),
+	}
+	imported, expired, failed := 0, 0, 0
+	for _, sticker := range stickers {
+		err = ce.User.uploadRecentSticker(ce.Ctx, sticker)
+		if errors.Is(err, errStickerExpired) {
+			ce.ZLog.Debug().Err(err).Str("file_sha256", sticker.FileSHA256).Msg("Recent sticker has expired")
+			expired++
+			continue
+		} else if err != nil {
+			ce.ZLog.Warn().Err(err).Str("file_sha256", sticker.FileSHA256).Msg("Failed to import sticker")
+			failed++
+			continue
+		}
+		content.Images[stickerPackImageKey(sticker)] = &StickerPackImage{
+			URL:  sticker.MXC,
+			Body: strings.Join(sticker.Emojis, " "),
+			Info: &event.FileInfo{
+				MimeType: sticker.MimeType,
+				Width:    sticker.Width,
+				Height:   sticker.Height,
+			},
+		}
+		imported++
+	}
+	var failureNote string
+	if expired > 0 {
+		failureNote += fmt.Sprintf("\n\n%d stickers couldn't be downloaded because they're no longer available on the WhatsApp servers. "+
+			"The list of recent stickers is only refreshed when WhatsApp sends a new history sync, e.g. after logging in again.", expired)
+	}
+	if failed > 0 {
+		failureNote += fmt.Sprintf("\n\n%d stickers failed to import, check the bridge logs for details.", failed)
+	}
+	if imported == 0 {
+		ce.Reply("Failed to import any of your recent stickers from WhatsApp.%s", failureNote)
+		return
+	}
+	if toUser {
+		customPuppet := ce.Bridge.GetPuppetByCustomMXID(ce.User.MXID)
+		if customPuppet == nil || customPuppet.CustomIntent() == nil {
+			ce.Reply("Importing stickers to your account requires double puppeting")
+			return
+		}
+		// Merge into the existing personal pack, so that stickers from other sources aren't removed
+		var existing StickerPackEventContent
+		err = customPuppet.CustomIntent().GetAccountData(ce.Ctx, AccountDataUserEmotes.Type, &existing)
+		if err != nil && !errors.Is(err, mautrix.MNotFound) {
+			ce.ZLog.Err(err).Msg("Failed to get existing personal sticker pack")
+			ce.Reply("Failed to get your existing sticker pack: %v", err)
+			return
+		}
+		if existing.Images != nil {
+			for key, img := range content.Images {
+				existing.Images[key] = img
+			}
+			content.Images = existing.Images
+		}
+		if existing.Pack.DisplayName != "" {
+			content.Pack = existing.Pack
+		}
+		err = customPuppet.CustomIntent().SetAccountData(ce.Ctx, AccountDataUserEmotes.Type, content)
+	} else if ce.Portal != nil {
+		_, err = ce.Portal.MainIntent().SendStateEvent(ce.Ctx, ce.Portal.MXID, StateRoomStickerPack, stickerPackStateKey, content)
+	} else {
+		_, err = ce.Bot.SendStateEvent(ce.Ctx, ce.RoomID, StateRoomStickerPack, stickerPackStateKey, content)
+	}
+	if err != nil {
+		ce.ZLog.Err(err).Msg("Failed to save sticker pack")
+		ce.Reply("Failed to save sticker pack: %v", err)
+		return
+	}
+	ce.Reply("Imported %d stickers%s", imported, failureNote)
+}
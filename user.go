@@ -30,6 +30,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -52,6 +53,7 @@ import (
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/pushrules"
 
+	"maunium.net/go/mautrix-whatsapp/config"
 	"maunium.net/go/mautrix-whatsapp/database"
 )
 
@@ -72,8 +74,9 @@ type User struct {
 	spaceCreateLock sync.Mutex
 	connLock        sync.Mutex
 
-	historySyncs chan *events.HistorySync
-	lastPresence types.Presence
+	historySyncs     chan *events.HistorySync
+	lastPresence     types.Presence
+	lastPresenceLock sync.Mutex
 
 	mediaRetryLock *semaphore.Weighted
 
@@ -81,6 +84,10 @@ type User struct {
 	enqueueBackfillsTimer   *time.Timer
 	spaceMembershipChecked  bool
 	lastPhoneOfflineWarning time.Time
+	connAlerts              connectionAlerts
+
+	ignoredJIDs     map[types.JID]struct{}
+	ignoredJIDsLock sync.Mutex
 
 	groupListCache     []*types.GroupInfo
 	groupListCacheLock sync.Mutex
@@ -96,6 +103,23 @@ type User struct {
 	createKeyDedup       string
 	skipGroupCreateDelay types.JID
 	groupJoinLock        sync.Mutex
+
+	portalCreateLock sync.Mutex
+	lastPortalCreate time.Time
+
+	lastSyncedMatrixAvatar     id.ContentURI
+	lastSyncedMatrixAvatarLock sync.Mutex
+	lastSyncedMatrixName       string
+	lastSyncedMatrixNameLock   sync.Mutex
+
+	offlineQueueLock     sync.Mutex
+	offlineQueueFlushing bool
+
+	reconnecting          atomic.Bool
+	createdContactPortals atomic.Bool
+	subscribedPresence    atomic.Bool
+	lastEventReceived     atomic.Int64
+	keepAliveFailingSince atomic.Int64
 }
 
 type resyncQueueItem struct {
@@ -387,6 +411,7 @@ func (user *User) doPuppetResync() {
 			contactPtr = &contact
 		}
 		puppet.Sync(ctx, user, contactPtr, info.PictureID != "" && info.PictureID != puppet.Avatar, true)
+		user.syncAbout(ctx, puppet, info.Status)
 	}
 }
 
@@ -537,6 +562,7 @@ func (user *User) obfuscateJID(jid types.JID) string {
 func (user *User) createClient(sess *store.Device) {
 	user.Client = whatsmeow.NewClient(sess, waLog.Zerolog(user.zlog.With().Str("component", "whatsmeow").Logger()))
 	user.Client.AddEventHandler(user.HandleEvent)
+	user.Client.EnableAutoReconnect = false
 	user.Client.SetForceActiveDeliveryReceipts(user.bridge.Config.Bridge.ForceActiveDeliveryReceipts)
 	user.Client.AutomaticMessageRerequestFromPhone = true
 	user.Client.GetMessageForRetry = func(requester, to types.JID, id types.MessageID) *waProto.Message {
@@ -674,7 +700,7 @@ func (user *User) sendMarkdownBridgeAlert(ctx context.Context, formatString stri
 	if user.bridge.Config.Bridge.DisableBridgeAlerts {
 		return
 	}
-	notice := fmt.Sprintf(formatString, args...)
+	notice := user.T(formatString, args...)
 	content := format.RenderMarkdown(notice, true, false)
 	_, err := user.bridge.Bot.SendMessageEvent(ctx, user.GetManagementRoom(ctx), event.EventMessage, content)
 	if err != nil {
@@ -682,6 +708,39 @@ func (user *User) sendMarkdownBridgeAlert(ctx context.Context, formatString stri
 	}
 }
 
+// rerequestUndecryptableMessages asks the phone to resend recent messages that are still undecryptable,
+// which fills the gaps left by messages received while the encryption session was broken.
+func (user *User) rerequestUndecryptableMessages(ctx context.Context) {
+	cfg := user.bridge.Config.Bridge.UndecryptableRerequest
+	if cfg.Window <= 0 || cfg.MaxMessages <= 0 || user.ReadOnly {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Str("action", "rerequest undecryptable messages").Logger()
+	since := time.Now().Add(-time.Duration(cfg.Window) * time.Second)
+	msgs, err := user.bridge.DB.Message.GetUndecryptableSince(ctx, user.MXID, since, cfg.MaxMessages)
+	if err != nil {
+		log.Err(err).Msg("Failed to get undecryptable messages from database")
+		return
+	} else if len(msgs) == 0 {
+		return
+	}
+	log.Info().Int("message_count", len(msgs)).Msg("Requesting undecryptable messages from phone")
+	for _, msg := range msgs {
+		portal := user.GetPortalByJID(msg.Chat.JID)
+		if portal == nil || portal.Key != msg.Chat {
+			continue
+		} else if _, alreadyPending := portal.pendingDecryptRetries.Load(msg.JID); alreadyPending {
+			continue
+		}
+		err = portal.RequestUnavailableMessage(log.WithContext(ctx), user, msg, false)
+		if err != nil {
+			log.Warn().Err(err).Str("message_id", msg.JID).Msg("Failed to request undecryptable message")
+		} else if err = msg.MarkRerequested(ctx); err != nil {
+			log.Warn().Err(err).Str("message_id", msg.JID).Msg("Failed to mark undecryptable message as requested")
+		}
+	}
+}
+
 const callEventMaxAge = 15 * time.Minute
 
 func (user *User) handleCallStart(sender types.JID, id, callType string, ts time.Time) {
@@ -689,10 +748,11 @@ func (user *User) handleCallStart(sender types.JID, id, callType string, ts time
 		return
 	}
 	portal := user.GetPortalByJID(sender)
-	text := "Incoming call. Use the WhatsApp app to answer."
+	text := user.T("Incoming call. Use the WhatsApp app to answer.")
 	if callType != "" {
-		text = fmt.Sprintf("Incoming %s call. Use the WhatsApp app to answer.", callType)
+		text = user.T("Incoming %s call. Use the WhatsApp app to answer.", user.T(callType))
 	}
+	text = user.bridge.Config.Bridge.FormatNotice("call_start", text, map[string]any{"CallType": callType})
 	portal.events <- &PortalEvent{
 		Message: &PortalMessage{
 			fake: &fakeMessage{
@@ -710,8 +770,27 @@ func (user *User) handleCallStart(sender types.JID, id, callType string, ts time
 const PhoneDisconnectWarningTime = 12 * 24 * time.Hour // 12 days
 const PhoneDisconnectPingTime = 10 * 24 * time.Hour
 const PhoneMinPingInterval = 24 * time.Hour
+const PhoneOfflineWarningInterval = 12 * time.Hour
+
+func hoursOrDefault(hours int, defaultVal time.Duration) time.Duration {
+	if hours <= 0 {
+		return defaultVal
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// phoneOfflineThresholds returns the configured time after which the phone is considered offline
+// and the time after which the bridge tries to wake it up with a ping.
+func (br *WABridge) phoneOfflineThresholds() (warning, ping time.Duration) {
+	cfg := br.Config.Bridge.PhoneOffline
+	return hoursOrDefault(cfg.WarningAfter, PhoneDisconnectWarningTime), hoursOrDefault(cfg.PingAfter, PhoneDisconnectPingTime)
+}
 
 func (user *User) sendHackyPhonePing(ctx context.Context) {
+	if user.ReadOnly {
+		user.zlog.Debug().Msg("Not sending hacky phone ping as the login is in read-only mode")
+		return
+	}
 	user.PhoneLastPinged = time.Now()
 	msgID := user.Client.GenerateMessageID()
 	keyIDs := make([]*waProto.AppStateSyncKeyId, 0, 1)
@@ -737,7 +816,7 @@ func (user *User) sendHackyPhonePing(ctx context.Context) {
 		user.zlog.Debug().
 			Str("message_id", msgID).
 			Int64("message_ts", resp.Timestamp.Unix()).
-			Msg("Sent hacky phone ping because phone has been offline for >10 days")
+			Msg("Sent hacky phone ping because phone has been offline for a while")
 		user.PhoneLastPinged = resp.Timestamp
 		err = user.Update(ctx)
 		if err != nil {
@@ -747,11 +826,12 @@ func (user *User) sendHackyPhonePing(ctx context.Context) {
 }
 
 func (user *User) PhoneRecentlySeen(doPing bool) bool {
-	if doPing && !user.PhoneLastSeen.IsZero() && user.PhoneLastSeen.Add(PhoneDisconnectPingTime).Before(time.Now()) && user.PhoneLastPinged.Add(PhoneMinPingInterval).Before(time.Now()) {
-		// Over 10 days since the phone was seen and over a day since the last somewhat hacky ping, send a new ping.
+	warningTime, pingTime := user.bridge.phoneOfflineThresholds()
+	if doPing && !user.PhoneLastSeen.IsZero() && user.PhoneLastSeen.Add(pingTime).Before(time.Now()) && user.PhoneLastPinged.Add(PhoneMinPingInterval).Before(time.Now()) {
+		// The phone hasn't been seen in a while and it's over a day since the last somewhat hacky ping, send a new ping.
 		go user.sendHackyPhonePing(context.TODO())
 	}
-	return user.PhoneLastSeen.IsZero() || user.PhoneLastSeen.Add(PhoneDisconnectWarningTime).After(time.Now())
+	return user.PhoneLastSeen.IsZero() || user.PhoneLastSeen.Add(warningTime).After(time.Now())
 }
 
 // phoneSeen records a timestamp when the user's main device was seen online.
@@ -794,13 +874,17 @@ func formatDisconnectTime(dur time.Duration) string {
 }
 
 func (user *User) sendPhoneOfflineWarning(ctx context.Context) {
-	if user.lastPhoneOfflineWarning.Add(12 * time.Hour).After(time.Now()) {
+	cfg := user.bridge.Config.Bridge.PhoneOffline
+	if !cfg.SendWarnings {
+		return
+	} else if user.lastPhoneOfflineWarning.Add(hoursOrDefault(cfg.WarningInterval, PhoneOfflineWarningInterval)).After(time.Now()) {
 		// Don't spam the warning too much
 		return
 	}
 	user.lastPhoneOfflineWarning = time.Now()
 	timeSinceSeen := time.Now().Sub(user.PhoneLastSeen)
-	user.sendMarkdownBridgeAlert(ctx, "Your phone hasn't been seen in %s. The server will force the bridge to log out if the phone is not active at least every 2 weeks.", formatDisconnectTime(timeSinceSeen))
+	user.sendMarkdownBridgeAlert(ctx, "Your phone hasn't been seen in %s. The server will force the bridge to log out if the phone is not active at least every 2 weeks. "+
+		"Open WhatsApp on your phone and make sure it's connected to the internet to keep the bridge logged in.", formatDisconnectTime(timeSinceSeen))
 }
 
 func (user *User) HandleEvent(event interface{}) {
@@ -809,21 +893,27 @@ func (user *User) HandleEvent(event interface{}) {
 		Type("wa_event_type", event).
 		Logger().
 		WithContext(context.TODO())
+	user.lastEventReceived.Store(time.Now().UnixMilli())
 	switch v := event.(type) {
 	case *events.LoggedOut:
 		go user.handleLoggedOut(ctx, v.OnConnect, v.Reason)
 	case *events.Connected:
+		user.keepAliveFailingSince.Store(0)
 		user.bridge.Metrics.TrackConnectionState(user.JID, true)
 		user.bridge.Metrics.TrackLoginState(user.JID, true)
 		if len(user.Client.Store.PushName) > 0 {
 			go func() {
-				err := user.Client.SendPresence(user.lastPresence)
+				err := user.sendPresence(user.getLastPresence())
 				if err != nil {
 					user.zlog.Warn().Err(err).Msg("Failed to send initial presence after connecting")
 				}
 			}()
 		}
 		go user.tryAutomaticDoublePuppeting()
+		go user.flushOfflineQueue(ctx)
+		if user.shouldReceivePresence() {
+			go user.subscribePresence(ctx)
+		}
 
 		if user.bridge.Config.Bridge.HistorySync.Backfill && !user.historySyncLoopsStarted {
 			go user.handleHistorySyncsLoop()
@@ -851,10 +941,11 @@ func (user *User) HandleEvent(event interface{}) {
 				user.zlog.Info().Msg("Offline sync completed")
 			}
 			user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+			go user.rerequestUndecryptableMessages(ctx)
 		}
 	case *events.AppStateSyncComplete:
 		if len(user.Client.Store.PushName) > 0 && v.Name == appstate.WAPatchCriticalBlock {
-			err := user.Client.SendPresence(user.lastPresence)
+			err := user.sendPresence(user.getLastPresence())
 			if err != nil {
 				user.zlog.Warn().Err(err).Msg("Failed to send presence after app state sync")
 			}
@@ -864,12 +955,15 @@ func (user *User) HandleEvent(event interface{}) {
 				if err != nil {
 					user.zlog.Err(err).Msg("Failed to resync contacts after app state sync")
 				}
+				if user.bridge.Config.Bridge.ContactPortals.Create {
+					user.CreateContactPortals(ctx)
+				}
 			}()
 		}
 	case *events.PushNameSetting:
 		// Send presence available when connecting and when the pushname is changed.
 		// This makes sure that outgoing messages always have the right pushname.
-		err := user.Client.SendPresence(user.lastPresence)
+		err := user.sendPresence(user.getLastPresence())
 		if err != nil {
 			user.zlog.Warn().Err(err).Msg("Failed to send presence after push name update")
 		}
@@ -883,10 +977,19 @@ func (user *User) HandleEvent(event interface{}) {
 		user.Session = user.Client.Store
 		user.JID = v.ID
 		user.addToJIDMap()
+		user.createdContactPortals.Store(false)
+		user.subscribedPresence.Store(false)
 		err := user.Update(ctx)
 		if err != nil {
 			user.zlog.Err(err).Msg("Failed to save user after pair success")
 		}
+		Analytics.Track(user.MXID, "WhatsApp paired", map[string]interface{}{
+			"platform": v.Platform,
+			"business": v.BusinessName != "",
+		})
+		user.bridge.Webhooks.Send(user, WebhookLogin, map[string]interface{}{
+			"platform": v.Platform,
+		})
 	case *events.StreamError:
 		var message string
 		if v.Code != "" {
@@ -898,28 +1001,38 @@ func (user *User) HandleEvent(event interface{}) {
 		}
 		user.BridgeState.Send(status.BridgeState{StateEvent: status.StateUnknownError, Message: message})
 		user.bridge.Metrics.TrackConnectionState(user.JID, false)
+		user.bridge.Webhooks.Send(user, WebhookStreamError, map[string]interface{}{"message": message})
+		user.sendConnectionAlert(ctx, ConnAlertStreamError, v.Code)
 	case *events.StreamReplaced:
+		user.bridge.Webhooks.Send(user, WebhookStreamError, map[string]interface{}{"message": "Stream replaced"})
 		if user.bridge.Config.Bridge.CrashOnStreamReplaced {
 			user.zlog.Info().Msg("Stopping bridge due to StreamReplaced event")
 			user.bridge.ManualStop(60)
 		} else {
 			user.BridgeState.Send(status.BridgeState{StateEvent: status.StateUnknownError, Message: "Stream replaced"})
 			user.bridge.Metrics.TrackConnectionState(user.JID, false)
-			user.sendMarkdownBridgeAlert(ctx, "The bridge was started in another location. Use `reconnect` to reconnect this one.")
+			user.sendConnectionAlert(ctx, ConnAlertStreamReplaced, "")
 		}
 	case *events.ConnectFailure:
 		user.BridgeState.Send(status.BridgeState{StateEvent: status.StateUnknownError, Message: fmt.Sprintf("Unknown connection failure: %s (%s)", v.Reason, v.Message)})
 		user.bridge.Metrics.TrackConnectionState(user.JID, false)
 		user.bridge.Metrics.TrackConnectionFailure(fmt.Sprintf("status-%d", v.Reason))
+		user.sendConnectionAlert(ctx, ConnAlertConnectFailure, fmt.Sprintf("%s: %s", v.Reason, v.Message))
 	case *events.ClientOutdated:
 		user.zlog.Error().Msg("Got a client outdated connect failure. The bridge is likely out of date, please update immediately.")
 		user.BridgeState.Send(status.BridgeState{StateEvent: status.StateUnknownError, Message: "Connect failure: 405 client outdated"})
 		user.bridge.Metrics.TrackConnectionState(user.JID, false)
 		user.bridge.Metrics.TrackConnectionFailure("client-outdated")
+		user.sendConnectionAlert(ctx, ConnAlertClientOutdated, "")
 	case *events.TemporaryBan:
 		user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBadCredentials, Message: v.String()})
 		user.bridge.Metrics.TrackConnectionState(user.JID, false)
 		user.bridge.Metrics.TrackConnectionFailure("temporary-ban")
+		user.bridge.Webhooks.Send(user, WebhookBan, map[string]interface{}{
+			"code":   int(v.Code),
+			"expire": v.Expire.Seconds(),
+		})
+		user.sendConnectionAlert(ctx, ConnAlertTemporaryBan, v.String())
 	case *events.Disconnected:
 		// Don't send the normal transient disconnect state if we're already in a different transient disconnect state.
 		// TODO remove this if/when the phone offline state is moved to a sub-state of CONNECTED
@@ -927,32 +1040,66 @@ func (user *User) HandleEvent(event interface{}) {
 			user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: WADisconnected})
 		}
 		user.bridge.Metrics.TrackConnectionState(user.JID, false)
+		user.sendConnectionAlert(ctx, ConnAlertDisconnected, "")
+		go user.reconnectWithBackoff(ctx)
 	case *events.Contact:
-		go user.syncPuppet(v.JID, "contact event")
+		if !user.isIgnored(v.JID) {
+			go user.syncPuppet(v.JID, "contact event")
+		}
 	case *events.PushName:
-		go user.syncPuppet(v.JID, "push name event")
+		if !user.isIgnored(v.JID) {
+			go user.syncPuppet(v.JID, "push name event")
+		}
 	case *events.BusinessName:
-		go user.syncPuppet(v.JID, "business name event")
+		if !user.isIgnored(v.JID) {
+			go user.syncPuppet(v.JID, "business name event")
+		}
 	case *events.GroupInfo:
 		user.groupListCache = nil
-		go user.handleGroupUpdate(v)
+		if !user.isIgnored(v.JID) {
+			go user.handleGroupUpdate(v)
+		}
 	case *events.JoinedGroup:
 		user.groupListCache = nil
-		go user.handleGroupCreate(v)
+		if !user.isIgnored(v.JID) {
+			go user.handleGroupCreate(v)
+		}
 	case *events.NewsletterJoin:
 		go user.handleNewsletterJoin(v)
 	case *events.NewsletterLeave:
 		go user.handleNewsletterLeave(v)
 	case *events.Picture:
-		go user.handlePictureUpdate(ctx, v)
+		if !user.isIgnored(v.JID) {
+			go user.handlePictureUpdate(ctx, v)
+		}
 	case *events.Receipt:
 		if v.IsFromMe && v.Sender.Device == 0 {
 			user.phoneSeen(v.Timestamp)
 		}
-		go user.handleReceipt(v)
+		if !user.isIgnored(v.Chat) {
+			go user.handleReceipt(v)
+		}
 	case *events.ChatPresence:
-		go user.handleChatPresence(ctx, v)
+		if !user.isIgnored(v.Chat, v.Sender) {
+			go user.handleChatPresence(ctx, v)
+		}
+	case *events.Presence:
+		if !user.isIgnored(v.From) {
+			go user.handlePresence(ctx, v)
+		}
 	case *events.Message:
+		if user.isIgnored(v.Info.Chat, v.Info.Sender) {
+			zerolog.Ctx(ctx).Debug().
+				Str("message_id", v.Info.ID).
+				Stringer("chat_jid", v.Info.Chat).
+				Stringer("sender_jid", v.Info.Sender).
+				Msg("Dropping message from ignored JID")
+			return
+		}
+		if !user.ReadOnly && user.isSelfChatCommand(v) {
+			go user.handleSelfChatCommand(context.WithoutCancel(ctx), v)
+			return
+		}
 		portal := user.GetPortalByMessageSource(v.Info.MessageSource)
 		portal.events <- &PortalEvent{
 			Message: &PortalMessage{evt: v, source: user},
@@ -962,9 +1109,13 @@ func (user *User) HandleEvent(event interface{}) {
 		portal := user.GetPortalByJID(v.ChatID)
 		go portal.handleMediaRetry(v, user)
 	case *events.CallOffer:
-		user.handleCallStart(v.CallCreator, v.CallID, "", v.Timestamp)
+		if !user.isIgnored(v.CallCreator) {
+			user.handleCallStart(v.CallCreator, v.CallID, "", v.Timestamp)
+		}
 	case *events.CallOfferNotice:
-		user.handleCallStart(v.CallCreator, v.CallID, v.Type, v.Timestamp)
+		if !user.isIgnored(v.CallCreator) {
+			user.handleCallStart(v.CallCreator, v.CallID, v.Type, v.Timestamp)
+		}
 	case *events.IdentityChange:
 		puppet := user.bridge.GetPuppetByJID(v.JID)
 		if puppet == nil {
@@ -992,6 +1143,9 @@ func (user *User) HandleEvent(event interface{}) {
 	case *events.CallTerminate, *events.CallRelayLatency, *events.CallAccept, *events.UnknownCallEvent:
 		// ignore
 	case *events.UndecryptableMessage:
+		if user.isIgnored(v.Info.Chat, v.Info.Sender) {
+			return
+		}
 		portal := user.GetPortalByMessageSource(v.Info.MessageSource)
 		portal.events <- &PortalEvent{
 			Message: &PortalMessage{undecryptable: v, source: user},
@@ -1022,8 +1176,13 @@ func (user *User) HandleEvent(event interface{}) {
 	case *events.AppState:
 		// Ignore
 	case *events.KeepAliveTimeout:
+		if !v.LastSuccess.IsZero() {
+			user.keepAliveFailingSince.CompareAndSwap(0, v.LastSuccess.UnixMilli())
+		}
 		user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect, Error: WAKeepaliveTimeout})
+		user.sendConnectionAlert(ctx, ConnAlertKeepaliveTimeout, "")
 	case *events.KeepAliveRestored:
+		user.keepAliveFailingSince.Store(0)
 		user.zlog.Info().Msg("Keepalive restored after timeouts, sending connected event")
 		user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
 	case *events.MarkChatAsRead:
@@ -1167,7 +1326,10 @@ func (user *User) getDirectChats(ctx context.Context) map[id.UserID][]id.RoomID
 		return res
 	}
 	for _, portal := range privateChats {
-		if len(portal.MXID) > 0 {
+		if portal.Key.JID.User == user.JID.User && user.bridge.Config.Bridge.NoteToSelfName != "" {
+			// The note to self chat is bridged as a normal room rather than a DM
+			continue
+		} else if len(portal.MXID) > 0 {
 			res[user.bridge.FormatPuppetMXID(portal.Key.JID)] = []id.RoomID{portal.MXID}
 		}
 	}
@@ -1228,6 +1390,12 @@ func (user *User) handleLoggedOut(ctx context.Context, onConnect bool, reason ev
 	} else if reason == events.ConnectFailureMainDeviceGone {
 		errorCode = WAMainDeviceGone
 	}
+	user.bridge.Webhooks.Send(user, WebhookLogout, map[string]interface{}{
+		"remote":   true,
+		"reason":   int(reason),
+		"error":    string(errorCode),
+		"on_login": onConnect,
+	})
 	user.removeFromJIDMap(status.BridgeState{StateEvent: status.StateBadCredentials, Error: errorCode})
 	user.DeleteConnection()
 	user.Session = nil
@@ -1246,7 +1414,11 @@ func (user *User) handleLoggedOut(ctx context.Context, onConnect bool, reason ev
 func (user *User) GetPortalByMessageSource(ms types.MessageSource) *Portal {
 	jid := ms.Chat
 	if ms.IsIncomingBroadcast() {
-		if ms.IsFromMe {
+		if ms.IsFromMe && user.bridge.Config.Bridge.BroadcastListPortals {
+			// Messages sent to our own broadcast lists go to the broadcast list portal,
+			// while broadcasts from other users stay in their private chat portal.
+			return user.bridge.GetPortalByJID(database.NewPortalKey(jid, user.JID))
+		} else if ms.IsFromMe {
 			jid = ms.BroadcastListOwner.ToNonAD()
 		} else {
 			jid = ms.Sender.ToNonAD()
@@ -1284,6 +1456,42 @@ func (user *User) ResyncContacts(forceAvatarSync bool) error {
 	return nil
 }
 
+// CreateContactPortals creates DM portals for all saved contacts that don't have one yet.
+// It only runs once per login, later app state syncs don't check the contact list again.
+func (user *User) CreateContactPortals(ctx context.Context) {
+	if !user.createdContactPortals.CompareAndSwap(false, true) {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Str("action", "create contact portals").Logger()
+	contacts, err := user.Client.Store.Contacts.GetAllContacts()
+	if err != nil {
+		log.Err(err).Msg("Failed to get cached contacts")
+		user.createdContactPortals.Store(false)
+		return
+	}
+	created := 0
+	for jid, contact := range contacts {
+		if jid.Server != types.DefaultUserServer || jid.User == user.JID.User || contact.FullName == "" {
+			continue
+		}
+		portal := user.GetPortalByJID(jid)
+		if len(portal.MXID) > 0 {
+			continue
+		} else if created > 0 {
+			time.Sleep(time.Duration(user.bridge.Config.Bridge.ContactPortals.Delay) * time.Second)
+		}
+		err = portal.CreateMatrixRoom(log.With().Stringer("contact_jid", jid).Logger().WithContext(ctx), user, nil, nil, true, false)
+		if err != nil {
+			log.Err(err).Stringer("contact_jid", jid).Msg("Failed to create portal for contact")
+		} else {
+			created++
+		}
+	}
+	if created > 0 {
+		log.Info().Int("portal_count", created).Msg("Created portals for contacts")
+	}
+}
+
 func (user *User) ResyncGroups(createPortals bool) error {
 	groups, err := user.Client.GetJoinedGroups()
 	if err != nil {
@@ -1295,6 +1503,9 @@ func (user *User) ResyncGroups(createPortals bool) error {
 	user.groupListCacheLock.Unlock()
 	ctx := user.zlog.With().Str("method", "ResyncGroups").Logger().WithContext(context.TODO())
 	for _, group := range groups {
+		if user.isIgnored(group.JID) {
+			continue
+		}
 		portal := user.GetPortalByJID(group.JID)
 		if len(portal.MXID) == 0 {
 			if createPortals {
@@ -1318,7 +1529,7 @@ func (user *User) handleChatPresence(ctx context.Context, presence *events.ChatP
 		return
 	}
 	portal := user.GetPortalByJID(presence.Chat)
-	if puppet == nil || portal == nil || len(portal.MXID) == 0 {
+	if puppet == nil || portal == nil || len(portal.MXID) == 0 || !user.shouldReceiveTyping(portal) {
 		return
 	}
 	if presence.State == types.ChatPresenceComposing {
@@ -1377,18 +1588,26 @@ func (user *User) markSelfReadFull(ctx context.Context, portal *Portal) {
 	} else if lastMessage == nil {
 		return
 	}
+	user.markSelfReadUpTo(ctx, portal, lastMessage)
+}
+
+func (user *User) markSelfReadUpTo(ctx context.Context, portal *Portal, lastMessage *database.Message) {
+	puppet := user.bridge.GetPuppetByCustomMXID(user.MXID)
+	if puppet == nil || puppet.CustomIntent() == nil {
+		return
+	}
 	user.SetLastReadTS(ctx, portal.Key, lastMessage.Timestamp)
-	err = puppet.CustomIntent().SetReadMarkers(ctx, portal.MXID, user.makeReadMarkerContent(lastMessage.MXID, true))
+	err := puppet.CustomIntent().SetReadMarkers(ctx, portal.MXID, user.makeReadMarkerContent(lastMessage.MXID, true))
 	if err != nil {
 		user.zlog.Err(err).
 			Stringer("portal_mxid", portal.MXID).
 			Stringer("last_message_mxid", lastMessage.MXID).
-			Msg("Failed to mark last message in chat as read")
+			Msg("Failed to mark message in chat as read")
 	} else {
 		user.zlog.Debug().
 			Stringer("portal_mxid", portal.MXID).
 			Stringer("last_message_mxid", lastMessage.MXID).
-			Msg("Marked last message in chat as read")
+			Msg("Marked message in chat as read")
 	}
 }
 
@@ -1419,6 +1638,12 @@ func (user *User) handleGroupCreate(evt *events.JoinedGroup) {
 	log := user.zlog.With().Str("whatsapp_event", "JoinedGroup").Logger()
 	ctx := log.WithContext(context.TODO())
 	portal := user.GetPortalByJID(evt.JID)
+	pendingInvite := user.bridge.DB.GroupInvite.New()
+	pendingInvite.UserMXID = user.MXID
+	pendingInvite.GroupJID = evt.JID
+	if err := pendingInvite.Delete(ctx); err != nil {
+		log.Err(err).Msg("Failed to delete pending invite of joined group")
+	}
 	if evt.CreateKey == "" && len(portal.MXID) == 0 && portal.Key.JID != user.skipGroupCreateDelay {
 		log.Debug().Msg("Delaying handling group create with empty key to avoid race conditions")
 		time.Sleep(5 * time.Second)
@@ -1459,15 +1684,37 @@ func (user *User) handleGroupUpdate(evt *events.GroupInfo) {
 	case evt.Announce != nil:
 		log.Debug().Msg("Group announcement mode (message send permission) changed")
 		portal.RestrictMessageSending(ctx, evt.Announce.IsAnnounce)
+		portal.saveGroupFlags(ctx, evt.Announce.IsAnnounce, portal.IsLocked, portal.IsIncognito)
+		if evt.Announce.IsAnnounce {
+			portal.sendGroupChangeNotice(ctx, evt.Sender, evt.Timestamp, portal.T("Changed the group settings to allow only admins to send messages"))
+		} else {
+			portal.sendGroupChangeNotice(ctx, evt.Sender, evt.Timestamp, portal.T("Changed the group settings to allow all participants to send messages"))
+		}
 	case evt.Locked != nil:
 		log.Debug().Msg("Group locked mode (metadata change permission) changed")
 		portal.RestrictMetadataChanges(ctx, evt.Locked.IsLocked)
+		portal.saveGroupFlags(ctx, portal.IsAnnounce, evt.Locked.IsLocked, portal.IsIncognito)
+		if evt.Locked.IsLocked {
+			portal.sendGroupChangeNotice(ctx, evt.Sender, evt.Timestamp, portal.T("Changed the group settings to allow only admins to edit the group info"))
+		} else {
+			portal.sendGroupChangeNotice(ctx, evt.Sender, evt.Timestamp, portal.T("Changed the group settings to allow all participants to edit the group info"))
+		}
 	case evt.Name != nil:
 		log.Debug().Msg("Group name changed")
 		portal.UpdateName(ctx, evt.Name.Name, evt.Name.NameSetBy, true)
 	case evt.Topic != nil:
 		log.Debug().Msg("Group topic changed")
-		portal.UpdateTopic(ctx, evt.Topic.Topic, evt.Topic.TopicSetBy, true)
+		if portal.UpdateTopic(ctx, evt.Topic.Topic, evt.Topic.TopicSetBy, true) {
+			sender := evt.Sender
+			if !evt.Topic.TopicSetBy.IsEmpty() {
+				sender = &evt.Topic.TopicSetBy
+			}
+			if evt.Topic.TopicDeleted {
+				portal.sendGroupChangeNotice(ctx, sender, evt.Timestamp, portal.T("Removed the group description"))
+			} else {
+				portal.sendGroupChangeNotice(ctx, sender, evt.Timestamp, portal.T("Changed the group description"))
+			}
+		}
 	case evt.Leave != nil:
 		log.Debug().Msg("Someone left the group")
 		if evt.Sender != nil && !evt.Sender.IsEmpty() {
@@ -1486,14 +1733,30 @@ func (user *User) handleGroupUpdate(evt *events.GroupInfo) {
 		log.Debug().Msg("Group ephemeral mode (disappearing message timer) changed")
 		portal.UpdateGroupDisappearingMessages(ctx, evt.Sender, evt.Timestamp, evt.Ephemeral.DisappearingTimer)
 	case evt.Link != nil:
-		log.Debug().Msg("Group parent changed")
-		if evt.Link.Type == types.GroupLinkChangeTypeParent {
+		switch evt.Link.Type {
+		case types.GroupLinkChangeTypeParent:
+			log.Debug().Msg("Group parent changed")
 			portal.UpdateParentGroup(ctx, user, evt.Link.Group.JID, true)
+		case types.GroupLinkChangeTypeSub:
+			log.Debug().Stringer("sub_group_jid", evt.Link.Group.JID).Msg("Group linked to community")
+			child := user.GetPortalByJID(evt.Link.Group.JID)
+			if child.MXID != "" {
+				child.updateCommunityLink(ctx, user, portal.Key.JID, evt.Link.Group.IsDefaultSubGroup)
+			}
 		}
 	case evt.Unlink != nil:
-		log.Debug().Msg("Group parent removed")
-		if evt.Unlink.Type == types.GroupLinkChangeTypeParent && portal.ParentGroup == evt.Unlink.Group.JID {
-			portal.UpdateParentGroup(ctx, user, types.EmptyJID, true)
+		switch evt.Unlink.Type {
+		case types.GroupLinkChangeTypeParent:
+			log.Debug().Msg("Group parent removed")
+			if portal.ParentGroup == evt.Unlink.Group.JID {
+				portal.UpdateParentGroup(ctx, user, types.EmptyJID, true)
+			}
+		case types.GroupLinkChangeTypeSub:
+			log.Debug().Stringer("sub_group_jid", evt.Unlink.Group.JID).Msg("Group unlinked from community")
+			child := user.GetPortalByJID(evt.Unlink.Group.JID)
+			if child.MXID != "" && child.ParentGroup == portal.Key.JID {
+				child.updateCommunityLink(ctx, user, types.EmptyJID, false)
+			}
 		}
 	case evt.Delete != nil:
 		log.Debug().Msg("Group deleted")
@@ -1526,6 +1789,10 @@ func (user *User) handleNewsletterLeave(evt *events.NewsletterLeave) {
 }
 
 func (user *User) handlePictureUpdate(ctx context.Context, evt *events.Picture) {
+	if evt.Remove {
+		// Removal events don't have a picture ID, but updateAvatar stores removed avatars with a special ID
+		evt.PictureID = "remove"
+	}
 	if evt.JID.Server == types.DefaultUserServer {
 		puppet := user.bridge.GetPuppetByJID(evt.JID)
 		user.zlog.Debug().
@@ -1536,6 +1803,11 @@ func (user *User) handlePictureUpdate(ctx context.Context, evt *events.Picture)
 		if puppet.Avatar != evt.PictureID {
 			puppet.Sync(ctx, user, nil, true, false)
 		}
+		// The puppet is shared between logins, so it may have already been updated by the event another login received.
+		// The notice is still sent, as every login has its own private chat portal with the contact.
+		if user.bridge.Config.Bridge.AvatarChangeNotices && puppet.Avatar == evt.PictureID {
+			user.sendAvatarChangeNotice(ctx, puppet, evt)
+		}
 	} else if portal := user.GetPortalByJID(evt.JID); portal != nil {
 		user.zlog.Debug().
 			Stringer("jid", evt.JID).
@@ -1548,6 +1820,98 @@ func (user *User) handlePictureUpdate(ctx context.Context, evt *events.Picture)
 	}
 }
 
+// sendAvatarChangeNotice posts the new avatar of a contact in the private chat portal, similar to how
+// the change is shown in the chat on the phone.
+func (user *User) sendAvatarChangeNotice(ctx context.Context, puppet *Puppet, evt *events.Picture) {
+	if evt.JID.User == user.JID.User {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Stringer("contact_jid", evt.JID).Logger()
+	portal := user.bridge.GetExistingPortalByJID(database.NewPortalKey(evt.JID, user.JID))
+	if portal == nil || len(portal.MXID) == 0 {
+		log.Debug().Msg("Not sending avatar change notice, no private chat portal")
+		return
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    portal.T("Removed their profile picture"),
+	}
+	if !evt.Remove && !puppet.AvatarURL.IsEmpty() {
+		content = &event.MessageEventContent{
+			MsgType: event.MsgImage,
+			Body:    portal.T("Changed their profile picture"),
+			URL:     puppet.AvatarURL.CUString(),
+		}
+	}
+	_, err := portal.sendMessage(ctx, puppet.IntentFor(portal), event.EventMessage, content, nil, evt.Timestamp.UnixMilli())
+	if err != nil {
+		log.Err(err).Msg("Failed to send avatar change notice")
+	}
+}
+
+// syncAbout stores the about text of a contact fetched during a background sync and notifies the user
+// if it changed. The whatsmeow version used by the bridge doesn't emit events for about text changes,
+// so changes are only noticed when the contact is resynced. The last seen text is stored per user,
+// so that every login with the same contact gets notified.
+func (user *User) syncAbout(ctx context.Context, puppet *Puppet, about string) {
+	log := zerolog.Ctx(ctx).With().Stringer("contact_jid", puppet.JID).Logger()
+	existing, err := user.bridge.DB.ContactAbout.Get(ctx, user.MXID, puppet.JID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get last known contact about text")
+		return
+	} else if existing != nil && existing.About == about {
+		return
+	}
+	// Don't notify about the first about text fetched for the contact, as it's not known if it changed
+	isChange := existing != nil
+	if existing == nil {
+		existing = user.bridge.DB.ContactAbout.New()
+		existing.UserMXID = user.MXID
+		existing.JID = puppet.JID
+	}
+	existing.About = about
+	err = existing.Upsert(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to save contact about text")
+	}
+	if isChange && !user.isIgnored(puppet.JID) {
+		user.handleAboutChange(ctx, puppet, about)
+	}
+}
+
+// handleAboutChange notifies the user when a contact changes their about text, if enabled in the config.
+func (user *User) handleAboutChange(ctx context.Context, puppet *Puppet, about string) {
+	mode := user.bridge.Config.Bridge.AboutChangeNotices
+	if mode == config.AboutChangeNoticeOff || puppet.JID.Server != types.DefaultUserServer || puppet.JID.User == user.JID.User {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Stringer("contact_jid", puppet.JID).Logger()
+	ctx = log.WithContext(ctx)
+	switch mode {
+	case config.AboutChangeNoticePortal:
+		portal := user.bridge.GetExistingPortalByJID(database.NewPortalKey(puppet.JID, user.JID))
+		if portal == nil || len(portal.MXID) == 0 {
+			log.Debug().Msg("Not sending about text change notice, no private chat portal")
+			return
+		}
+		text := portal.T("Cleared their about text")
+		if about != "" {
+			text = portal.T("Changed their about text to: %s", about)
+		}
+		portal.sendGroupChangeNotice(ctx, &puppet.JID, time.Now(), text)
+	case config.AboutChangeNoticeManagementRoom:
+		name := "+" + puppet.JID.User
+		if puppet.Displayname != "" {
+			name = fmt.Sprintf("%s (+%s)", puppet.Displayname, puppet.JID.User)
+		}
+		if about == "" {
+			user.sendMarkdownBridgeAlert(ctx, "%s cleared their about text.", name)
+		} else {
+			user.sendMarkdownBridgeAlert(ctx, "%s changed their about text to:\n\n> %s", name, strings.ReplaceAll(about, "\n", "\n> "))
+		}
+	}
+}
+
 func (user *User) StartPM(ctx context.Context, jid types.JID, reason string) (*Portal, *Puppet, bool, error) {
 	zerolog.Ctx(ctx).Debug().Stringer("jid", jid).Str("source", reason).Msg("Starting PM with user")
 	puppet := user.bridge.GetPuppetByJID(jid)
@@ -1580,3 +1944,201 @@ func (user *User) getCachedGroupList() ([]*types.GroupInfo, error) {
 	user.groupListCacheTime = time.Now()
 	return user.groupListCache, err
 }
+
+// SetWhatsAppAvatar downloads the given Matrix avatar and sets it as the WhatsApp profile picture.
+// An empty URI removes the profile picture.
+func (user *User) SetWhatsAppAvatar(ctx context.Context, avatarURL id.ContentURI) error {
+	user.lastSyncedMatrixAvatarLock.Lock()
+	defer user.lastSyncedMatrixAvatarLock.Unlock()
+	return user.setWhatsAppAvatar(ctx, avatarURL)
+}
+
+// syncMatrixAvatar sets the given Matrix avatar as the WhatsApp profile picture unless it was already synced.
+// The lock is held during the upload, so the same change received in multiple rooms is only uploaded once.
+func (user *User) syncMatrixAvatar(ctx context.Context, avatarURL id.ContentURI) error {
+	user.lastSyncedMatrixAvatarLock.Lock()
+	defer user.lastSyncedMatrixAvatarLock.Unlock()
+	if avatarURL == user.lastSyncedMatrixAvatar {
+		return nil
+	}
+	return user.setWhatsAppAvatar(ctx, avatarURL)
+}
+
+func (user *User) setWhatsAppAvatar(ctx context.Context, avatarURL id.ContentURI) error {
+	var data []byte
+	if !avatarURL.IsEmpty() {
+		rawData, err := user.bridge.Bot.DownloadBytes(ctx, avatarURL)
+		if err != nil {
+			return fmt.Errorf("failed to download avatar: %w", err)
+		}
+		data, err = convertAvatarForWhatsApp(rawData)
+		if err != nil {
+			return err
+		}
+	}
+	// Setting the group photo without a target JID changes the profile picture of the account itself
+	newID, err := user.Client.SetGroupPhoto(types.EmptyJID, data)
+	if err != nil {
+		return fmt.Errorf("failed to set profile picture: %w", err)
+	}
+	user.lastSyncedMatrixAvatar = avatarURL
+	zerolog.Ctx(ctx).Debug().
+		Stringer("mxc_uri", avatarURL).
+		Str("avatar_id", newID).
+		Msg("Updated WhatsApp profile picture")
+	return nil
+}
+
+// SetWhatsAppPushName changes the push name of the account, which is the name shown to people who don't have the user
+// in their contacts.
+func (user *User) SetWhatsAppPushName(ctx context.Context, name string) error {
+	user.lastSyncedMatrixNameLock.Lock()
+	defer user.lastSyncedMatrixNameLock.Unlock()
+	return user.setWhatsAppPushName(ctx, name)
+}
+
+// syncMatrixName sets the given Matrix displayname as the WhatsApp push name unless it was already synced.
+func (user *User) syncMatrixName(ctx context.Context, name string) error {
+	user.lastSyncedMatrixNameLock.Lock()
+	defer user.lastSyncedMatrixNameLock.Unlock()
+	if name == user.lastSyncedMatrixName {
+		return nil
+	}
+	return user.setWhatsAppPushName(ctx, name)
+}
+
+func (user *User) setWhatsAppPushName(ctx context.Context, name string) error {
+	err := user.Client.SendAppState(appstate.BuildSettingPushName(name))
+	if err != nil {
+		return fmt.Errorf("failed to send push name change: %w", err)
+	}
+	user.Client.Store.PushName = name
+	err = user.Client.Store.Save()
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save device store after changing push name")
+	}
+	user.lastSyncedMatrixName = name
+	zerolog.Ctx(ctx).Debug().Str("push_name", name).Msg("Updated WhatsApp push name")
+	return nil
+}
+
+func (user *User) shouldSendReadReceipts() bool {
+	if user.SendReadReceipts != nil {
+		return *user.SendReadReceipts
+	}
+	return user.bridge.Config.Bridge.SendReadReceipts
+}
+
+// shouldSendTyping checks whether Matrix typing notifications from the user should be sent to the given portal.
+// Portal overrides take precedence over user overrides, which take precedence over the config.
+func (user *User) shouldSendTyping(portal *Portal) bool {
+	if portal.TypingNotifications != nil {
+		return *portal.TypingNotifications
+	} else if user.SendTyping != nil {
+		return *user.SendTyping
+	}
+	return user.bridge.Config.Bridge.TypingNotifications.Send
+}
+
+// shouldReceiveTyping checks whether WhatsApp typing notifications received by the user should be bridged to the given portal.
+func (user *User) shouldReceiveTyping(portal *Portal) bool {
+	if portal.TypingNotifications != nil {
+		return *portal.TypingNotifications
+	} else if user.ReceiveTyping != nil {
+		return *user.ReceiveTyping
+	}
+	return user.bridge.Config.Bridge.TypingNotifications.Receive
+}
+
+// canSendAvailablePresence checks whether the user allows marking them as available on WhatsApp.
+// This is controlled by the presence flag of the double puppet (see `toggle-presence`).
+func (user *User) canSendAvailablePresence() bool {
+	customPuppet := user.bridge.GetPuppetByCustomMXID(user.MXID)
+	return customPuppet == nil || customPuppet.EnablePresence
+}
+
+func (user *User) shouldReceivePresence() bool {
+	if user.ReceivePresence != nil {
+		return *user.ReceivePresence
+	}
+	return user.bridge.Config.Bridge.Presence.Receive
+}
+
+func (user *User) shouldAnnounceOfflineAfterSend() bool {
+	if user.OfflineAfterSend != nil {
+		return *user.OfflineAfterSend
+	}
+	return user.bridge.Config.Bridge.Presence.OfflineAfterSend
+}
+
+// sendPresence sends the global presence of the user to WhatsApp. Nothing is sent if the login is in read-only mode.
+func (user *User) sendPresence(presence types.Presence) error {
+	if user.ReadOnly {
+		return nil
+	}
+	return user.Client.SendPresence(presence)
+}
+
+func (user *User) getLastPresence() types.Presence {
+	user.lastPresenceLock.Lock()
+	defer user.lastPresenceLock.Unlock()
+	return user.lastPresence
+}
+
+func (user *User) setLastPresence(presence types.Presence) {
+	user.lastPresenceLock.Lock()
+	user.lastPresence = presence
+	user.lastPresenceLock.Unlock()
+}
+
+func (user *User) announceOffline() {
+	user.setLastPresence(types.PresenceUnavailable)
+	err := user.sendPresence(types.PresenceUnavailable)
+	if err != nil {
+		user.zlog.Warn().Err(err).Msg("Failed to mark user as unavailable after sending message")
+	}
+}
+
+// subscribePresence subscribes to the presence of the other users in all private chat portals of the user.
+// It only runs once per login rather than on every reconnect.
+func (user *User) subscribePresence(ctx context.Context) {
+	if !user.subscribedPresence.CompareAndSwap(false, true) {
+		return
+	}
+	privateChats, err := user.bridge.DB.Portal.FindPrivateChats(ctx, user.JID.ToNonAD())
+	if err != nil {
+		user.zlog.Err(err).Msg("Failed to get private chats to subscribe to presence")
+		user.subscribedPresence.Store(false)
+		return
+	}
+	for _, portal := range privateChats {
+		if len(portal.MXID) == 0 || portal.Key.JID.Server != types.DefaultUserServer {
+			continue
+		}
+		err = user.Client.SubscribePresence(portal.Key.JID)
+		if err != nil {
+			user.zlog.Warn().Err(err).Stringer("jid", portal.Key.JID).Msg("Failed to subscribe to presence")
+		}
+	}
+}
+
+func (user *User) handlePresence(ctx context.Context, presence *events.Presence) {
+	if !user.shouldReceivePresence() {
+		return
+	}
+	puppet := user.bridge.GetPuppetByJID(presence.From)
+	if puppet == nil || puppet.JID.User == user.JID.User || puppet.CustomIntent() != nil {
+		// Contacts who use the bridge with double puppeting have their own Matrix presence
+		return
+	}
+	matrixPresence := event.PresenceOnline
+	if presence.Unavailable {
+		matrixPresence = event.PresenceOffline
+	}
+	err := puppet.DefaultIntent().SetPresence(ctx, matrixPresence)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).
+			Stringer("jid", presence.From).
+			Msg("Failed to bridge presence to Matrix")
+	}
+}
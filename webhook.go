@@ -0,0 +1,137 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/whatsmeow/types"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/config"
+)
+
+const (
+	WebhookLogin        = "login"
+	WebhookLogout       = "logout"
+	WebhookBan          = "ban"
+	WebhookStreamError  = "stream_error"
+	WebhookPortalCreate = "portal_create"
+)
+
+const webhookSignatureHeader = "X-Bridge-Signature"
+
+// WebhookEvent is the JSON body sent to webhook targets.
+type WebhookEvent struct {
+	Event     string                 `json:"event"`
+	Timestamp int64                  `json:"timestamp"`
+	UserID    id.UserID              `json:"user_id,omitempty"`
+	RemoteID  types.JID              `json:"remote_id,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+type WebhookSender struct {
+	bridge *WABridge
+	log    zerolog.Logger
+	client http.Client
+}
+
+func NewWebhookSender(br *WABridge) *WebhookSender {
+	return &WebhookSender{
+		bridge: br,
+		log:    br.ZLog.With().Str("component", "webhooks").Logger(),
+		client: http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Send sends the given event to all webhook targets that are subscribed to it. Delivery happens in the background.
+func (ws *WebhookSender) Send(user *User, eventName string, data map[string]interface{}) {
+	cfg := ws.bridge.Config.Bridge.Webhooks
+	if len(cfg.Targets) == 0 {
+		return
+	}
+	evt := &WebhookEvent{
+		Event:     eventName,
+		Timestamp: time.Now().UnixMilli(),
+		Data:      data,
+	}
+	if user != nil {
+		evt.UserID = user.MXID
+		evt.RemoteID = user.JID.ToNonAD()
+	}
+	body, err := json.Marshal(evt)
+	if err != nil {
+		ws.log.Err(err).Str("event", eventName).Msg("Failed to marshal webhook event")
+		return
+	}
+	for _, target := range cfg.Targets {
+		if len(target.Events) > 0 && !slices.Contains(target.Events, eventName) {
+			continue
+		}
+		go ws.deliver(target, eventName, body, cfg.MaxRetries)
+	}
+}
+
+func (ws *WebhookSender) deliver(target config.WebhookTarget, eventName string, body []byte, maxRetries int) {
+	log := ws.log.With().Str("event", eventName).Str("url", target.URL).Logger()
+	backoff := 1 * time.Second
+	for attempt := 0; ; attempt++ {
+		err := ws.post(target, body)
+		if err == nil {
+			log.Debug().Int("attempt", attempt+1).Msg("Delivered webhook")
+			return
+		} else if attempt >= maxRetries {
+			log.Err(err).Int("attempt", attempt+1).Msg("Failed to deliver webhook, giving up")
+			return
+		}
+		log.Warn().Err(err).Int("attempt", attempt+1).Dur("retry_in", backoff).Msg("Failed to deliver webhook, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (ws *WebhookSender) post(target config.WebhookTarget, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if target.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(target.Secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}